@@ -2,16 +2,45 @@ package spocp
 
 import (
 	"fmt"
+	"iter"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirosfoundation/go-spocp/pkg/persist"
 	"github.com/sirosfoundation/go-spocp/pkg/sexp"
 )
 
 // AdaptiveEngine automatically chooses between indexed and non-indexed
-// query strategies based on ruleset characteristics.
+// query strategies based on ruleset characteristics and observed queries.
+//
+// The tag index is always maintained. Rule counts are kept up to date as
+// rules change; the strategy is re-evaluated lazily, on the first query or
+// Stats call after a change, so loading rules one by one stays linear.
+//
+// Every n-th query (see SetSampleInterval) is timed and its tag is
+// recorded. Once enough queries are observed, the tags queried replace the
+// average fanout in the threshold check, and a clear difference in
+// measured latency overrides it. Until the latencies clearly favour one
+// strategy, every other sample runs the strategy not in use so that both
+// are measured; after that only the strategy in use is, so large rulesets
+// are not scanned linearly just to keep measuring the scan.
 type AdaptiveEngine struct {
 	engine *Engine
-	stats  AdaptiveStats
+
+	indexed     atomic.Bool  // strategy used by queries
+	dirty       atomic.Bool  // rules or observations changed since the last evaluation
+	queries     atomic.Int64 // queries served, for sampling
+	sampleEvery atomic.Int64 // sample interval, 0 to disable
+
+	// mu guards the fields below and the derived fields of stats. The rule
+	// counts in stats change with the rules, under engine.mu; code that
+	// needs both takes engine.mu first.
+	mu       sync.Mutex
+	stats    AdaptiveStats
+	obs      queryObservations
+	forced   bool // ForceIndexing overrides the adaptive strategy
+	forcedTo bool
 }
 
 // AdaptiveStats tracks metrics for adaptive behavior
@@ -22,6 +51,19 @@ type AdaptiveStats struct {
 	UniqueTags      int
 	AvgTagFanout    float64
 	IndexingEnabled bool
+
+	// SampledQueries is the number of queries observed
+	SampledQueries int
+
+	// QueryFanout is the number of rules an indexed query is expected to
+	// check, weighted by the tags of observed queries (0 until
+	// minObservedQueries queries are observed)
+	QueryFanout float64
+
+	// IndexedLatency and LinearLatency are the moving averages of sampled
+	// query times per strategy (0 until measured)
+	IndexedLatency time.Duration
+	LinearLatency  time.Duration
 }
 
 const (
@@ -29,8 +71,60 @@ const (
 	minRulesForIndexing     = 50  // Don't index small rulesets
 	minTagCountForIndexing  = 5   // Need enough tags to benefit
 	maxAvgFanoutForIndexing = 100 // Don't index if tags aren't selective
+
+	// Query observation
+	minObservedQueries = 32   // sampled queries before their tags are used
+	maxObservedQueries = 4096 // tag counts are halved beyond this, favouring recent queries
+	minLatencySamples  = 16   // samples per strategy before latencies are compared
+	latencyMargin      = 0.1  // latencies must differ by this fraction to decide
+	latencyWeight      = 0.1  // weight of a new sample in the moving average
 )
 
+// DefaultSampleInterval is the default for SetSampleInterval
+const DefaultSampleInterval = 64
+
+// queryObservations records sampled queries
+type queryObservations struct {
+	sampled  int
+	tagHits  map[string]int // sampled list queries by tag
+	atomHits int            // sampled queries that are not lists
+
+	// Moving averages of query times in nanoseconds, linear and indexed
+	latency [2]latencyAverage
+}
+
+// latencyAverage is an exponentially weighted moving average
+type latencyAverage struct {
+	mean    float64
+	samples int
+}
+
+// settled reports whether the measured latencies clearly favour one
+// strategy
+func (o *queryObservations) settled() bool {
+	linear, indexed := &o.latency[0], &o.latency[1]
+	return linear.samples >= minLatencySamples && indexed.samples >= minLatencySamples &&
+		(indexed.mean < linear.mean*(1-latencyMargin) || linear.mean < indexed.mean*(1-latencyMargin))
+}
+
+// add records a sample
+func (a *latencyAverage) add(d time.Duration) {
+	if a.samples == 0 {
+		a.mean = float64(d)
+	} else {
+		a.mean += latencyWeight * (float64(d) - a.mean)
+	}
+	a.samples++
+}
+
+// duration returns the average, or 0 without samples
+func (a *latencyAverage) duration() time.Duration {
+	if a.samples == 0 {
+		return 0
+	}
+	return time.Duration(a.mean)
+}
+
 // New creates a new adaptive SPOCP engine (recommended).
 // This is an alias for NewAdaptiveEngine() and is the recommended
 // constructor for most use cases. The engine automatically determines
@@ -48,15 +142,14 @@ func New() *AdaptiveEngine {
 //
 // This is the same as New() - use whichever name you prefer.
 func NewAdaptiveEngine() *AdaptiveEngine {
-	return &AdaptiveEngine{
-		engine: &Engine{
-			rules:        make([]sexp.Element, 0),
-			tagIndex:     make(map[string][]int),
-			atomRules:    make([]int, 0),
-			indexEnabled: false, // Start without indexing
-		},
-		stats: AdaptiveStats{},
+	ae := &AdaptiveEngine{
+		// The engine maintains the index; queries start without using it
+		engine: NewEngine(),
+		stats:  AdaptiveStats{},
+		obs:    queryObservations{tagHits: make(map[string]int)},
 	}
+	ae.sampleEvery.Store(DefaultSampleInterval)
+	return ae
 }
 
 // AddRule adds a policy rule and updates adaptive statistics
@@ -72,65 +165,214 @@ func (ae *AdaptiveEngine) AddRule(rule string) error {
 
 // AddRuleElement adds a parsed rule element
 func (ae *AdaptiveEngine) AddRuleElement(rule sexp.Element) {
-	// Always build the index structure for potential use
-	idx := len(ae.engine.rules)
-	ae.engine.rules = append(ae.engine.rules, rule)
+	ae.engine.mu.Lock()
+	defer ae.engine.mu.Unlock()
 
-	// Update statistics and index
-	ae.stats.TotalRules++
+	ae.addRule(rule)
+}
 
-	if list, ok := rule.(*sexp.List); ok {
+// AddRuleElements adds parsed rules in order
+func (ae *AdaptiveEngine) AddRuleElements(rules []sexp.Element) {
+	ae.engine.mu.Lock()
+	defer ae.engine.mu.Unlock()
+
+	for _, rule := range rules {
+		ae.addRule(rule)
+	}
+}
+
+// addRule appends and indexes a rule and updates the rule counts; the
+// caller must hold the engine's mu
+func (ae *AdaptiveEngine) addRule(rule sexp.Element) {
+	ae.engine.addRule(rule)
+
+	ae.stats.TotalRules++
+	if rule.IsList() {
 		ae.stats.ListRules++
-		ae.engine.tagIndex[list.Tag] = append(ae.engine.tagIndex[list.Tag], idx)
 	} else {
 		ae.stats.AtomRules++
-		ae.engine.atomRules = append(ae.engine.atomRules, idx)
+	}
+	ae.dirty.Store(true)
+}
+
+// RemoveRule removes a rule equal to rule, as Engine.RemoveRule does, and
+// updates adaptive statistics; it reports whether a rule was removed
+func (ae *AdaptiveEngine) RemoveRule(rule sexp.Element) bool {
+	ae.engine.mu.Lock()
+	defer ae.engine.mu.Unlock()
+
+	if !ae.engine.removeRule(rule) {
+		return false
 	}
 
-	// Recalculate whether indexing should be used
-	ae.updateIndexingStrategy()
+	ae.stats.TotalRules--
+	if rule.IsList() {
+		ae.stats.ListRules--
+	} else {
+		ae.stats.AtomRules--
+	}
+	ae.dirty.Store(true)
+	return true
+}
+
+// strategy returns whether queries use the index, re-evaluating the
+// strategy first if rules or observations changed
+func (ae *AdaptiveEngine) strategy() bool {
+	if ae.dirty.Load() {
+		ae.engine.mu.RLock()
+		ae.mu.Lock()
+		if ae.dirty.Swap(false) {
+			ae.updateIndexingStrategy()
+		}
+		ae.mu.Unlock()
+		ae.engine.mu.RUnlock()
+	}
+	return ae.indexed.Load()
 }
 
-// updateIndexingStrategy determines whether to enable indexing
+// updateIndexingStrategy determines whether to enable indexing; the caller
+// must hold engine.mu for reading and mu. It takes time proportional to
+// the number of tags queried, not the number of rules or tags.
 func (ae *AdaptiveEngine) updateIndexingStrategy() {
-	// Calculate statistics
+	// Every list rule is in exactly one tag bucket
 	ae.stats.UniqueTags = len(ae.engine.tagIndex)
-
-	// Calculate average fanout (rules per tag)
+	ae.stats.AvgTagFanout = 0
 	if ae.stats.UniqueTags > 0 {
-		totalTagged := 0
-		for _, indices := range ae.engine.tagIndex {
-			totalTagged += len(indices)
-		}
-		ae.stats.AvgTagFanout = float64(totalTagged) / float64(ae.stats.UniqueTags)
+		ae.stats.AvgTagFanout = float64(ae.stats.ListRules) / float64(ae.stats.UniqueTags)
+	}
+
+	// The rules checked per query, by the tags actually queried if enough
+	// queries were observed
+	fanout := ae.stats.AvgTagFanout
+	ae.stats.SampledQueries = ae.obs.sampled
+	ae.stats.QueryFanout = 0
+	if ae.obs.sampled >= minObservedQueries {
+		fanout = ae.queryFanout()
+		ae.stats.QueryFanout = fanout
 	}
 
 	// Decision logic: enable indexing if:
 	// 1. We have enough rules to make indexing worthwhile
 	// 2. We have enough unique tags for selectivity
-	// 3. Average fanout isn't too high (tags are selective)
+	// 3. Fanout isn't too high (tags are selective)
 	shouldIndex := ae.stats.TotalRules >= minRulesForIndexing &&
 		ae.stats.UniqueTags >= minTagCountForIndexing &&
-		ae.stats.AvgTagFanout <= maxAvgFanoutForIndexing
+		fanout <= maxAvgFanoutForIndexing
+
+	// Measured latencies win if they clearly favour one strategy
+	linear, indexed := &ae.obs.latency[0], &ae.obs.latency[1]
+	ae.stats.LinearLatency = linear.duration()
+	ae.stats.IndexedLatency = indexed.duration()
+	if ae.obs.settled() {
+		shouldIndex = indexed.mean < linear.mean
+	}
 
-	// Update engine's indexing flag
-	ae.engine.indexEnabled = shouldIndex
+	if ae.forced {
+		shouldIndex = ae.forcedTo
+	}
+	ae.indexed.Store(shouldIndex)
 	ae.stats.IndexingEnabled = shouldIndex
 }
 
+// queryFanout returns the average number of rules an indexed query checks
+// for the observed queries; the caller must hold engine.mu for reading
+// and mu
+func (ae *AdaptiveEngine) queryFanout() float64 {
+	checked := ae.obs.atomHits * len(ae.engine.atomRules)
+	for tag, hits := range ae.obs.tagHits {
+		checked += hits * len(ae.engine.tagIndex[tag])
+	}
+	return float64(checked) / float64(ae.obs.sampled)
+}
+
 // Query checks if a query is authorized by any rule
 func (ae *AdaptiveEngine) Query(query string) (bool, error) {
-	return ae.engine.Query(query)
+	parser := sexp.NewParser(query)
+	queryElem, err := parser.Parse()
+	if err != nil {
+		return false, fmt.Errorf("failed to parse query: %v", err)
+	}
+	return ae.QueryElement(queryElem), nil
 }
 
 // QueryElement checks if a query element is authorized
 func (ae *AdaptiveEngine) QueryElement(query sexp.Element) bool {
-	return ae.engine.QueryElement(query)
+	indexed := ae.strategy()
+	if every := ae.sampleEvery.Load(); every > 0 {
+		if n := ae.queries.Add(1); n%every == 0 {
+			return ae.sample(query, indexed, (n/every)%2 == 1)
+		}
+	}
+	return ae.engine.queryElement(query, indexed)
+}
+
+// sample runs a query and records its tag and time. With probe, it runs
+// the strategy not in use instead, unless the latencies are settled.
+func (ae *AdaptiveEngine) sample(query sexp.Element, indexed, probe bool) bool {
+	if probe {
+		ae.mu.Lock()
+		if !ae.forced && !ae.obs.settled() {
+			indexed = !indexed
+		}
+		ae.mu.Unlock()
+	}
+
+	start := time.Now()
+	allowed := ae.engine.queryElement(query, indexed)
+	elapsed := time.Since(start)
+
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+
+	obs := &ae.obs
+	if obs.sampled == maxObservedQueries {
+		obs.sampled = 0
+		for tag, hits := range obs.tagHits {
+			if hits /= 2; hits == 0 {
+				delete(obs.tagHits, tag)
+			} else {
+				obs.tagHits[tag] = hits
+			}
+			obs.sampled += hits
+		}
+		obs.atomHits /= 2
+		obs.sampled += obs.atomHits
+	}
+	obs.sampled++
+	if list, ok := query.(*sexp.List); ok {
+		obs.tagHits[list.Tag]++
+	} else {
+		obs.atomHits++
+	}
+	if indexed {
+		obs.latency[1].add(elapsed)
+	} else {
+		obs.latency[0].add(elapsed)
+	}
+	ae.dirty.Store(true)
+	return allowed
+}
+
+// SetSampleInterval observes every n-th query (default
+// DefaultSampleInterval); 0 disables observation so that only the rule
+// thresholds decide. Observations made so far are discarded.
+func (ae *AdaptiveEngine) SetSampleInterval(n int) {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+
+	ae.sampleEvery.Store(int64(max(n, 0)))
+	ae.obs = queryObservations{tagHits: make(map[string]int)}
+	ae.dirty.Store(true)
 }
 
 // FindMatchingRules returns all rules that authorize the query
 func (ae *AdaptiveEngine) FindMatchingRules(query string) ([]sexp.Element, error) {
-	return ae.engine.FindMatchingRules(query)
+	parser := sexp.NewParser(query)
+	queryElem, err := parser.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %v", err)
+	}
+	return ae.engine.findMatching(queryElem, ae.strategy()), nil
 }
 
 // RuleCount returns the number of rules in the engine
@@ -140,36 +382,70 @@ func (ae *AdaptiveEngine) RuleCount() int {
 
 // Clear removes all rules from the engine
 func (ae *AdaptiveEngine) Clear() {
-	ae.engine.Clear()
+	ae.engine.mu.Lock()
+	defer ae.engine.mu.Unlock()
+
+	ae.engine.reset()
+
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
 	ae.stats = AdaptiveStats{}
+	ae.obs = queryObservations{tagHits: make(map[string]int)}
+	ae.dirty.Store(true)
 }
 
 // Stats returns the current adaptive statistics
 func (ae *AdaptiveEngine) Stats() AdaptiveStats {
+	ae.strategy()
+
+	ae.engine.mu.RLock()
+	defer ae.engine.mu.RUnlock()
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
 	return ae.stats
 }
 
 // GetIndexStats returns indexing statistics (for compatibility)
 func (ae *AdaptiveEngine) GetIndexStats() map[string]any {
+	stats := ae.Stats()
 	baseStats := ae.engine.GetIndexStats()
+	baseStats["index_enabled"] = stats.IndexingEnabled
 
 	// Add adaptive-specific stats
-	baseStats["adaptive_total_rules"] = ae.stats.TotalRules
-	baseStats["adaptive_list_rules"] = ae.stats.ListRules
-	baseStats["adaptive_atom_rules"] = ae.stats.AtomRules
-	baseStats["adaptive_unique_tags"] = ae.stats.UniqueTags
-	baseStats["adaptive_avg_fanout"] = ae.stats.AvgTagFanout
-	baseStats["adaptive_indexing_enabled"] = ae.stats.IndexingEnabled
+	baseStats["adaptive_total_rules"] = stats.TotalRules
+	baseStats["adaptive_list_rules"] = stats.ListRules
+	baseStats["adaptive_atom_rules"] = stats.AtomRules
+	baseStats["adaptive_unique_tags"] = stats.UniqueTags
+	baseStats["adaptive_avg_fanout"] = stats.AvgTagFanout
+	baseStats["adaptive_indexing_enabled"] = stats.IndexingEnabled
+	baseStats["adaptive_sampled_queries"] = stats.SampledQueries
+	baseStats["adaptive_query_fanout"] = stats.QueryFanout
+	baseStats["adaptive_indexed_latency_ns"] = stats.IndexedLatency.Nanoseconds()
+	baseStats["adaptive_linear_latency_ns"] = stats.LinearLatency.Nanoseconds()
 
 	return baseStats
 }
 
-// ForceIndexing allows manual override of the adaptive strategy
+// ForceIndexing allows manual override of the adaptive strategy. The
+// override holds until ResetIndexing is called.
 func (ae *AdaptiveEngine) ForceIndexing(enabled bool) {
-	ae.engine.indexEnabled = enabled
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+
+	ae.forced, ae.forcedTo = true, enabled
+	ae.indexed.Store(enabled)
 	ae.stats.IndexingEnabled = enabled
 }
 
+// ResetIndexing undoes ForceIndexing, returning to the adaptive strategy
+func (ae *AdaptiveEngine) ResetIndexing() {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+
+	ae.forced = false
+	ae.dirty.Store(true)
+}
+
 // LoadRulesFromFile loads rules from a file into the adaptive engine
 func (ae *AdaptiveEngine) LoadRulesFromFile(filename string) error {
 	rules, err := persist.LoadFileToSlice(filename)
@@ -177,10 +453,7 @@ func (ae *AdaptiveEngine) LoadRulesFromFile(filename string) error {
 		return fmt.Errorf("failed to load rules: %w", err)
 	}
 
-	for _, rule := range rules {
-		ae.AddRuleElement(rule)
-	}
-
+	ae.AddRuleElements(rules)
 	return nil
 }
 
@@ -191,27 +464,49 @@ func (ae *AdaptiveEngine) LoadRulesFromFileWithOptions(filename string, opts per
 		return fmt.Errorf("failed to load rules: %w", err)
 	}
 
-	for _, rule := range rules {
-		ae.AddRuleElement(rule)
-	}
-
+	ae.AddRuleElements(rules)
 	return nil
 }
 
-// SaveRulesToFile saves all rules from the engine to a file
+// LoadRuleset appends a ruleset using its prebuilt tag index and updates
+// the adaptive statistics once for the whole set
+func (ae *AdaptiveEngine) LoadRuleset(rs *persist.Ruleset) {
+	ae.engine.mu.Lock()
+	defer ae.engine.mu.Unlock()
+
+	ae.engine.loadRuleset(rs)
+
+	ae.stats.TotalRules += len(rs.Rules)
+	ae.stats.AtomRules += len(rs.AtomRules)
+	ae.stats.ListRules += len(rs.Rules) - len(rs.AtomRules)
+	ae.dirty.Store(true)
+}
+
+// SaveRulesToFile saves a consistent snapshot of the rules to a file,
+// replacing it atomically
 func (ae *AdaptiveEngine) SaveRulesToFile(filename string, format persist.FileFormat) error {
 	return ae.engine.SaveRulesToFile(filename, format)
 }
 
+// SaveRulesToFileWithOptions saves rules like SaveRulesToFile, keeping
+// backups of the previous file as configured in opts
+func (ae *AdaptiveEngine) SaveRulesToFileWithOptions(filename string, format persist.FileFormat, opts persist.SaveOptions) error {
+	return ae.engine.SaveRulesToFileWithOptions(filename, format, opts)
+}
+
 // ExportRules returns all rules as a slice for serialization
 func (ae *AdaptiveEngine) ExportRules() []sexp.Element {
 	return ae.engine.ExportRules()
 }
 
+// Rules returns an iterator over the rules without copying them, as
+// Engine.Rules does
+func (ae *AdaptiveEngine) Rules() iter.Seq[sexp.Element] {
+	return ae.engine.Rules()
+}
+
 // ImportRules replaces all rules with the provided slice
 func (ae *AdaptiveEngine) ImportRules(rules []sexp.Element) {
 	ae.Clear()
-	for _, rule := range rules {
-		ae.AddRuleElement(rule)
-	}
+	ae.AddRuleElements(rules)
 }
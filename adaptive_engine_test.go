@@ -1,7 +1,10 @@
 package spocp
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/sirosfoundation/go-spocp/pkg/sexp"
 )
@@ -381,3 +384,220 @@ func TestAdaptiveEngine_EdgeCaseThresholds(t *testing.T) {
 		t.Error("Expected indexing enabled at exact threshold")
 	}
 }
+
+func TestAdaptiveEngine_RemoveRule(t *testing.T) {
+	engine := NewAdaptiveEngine()
+	engine.AddRule("(4:http(4:page5:index))")
+	engine.AddRule("(5:admin)")
+
+	rule, _ := sexp.NewParser("(5:admin)").Parse()
+	if !engine.RemoveRule(rule) {
+		t.Fatal("Expected rule to be removed")
+	}
+	if engine.RemoveRule(rule) {
+		t.Error("Expected no rule to be removed the second time")
+	}
+
+	stats := engine.Stats()
+	if stats.TotalRules != 1 || stats.AtomRules != 0 || stats.ListRules != 1 {
+		t.Errorf("Unexpected stats after remove: %+v", stats)
+	}
+	if ok, _ := engine.Query("(5:admin)"); ok {
+		t.Error("Expected removed rule not to match")
+	}
+	if ok, _ := engine.Query("(4:http(4:page5:index))"); !ok {
+		t.Error("Expected remaining rule to match")
+	}
+}
+
+func TestAdaptiveEngine_AddRuleElements(t *testing.T) {
+	var rules []sexp.Element
+	for i := 0; i < 100; i++ {
+		rules = append(rules, sexp.NewList(fmt.Sprintf("tag%d", i%10), sexp.NewAtom("resource")))
+	}
+	rules = append(rules, sexp.NewAtom("admin"))
+
+	single := NewAdaptiveEngine()
+	for _, rule := range rules {
+		single.AddRuleElement(rule)
+	}
+	bulk := NewAdaptiveEngine()
+	bulk.AddRuleElements(rules[:50])
+	bulk.AddRuleElements(rules[50:])
+
+	if single.Stats() != bulk.Stats() {
+		t.Errorf("Bulk stats %+v differ from %+v", bulk.Stats(), single.Stats())
+	}
+	if !reflect.DeepEqual(single.ExportRules(), bulk.ExportRules()) {
+		t.Error("Bulk rules differ in order")
+	}
+	if ok, _ := bulk.Query("(4:tag78:resource)"); !ok {
+		t.Error("Expected tag7 rule to match")
+	}
+}
+
+func TestAdaptiveEngine_LazyStrategy(t *testing.T) {
+	engine := NewAdaptiveEngine()
+	for i := 0; i < 100; i++ {
+		engine.AddRuleElement(sexp.NewList(fmt.Sprintf("tag%d", i%20), sexp.NewAtom("resource")))
+	}
+
+	// Adding rules only marks the strategy for re-evaluation
+	if engine.indexed.Load() || !engine.dirty.Load() {
+		t.Fatal("Expected the strategy to be evaluated lazily")
+	}
+	if ok, _ := engine.Query("(5:tag138:resource)"); !ok {
+		t.Error("Expected tag13 rule to match")
+	}
+	if !engine.indexed.Load() || engine.dirty.Load() {
+		t.Error("Expected the first query to enable indexing")
+	}
+
+	// Clearing resets the index even while it is not used
+	engine.Clear()
+	engine.AddRule("(4:tag1)")
+	if stats := engine.GetIndexStats(); stats["unique_tags"] != 1 || stats["index_enabled"] != false {
+		t.Errorf("Unexpected stats after clear: %v", stats)
+	}
+}
+
+func TestAdaptiveEngine_ObservedQueries(t *testing.T) {
+	// 10 tags with an average fanout of 30.9, but one holds 300 rules
+	engine := NewAdaptiveEngine()
+	for i := 0; i < 300; i++ {
+		engine.AddRuleElement(sexp.NewList("hot", sexp.NewAtom(fmt.Sprint(i))))
+	}
+	for i := 0; i < 9; i++ {
+		engine.AddRuleElement(sexp.NewList(fmt.Sprintf("cold%d", i)))
+	}
+	if !engine.Stats().IndexingEnabled {
+		t.Fatal("Expected the rule thresholds to enable indexing")
+	}
+
+	observe := func(f func(obs *queryObservations)) AdaptiveStats {
+		engine.mu.Lock()
+		f(&engine.obs)
+		engine.mu.Unlock()
+		engine.dirty.Store(true)
+		return engine.Stats()
+	}
+
+	// Queries for the hot tag check 300 rules each
+	stats := observe(func(obs *queryObservations) {
+		obs.sampled, obs.tagHits["hot"] = minObservedQueries, minObservedQueries
+	})
+	if stats.IndexingEnabled || stats.QueryFanout != 300 {
+		t.Errorf("Expected no indexing for hot tag queries, got %+v", stats)
+	}
+
+	// Measured latencies override the fanout
+	stats = observe(func(obs *queryObservations) {
+		obs.latency[0] = latencyAverage{mean: 1000, samples: minLatencySamples}
+		obs.latency[1] = latencyAverage{mean: 100, samples: minLatencySamples}
+	})
+	if !stats.IndexingEnabled || stats.IndexedLatency != 100 || stats.LinearLatency != 1000 {
+		t.Errorf("Expected indexing for faster indexed queries, got %+v", stats)
+	}
+
+	// Latencies within the margin leave the decision to the fanout
+	stats = observe(func(obs *queryObservations) {
+		obs.latency[1].mean = 950
+	})
+	if stats.IndexingEnabled {
+		t.Error("Expected close latencies not to decide")
+	}
+
+	// An override holds until reset
+	engine.ForceIndexing(true)
+	engine.AddRule("(5:cold9)")
+	if !engine.Stats().IndexingEnabled {
+		t.Error("Expected forced indexing to hold")
+	}
+	engine.ResetIndexing()
+	if engine.Stats().IndexingEnabled {
+		t.Error("Expected the adaptive strategy after reset")
+	}
+}
+
+func TestAdaptiveEngine_SampleInterval(t *testing.T) {
+	engine := NewAdaptiveEngine()
+	for i := 0; i < 60; i++ {
+		engine.AddRuleElement(sexp.NewList(fmt.Sprintf("tag%d", i%6), sexp.NewAtom(fmt.Sprint(i))))
+	}
+	engine.AddRule("(5:admin)")
+
+	engine.SetSampleInterval(1)
+	for i := 0; i < 10; i++ {
+		// Sampled queries alternate strategies with the same results
+		if ok, _ := engine.Query("(4:tag32:33)"); !ok {
+			t.Fatal("Expected tag3 rule to match")
+		}
+		if ok, _ := engine.Query("5:admin"); ok {
+			t.Fatal("Expected atom query not to match a list rule")
+		}
+	}
+	stats := engine.Stats()
+	if stats.SampledQueries != 20 || engine.obs.tagHits["tag3"] != 10 || engine.obs.atomHits != 10 {
+		t.Errorf("Unexpected observations %+v", engine.obs)
+	}
+	if engine.obs.latency[0].samples != 10 || engine.obs.latency[1].samples != 10 {
+		t.Errorf("Expected both strategies to be sampled, got %+v", engine.obs.latency)
+	}
+
+	// Once the latencies are settled, only the strategy in use is sampled
+	engine.mu.Lock()
+	engine.obs.latency[0] = latencyAverage{mean: float64(time.Second), samples: minLatencySamples}
+	engine.obs.latency[1] = latencyAverage{mean: 100, samples: minLatencySamples}
+	engine.mu.Unlock()
+	engine.dirty.Store(true)
+	for i := 0; i < 10; i++ {
+		engine.Query("(4:tag32:33)")
+	}
+	if engine.obs.latency[0].samples != minLatencySamples || engine.obs.latency[1].samples != minLatencySamples+10 {
+		t.Errorf("Expected only indexed queries to be sampled, got %+v", engine.obs.latency)
+	}
+
+	// Old observations lose weight
+	engine.mu.Lock()
+	engine.obs.sampled = maxObservedQueries
+	engine.obs.tagHits["tag3"] = maxObservedQueries - 1
+	engine.obs.atomHits = 1
+	engine.mu.Unlock()
+	engine.Query("(4:tag12:31)")
+	if engine.obs.sampled != maxObservedQueries/2 || engine.obs.tagHits["tag1"] != 1 || engine.obs.atomHits != 0 {
+		t.Errorf("Expected halved observations, got %+v", engine.obs)
+	}
+
+	engine.SetSampleInterval(0)
+	engine.Query("(4:tag32:33)")
+	if stats := engine.Stats(); stats.SampledQueries != 0 {
+		t.Errorf("Expected no sampling, got %d sampled queries", stats.SampledQueries)
+	}
+}
+
+// TestAdaptiveEngine_ConcurrentStats tests that Stats can run while rules
+// are added and removed; run with -race
+func TestAdaptiveEngine_ConcurrentStats(t *testing.T) {
+	engine := NewAdaptiveEngine()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Every rule with tag0 or tag10 is removed again
+		for i := 0; i < 500; i++ {
+			rule := sexp.NewList(fmt.Sprintf("tag%d", i%20), sexp.NewAtom("resource"))
+			engine.AddRuleElement(rule)
+			if i%10 == 0 {
+				engine.RemoveRule(rule)
+			}
+		}
+	}()
+	for i := 0; i < 500; i++ {
+		engine.Stats()
+	}
+	<-done
+
+	if stats := engine.Stats(); stats.TotalRules != 450 || stats.UniqueTags != 18 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
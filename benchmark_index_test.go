@@ -264,3 +264,20 @@ func BenchmarkIndexed_WorstCase_10k(b *testing.B) {
 		engine.QueryElement(query)
 	}
 }
+
+func BenchmarkAdaptive_AddRules_50k(b *testing.B) {
+	// Adding rules one by one with many tags must stay linear
+	rules := make([]sexp.Element, 50000)
+	for i := range rules {
+		rules[i] = sexp.NewList(fmt.Sprintf("tag%d", i%5000), sexp.NewAtom("resource"))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine := NewAdaptiveEngine()
+		for _, rule := range rules {
+			engine.AddRuleElement(rule)
+		}
+		engine.QueryElement(rules[0])
+	}
+}
@@ -0,0 +1,68 @@
+package spocp
+
+import (
+	"fmt"
+	"iter"
+
+	"github.com/sirosfoundation/go-spocp/pkg/persist"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// Builder builds an engine from a stream of rules, indexing each rule as it
+// arrives. Combined with persist.Scan or persist.ScanFile, rule files of
+// any size load without holding an intermediate copy of their rules.
+//
+//	b := spocp.NewBuilder()
+//	opts := persist.DefaultLoadOptions()
+//	opts.Progress = func(p persist.Progress) { log.Printf("%d rules", p.Rules) }
+//	if err := b.LoadFile("huge.spoc", opts); err != nil {
+//		return err
+//	}
+//	engine := b.Build()
+//
+// A Builder is not safe for concurrent use.
+type Builder struct {
+	engine *Engine
+}
+
+// NewBuilder returns a builder for an engine with indexing enabled
+func NewBuilder() *Builder {
+	return &Builder{engine: NewEngine()}
+}
+
+// Add adds a rule
+func (b *Builder) Add(rule sexp.Element) {
+	b.engine.addRule(rule)
+}
+
+// AddAll adds the rules of a stream, stopping at its first error. Rules
+// added before the error are kept.
+func (b *Builder) AddAll(rules iter.Seq2[persist.Rule, error]) error {
+	for rule, err := range rules {
+		if err != nil {
+			return err
+		}
+		b.engine.addRule(rule.Element)
+	}
+	return nil
+}
+
+// LoadFile adds the rules of a file, read with persist.ScanFile
+func (b *Builder) LoadFile(filename string, opts persist.LoadOptions) error {
+	if err := b.AddAll(persist.ScanFile(filename, opts)); err != nil {
+		return fmt.Errorf("failed to load rules: %w", err)
+	}
+	return nil
+}
+
+// Len returns the number of rules added so far
+func (b *Builder) Len() int {
+	return len(b.engine.rules)
+}
+
+// Build returns the engine. The builder must not be used afterwards.
+func (b *Builder) Build() *Engine {
+	engine := b.engine
+	b.engine = nil
+	return engine
+}
@@ -0,0 +1,50 @@
+package spocp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirosfoundation/go-spocp/pkg/persist"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+func TestBuilder(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.spoc")
+	content := "(4:http(4:page10:index.html))\n(4:http(4:page10:about.html))\n(5:admin)\n"
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBuilder()
+	b.Add(sexp.NewList("ftp"))
+
+	progress := 0
+	opts := persist.DefaultLoadOptions()
+	opts.ProgressInterval = 1
+	opts.Progress = func(p persist.Progress) { progress = p.Rules }
+	if err := b.LoadFile(filename, opts); err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if b.Len() != 4 || progress != 3 {
+		t.Errorf("Expected 4 rules and progress at 3, got %d and %d", b.Len(), progress)
+	}
+
+	engine := b.Build()
+	for _, query := range []string{"(4:http(4:page10:index.html))", "(5:admin)", "(3:ftp)"} {
+		if ok, err := engine.Query(query); err != nil || !ok {
+			t.Errorf("Expected %s to be allowed, got %v, %v", query, ok, err)
+		}
+	}
+	if stats := engine.GetIndexStats(); stats["unique_tags"] != 3 || stats["most_common_tag_count"] != 2 {
+		t.Errorf("Expected the rules to be indexed, got %v", stats)
+	}
+
+	// Rules before an error are kept
+	b = NewBuilder()
+	err := b.AddAll(persist.Scan(strings.NewReader("(1:a)\n(1:b\n"), persist.DefaultLoadOptions()))
+	if err == nil || b.Len() != 1 {
+		t.Errorf("Expected an error after 1 rule, got %v with %d rules", err, b.Len())
+	}
+}
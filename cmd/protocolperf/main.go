@@ -2,7 +2,8 @@
 //
 // This tool compares the performance overhead of different access methods to the SPOCP engine:
 //   - Direct: Library calls to the engine (baseline)
-//   - TCP: Using the SPOCP TCP protocol via client library
+//   - TCP: Using the SPOCP TCP protocol via client library, one query at a
+//     time and pipelined with QueryAsync
 //   - HTTP: Using the AuthZen HTTP endpoint
 //
 // All tests use the same rules and queries to ensure fair comparison.
@@ -53,6 +54,7 @@ func main() {
 	numRules := flag.Int("rules", 1000, "Number of rules to generate")
 	numQueries := flag.Int("queries", 10000, "Number of queries to run")
 	numConcurrent := flag.Int("concurrent", 1, "Number of concurrent clients (for TCP/HTTP)")
+	pipeline := flag.Int("pipeline", 64, "Queries in flight for the pipelined TCP benchmark (0 to skip)")
 	warmup := flag.Int("warmup", 100, "Number of warmup queries")
 	tcpPort := flag.Int("tcp-port", 16000, "TCP server port")
 	httpPort := flag.Int("http-port", 18000, "HTTP server port")
@@ -121,6 +123,17 @@ func main() {
 			results = append(results, *tcpResult)
 			printResult(*tcpResult, *verbose)
 		}
+
+		if *pipeline > 0 {
+			fmt.Println("\n🚀 Benchmark 2b: Pipelined TCP Protocol")
+			fmt.Printf("   One connection, up to %d queries in flight with QueryAsync\n", *pipeline)
+
+			pipelineResult := runTCPPipelineBenchmark(engine, testCases, *tcpPort, *warmup, *pipeline, *verbose)
+			if pipelineResult != nil {
+				results = append(results, *pipelineResult)
+				printResult(*pipelineResult, *verbose)
+			}
+		}
 	}
 
 	// ═══════════════════════════════════════════════════════════════════════
@@ -263,38 +276,10 @@ func generateRulesAndTestCases(engine *spocp.Engine, numRules, numTestCases int)
 
 // runTCPBenchmark runs the TCP protocol benchmark
 func runTCPBenchmark(engine *spocp.Engine, testCases []TestCase, port, warmup, concurrent int, verbose bool) *BenchmarkResult {
-	tcpAddr := fmt.Sprintf("127.0.0.1:%d", port)
-
-	// Check if port is available
-	ln, err := net.Listen("tcp", tcpAddr)
-	if err != nil {
-		fmt.Printf("   ❌ Port %d not available: %v\n", port, err)
-		return nil
-	}
-	ln.Close()
-
-	// Start TCP server
-	tcpConfig := &server.Config{
-		Address:  tcpAddr,
-		Engine:   engine,
-		LogLevel: server.LogLevelSilent,
-	}
-
-	tcpServer, err := server.NewServer(tcpConfig)
-	if err != nil {
-		fmt.Printf("   ❌ Failed to create TCP server: %v\n", err)
+	tcpServer, tcpAddr := startTCPServer(engine, port)
+	if tcpServer == nil {
 		return nil
 	}
-
-	// Start server in background
-	serverReady := make(chan struct{})
-	go func() {
-		close(serverReady)
-		_ = tcpServer.Serve() //nolint:errcheck // benchmark server
-	}()
-	<-serverReady
-	time.Sleep(50 * time.Millisecond) // Give server time to start
-
 	defer tcpServer.Close()
 
 	queries := testCases[warmup:]
@@ -399,6 +384,107 @@ func runTCPBenchmark(engine *spocp.Engine, testCases []TestCase, port, warmup, c
 	}
 }
 
+// startTCPServer starts a TCP server for the engine on port, or prints
+// why it could not and returns nil
+func startTCPServer(engine *spocp.Engine, port int) (*server.Server, string) {
+	tcpAddr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	// Check if port is available
+	ln, err := net.Listen("tcp", tcpAddr)
+	if err != nil {
+		fmt.Printf("   ❌ Port %d not available: %v\n", port, err)
+		return nil, ""
+	}
+	ln.Close()
+
+	// Start TCP server
+	tcpConfig := &server.Config{
+		Address:  tcpAddr,
+		Engine:   engine,
+		LogLevel: server.LogLevelSilent,
+	}
+
+	tcpServer, err := server.NewServer(tcpConfig)
+	if err != nil {
+		fmt.Printf("   ❌ Failed to create TCP server: %v\n", err)
+		return nil, ""
+	}
+
+	// Start server in background
+	serverReady := make(chan struct{})
+	go func() {
+		close(serverReady)
+		_ = tcpServer.Serve() //nolint:errcheck // benchmark server
+	}()
+	<-serverReady
+	time.Sleep(50 * time.Millisecond) // Give server time to start
+
+	return tcpServer, tcpAddr
+}
+
+// runTCPPipelineBenchmark runs the TCP protocol benchmark with a single
+// client that keeps up to depth queries in flight with QueryAsync
+func runTCPPipelineBenchmark(engine *spocp.Engine, testCases []TestCase, port, warmup, depth int, verbose bool) *BenchmarkResult {
+	tcpServer, tcpAddr := startTCPServer(engine, port)
+	if tcpServer == nil {
+		return nil
+	}
+	defer tcpServer.Close()
+
+	cli, err := client.NewClient(&client.Config{
+		Address: tcpAddr,
+		Timeout: 5 * time.Second,
+	})
+	if err != nil {
+		fmt.Printf("   ❌ Failed to connect: %v\n", err)
+		return nil
+	}
+	defer cli.Close()
+
+	// Warmup
+	for i := 0; i < warmup; i++ {
+		_, _ = cli.Query(testCases[i].Query) //nolint:errcheck // warmup
+	}
+
+	total := len(testCases) - warmup
+	queries := testCases[warmup:]
+	futures := make([]*client.QueryFuture, 0, depth)
+	start := time.Now()
+	matches := 0
+	for len(queries) > 0 {
+		// Send a batch of depth queries, then collect their results
+		batch := queries[:min(depth, len(queries))]
+		queries = queries[len(batch):]
+		futures = futures[:0]
+		for _, tc := range batch {
+			futures = append(futures, cli.QueryAsync(tc.Query))
+		}
+		for _, f := range futures {
+			result, err := f.Wait()
+			if err != nil {
+				if verbose {
+					fmt.Printf("   ⚠️  Query error: %v\n", err)
+				}
+				continue
+			}
+			if result {
+				matches++
+			}
+		}
+	}
+	duration := time.Since(start)
+
+	return &BenchmarkResult{
+		Name:          "TCP (pipelined)",
+		Duration:      duration,
+		Queries:       total,
+		QueriesPerSec: float64(total) / duration.Seconds(),
+		AvgLatency:    duration / time.Duration(total),
+		Matches:       matches,
+		MatchRate:     float64(matches) * 100 / float64(total),
+	}
+}
+
 // runHTTPBenchmark runs the HTTP/AuthZen protocol benchmark
 func runHTTPBenchmark(engine *spocp.Engine, testCases []TestCase, port, warmup, concurrent int, verbose bool) *BenchmarkResult {
 	httpAddr := fmt.Sprintf("127.0.0.1:%d", port)
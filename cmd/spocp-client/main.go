@@ -11,31 +11,70 @@ import (
 	"strings"
 
 	"github.com/sirosfoundation/go-spocp/pkg/client"
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sasl"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
 )
 
 func main() {
 	var (
-		address    = flag.String("addr", "localhost:6000", "Server address (host:port)")
-		useTLS     = flag.Bool("tls", false, "Use TLS")
-		skipVerify = flag.Bool("insecure", false, "Skip TLS certificate verification")
-		query      = flag.String("query", "", "Execute single query and exit")
-		addRule    = flag.String("add", "", "Add single rule and exit")
+		address      = flag.String("addr", "localhost:6000", "Server address (host:port)")
+		useTLS       = flag.Bool("tls", false, "Use TLS")
+		startTLS     = flag.Bool("starttls", false, "Connect in plain TCP and upgrade to TLS with STARTTLS")
+		skipVerify   = flag.Bool("insecure", false, "Skip TLS certificate verification")
+		certFile     = flag.String("cert", "", "TLS client certificate file (for EXTERNAL authentication)")
+		keyFile      = flag.String("key", "", "TLS client private key file")
+		user         = flag.String("user", "", "Authenticate as this user (password from SPOCP_PASSWORD)")
+		mechanism    = flag.String("mech", sasl.ScramSHA256, "SASL mechanism: SCRAM-SHA-256, PLAIN or EXTERNAL")
+		insecureAuth = flag.Bool("insecure-auth", false, "Allow PLAIN authentication without TLS (loopback only)")
+		query        = flag.String("query", "", "Execute single query and exit")
+		addRule      = flag.String("add", "", "Add single rule and exit")
+		deleteRule   = flag.String("delete", "", "Delete single rule and exit")
 	)
 
 	flag.Parse()
 
 	// Setup TLS if requested
 	var tlsConfig *tls.Config
-	if *useTLS {
+	if *useTLS || *startTLS {
 		tlsConfig = &tls.Config{
 			InsecureSkipVerify: *skipVerify,
 		}
+		if *certFile != "" {
+			cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to load client certificate: %v\n", err)
+				os.Exit(1)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	var auth sasl.ClientMechanism
+	switch strings.ToUpper(*mechanism) {
+	case sasl.External:
+		auth = sasl.NewExternalClient(*user)
+	case sasl.Plain:
+		auth = sasl.NewPlainClient(*user, os.Getenv("SPOCP_PASSWORD"))
+	case sasl.ScramSHA256:
+		auth = sasl.NewScramSHA256Client(*user, os.Getenv("SPOCP_PASSWORD"))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown mechanism: %s\n", *mechanism)
+		os.Exit(1)
+	}
+	if *user == "" && auth.Name() != sasl.External {
+		auth = nil
 	}
 
 	// Create client
 	config := &client.Config{
-		Address:   *address,
-		TLSConfig: tlsConfig,
+		Address:      *address,
+		TLSConfig:    tlsConfig,
+		Auth:         auth,
+		InsecureAuth: *insecureAuth,
+	}
+	if *startTLS {
+		config.StartTLS = client.StartTLSRequired
 	}
 
 	c, err := client.NewClient(config)
@@ -45,7 +84,16 @@ func main() {
 	}
 	defer c.Close()
 
-	fmt.Printf("Connected to %s\n", *address)
+	switch {
+	case c.Encrypted() && auth != nil:
+		fmt.Printf("Connected to %s (TLS, authenticated with %s)\n", *address, auth.Name())
+	case c.Encrypted():
+		fmt.Printf("Connected to %s (TLS)\n", *address)
+	case auth != nil:
+		fmt.Printf("Connected to %s (authenticated with %s)\n", *address, auth.Name())
+	default:
+		fmt.Printf("Connected to %s\n", *address)
+	}
 
 	// Single command mode
 	if *query != "" {
@@ -72,12 +120,26 @@ func main() {
 		return
 	}
 
+	if *deleteRule != "" {
+		err := c.DeleteString(*deleteRule)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Delete failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Rule deleted successfully")
+		return
+	}
+
 	// Interactive mode
 	fmt.Println("SPOCP Client - Interactive Mode")
 	fmt.Println("Commands:")
 	fmt.Println("  query <s-expression>  - Query a rule")
 	fmt.Println("  add <s-expression>    - Add a rule")
-	fmt.Println("  reload                - Reload server rules")
+	fmt.Println("  delete <s-expression> - Delete a rule")
+	fmt.Println("  reload [dryrun|force|rollback] - Reload server rules, preview changes, bypass guards")
+	fmt.Println("                          or restore the rules from before the last reload")
+	fmt.Println("  list [tag <tag>|match <s-expression>] - List the server's rules")
+	fmt.Println("  capa                  - Show the server's capabilities")
 	fmt.Println("  quit                  - Exit")
 	fmt.Println()
 
@@ -129,17 +191,96 @@ func main() {
 			}
 			fmt.Println("✓ Rule added successfully")
 
-		case "reload":
-			err := c.Reload()
+		case "delete":
+			if len(parts) < 2 {
+				fmt.Println("Error: delete requires an S-expression argument")
+				continue
+			}
+			err := c.DeleteString(parts[1])
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 				continue
 			}
-			fmt.Println("✓ Server rules reloaded")
+			fmt.Println("✓ Rule deleted successfully")
+
+		case "reload":
+			mode := ""
+			if len(parts) == 2 {
+				mode = strings.ToLower(strings.TrimSpace(parts[1]))
+			}
+			switch mode {
+			case "":
+				if err := c.Reload(); err != nil {
+					fmt.Printf("Error: %v\n", err)
+					continue
+				}
+				fmt.Println("✓ Server rules reloaded")
+			case "dryrun":
+				report, err := c.ReloadDryRun()
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					continue
+				}
+				fmt.Println(report)
+			case "force":
+				if err := c.ReloadForce(); err != nil {
+					fmt.Printf("Error: %v\n", err)
+					continue
+				}
+				fmt.Println("✓ Server rules reloaded (guards bypassed)")
+			case "rollback":
+				if err := c.Rollback(); err != nil {
+					fmt.Printf("Error: %v\n", err)
+					continue
+				}
+				fmt.Println("✓ Server rules rolled back")
+			default:
+				fmt.Println("Error: reload takes no argument, dryrun, force or rollback")
+			}
+
+		case "list":
+			opts := &client.ListOptions{}
+			if len(parts) == 2 {
+				filter := strings.SplitN(strings.TrimSpace(parts[1]), " ", 2)
+				switch {
+				case len(filter) == 2 && strings.EqualFold(filter[0], "tag"):
+					opts.Tag = strings.TrimSpace(filter[1])
+				case len(filter) == 2 && strings.EqualFold(filter[0], "match"):
+					pattern, err := protocol.ParseQuery(strings.TrimSpace(filter[1]))
+					if err != nil {
+						fmt.Printf("Error: invalid pattern: %v\n", err)
+						continue
+					}
+					opts.Pattern = pattern
+				default:
+					fmt.Println("Error: list takes tag <tag> or match <s-expression>")
+					continue
+				}
+			}
+			count := 0
+			for rule, err := range c.List(opts) {
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					break
+				}
+				fmt.Println(sexp.AdvancedForm(rule))
+				count++
+			}
+			fmt.Printf("%d rules\n", count)
+
+		case "capa":
+			caps := c.Capabilities()
+			if caps == nil {
+				fmt.Println("Server does not report capabilities")
+				continue
+			}
+			for _, line := range caps.Lines() {
+				fmt.Println(line)
+			}
 
 		default:
 			fmt.Printf("Unknown command: %s\n", cmd)
-			fmt.Println("Use: query, add, reload, or quit")
+			fmt.Println("Use: query, add, delete, reload, list, capa, or quit")
 		}
 	}
 
@@ -0,0 +1,216 @@
+// spocp-diff - compare two rulesets and report their permission impact
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sirosfoundation/go-spocp/pkg/persist"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage:
+  spocp-diff [-semantic] [-unchanged] [-json] <old> <new>
+
+<old> and <new> are rule files, directories of rule files or rule bundles
+(.tar.gz). Rules are compared by canonical form. The exit status is 0 if
+both hold the same rules, 1 if they differ and 2 on errors.
+
+Options:
+`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	var (
+		semantic  = flag.Bool("semantic", false, "Report rules that widen, narrow, grant or revoke permissions")
+		unchanged = flag.Bool("unchanged", false, "List unchanged rules as well")
+		asJSON    = flag.Bool("json", false, "Write the report as JSON")
+	)
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		usage()
+	}
+
+	old, err := loadRules(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	new, err := loadRules(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	diff := persist.DiffWithOptions(old, new, persist.DiffOptions{Semantic: *semantic})
+	if *asJSON {
+		err = writeJSON(os.Stdout, diff, *unchanged)
+	} else {
+		err = writeText(os.Stdout, diff, flag.Arg(0), flag.Arg(1), *unchanged)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	if !diff.Equal() {
+		os.Exit(1)
+	}
+}
+
+// loadRules loads a rule file, every rule file below a directory, or a
+// rule bundle
+func loadRules(name string) ([]sexp.Element, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := persist.DefaultLoadOptions()
+	switch {
+	case info.IsDir():
+		return loadDir(name, opts)
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		bundle, err := persist.LoadBundle(name, opts)
+		if err != nil {
+			return nil, err
+		}
+		rules := make([]sexp.Element, len(bundle.Rules))
+		for i, rule := range bundle.Rules {
+			rules[i] = rule.Element
+		}
+		return rules, nil
+	default:
+		return persist.LoadFile(name, opts)
+	}
+}
+
+// loadDir loads the rule files below dir the way spocpd does
+func loadDir(dir string, opts persist.LoadOptions) ([]sexp.Element, error) {
+	fsys := os.DirFS(dir)
+	var rules []sexp.Element
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !persist.IsRuleFile(name) {
+			return nil
+		}
+		switch path.Ext(name) {
+		case ".json", ".yaml", ".yml":
+			data, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return err
+			}
+			if !persist.IsRuleDocument(name, data) {
+				return nil
+			}
+		}
+		loaded, err := persist.LoadFS(fsys, name, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path.Join(dir, name), err)
+		}
+		rules = append(rules, loaded...)
+		return nil
+	})
+	return rules, err
+}
+
+func writeText(w io.Writer, diff *persist.RuleDiff, oldName, newName string, unchanged bool) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", oldName, newName)
+	for _, rule := range diff.Removed {
+		fmt.Fprintf(&b, "- %s\n", rule)
+	}
+	for _, rule := range diff.Added {
+		fmt.Fprintf(&b, "+ %s\n", rule)
+	}
+	if unchanged {
+		for _, rule := range diff.Unchanged {
+			fmt.Fprintf(&b, "  %s\n", rule)
+		}
+	}
+
+	if len(diff.Changes) > 0 {
+		b.WriteString("\nPermission impact:\n")
+		for _, c := range diff.Changes {
+			switch {
+			case c.Old == nil:
+				fmt.Fprintf(&b, "  %-10s %s\n", c.Impact, c.New)
+			case c.New == nil:
+				fmt.Fprintf(&b, "  %-10s %s\n", c.Impact, c.Old)
+			default:
+				fmt.Fprintf(&b, "  %-10s %s -> %s\n", c.Impact, c.Old, c.New)
+			}
+		}
+	}
+
+	fmt.Fprintf(&b, "\n%d added, %d removed, %d unchanged\n", len(diff.Added), len(diff.Removed), len(diff.Unchanged))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// jsonReport is the -json output
+type jsonReport struct {
+	Added     []string     `json:"added"`
+	Removed   []string     `json:"removed"`
+	Unchanged []string     `json:"unchanged,omitempty"`
+	Changes   []jsonChange `json:"changes,omitempty"`
+	Counts    struct {
+		Added     int `json:"added"`
+		Removed   int `json:"removed"`
+		Unchanged int `json:"unchanged"`
+	} `json:"counts"`
+}
+
+type jsonChange struct {
+	Impact string `json:"impact"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+func writeJSON(w io.Writer, diff *persist.RuleDiff, unchanged bool) error {
+	report := jsonReport{
+		Added:   ruleStrings(diff.Added),
+		Removed: ruleStrings(diff.Removed),
+	}
+	if unchanged {
+		report.Unchanged = ruleStrings(diff.Unchanged)
+	}
+	for _, c := range diff.Changes {
+		change := jsonChange{Impact: c.Impact.String()}
+		if c.Old != nil {
+			change.Old = c.Old.String()
+		}
+		if c.New != nil {
+			change.New = c.New.String()
+		}
+		report.Changes = append(report.Changes, change)
+	}
+	report.Counts.Added = len(diff.Added)
+	report.Counts.Removed = len(diff.Removed)
+	report.Counts.Unchanged = len(diff.Unchanged)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func ruleStrings(rules []sexp.Element) []string {
+	s := make([]string, len(rules))
+	for i, rule := range rules {
+		s[i] = rule.String()
+	}
+	return s
+}
@@ -0,0 +1,169 @@
+// spocp-sign - create keys, detached Ed25519 signatures and signed rule bundles
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirosfoundation/go-spocp/pkg/persist"
+	"github.com/sirosfoundation/go-spocp/pkg/signing"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage:
+  spocp-sign keygen -out <name>              write <name>.key and <name>.pub
+  spocp-sign sign -key <key.pem> <file>...   write <file>.sig for each file
+  spocp-sign verify -keys <path>[,<path>] <file>...
+  spocp-sign bundle -dir <rules> -out <bundle.tar.gz> [-version v] [-revision r] [-key <key.pem>]
+
+A detached signature covers the file contents only: a signed file still
+verifies after it is renamed or replaced by an older signed version. A
+signed bundle also covers the file names, version and revision.
+`)
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "keygen":
+		err = keygen(os.Args[2:])
+	case "sign":
+		err = sign(os.Args[2:])
+	case "verify":
+		err = verify(os.Args[2:])
+	case "bundle":
+		err = bundle(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func keygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "spocp-signing", "Output file name prefix")
+	fs.Parse(args) //nolint:errcheck // ExitOnError
+
+	pub, priv, err := signing.GenerateKey()
+	if err != nil {
+		return err
+	}
+	privPEM, err := signing.MarshalPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	pubPEM, err := signing.MarshalPublicKey(pub)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(*out+".key", privPEM, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out+".pub", pubPEM, 0644); err != nil { //nolint:gosec // public key
+		return err
+	}
+
+	fmt.Printf("Wrote %s.key and %s.pub (key id %s)\n", *out, *out, signing.KeyID(pub))
+	return nil
+}
+
+func sign(args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyFile := fs.String("key", "", "PEM private key file (required)")
+	fs.Parse(args) //nolint:errcheck // ExitOnError
+
+	if *keyFile == "" || fs.NArg() == 0 {
+		usage()
+	}
+
+	key, err := signing.LoadPrivateKey(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range fs.Args() {
+		if err := signing.SignFile(key, file); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		fmt.Printf("Signed %s -> %s\n", file, signing.SignaturePath(file))
+	}
+	return nil
+}
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	keys := fs.String("keys", "", "Comma-separated trusted public key files or directories (required)")
+	fs.Parse(args) //nolint:errcheck // ExitOnError
+
+	if *keys == "" || fs.NArg() == 0 {
+		usage()
+	}
+
+	ring, err := signing.LoadKeyRing(strings.Split(*keys, ",")...)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, file := range fs.Args() {
+		if err := ring.VerifyFile(file); err != nil {
+			fmt.Printf("FAIL %s: %v\n", file, err)
+			failed++
+			continue
+		}
+		fmt.Printf("OK   %s\n", file)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed verification", failed, fs.NArg())
+	}
+	return nil
+}
+
+func bundle(args []string) error {
+	fs := flag.NewFlagSet("bundle", flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory of rule files to bundle (required)")
+	out := fs.String("out", "", "Bundle file to write (required)")
+	version := fs.String("version", "", "Policy version recorded in the manifest")
+	revision := fs.String("revision", "", "Policy revision recorded in the manifest (e.g. commit hash)")
+	keyFile := fs.String("key", "", "PEM private key to sign the manifest with (optional)")
+	fs.Parse(args) //nolint:errcheck // ExitOnError
+
+	if *dir == "" || *out == "" {
+		usage()
+	}
+
+	opts := persist.BundleOptions{Version: *version, Revision: *revision}
+	if *keyFile != "" {
+		key, err := signing.LoadPrivateKey(*keyFile)
+		if err != nil {
+			return err
+		}
+		opts.Sign = func(manifest []byte) ([]byte, error) {
+			return signing.Sign(key, manifest), nil
+		}
+	}
+
+	manifest, err := persist.SaveBundle(*out, *dir, opts)
+	if err != nil {
+		return err
+	}
+
+	signed := "unsigned"
+	if opts.Sign != nil {
+		signed = "signed"
+	}
+	fmt.Printf("Wrote %s: %d files, revision %q (%s)\n", *out, len(manifest.Files), manifest.Revision, signed)
+	return nil
+}
@@ -2,16 +2,25 @@
 package main
 
 import (
-	"crypto/tls"
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/sirosfoundation/go-spocp/pkg/admin"
 	"github.com/sirosfoundation/go-spocp/pkg/httpserver"
+	"github.com/sirosfoundation/go-spocp/pkg/journal"
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sasl"
 	"github.com/sirosfoundation/go-spocp/pkg/server"
+	"github.com/sirosfoundation/go-spocp/pkg/signing"
+	"github.com/sirosfoundation/go-spocp/pkg/tlsutil"
 )
 
 func main() {
@@ -23,21 +32,61 @@ func main() {
 		// HTTP options
 		httpAddress    = flag.String("http-addr", ":8000", "HTTP server address for health/stats/metrics (and optionally AuthZen)")
 		authzenEnabled = flag.Bool("authzen", false, "Enable AuthZen API endpoint on HTTP server")
+		httpHealthAddr = flag.String("http-health-addr", "", "Also serve /health, /ready, /stats and /metrics in plain HTTP on this address (optional)")
+		httpTLSCert    = flag.String("http-tls-cert", "", "Path to TLS certificate file for HTTP server, enabling HTTPS and HTTP/2 (optional)")
+		httpTLSKey     = flag.String("http-tls-key", "", "Path to TLS private key file for HTTP server (optional)")
+		httpClientCA   = flag.String("http-tls-client-ca", "", "Comma-separated PEM files of CAs issuing HTTP client certificates (optional)")
+		httpClientAuth = flag.String("http-tls-client-auth", "none", "HTTP client certificates: none, optional (verified if sent), require")
+		httpCRL        = flag.String("http-tls-crl", "", "Comma-separated CRL files (PEM or DER) of the HTTP client CAs (optional)")
 
 		// Common options
-		rulesDir       = flag.String("rules", "", "Directory containing .spoc rule files (required)")
+		rulesDir       = flag.String("rules", "", "Directory containing .spoc rule files (required unless -bundle)")
+		bundlePath     = flag.String("bundle", "", "Rule bundle (.tar.gz with manifest) to load instead of -rules")
+		loadWorkers    = flag.Int("load-workers", 0, "Number of rule files parsed concurrently - 0 for one per CPU")
 		tlsCert        = flag.String("tls-cert", "", "Path to TLS certificate file for TCP server (optional)")
 		tlsKey         = flag.String("tls-key", "", "Path to TLS private key file for TCP server (optional)")
+		tlsClientCA    = flag.String("tls-client-ca", "", "Comma-separated PEM files of CAs issuing client certificates (optional)")
+		tlsClientAuth  = flag.String("tls-client-auth", "none", "Client certificates: none, optional (verified if sent), require")
+		tlsCRL         = flag.String("tls-crl", "", "Comma-separated CRL files (PEM or DER) of the client CAs (optional)")
+		tlsWatch       = flag.Duration("tls-watch", time.Minute, "Interval for checking TLS certificate, key, CA and CRL files for changes - 0 to reload only on SIGHUP")
+		startTLS       = flag.Bool("starttls", false, "Listen in plain TCP and let clients upgrade to TLS with STARTTLS (needs -tls-cert and -tls-key)")
+		requireTLS     = flag.Bool("require-tls", false, "With -starttls, refuse operations before STARTTLS except from loopback")
+		authFile       = flag.String("auth-file", "", "Credential file enabling AUTH with SCRAM-SHA-256 and PLAIN (optional)")
+		requireAuth    = flag.Bool("require-auth", false, "Refuse ADD, DELETE, RELOAD and LIST on unauthenticated connections")
+		adminRules     = flag.String("admin-rules", "", "Comma-separated rule files authorizing ADD, DELETE, RELOAD and LIST with spocp-admin queries (optional)")
+		maxMessage     = flag.Int("max-message-size", protocol.DefaultMaxMessageSize, "Largest protocol message accepted, in bytes")
+		hashPassword   = flag.Bool("hash-password", false, "Read a password from stdin, print its -auth-file credentials and exit")
 		reloadInterval = flag.Duration("reload", 0, "Auto-reload interval (e.g., 5m, 1h) - 0 to disable")
+		watch          = flag.Bool("watch", false, "Reload rules as soon as rule files change (inotify on Linux, polling elsewhere)")
+		watchDebounce  = flag.Duration("watch-debounce", server.DefaultWatchDebounce, "Time for a burst of rule file changes to settle before reloading")
+		maxRuleDelta   = flag.Float64("max-rule-delta", 0, "Reject reloads changing the rule count by more than this fraction (e.g., 0.1 for 10%) - 0 to disable")
+		canariesFile   = flag.String("canaries", "", "File of allow/deny canary queries that reloads must not change (optional)")
 		pidFile        = flag.String("pid", "", "PID file path (optional)")
 		logLevel       = flag.String("log", "error", "Log level: silent, error, warn, info, debug")
+		trustedKeys    = flag.String("trusted-keys", "", "Comma-separated public key files or directories; rule files must be signed (optional)")
+		journalPath    = flag.String("journal", "", "Journal file recording rules added/deleted at runtime (optional)")
+		journalSync    = flag.String("journal-sync", "always", "Journal fsync policy: always, interval, never")
+		journalCompact = flag.Int("journal-compact", 0, "Compact the journal into runtime.spoc after this many records (0 to disable)")
 	)
 
 	flag.Parse()
 
+	if *hashPassword {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+		creds, err := sasl.NewCredentials(strings.TrimRight(password, "\r\n"), 0)
+		if err != nil {
+			log.Fatalf("Failed to derive credentials: %v", err)
+		}
+		fmt.Println(creds)
+		return
+	}
+
 	// Validate required arguments
-	if *rulesDir == "" {
-		fmt.Fprintf(os.Stderr, "Error: -rules directory is required\n\n")
+	if *rulesDir == "" && *bundlePath == "" {
+		fmt.Fprintf(os.Stderr, "Error: -rules directory or -bundle is required\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -49,6 +98,30 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *journalPath != "" && !*tcpEnabled {
+		fmt.Fprintf(os.Stderr, "Error: -journal requires -tcp\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *watch && !*tcpEnabled {
+		fmt.Fprintf(os.Stderr, "Error: -watch requires -tcp\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if (*authFile != "" || *requireAuth || *adminRules != "") && !*tcpEnabled {
+		fmt.Fprintf(os.Stderr, "Error: -auth-file, -require-auth and -admin-rules require -tcp\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if (*maxRuleDelta != 0 || *canariesFile != "") && !*tcpEnabled {
+		fmt.Fprintf(os.Stderr, "Error: -max-rule-delta and -canaries require -tcp\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	// Parse log level
 	var level server.LogLevel
 	switch *logLevel {
@@ -70,22 +143,82 @@ func main() {
 	logger := log.New(os.Stdout, "[SPOCP] ", log.LstdFlags)
 
 	// Setup TLS if certificates are provided
-	var tlsConfig *tls.Config
-	if *tlsCert != "" && *tlsKey != "" {
-		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	certManager, err := newCertManager("-tls", *tlsCert, *tlsKey, *tlsClientCA, *tlsClientAuth, *tlsCRL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if certManager != nil && level >= server.LogLevelInfo {
+		logger.Printf("[INFO] TLS enabled for TCP server (client certificates: %s, certificate expires %s)",
+			*tlsClientAuth, certManager.NotAfter().Format(time.RFC3339))
+	}
+	httpCertManager, err := newCertManager("-http-tls", *httpTLSCert, *httpTLSKey, *httpClientCA, *httpClientAuth, *httpCRL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if httpCertManager != nil && level >= server.LogLevelInfo {
+		logger.Printf("[INFO] TLS enabled for HTTP server (client certificates: %s, certificate expires %s)",
+			*httpClientAuth, httpCertManager.NotAfter().Format(time.RFC3339))
+	}
+	if *startTLS && certManager == nil {
+		log.Fatal("-starttls requires -tls-cert and -tls-key")
+	}
+	if *requireTLS && !*startTLS {
+		log.Fatal("-require-tls requires -starttls")
+	}
+
+	syncPolicy, err := journal.ParseSyncPolicy(*journalSync)
+	if err != nil {
+		log.Fatalf("Invalid -journal-sync: %v", err)
+	}
+
+	// Load trusted signing keys if rule signatures are required
+	var keyRing *signing.KeyRing
+	if *trustedKeys != "" {
+		var err error
+		keyRing, err = signing.LoadKeyRing(strings.Split(*trustedKeys, ",")...)
 		if err != nil {
-			log.Fatalf("Failed to load TLS certificates: %v", err)
+			log.Fatalf("Failed to load trusted keys: %v", err)
 		}
+		if level >= server.LogLevelInfo {
+			logger.Printf("[INFO] Rule signatures required (%d trusted keys)", keyRing.Len())
+		}
+	}
 
-		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			MinVersion:   tls.VersionTLS12,
+	var canaries []server.Canary
+	if *canariesFile != "" {
+		canaries, err = server.LoadCanaries(*canariesFile)
+		if err != nil {
+			log.Fatalf("Failed to load canaries: %v", err)
 		}
 		if level >= server.LogLevelInfo {
-			logger.Println("[INFO] TLS enabled for TCP server")
+			logger.Printf("[INFO] Reloads checked against %d canary queries", len(canaries))
+		}
+	}
+
+	var credentials sasl.CredentialStore
+	if *authFile != "" {
+		store, err := sasl.LoadCredentialFile(*authFile)
+		if err != nil {
+			log.Fatalf("Failed to load credentials: %v", err)
+		}
+		credentials = store
+		if level >= server.LogLevelInfo {
+			logger.Printf("[INFO] Authentication enabled (%d users)", store.Len())
+		}
+	}
+	if *requireAuth && credentials == nil {
+		log.Fatal("-require-auth requires -auth-file")
+	}
+
+	var adminPolicy *admin.Policy
+	if *adminRules != "" {
+		adminPolicy, err = admin.Load(strings.Split(*adminRules, ",")...)
+		if err != nil {
+			log.Fatalf("Failed to load admin rules: %v", err)
+		}
+		if level >= server.LogLevelInfo {
+			logger.Printf("[INFO] Administrative operations authorized by %d admin rules", adminPolicy.Len())
 		}
-	} else if *tlsCert != "" || *tlsKey != "" {
-		log.Fatal("Both -tls-cert and -tls-key must be specified for TLS")
 	}
 
 	var srv *server.Server
@@ -96,11 +229,28 @@ func main() {
 		config := &server.Config{
 			Address:        *tcpAddress,
 			RulesDir:       *rulesDir,
-			TLSConfig:      tlsConfig,
+			BundlePath:     *bundlePath,
+			LoadWorkers:    *loadWorkers,
+			CertManager:    certManager,
+			StartTLS:       *startTLS,
+			RequireTLS:     *requireTLS,
+			Credentials:    credentials,
+			RequireAuth:    *requireAuth,
+			AdminPolicy:    adminPolicy,
+			MaxMessageSize: *maxMessage,
 			ReloadInterval: *reloadInterval,
+			Watch:          *watch,
+			WatchDebounce:  *watchDebounce,
+			MaxRuleDelta:   *maxRuleDelta,
+			Canaries:       canaries,
 			PidFile:        *pidFile,
 			Logger:         logger,
 			LogLevel:       level,
+			TrustedKeys:    keyRing,
+
+			JournalPath:             *journalPath,
+			JournalSync:             syncPolicy,
+			JournalCompactThreshold: *journalCompact,
 		}
 
 		var err error
@@ -114,6 +264,9 @@ func main() {
 	httpConfig := &httpserver.Config{
 		Address:       *httpAddress,
 		EnableAuthZen: *authzenEnabled,
+		HealthAddress: *httpHealthAddr,
+		CertManager:   httpCertManager,
+		CertMetrics:   map[string]*tlsutil.CertManager{"tcp": certManager},
 		Logger:        logger,
 		LogLevel:      level,
 	}
@@ -122,14 +275,17 @@ func main() {
 	if srv != nil {
 		httpConfig.Engine = srv.GetEngine()
 		httpConfig.EngineMutex = srv.GetEngineMutex()
+		httpConfig.Manifest = srv.Manifest
 	} else {
 		// No TCP server: HTTP server manages its own engine
 		httpConfig.RulesDir = *rulesDir
+		httpConfig.BundlePath = *bundlePath
+		httpConfig.LoadWorkers = *loadWorkers
 		httpConfig.ReloadInterval = *reloadInterval
 		httpConfig.PidFile = *pidFile
+		httpConfig.TrustedKeys = keyRing
 	}
 
-	var err error
 	httpSrv, err = httpserver.NewHTTPServer(httpConfig)
 	if err != nil {
 		if srv != nil {
@@ -142,10 +298,49 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	// Reload certificates when their files change or on SIGHUP
+	ctx, cancel := context.WithCancel(context.Background())
+	for name, m := range map[string]*tlsutil.CertManager{"TCP": certManager, "HTTP": httpCertManager} {
+		if m == nil {
+			continue
+		}
+		reported := func(trigger string) func(error) {
+			return func(err error) {
+				if err != nil {
+					if level >= server.LogLevelError {
+						logger.Printf("[ERROR] %s TLS certificate reload (%s) failed, keeping the current certificates: %v", name, trigger, err)
+					}
+					return
+				}
+				if level >= server.LogLevelInfo {
+					logger.Printf("[INFO] %s TLS certificates reloaded (%s), certificate expires %s",
+						name, trigger, m.NotAfter().Format(time.RFC3339))
+				}
+			}
+		}
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		go func() {
+			onHUP := reported("SIGHUP")
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-hupChan:
+					onHUP(m.Reload())
+				}
+			}
+		}()
+		if *tlsWatch > 0 {
+			go m.Watch(ctx, *tlsWatch, reported("file change"))
+		}
+	}
+
 	// Shutdown handler
 	shutdownComplete := make(chan struct{})
 	go func() {
 		<-sigChan
+		cancel()
 		if level >= server.LogLevelInfo {
 			logger.Println("[INFO] Received shutdown signal")
 		}
@@ -161,21 +356,37 @@ func main() {
 	// Start servers
 	if level >= server.LogLevelInfo {
 		logger.Printf("[INFO] SPOCP Server starting...")
-		logger.Printf("[INFO]   Rules directory: %s", *rulesDir)
+		if *bundlePath != "" {
+			logger.Printf("[INFO]   Rule bundle: %s", *bundlePath)
+		} else {
+			logger.Printf("[INFO]   Rules directory: %s", *rulesDir)
+		}
 		if *tcpEnabled {
 			logger.Printf("[INFO]   TCP server: %s", *tcpAddress)
-			if tlsConfig != nil {
+			if certManager != nil {
 				logger.Printf("[INFO]     TLS: enabled")
 			}
 		}
 		logger.Printf("[INFO]   HTTP server: %s", *httpAddress)
+		if httpCertManager != nil {
+			logger.Printf("[INFO]     TLS: enabled (HTTP/2)")
+		}
+		if *httpHealthAddr != "" {
+			logger.Printf("[INFO]     Health endpoints: %s", *httpHealthAddr)
+		}
 		if *authzenEnabled {
 			logger.Printf("[INFO]     AuthZen API: enabled")
 		}
 		logger.Printf("[INFO]     Health/Stats: always enabled")
+		if *watch {
+			logger.Printf("[INFO]   Auto-reload: on rule file changes")
+		}
 		if *reloadInterval > 0 {
 			logger.Printf("[INFO]   Auto-reload: every %v", *reloadInterval)
 		}
+		if *maxRuleDelta > 0 {
+			logger.Printf("[INFO]   Reload guard: at most %.0f%% rule count change", *maxRuleDelta*100)
+		}
 		if *pidFile != "" {
 			logger.Printf("[INFO]   PID file: %s", *pidFile)
 		}
@@ -197,3 +408,34 @@ func main() {
 		<-shutdownComplete
 	}
 }
+
+// newCertManager loads the TLS files named by the flags with the given
+// prefix, or returns nil if the certificate flags are not set
+func newCertManager(prefix, certFile, keyFile, clientCA, clientAuth, crl string) (*tlsutil.CertManager, error) {
+	switch {
+	case certFile == "" && keyFile == "":
+		if clientCA != "" || crl != "" {
+			return nil, fmt.Errorf("%[1]s-client-ca and %[1]s-crl require %[1]s-cert and %[1]s-key", prefix)
+		}
+		return nil, nil
+	case certFile == "" || keyFile == "":
+		return nil, fmt.Errorf("both %[1]s-cert and %[1]s-key must be specified for TLS", prefix)
+	}
+
+	auth, err := tlsutil.ParseClientAuth(clientAuth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s-client-auth: %w", prefix, err)
+	}
+	opts := tlsutil.ServerOptions{CertFile: certFile, KeyFile: keyFile, ClientAuth: auth}
+	if clientCA != "" {
+		opts.ClientCAFiles = strings.Split(clientCA, ",")
+	}
+	if crl != "" {
+		opts.CRLFiles = strings.Split(crl, ",")
+	}
+	m, err := tlsutil.NewCertManager(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure TLS (%s-cert): %w", prefix, err)
+	}
+	return m, nil
+}
@@ -2,6 +2,7 @@ package spocp
 
 import (
 	"fmt"
+	"iter"
 
 	"github.com/sirosfoundation/go-spocp/pkg/persist"
 	"github.com/sirosfoundation/go-spocp/pkg/sexp"
@@ -14,10 +15,7 @@ func (e *Engine) LoadRulesFromFile(filename string) error {
 		return fmt.Errorf("failed to load rules: %w", err)
 	}
 
-	for _, rule := range rules {
-		e.AddRuleElement(rule)
-	}
-
+	e.AddRuleElements(rules)
 	return nil
 }
 
@@ -28,30 +26,95 @@ func (e *Engine) LoadRulesFromFileWithOptions(filename string, opts persist.Load
 		return fmt.Errorf("failed to load rules: %w", err)
 	}
 
-	for _, rule := range rules {
-		e.AddRuleElement(rule)
-	}
-
+	e.AddRuleElements(rules)
 	return nil
 }
 
-// SaveRulesToFile saves all rules from the engine to a file
+// LoadRuleset appends a ruleset to the engine, reusing its prebuilt tag
+// index instead of re-indexing every rule. The engine takes ownership of
+// the ruleset's index slices.
+func (e *Engine) LoadRuleset(rs *persist.Ruleset) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.loadRuleset(rs)
+}
+
+// loadRuleset implements LoadRuleset; the caller must hold mu
+func (e *Engine) loadRuleset(rs *persist.Ruleset) {
+	base := len(e.rules)
+	e.rules = append(e.rules, rs.Rules...)
+
+	if !e.indexEnabled {
+		return
+	}
+	if base == 0 && len(e.tagIndex) == 0 && len(e.atomRules) == 0 {
+		e.tagIndex = rs.TagIndex
+		e.atomRules = rs.AtomRules
+		return
+	}
+	for tag, indices := range rs.TagIndex {
+		bucket := e.tagIndex[tag]
+		for _, idx := range indices {
+			bucket = append(bucket, base+idx)
+		}
+		e.tagIndex[tag] = bucket
+	}
+	for _, idx := range rs.AtomRules {
+		e.atomRules = append(e.atomRules, base+idx)
+	}
+}
+
+// SaveRulesToFile saves a consistent snapshot of the engine's rules to a
+// file, replacing it atomically. Rules added while the file is written are
+// not included.
 func (e *Engine) SaveRulesToFile(filename string, format persist.FileFormat) error {
-	return persist.SaveFile(filename, e.rules, format)
+	return e.SaveRulesToFileWithOptions(filename, format, persist.SaveOptions{})
+}
+
+// SaveRulesToFileWithOptions saves rules like SaveRulesToFile, keeping
+// backups of the previous file as configured in opts
+func (e *Engine) SaveRulesToFileWithOptions(filename string, format persist.FileFormat, opts persist.SaveOptions) error {
+	return persist.SaveFileWithOptions(filename, e.snapshot(), format, opts)
+}
+
+// snapshot returns a copy of the current rule list, taken under the lock
+// since removing a rule changes the list in place
+func (e *Engine) snapshot() []sexp.Element {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	rules := make([]sexp.Element, len(e.rules))
+	copy(rules, e.rules)
+	return rules
 }
 
 // ExportRules returns all rules as a slice for serialization
 func (e *Engine) ExportRules() []sexp.Element {
-	// Return a copy to prevent external modification
-	exported := make([]sexp.Element, len(e.rules))
-	copy(exported, e.rules)
-	return exported
+	// A copy, so it is safe from later changes and external modification
+	return e.snapshot()
+}
+
+// Rules returns an iterator over the rules without copying them. Rules
+// cannot change while the iteration runs, so the loop body must not
+// change them either.
+func (e *Engine) Rules() iter.Seq[sexp.Element] {
+	return func(yield func(sexp.Element) bool) {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		for _, rule := range e.rules {
+			if !yield(rule) {
+				return
+			}
+		}
+	}
 }
 
 // ImportRules replaces all rules with the provided slice
 func (e *Engine) ImportRules(rules []sexp.Element) {
-	e.Clear()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.reset()
 	for _, rule := range rules {
-		e.AddRuleElement(rule)
+		e.addRule(rule)
 	}
 }
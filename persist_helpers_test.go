@@ -219,3 +219,105 @@ func TestExportRulesReturnsCopy(t *testing.T) {
 		t.Error("ExportRules should return a copy, not the original slice")
 	}
 }
+
+func TestEngineLoadRuleset(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.spocp")
+	rules := []sexp.Element{
+		sexp.NewList("http", sexp.NewAtom("GET")),
+		sexp.NewAtom("admin"),
+		sexp.NewList("file", sexp.NewAtom("read")),
+	}
+	if err := persist.SaveRuleset(filename, persist.NewRuleset(rules, nil), persist.BinaryOptions{}); err != nil {
+		t.Fatalf("SaveRuleset failed: %v", err)
+	}
+
+	rs, err := persist.LoadRuleset(filename, persist.DefaultLoadOptions())
+	if err != nil {
+		t.Fatalf("LoadRuleset failed: %v", err)
+	}
+
+	// Appending to a non-empty engine must offset the prebuilt index
+	engine := NewEngineWithIndexing(true)
+	engine.AddRule("(4:http4:POST)")
+	engine.LoadRuleset(rs)
+
+	if engine.RuleCount() != 4 {
+		t.Fatalf("Expected 4 rules, got %d", engine.RuleCount())
+	}
+	for _, query := range []string{"(4:http3:GET)", "(4:http4:POST)", "5:admin", "(4:file4:read)"} {
+		if allowed, _ := engine.Query(query); !allowed {
+			t.Errorf("Expected %s to be allowed", query)
+		}
+	}
+	if got := engine.tagIndex["http"]; len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Errorf("Unexpected http index: %v", got)
+	}
+
+	adaptive := NewAdaptiveEngine()
+	adaptive.LoadRuleset(rs)
+	stats := adaptive.Stats()
+	if stats.TotalRules != 3 || stats.AtomRules != 1 || stats.ListRules != 2 || stats.UniqueTags != 2 {
+		t.Errorf("Unexpected adaptive stats: %+v", stats)
+	}
+	if allowed, _ := adaptive.Query("(4:file4:read)"); !allowed {
+		t.Error("Expected query to be allowed after LoadRuleset")
+	}
+}
+
+func TestEngineSaveDuringAdds(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.spoc")
+
+	engine := NewEngine()
+	for i := 0; i < 100; i++ {
+		engine.AddRule("(4:base)")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			engine.AddRule("(5:extra)")
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		if err := engine.SaveRulesToFile(filename, persist.FormatCanonical); err != nil {
+			t.Fatalf("SaveRulesToFile failed: %v", err)
+		}
+		rules, err := persist.LoadFileToSlice(filename)
+		if err != nil {
+			t.Fatalf("Saved file does not load: %v", err)
+		}
+		if len(rules) < 100 || len(rules) > 1100 {
+			t.Errorf("Unexpected snapshot size %d", len(rules))
+		}
+	}
+	<-done
+}
+
+func TestAdaptiveEngineSaveWithBackups(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.spoc")
+	opts := persist.SaveOptions{Backups: 1}
+
+	engine := NewAdaptiveEngine()
+	engine.AddRule("(4:read)")
+	if err := engine.SaveRulesToFileWithOptions(filename, persist.FormatCanonical, opts); err != nil {
+		t.Fatalf("SaveRulesToFileWithOptions failed: %v", err)
+	}
+	engine.AddRule("(5:write)")
+	if err := engine.SaveRulesToFileWithOptions(filename, persist.FormatCanonical, opts); err != nil {
+		t.Fatalf("SaveRulesToFileWithOptions failed: %v", err)
+	}
+
+	backup, err := persist.LoadFileToSlice(persist.BackupPath(filename, 1))
+	if err != nil {
+		t.Fatalf("Failed to load backup: %v", err)
+	}
+	if len(backup) != 1 {
+		t.Errorf("Expected backup with 1 rule, got %d", len(backup))
+	}
+	current, _ := persist.LoadFileToSlice(filename)
+	if len(current) != 2 {
+		t.Errorf("Expected 2 rules, got %d", len(current))
+	}
+}
@@ -0,0 +1,117 @@
+// Package admin authorizes administrative operations on SPOCP servers with
+// SPOCP itself. An operation is allowed if the query
+//
+//	(spocp-admin (op ADD)(subject alice)(rule-tag http)
+//	  (peer (subject CN=alice,O=Example)(fingerprint <hex SHA-256>)))
+//
+// is permitted by the admin ruleset. subject is the authenticated identity,
+// rule-tag is the tag of the rule added or deleted (the value of an atom
+// rule) and peer describes the client's verified TLS certificate. Every
+// element is always present so that rules can match on position; an
+// element that does not apply is left empty, as in (subject) for anonymous
+// clients, (rule-tag) for RELOAD or (peer) without a client certificate.
+// Since a rule permits every query that is more specific than it, the rule
+//
+//	(spocp-admin (op ADD)(subject alice))
+//
+// lets alice add any rule, (spocp-admin (op RELOAD)) lets anyone reload
+// and
+//
+//	(spocp-admin (op)(subject)(rule-tag)(peer (subject CN=ops,O=Example)))
+//
+// lets the holder of the ops certificate do anything.
+package admin
+
+import (
+	"fmt"
+
+	"github.com/sirosfoundation/go-spocp"
+	"github.com/sirosfoundation/go-spocp/pkg/persist"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+	"github.com/sirosfoundation/go-spocp/pkg/tlsutil"
+)
+
+// Tag is the tag of admin queries
+const Tag = "spocp-admin"
+
+// Request is an administrative operation to authorize
+type Request struct {
+	// Op is the operation, such as ADD or RELOAD
+	Op string
+
+	// Subject is the authenticated identity, "" for anonymous clients
+	Subject string
+
+	// Rule is the rule added or deleted, a list with the tag a LIST is
+	// restricted to, or nil for other operations
+	Rule sexp.Element
+
+	// Peer is the client's verified TLS certificate, if any
+	Peer *tlsutil.PeerIdentity
+}
+
+// Policy is an admin ruleset. It does not change once created and is safe
+// for concurrent use.
+type Policy struct {
+	engine *spocp.Engine
+}
+
+// New creates a policy from admin rules
+func New(rules ...sexp.Element) *Policy {
+	engine := spocp.NewEngine()
+	engine.AddRuleElements(rules)
+	return &Policy{engine: engine}
+}
+
+// Load reads a policy from rule files
+func Load(filenames ...string) (*Policy, error) {
+	var rules []sexp.Element
+	for _, filename := range filenames {
+		loaded, err := persist.LoadFileToSlice(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load admin rules from %s: %w", filename, err)
+		}
+		rules = append(rules, loaded...)
+	}
+	return New(rules...), nil
+}
+
+// Len returns the number of admin rules
+func (p *Policy) Len() int {
+	return p.engine.RuleCount()
+}
+
+// Authorize reports whether the admin rules permit a request
+func (p *Policy) Authorize(req Request) bool {
+	return p.engine.QueryElement(Query(req))
+}
+
+// Query returns the admin query for a request
+func Query(req Request) *sexp.List {
+	subject := sexp.NewList("subject")
+	if req.Subject != "" {
+		subject.Elements = append(subject.Elements, sexp.NewAtom(req.Subject))
+	}
+	ruleTagList := sexp.NewList("rule-tag")
+	if tag := ruleTag(req.Rule); tag != "" {
+		ruleTagList.Elements = append(ruleTagList.Elements, sexp.NewAtom(tag))
+	}
+	peer := sexp.NewList("peer")
+	if req.Peer != nil {
+		peer.Elements = append(peer.Elements,
+			sexp.NewList("subject", sexp.NewAtom(req.Peer.Subject)),
+			sexp.NewList("fingerprint", sexp.NewAtom(req.Peer.Fingerprint)))
+	}
+	return sexp.NewList(Tag, sexp.NewList("op", sexp.NewAtom(req.Op)), subject, ruleTagList, peer)
+}
+
+// ruleTag returns the tag of a list rule or the value of an atom rule
+func ruleTag(rule sexp.Element) string {
+	switch r := rule.(type) {
+	case *sexp.List:
+		return r.Tag
+	case *sexp.Atom:
+		return r.Value
+	}
+	return ""
+}
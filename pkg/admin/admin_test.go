@@ -0,0 +1,117 @@
+package admin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+	"github.com/sirosfoundation/go-spocp/pkg/starform"
+	"github.com/sirosfoundation/go-spocp/pkg/tlsutil"
+)
+
+func mustParse(t *testing.T, s string) sexp.Element {
+	t.Helper()
+	elem, err := sexp.NewParser(s).Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", s, err)
+	}
+	return elem
+}
+
+func TestQuery(t *testing.T) {
+	peer := &tlsutil.PeerIdentity{Subject: "CN=ops", Fingerprint: "ab12"}
+	tests := []struct {
+		subject, op string
+		rule        sexp.Element
+		peer        *tlsutil.PeerIdentity
+		want        string
+	}{
+		{"alice", "ADD", sexp.NewList("http", sexp.NewAtom("GET")), nil,
+			"(11:spocp-admin(2:op3:ADD)(7:subject5:alice)(8:rule-tag4:http)(4:peer))"},
+		{"", "DELETE", sexp.NewAtom("admin"), nil,
+			"(11:spocp-admin(2:op6:DELETE)(7:subject)(8:rule-tag5:admin)(4:peer))"},
+		{"bob", "RELOAD", nil, nil,
+			"(11:spocp-admin(2:op6:RELOAD)(7:subject3:bob)(8:rule-tag)(4:peer))"},
+		{"", "RELOAD", nil, peer,
+			"(11:spocp-admin(2:op6:RELOAD)(7:subject)(8:rule-tag)(4:peer(7:subject6:CN=ops)(11:fingerprint4:ab12)))"},
+	}
+	for _, tt := range tests {
+		req := Request{Op: tt.op, Subject: tt.subject, Rule: tt.rule, Peer: tt.peer}
+		if got := Query(req).String(); got != tt.want {
+			t.Errorf("Query(%+v) = %s, want %s", req, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	// alice manages http rules, bob anything, and anyone may reload
+	policy := New(
+		sexp.NewList(Tag,
+			sexp.NewList("op", &starform.Set{Elements: []sexp.Element{sexp.NewAtom("ADD"), sexp.NewAtom("DELETE")}}),
+			sexp.NewList("subject", sexp.NewAtom("alice")),
+			sexp.NewList("rule-tag", sexp.NewAtom("http"))),
+		sexp.NewList(Tag, &starform.Wildcard{}, sexp.NewList("subject", sexp.NewAtom("bob"))),
+		mustParse(t, "(11:spocp-admin(2:op6:RELOAD))"),
+		mustParse(t, "(11:spocp-admin(2:op)(7:subject)(8:rule-tag)(4:peer(7:subject6:CN=ops)))"),
+	)
+	if policy.Len() != 4 {
+		t.Fatalf("Expected 4 rules, got %d", policy.Len())
+	}
+
+	httpRule := mustParse(t, "(4:http(4:page10:index.html))")
+	sshRule := mustParse(t, "(3:ssh)")
+	tests := []struct {
+		subject, op string
+		rule        sexp.Element
+		want        bool
+	}{
+		{"alice", "ADD", httpRule, true},
+		{"alice", "DELETE", httpRule, true},
+		{"alice", "ADD", sshRule, false},
+		{"alice", "ROLLBACK", nil, false},
+		{"bob", "ADD", sshRule, true},
+		{"bob", "ROLLBACK", nil, true},
+		{"", "ADD", httpRule, false},
+		{"", "RELOAD", nil, true},
+		{"carol", "RELOAD", nil, true},
+	}
+	for _, tt := range tests {
+		if got := policy.Authorize(Request{Op: tt.op, Subject: tt.subject, Rule: tt.rule}); got != tt.want {
+			t.Errorf("Authorize(%q, %q, %v) = %v, want %v", tt.subject, tt.op, tt.rule, got, tt.want)
+		}
+	}
+
+	ops := &tlsutil.PeerIdentity{Subject: "CN=ops", Fingerprint: "ab12"}
+	dev := &tlsutil.PeerIdentity{Subject: "CN=dev", Fingerprint: "cd34"}
+	if !policy.Authorize(Request{Op: "DELETE", Rule: sshRule, Peer: ops}) {
+		t.Error("Expected the ops certificate to be allowed to DELETE")
+	}
+	if !policy.Authorize(Request{Op: "ADD", Subject: "dave", Rule: sshRule, Peer: ops}) {
+		t.Error("Expected the ops certificate to be allowed whatever the subject")
+	}
+	if policy.Authorize(Request{Op: "DELETE", Rule: sshRule, Peer: dev}) {
+		t.Error("Expected the dev certificate to be denied")
+	}
+
+	if New().Authorize(Request{Op: "RELOAD", Subject: "alice"}) {
+		t.Error("An empty policy must deny everything")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.spoc")
+	if err := os.WriteFile(path, []byte("(11:spocp-admin(2:op6:RELOAD))\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if !policy.Authorize(Request{Op: "RELOAD"}) {
+		t.Error("Expected RELOAD to be allowed")
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.spoc")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
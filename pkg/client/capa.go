@@ -0,0 +1,59 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+)
+
+// ErrUnsupported is returned when an operation needs a capability the
+// server did not advertise
+var ErrUnsupported = errors.New("not supported by the server")
+
+// Capabilities returns the capabilities the server advertised with CAPA,
+// or nil if the server does not implement CAPA. Operations are not
+// checked against the capabilities of such servers.
+func (c *Client) Capabilities() protocol.Capabilities {
+	return c.caps
+}
+
+// negotiate asks the server for its capabilities. A server that refuses
+// CAPA is taken to predate it.
+func (c *Client) negotiate() error {
+	parts, resp, err := c.sendMultipart(&protocol.Message{Operation: protocol.OpCapa, Arguments: []string{}})
+	if err != nil {
+		return err
+	}
+	c.caps = nil
+	if resp.Code == protocol.CodeOK {
+		c.caps = protocol.ParseCapabilities(parts)
+	}
+	return nil
+}
+
+// require fails with ErrUnsupported if the server advertised its
+// capabilities without name
+func (c *Client) require(name string) error {
+	if c.caps != nil && !c.caps.Has(name) {
+		return fmt.Errorf("%s %w", name, ErrUnsupported)
+	}
+	return nil
+}
+
+// checkRequired fails unless the server advertised every capability in
+// names
+func (c *Client) checkRequired(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	if c.caps == nil {
+		return fmt.Errorf("%s %w", protocol.OpCapa, ErrUnsupported)
+	}
+	for _, name := range names {
+		if err := c.require(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
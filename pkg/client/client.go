@@ -4,20 +4,48 @@ package client
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sasl"
 	"github.com/sirosfoundation/go-spocp/pkg/sexp"
 )
 
-// Client represents a SPOCP TCP client
+// Client represents a SPOCP TCP client. Operations can be used from
+// several goroutines at once and are pipelined on the connection, except
+// StartTLS, Authenticate and Close, which must not overlap with any other
+// operation.
 type Client struct {
 	conn      net.Conn
 	reader    *bufio.Reader
 	writer    *bufio.Writer
 	tlsConfig *tls.Config
+
+	// caps are the server's capabilities, nil if it does not implement
+	// CAPA
+	caps protocol.Capabilities
+
+	// insecureAuth allows PLAIN without TLS
+	insecureAuth bool
+
+	// wmu serializes writes, and rmu reads: the goroutine holding rmu
+	// reads responses for every call. mu guards the calls awaiting a
+	// response, in the order of the requests unless they have an ID, and
+	// the error that ended the connection.
+	wmu     sync.Mutex
+	rmu     sync.Mutex
+	mu      sync.Mutex
+	pending []*call
+	tagged  map[string]*call
+	err     error
+
+	// nextID numbers the requests tagged by QueryAsync
+	nextID atomic.Uint64
 }
 
 // Config contains client configuration
@@ -28,11 +56,55 @@ type Config struct {
 	// TLS configuration (optional, nil for plain TCP)
 	TLSConfig *tls.Config
 
+	// StartTLS connects in plain TCP and upgrades the connection to TLS
+	// with the STARTTLS operation, using TLSConfig (default: verify the
+	// server against the system roots)
+	StartTLS StartTLSMode
+
+	// Auth, if set, authenticates the connection with this SASL mechanism
+	// once it is established (and upgraded with STARTTLS)
+	Auth sasl.ClientMechanism
+
+	// InsecureAuth allows authenticating with PLAIN on a connection
+	// without TLS, which sends the password in clear; servers accept that
+	// only from loopback addresses
+	InsecureAuth bool
+
+	// Require lists capabilities, such as protocol.CapList, that the
+	// server must advertise; NewClient fails otherwise, also with servers
+	// that do not implement CAPA
+	Require []string
+
 	// Connection timeout
 	Timeout time.Duration
 }
 
-// NewClient creates a new SPOCP client and connects to the server
+// StartTLSMode controls whether a client upgrades its connection with
+// STARTTLS
+type StartTLSMode int
+
+const (
+	// StartTLSNever uses TLS from the start if TLSConfig is set
+	StartTLSNever StartTLSMode = iota
+
+	// StartTLSOptional upgrades the connection if the server supports
+	// STARTTLS and stays in plain TCP otherwise
+	StartTLSOptional
+
+	// StartTLSRequired fails to connect unless the connection is upgraded
+	StartTLSRequired
+)
+
+// ErrStartTLSRefused is returned when the server does not accept STARTTLS
+var ErrStartTLSRefused = errors.New("STARTTLS refused")
+
+// ErrInsecureAuth is returned when authenticating with PLAIN on a
+// connection without TLS, unless Config.InsecureAuth is set
+var ErrInsecureAuth = errors.New("PLAIN authentication requires TLS")
+
+// NewClient creates a new SPOCP client and connects to the server. The
+// client asks the server for its capabilities, again after STARTTLS, and
+// fails operations the server does not support with ErrUnsupported.
 func NewClient(config *Config) (*Client, error) {
 	if config.Address == "" {
 		return nil, fmt.Errorf("address is required")
@@ -46,7 +118,7 @@ func NewClient(config *Config) (*Client, error) {
 	var conn net.Conn
 	var err error
 
-	if config.TLSConfig != nil {
+	if config.TLSConfig != nil && config.StartTLS == StartTLSNever {
 		dialer := &net.Dialer{Timeout: timeout}
 		conn, err = tls.DialWithDialer(dialer, "tcp", config.Address, config.TLSConfig)
 	} else {
@@ -57,12 +129,173 @@ func NewClient(config *Config) (*Client, error) {
 		return nil, fmt.Errorf("failed to connect to %s: %w", config.Address, err)
 	}
 
-	return &Client{
-		conn:      conn,
-		reader:    bufio.NewReader(conn),
-		writer:    bufio.NewWriter(conn),
-		tlsConfig: config.TLSConfig,
-	}, nil
+	c := &Client{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+
+		insecureAuth: config.InsecureAuth,
+	}
+	if config.StartTLS == StartTLSNever {
+		c.tlsConfig = config.TLSConfig
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(timeout)) //nolint:errcheck // non-critical timeout setting
+	err = c.negotiate()
+	_ = conn.SetDeadline(time.Time{}) //nolint:errcheck // non-critical timeout setting
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to negotiate with %s: %w", config.Address, err)
+	}
+	if config.StartTLS == StartTLSNever {
+		return c.finish(config, timeout)
+	}
+
+	tlsConfig := config.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(config.Address)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(timeout)) //nolint:errcheck // non-critical timeout setting
+	err = c.StartTLS(tlsConfig)
+	_ = conn.SetDeadline(time.Time{}) //nolint:errcheck // non-critical timeout setting
+	if err != nil && (config.StartTLS == StartTLSRequired || !errors.Is(err, ErrStartTLSRefused)) {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start TLS with %s: %w", config.Address, err)
+	}
+	return c.finish(config, timeout)
+}
+
+// finish checks the capabilities config requires and authenticates a new
+// connection if config asks for it
+func (c *Client) finish(config *Config, timeout time.Duration) (*Client, error) {
+	if err := c.checkRequired(config.Require); err != nil {
+		c.conn.Close()
+		return nil, fmt.Errorf("server %s: %w", config.Address, err)
+	}
+	if config.Auth == nil {
+		return c, nil
+	}
+	_ = c.conn.SetDeadline(time.Now().Add(timeout)) //nolint:errcheck // non-critical timeout setting
+	err := c.Authenticate(config.Auth)
+	_ = c.conn.SetDeadline(time.Time{}) //nolint:errcheck // non-critical timeout setting
+	if err != nil {
+		c.conn.Close()
+		return nil, fmt.Errorf("failed to authenticate with %s: %w", config.Address, err)
+	}
+	return c, nil
+}
+
+// StartTLS upgrades a plain connection to TLS with the STARTTLS operation
+// and asks for the server's capabilities again. If the server refuses or
+// does not advertise STARTTLS, the error wraps ErrStartTLSRefused and the
+// connection can still be used in plain TCP; after any other error it
+// must be closed.
+func (c *Client) StartTLS(config *tls.Config) error {
+	if c.tlsConfig != nil {
+		return errors.New("TLS already active")
+	}
+	if err := c.require(protocol.CapStartTLS); err != nil {
+		return fmt.Errorf("%w: %w", ErrStartTLSRefused, err)
+	}
+
+	resp, err := c.sendMessage(&protocol.Message{Operation: protocol.OpStartTLS, Arguments: []string{}})
+	if err != nil {
+		return err
+	}
+	if resp.Code != protocol.CodeOK {
+		return fmt.Errorf("%w: %s %s", ErrStartTLSRefused, resp.Code, resp.Message)
+	}
+
+	if err := c.handshake(config); err != nil {
+		return err
+	}
+
+	// Capabilities learned before the handshake were not protected by it
+	if c.caps != nil {
+		return c.negotiate()
+	}
+	return nil
+}
+
+// handshake switches the connection to TLS after STARTTLS was accepted
+func (c *Client) handshake(config *tls.Config) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	// Anything received before the handshake was not protected by it
+	if c.reader.Buffered() > 0 {
+		return errors.New("unexpected data after STARTTLS response")
+	}
+
+	conn := tls.Client(c.conn, config)
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	c.writer = bufio.NewWriter(conn)
+	c.tlsConfig = config
+	return nil
+}
+
+// Authenticate authenticates the connection with the AUTH operation. If
+// the server rejects the credentials, the error wraps sasl.ErrAuthFailed
+// and the connection can still be used unauthenticated; after any other
+// error it should be closed. PLAIN is refused with ErrInsecureAuth on a
+// connection without TLS, such as one where STARTTLS was refused, unless
+// Config.InsecureAuth is set.
+func (c *Client) Authenticate(mechanism sasl.ClientMechanism) error {
+	if mechanism.Name() == sasl.Plain && !c.Encrypted() && !c.insecureAuth {
+		return ErrInsecureAuth
+	}
+	if c.caps != nil && !c.caps.HasValue(protocol.CapAuth, mechanism.Name()) {
+		return fmt.Errorf("%s %s %w", protocol.CapAuth, mechanism.Name(), ErrUnsupported)
+	}
+	response, err := mechanism.Start()
+	if err != nil {
+		return err
+	}
+	msg := &protocol.Message{
+		Operation: protocol.OpAuth,
+		Arguments: []string{mechanism.Name(), string(response)},
+	}
+
+	for {
+		resp, err := c.sendMessage(msg)
+		if err != nil {
+			return err
+		}
+
+		switch resp.Code {
+		case protocol.CodeOK:
+			return mechanism.Finish([]byte(resp.Message))
+		case protocol.CodeDenied:
+			return fmt.Errorf("%w: %s", sasl.ErrAuthFailed, resp.Message)
+		case protocol.CodeContinue:
+		default:
+			return fmt.Errorf("authentication failed: %s %s", resp.Code, resp.Message)
+		}
+
+		response, err := mechanism.Next([]byte(resp.Message))
+		if err != nil {
+			// Tell the server the exchange is over
+			_, _ = c.sendMessage(&protocol.Message{Operation: protocol.OpAuth, Arguments: []string{"*"}}) //nolint:errcheck // best-effort abort
+			return err
+		}
+		msg = &protocol.Message{Operation: protocol.OpAuth, Arguments: []string{string(response)}}
+	}
+}
+
+// Encrypted reports whether the connection uses TLS
+func (c *Client) Encrypted() bool {
+	return c.tlsConfig != nil
 }
 
 // Close closes the connection to the server
@@ -85,6 +318,8 @@ func (c *Client) Close() error {
 	}
 
 	// Set a short timeout for logout
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
 	_ = c.conn.SetWriteDeadline(time.Now().Add(1 * time.Second)) //nolint:errcheck // best-effort logout
 	encoded := protocol.EncodeMessage(msg)
 	_, _ = c.writer.WriteString(encoded) //nolint:errcheck // best-effort logout
@@ -104,7 +339,11 @@ func (c *Client) Query(query sexp.Element) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	return queryResult(resp)
+}
 
+// queryResult maps the response to a QUERY to its result
+func queryResult(resp *protocol.Response) (bool, error) {
 	switch resp.Code {
 	case protocol.CodeOK:
 		return true, nil
@@ -152,11 +391,94 @@ func (c *Client) AddString(ruleStr string) error {
 	return c.Add(rule)
 }
 
+// Delete sends a DELETE operation to the server, removing a rule that was
+// loaded or added earlier
+func (c *Client) Delete(rule sexp.Element) error {
+	if err := c.require(protocol.CapDelete); err != nil {
+		return err
+	}
+	msg := &protocol.Message{
+		Operation: "DELETE",
+		Arguments: []string{rule.String()},
+	}
+
+	resp, err := c.sendMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	if resp.Code != protocol.CodeOK {
+		return fmt.Errorf("delete failed: %s %s", resp.Code, resp.Message)
+	}
+
+	return nil
+}
+
+// DeleteString sends a DELETE operation using a canonical S-expression string
+func (c *Client) DeleteString(ruleStr string) error {
+	rule, err := protocol.ParseRule(ruleStr)
+	if err != nil {
+		return fmt.Errorf("invalid rule: %w", err)
+	}
+	return c.Delete(rule)
+}
+
 // Reload sends a RELOAD operation to the server
 func (c *Client) Reload() error {
+	_, err := c.reload()
+	return err
+}
+
+// ReloadDryRun asks the server which rules a reload would add and remove,
+// without changing the loaded rules. The report starts with a summary line
+// such as "120 -> 122 rules (+3 -1)" followed by one "+ rule" or "- rule"
+// line per change. A reload that would be rejected by the server's reload
+// guards returns an error.
+func (c *Client) ReloadDryRun() (string, error) {
+	return c.reload("DRYRUN")
+}
+
+// ReloadForce reloads the rules even if the server's reload guards would
+// reject them
+func (c *Client) ReloadForce() error {
+	_, err := c.reload("FORCE")
+	return err
+}
+
+// reload sends a RELOAD operation with the given arguments
+func (c *Client) reload(args ...string) (string, error) {
+	if err := c.require(protocol.CapReload); err != nil {
+		return "", err
+	}
 	msg := &protocol.Message{
 		Operation: "RELOAD",
-		Arguments: []string{},
+		Arguments: args,
+	}
+	if msg.Arguments == nil {
+		msg.Arguments = []string{}
+	}
+
+	resp, err := c.sendMessage(msg)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.Code != protocol.CodeOK {
+		return "", fmt.Errorf("reload failed: %s %s", resp.Code, resp.Message)
+	}
+
+	return resp.Message, nil
+}
+
+// Rollback sends a RELOAD ROLLBACK operation, restoring the rules the
+// server used before its last reload
+func (c *Client) Rollback() error {
+	if err := c.require(protocol.CapReload); err != nil {
+		return err
+	}
+	msg := &protocol.Message{
+		Operation: "RELOAD",
+		Arguments: []string{"ROLLBACK"},
 	}
 
 	resp, err := c.sendMessage(msg)
@@ -165,7 +487,7 @@ func (c *Client) Reload() error {
 	}
 
 	if resp.Code != protocol.CodeOK {
-		return fmt.Errorf("reload failed: %s %s", resp.Code, resp.Message)
+		return fmt.Errorf("rollback failed: %s %s", resp.Code, resp.Message)
 	}
 
 	return nil
@@ -192,23 +514,12 @@ func (c *Client) Logout() error {
 
 // sendMessage sends a message and receives a response
 func (c *Client) sendMessage(msg *protocol.Message) (*protocol.Response, error) {
-	// Encode and send message
-	encoded := protocol.EncodeMessage(msg)
-	if _, err := c.writer.WriteString(encoded); err != nil {
-		return nil, fmt.Errorf("failed to write message: %w", err)
-	}
-	if err := c.writer.Flush(); err != nil {
-		return nil, fmt.Errorf("failed to flush: %w", err)
-	}
-
-	// Set read deadline
-	_ = c.conn.SetReadDeadline(time.Now().Add(30 * time.Second)) //nolint:errcheck // non-critical timeout setting
-
-	// Read response
-	resp, err := protocol.DecodeResponse(c.reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
-	}
+	_, resp, err := c.wait(c.send(msg, true))
+	return resp, err
+}
 
-	return resp, nil
+// sendMultipart sends a message and receives the CodeMultipart responses
+// before the final response
+func (c *Client) sendMultipart(msg *protocol.Message) ([]string, *protocol.Response, error) {
+	return c.wait(c.send(msg, true))
 }
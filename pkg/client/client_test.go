@@ -2,10 +2,12 @@ package client
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -307,6 +309,36 @@ func TestClientAddString(t *testing.T) {
 	}
 }
 
+// Test Delete
+func TestClientDelete(t *testing.T) {
+	ms := newMockServer(t, func(msg *protocol.Message) *protocol.Response {
+		if msg.Operation != "DELETE" {
+			return &protocol.Response{Code: protocol.CodeError, Message: "Unexpected operation"}
+		}
+		if msg.Arguments[0] != "(4:read)" {
+			return &protocol.Response{Code: protocol.CodeError, Message: "Rule not found"}
+		}
+		return &protocol.Response{Code: protocol.CodeOK, Message: "Ok"}
+	})
+	defer ms.close()
+
+	client, err := NewClient(&Config{Address: ms.addr()})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.DeleteString("(4:read)"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := client.Delete(sexp.NewAtom("write")); err == nil {
+		t.Error("Expected error for unknown rule")
+	}
+	if err := client.DeleteString("invalid("); err == nil {
+		t.Error("Expected error for invalid rule string")
+	}
+}
+
 // Test Reload
 func TestClientReload(t *testing.T) {
 	tests := []struct {
@@ -357,6 +389,40 @@ func TestClientReload(t *testing.T) {
 	}
 }
 
+// Test ReloadDryRun, ReloadForce and Rollback
+func TestClientReloadModes(t *testing.T) {
+	report := "1 -> 2 rules (+1 -0)\n+ (5:write)"
+	ms := newMockServer(t, func(msg *protocol.Message) *protocol.Response {
+		switch {
+		case msg.Operation == "RELOAD" && len(msg.Arguments) == 1 && msg.Arguments[0] == "DRYRUN":
+			return &protocol.Response{Code: protocol.CodeOK, Message: report}
+		case msg.Operation == "RELOAD" && len(msg.Arguments) == 1 && msg.Arguments[0] == "FORCE":
+			return &protocol.Response{Code: protocol.CodeOK, Message: "Reloaded"}
+		case msg.Operation == "RELOAD" && len(msg.Arguments) == 1 && msg.Arguments[0] == "ROLLBACK":
+			return &protocol.Response{Code: protocol.CodeError, Message: "Rollback failed: no previous rules"}
+		}
+		return &protocol.Response{Code: protocol.CodeError, Message: "Unexpected operation"}
+	})
+	defer ms.close()
+
+	client, err := NewClient(&Config{Address: ms.addr()})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	got, err := client.ReloadDryRun()
+	if err != nil || got != report {
+		t.Errorf("ReloadDryRun: expected %q, got %q, %v", report, got, err)
+	}
+	if err := client.ReloadForce(); err != nil {
+		t.Errorf("ReloadForce: unexpected error: %v", err)
+	}
+	if err := client.Rollback(); err == nil || !strings.Contains(err.Error(), "no previous rules") {
+		t.Errorf("Rollback: expected server error, got %v", err)
+	}
+}
+
 // Test Logout
 func TestClientLogout(t *testing.T) {
 	tests := []struct {
@@ -545,3 +611,308 @@ func TestClientMultipleOperations(t *testing.T) {
 		t.Errorf("Expected 2 adds, got %d", addCount)
 	}
 }
+
+func TestClientTransaction(t *testing.T) {
+	var mu sync.Mutex
+	var ops []string
+	ms := newMockServer(t, func(msg *protocol.Message) *protocol.Response {
+		if msg.Operation == protocol.OpCapa {
+			return &protocol.Response{Code: protocol.CodeUnknown, Message: "Unknown operation: CAPA"}
+		}
+		mu.Lock()
+		ops = append(ops, msg.Operation)
+		mu.Unlock()
+		switch msg.Operation {
+		case "ADD", "DELETE":
+			return &protocol.Response{Code: protocol.CodeOK, Message: "Staged"}
+		case protocol.OpBegin, protocol.OpRollback:
+			return &protocol.Response{Code: protocol.CodeOK, Message: "Ok"}
+		case protocol.OpCommit:
+			return &protocol.Response{Code: protocol.CodeError, Message: "Commit failed: change 2: rule not found"}
+		default:
+			return &protocol.Response{Code: protocol.CodeError, Message: fmt.Sprintf("Unknown: %s", msg.Operation)}
+		}
+	})
+	defer ms.close()
+
+	client, err := NewClient(&Config{Address: ms.addr()})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	tx, err := client.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	if err := tx.AddString("(5:spocp(7:subject3:bob))"); err != nil {
+		t.Errorf("Add failed: %v", err)
+	}
+	if err := tx.DeleteString("(5:spocp(7:subject5:alice))"); err != nil {
+		t.Errorf("Delete failed: %v", err)
+	}
+	if err := tx.Commit(); err == nil || !strings.Contains(err.Error(), "rule not found") {
+		t.Errorf("Expected the commit error, got %v", err)
+	}
+	if err := tx.AddString("(5:spocp)"); err != ErrTxDone {
+		t.Errorf("Expected ErrTxDone after Commit, got %v", err)
+	}
+
+	tx, err = client.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Errorf("Rollback failed: %v", err)
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Errorf("Expected ErrTxDone after Rollback, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := "BEGIN ADD DELETE COMMIT BEGIN ROLLBACK"
+	if got := strings.Join(ops, " "); got != want {
+		t.Errorf("Expected operations %q, got %q", want, got)
+	}
+}
+
+func TestClientList(t *testing.T) {
+	rules := []string{"(1:a)", "(1:b)", "(1:c)", "(1:d)", "(1:e)"}
+	var mu sync.Mutex
+	var requests []string
+	ms := newMockServer(t, func(msg *protocol.Message) *protocol.Response {
+		if msg.Operation == protocol.OpCapa {
+			return &protocol.Response{Code: protocol.CodeUnknown, Message: "Unknown operation: CAPA"}
+		}
+		mu.Lock()
+		requests = append(requests, strings.Join(msg.Arguments, " "))
+		mu.Unlock()
+		if msg.Operation != protocol.OpList {
+			return &protocol.Response{Code: protocol.CodeError, Message: "Unexpected operation"}
+		}
+		var offset, limit int
+		if _, err := fmt.Sscanf(strings.Join(msg.Arguments[len(msg.Arguments)-4:], " "), "OFFSET %d LIMIT %d", &offset, &limit); err != nil {
+			return &protocol.Response{Code: protocol.CodeError, Message: err.Error()}
+		}
+		end := min(offset+limit, len(rules))
+		return &protocol.Response{Code: protocol.CodeOK, Message: "Ok", Parts: rules[min(offset, end):end]}
+	})
+	defer ms.close()
+
+	client, err := NewClient(&Config{Address: ms.addr()})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	var got []string
+	for rule, err := range client.List(&ListOptions{Tag: "http", PageSize: 2}) {
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		got = append(got, rule.String())
+	}
+	if strings.Join(got, "") != strings.Join(rules, "") {
+		t.Errorf("Expected %v, got %v", rules, got)
+	}
+
+	mu.Lock()
+	want := []string{"TAG http OFFSET 0 LIMIT 2", "TAG http OFFSET 2 LIMIT 2", "TAG http OFFSET 4 LIMIT 2"}
+	if strings.Join(requests, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected requests %q, got %q", want, requests)
+	}
+	mu.Unlock()
+
+	// Breaking out of the loop leaves the connection usable
+	for range client.List(nil) {
+		break
+	}
+	count := 0
+	for _, err := range client.List(nil) {
+		if err != nil {
+			t.Fatalf("List after break failed: %v", err)
+		}
+		count++
+	}
+	if count != len(rules) {
+		t.Errorf("Expected %d rules after break, got %d", len(rules), count)
+	}
+}
+
+func TestClientCapabilities(t *testing.T) {
+	var mu sync.Mutex
+	var ops []string
+	ms := newMockServer(t, func(msg *protocol.Message) *protocol.Response {
+		mu.Lock()
+		ops = append(ops, msg.Operation)
+		mu.Unlock()
+		if msg.Operation == protocol.OpCapa {
+			return &protocol.Response{Code: protocol.CodeOK, Message: "Ok", Parts: []string{"VERSION 1", "MAXMESSAGE 64"}}
+		}
+		return &protocol.Response{Code: protocol.CodeOK, Message: "Ok"}
+	})
+	defer ms.close()
+
+	if _, err := NewClient(&Config{Address: ms.addr(), Require: []string{protocol.CapList}}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Expected a missing required capability to fail, got %v", err)
+	}
+
+	client, err := NewClient(&Config{Address: ms.addr()})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	if n, ok := client.Capabilities().Int(protocol.CapMaxMessage); !ok || n != 64 {
+		t.Errorf("Expected MAXMESSAGE 64, got %v", client.Capabilities())
+	}
+	if err := client.DeleteString("(1:a)"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Expected Delete to fail with ErrUnsupported, got %v", err)
+	}
+	if _, err := client.Begin(); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Expected Begin to fail with ErrUnsupported, got %v", err)
+	}
+	for _, err := range client.List(nil) {
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("Expected List to fail with ErrUnsupported, got %v", err)
+		}
+	}
+	if err := client.AddString("(4:http(4:page10:index.html)(6:action3:GET)(6:userid4:olav))"); !errors.Is(err, protocol.ErrMessageTooLarge) {
+		t.Errorf("Expected a message over MAXMESSAGE to fail, got %v", err)
+	}
+	if err := client.AddString("(1:a)"); err != nil {
+		t.Errorf("Add failed: %v", err)
+	}
+
+	// Nothing unsupported reached the server
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(ops, " "); got != "CAPA CAPA ADD" {
+		t.Errorf("Expected operations CAPA CAPA ADD, got %q", got)
+	}
+}
+
+func TestClientLegacyServer(t *testing.T) {
+	ms := newMockServer(t, func(msg *protocol.Message) *protocol.Response {
+		if msg.Operation == protocol.OpCapa {
+			return &protocol.Response{Code: protocol.CodeUnknown, Message: "Unknown operation: CAPA"}
+		}
+		return &protocol.Response{Code: protocol.CodeOK, Message: "Ok"}
+	})
+	defer ms.close()
+
+	if _, err := NewClient(&Config{Address: ms.addr(), Require: []string{protocol.CapVersion}}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Expected Require to fail without CAPA, got %v", err)
+	}
+
+	client, err := NewClient(&Config{Address: ms.addr()})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	// Without capabilities, operations are left to the server
+	if client.Capabilities() != nil {
+		t.Errorf("Expected no capabilities, got %v", client.Capabilities())
+	}
+	if err := client.DeleteString("(1:a)"); err != nil {
+		t.Errorf("Delete failed: %v", err)
+	}
+}
+
+// TestClientQueryAsync tests that pipelined queries are matched to their
+// responses, in order without request IDs and by ID with them
+func TestClientQueryAsync(t *testing.T) {
+	ms := newMockServer(t, func(msg *protocol.Message) *protocol.Response {
+		if msg.Operation == protocol.OpCapa {
+			return &protocol.Response{Code: protocol.CodeUnknown, Message: "Unknown operation: CAPA"}
+		}
+		if msg.Operation == "QUERY" && msg.Arguments[0] == "(4:deny)" {
+			return &protocol.Response{Code: protocol.CodeDenied, Message: "Denied"}
+		}
+		return &protocol.Response{Code: protocol.CodeOK, Message: "Ok"}
+	})
+	defer ms.close()
+
+	client, err := NewClient(&Config{Address: ms.addr()})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	// More queries than maxInFlight, from several goroutines
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var futures []*QueryFuture
+			for i := 0; i < 200; i++ {
+				tag := "allow"
+				if i%3 == 0 {
+					tag = "deny"
+				}
+				futures = append(futures, client.QueryAsync(sexp.NewList(tag)))
+			}
+			for i, f := range futures {
+				if ok, err := f.Wait(); err != nil || ok == (i%3 == 0) {
+					t.Errorf("Query %d: got %v, %v", i, ok, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// A server with request IDs answers in any order
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if _, err := protocol.DecodeMessage(reader); err != nil {
+			return
+		}
+		fmt.Fprint(conn, protocol.EncodeResponse(&protocol.Response{Code: protocol.CodeOK, Message: "Ok", Parts: []string{"REQUESTID"}}))
+
+		var queries []*protocol.Message
+		for len(queries) < 3 {
+			msg, err := protocol.DecodeMessage(reader)
+			if err != nil {
+				return
+			}
+			queries = append(queries, msg)
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			code := protocol.CodeDenied
+			if queries[i].Arguments[0] == "(5:allow)" {
+				code = protocol.CodeOK
+			}
+			fmt.Fprint(conn, protocol.EncodeResponse(&protocol.Response{Code: code, Message: "-", ID: queries[i].ID}))
+		}
+	}()
+
+	tagged, err := NewClient(&Config{Address: listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer tagged.Close()
+	allow := tagged.QueryAsync(sexp.NewList("allow"))
+	deny := tagged.QueryAsync(sexp.NewList("deny"))
+	again := tagged.QueryAsync(sexp.NewList("allow"))
+	for _, tt := range []struct {
+		f    *QueryFuture
+		want bool
+	}{{allow, true}, {deny, false}, {again, true}} {
+		if ok, err := tt.f.Wait(); ok != tt.want || err != nil {
+			t.Errorf("Expected %v, got %v, %v", tt.want, ok, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"fmt"
+	"iter"
+	"strconv"
+
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// DefaultListPageSize is the number of rules List fetches per request if
+// ListOptions.PageSize is not set
+const DefaultListPageSize = 1000
+
+// ListOptions filters the rules returned by List
+type ListOptions struct {
+	// Pattern, if set, keeps the rules that the pattern permits or that
+	// permit the pattern
+	Pattern sexp.Element
+
+	// Tag, if set, keeps the list rules with this tag
+	Tag string
+
+	// PageSize is the number of rules fetched per LIST operation
+	// (default: DefaultListPageSize), at most the limit the server
+	// advertises with protocol.CapList
+	PageSize int
+}
+
+// List returns an iterator over the server's rules, fetched with LIST
+// operations of one page each. Iteration stops at the first error. Rules
+// added or deleted while iterating can shift the pages, so a rule may be
+// skipped or returned twice.
+func (c *Client) List(opts *ListOptions) iter.Seq2[sexp.Element, error] {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultListPageSize
+	}
+	if limit, ok := c.caps.Int(protocol.CapList); ok && limit > 0 {
+		pageSize = min(pageSize, limit)
+	}
+
+	var filter []string
+	if opts.Pattern != nil {
+		filter = append(filter, "MATCH", opts.Pattern.String())
+	}
+	if opts.Tag != "" {
+		filter = append(filter, "TAG", opts.Tag)
+	}
+
+	return func(yield func(sexp.Element, error) bool) {
+		for offset := 0; ; offset += pageSize {
+			args := append(filter[:len(filter):len(filter)],
+				"OFFSET", strconv.Itoa(offset), "LIMIT", strconv.Itoa(pageSize))
+			page, err := c.list(args)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for _, rule := range page {
+				if !yield(rule, nil) {
+					return
+				}
+			}
+			if len(page) < pageSize {
+				return
+			}
+		}
+	}
+}
+
+// list sends one LIST operation and reads all of its parts, so that the
+// connection can be used again while the caller iterates
+func (c *Client) list(args []string) ([]sexp.Element, error) {
+	if err := c.require(protocol.CapList); err != nil {
+		return nil, err
+	}
+	parts, resp, err := c.sendMultipart(&protocol.Message{Operation: protocol.OpList, Arguments: args})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != protocol.CodeOK {
+		return nil, fmt.Errorf("list failed: %s %s", resp.Code, resp.Message)
+	}
+
+	rules := make([]sexp.Element, 0, len(parts))
+	for _, part := range parts {
+		rule, err := protocol.ParseRule(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule in listing: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,214 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// maxInFlight limits the requests sent without reading their response.
+// Past it, sending reads responses first, so that neither side blocks on
+// a full connection while the other is not reading.
+const maxInFlight = 256
+
+// call is a request awaiting its response
+type call struct {
+	parts []string
+	resp  *protocol.Response
+	err   error
+	done  chan struct{}
+}
+
+// QueryFuture is the pending result of QueryAsync
+type QueryFuture struct {
+	c    *Client
+	call *call
+}
+
+// QueryAsync sends a QUERY operation without waiting for the response,
+// so that many queries can be in flight on the connection. Servers that
+// advertise protocol.CapPipelining evaluate them concurrently; with
+// protocol.CapRequestID, the queries are tagged and a slow query does not
+// hold back the responses to the others.
+//
+// Queries are buffered to be written together: the buffer is flushed when
+// it is full, when any operation waits for a response, and at the latest
+// by Wait.
+func (c *Client) QueryAsync(query sexp.Element) *QueryFuture {
+	msg := &protocol.Message{
+		Operation: "QUERY",
+		Arguments: []string{query.String()},
+	}
+	if c.caps.Has(protocol.CapRequestID) {
+		msg.ID = strconv.FormatUint(c.nextID.Add(1), 36)
+	}
+	return &QueryFuture{c: c, call: c.send(msg, false)}
+}
+
+// Wait waits for the response to the query and returns its result, as
+// Query does
+func (f *QueryFuture) Wait() (bool, error) {
+	_, resp, err := f.c.wait(f.call)
+	if err != nil {
+		return false, err
+	}
+	return queryResult(resp)
+}
+
+// send writes a message and returns the call awaiting its response. The
+// message is flushed at once if flush is set, or else before the next
+// read.
+func (c *Client) send(msg *protocol.Message, flush bool) *call {
+	cl := &call{done: make(chan struct{})}
+
+	encoded := protocol.EncodeMessage(msg)
+	if limit, ok := c.caps.Int(protocol.CapMaxMessage); ok {
+		// The limit applies to the value of the outer length-value pair
+		if size := len(encoded) - strings.IndexByte(encoded, ':') - 1; size > limit {
+			cl.err = fmt.Errorf("%w: %d bytes, server limit %d", protocol.ErrMessageTooLarge, size, limit)
+			close(cl.done)
+			return cl
+		}
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	for c.outstanding() >= maxInFlight {
+		c.flush()
+		c.rmu.Lock()
+		c.readResponse()
+		c.rmu.Unlock()
+	}
+
+	// Register the call first, its response can be read as soon as the
+	// message is written
+	c.mu.Lock()
+	if c.err != nil {
+		cl.err = c.err
+		close(cl.done)
+		c.mu.Unlock()
+		return cl
+	}
+	if msg.ID != "" {
+		if c.tagged == nil {
+			c.tagged = make(map[string]*call)
+		}
+		c.tagged[msg.ID] = cl
+	} else {
+		c.pending = append(c.pending, cl)
+	}
+	c.mu.Unlock()
+
+	if _, err := c.writer.WriteString(encoded); err != nil {
+		c.fail(fmt.Errorf("failed to write message: %w", err))
+	} else if flush {
+		c.flush()
+	}
+	return cl
+}
+
+// flush writes the buffered messages. The caller holds wmu.
+func (c *Client) flush() {
+	if c.writer.Buffered() == 0 {
+		return
+	}
+	if err := c.writer.Flush(); err != nil {
+		c.fail(fmt.Errorf("failed to flush: %w", err))
+	}
+}
+
+// wait returns the response to a call, reading responses until it
+// arrives. Responses to other calls are handed over to them.
+func (c *Client) wait(cl *call) ([]string, *protocol.Response, error) {
+	for {
+		select {
+		case <-cl.done:
+			return cl.parts, cl.resp, cl.err
+		default:
+		}
+
+		// The message may still be buffered
+		c.wmu.Lock()
+		c.flush()
+		c.wmu.Unlock()
+
+		c.rmu.Lock()
+		select {
+		case <-cl.done:
+		default:
+			c.readResponse()
+		}
+		c.rmu.Unlock()
+	}
+}
+
+// readResponse reads a response with its parts and completes its call.
+// The caller holds rmu.
+func (c *Client) readResponse() {
+	// Set read deadline
+	_ = c.conn.SetReadDeadline(time.Now().Add(30 * time.Second)) //nolint:errcheck // non-critical timeout setting
+
+	var parts []string
+	for {
+		resp, err := protocol.DecodeResponse(c.reader)
+		if err != nil {
+			c.fail(fmt.Errorf("failed to read response: %w", err))
+			return
+		}
+		if resp.Code == protocol.CodeMultipart {
+			parts = append(parts, resp.Message)
+			continue
+		}
+
+		c.mu.Lock()
+		var cl *call
+		if resp.ID != "" {
+			cl = c.tagged[resp.ID]
+			delete(c.tagged, resp.ID)
+		} else if len(c.pending) > 0 {
+			cl = c.pending[0]
+			c.pending = c.pending[1:]
+		}
+		c.mu.Unlock()
+
+		if cl == nil {
+			c.fail(fmt.Errorf("unexpected response: %s %s", resp.Code, resp.Message))
+			return
+		}
+		cl.parts, cl.resp = parts, resp
+		close(cl.done)
+		return
+	}
+}
+
+// outstanding returns the number of calls awaiting a response
+func (c *Client) outstanding() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending) + len(c.tagged)
+}
+
+// fail completes every call awaiting a response with err. Later messages
+// fail with the same error, since the responses on the connection can no
+// longer be matched to them.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	for _, cl := range c.pending {
+		cl.err = err
+		close(cl.done)
+	}
+	for _, cl := range c.tagged {
+		cl.err = err
+		close(cl.done)
+	}
+	c.pending, c.tagged = nil, nil
+}
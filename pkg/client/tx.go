@@ -0,0 +1,97 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// ErrTxDone is returned by the methods of a transaction that was already
+// committed or rolled back
+var ErrTxDone = errors.New("transaction already committed or rolled back")
+
+// Tx is a transaction opened with Begin. Its changes are staged on the
+// server and applied together by Commit; closing the connection without
+// Commit discards them. The client must not send other operations while
+// a transaction is open.
+type Tx struct {
+	c    *Client
+	done bool
+}
+
+// Begin opens a transaction with the BEGIN operation
+func (c *Client) Begin() (*Tx, error) {
+	if err := c.require(protocol.CapTransactions); err != nil {
+		return nil, err
+	}
+	if err := c.simple(protocol.OpBegin, "begin"); err != nil {
+		return nil, err
+	}
+	return &Tx{c: c}, nil
+}
+
+// Add stages an ADD operation
+func (tx *Tx) Add(rule sexp.Element) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	return tx.c.Add(rule)
+}
+
+// AddString stages an ADD operation using a canonical S-expression string
+func (tx *Tx) AddString(ruleStr string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	return tx.c.AddString(ruleStr)
+}
+
+// Delete stages a DELETE operation
+func (tx *Tx) Delete(rule sexp.Element) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	return tx.c.Delete(rule)
+}
+
+// DeleteString stages a DELETE operation using a canonical S-expression
+// string
+func (tx *Tx) DeleteString(ruleStr string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	return tx.c.DeleteString(ruleStr)
+}
+
+// Commit applies the staged changes with the COMMIT operation. If it
+// fails, none of them was applied. The transaction ends either way.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	return tx.c.simple(protocol.OpCommit, "commit")
+}
+
+// Rollback discards the staged changes
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	return tx.c.simple(protocol.OpRollback, "rollback")
+}
+
+// simple sends an operation without arguments that must succeed
+func (c *Client) simple(op, name string) error {
+	resp, err := c.sendMessage(&protocol.Message{Operation: op, Arguments: []string{}})
+	if err != nil {
+		return err
+	}
+	if resp.Code != protocol.CodeOK {
+		return fmt.Errorf("%s failed: %s %s", name, resp.Code, resp.Message)
+	}
+	return nil
+}
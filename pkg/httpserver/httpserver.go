@@ -7,6 +7,11 @@
 // The HTTP server serves as a unified monitoring interface for both TCP and HTTP/AuthZen
 // protocols, while the AuthZen API endpoint can be enabled independently via configuration.
 //
+// With Config.TLSConfig or Config.CertManager the server serves HTTPS and
+// HTTP/2, verifying client certificates if the configuration asks for
+// them. Config.HealthAddress additionally serves the monitoring endpoints
+// in plain HTTP on a separate port.
+//
 // The server can operate in two modes:
 //
 //  1. Standalone mode: Creates its own SPOCP engine and loads rules from a directory
@@ -64,12 +69,15 @@ package httpserver
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -79,19 +87,28 @@ import (
 	"github.com/sirosfoundation/go-spocp/pkg/authzen"
 	"github.com/sirosfoundation/go-spocp/pkg/persist"
 	"github.com/sirosfoundation/go-spocp/pkg/server"
+	"github.com/sirosfoundation/go-spocp/pkg/signing"
+	"github.com/sirosfoundation/go-spocp/pkg/tlsutil"
 )
 
 // HTTPServer provides an HTTP/AuthZen interface to SPOCP engine.
 type HTTPServer struct {
 	server   *http.Server
+	health   *http.Server // nil without a separate health address
 	engine   *spocp.Engine
 	mu       *sync.RWMutex // Pointer to allow sharing mutex with other components
 	logger   *log.Logger
 	logLevel server.LogLevel
+	manifest func() *persist.Manifest // nil if rules are not from a bundle
+	certs    map[string]*tlsutil.CertManager
 	ctx      context.Context
 	cancel   context.CancelFunc
 	wg       sync.WaitGroup
 
+	// listener and healthListener are set by Start
+	listener       net.Listener
+	healthListener net.Listener
+
 	// Metrics
 	metrics struct {
 		requestsTotal atomic.Int64
@@ -112,12 +129,43 @@ type Config struct {
 	// RulesDir for loading rules (required if Engine not provided)
 	RulesDir string
 
+	// BundlePath is a rule bundle to load instead of RulesDir
+	BundlePath string
+
+	// Manifest reports the bundle loaded by a shared engine's owner
+	// (optional, e.g. the TCP server's Manifest method)
+	Manifest func() *persist.Manifest
+
+	// TrustedKeys, if set, requires every rule file loaded from RulesDir
+	// to carry a detached signature by one of these keys
+	TrustedKeys *signing.KeyRing
+
+	// LoadWorkers is the number of rule files from RulesDir parsed
+	// concurrently (default: GOMAXPROCS)
+	LoadWorkers int
+
 	// Engine is the SPOCP engine (optional - will be created if not provided)
 	Engine *spocp.Engine
 
 	// EngineMutex protects engine access (optional - will be created if not provided)
 	EngineMutex *sync.RWMutex
 
+	// TLSConfig serves HTTPS instead of plain HTTP, with HTTP/2 (optional)
+	TLSConfig *tls.Config
+
+	// CertManager, if set and TLSConfig is not, provides the TLS
+	// configuration so that certificates can be rotated without a restart
+	CertManager *tlsutil.CertManager
+
+	// CertMetrics are further certificate managers whose metrics /metrics
+	// reports, by server, e.g. "tcp" for the TCP server sharing the engine
+	CertMetrics map[string]*tlsutil.CertManager
+
+	// HealthAddress, if set, also serves /health, /ready, /stats and
+	// /metrics in plain HTTP on a separate address, e.g. for probes that
+	// cannot present client certificates
+	HealthAddress string
+
 	// Logger (optional)
 	Logger *log.Logger
 
@@ -166,16 +214,27 @@ func NewHTTPServer(config *Config) (*HTTPServer, error) {
 		return nil, fmt.Errorf("address is required")
 	}
 
+	manifestFunc := config.Manifest
+
 	// Create engine if not provided
 	if config.Engine == nil {
-		if config.RulesDir == "" {
-			return nil, fmt.Errorf("either engine or rules directory is required")
-		}
-		config.Engine = spocp.NewEngine()
-
-		// Load rules from directory
-		if err := loadRulesFromDir(config.Engine, config.RulesDir); err != nil {
-			return nil, fmt.Errorf("failed to load rules: %w", err)
+		switch {
+		case config.BundlePath != "":
+			config.Engine = spocp.NewEngine()
+			manifest, err := loadRulesFromBundle(config.Engine, config.BundlePath, config.TrustedKeys)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load rules: %w", err)
+			}
+			manifestFunc = func() *persist.Manifest { return manifest }
+		case config.RulesDir != "":
+			config.Engine = spocp.NewEngine()
+
+			// Load rules from directory
+			if err := loadRulesFromDir(config.Engine, config.RulesDir, config.TrustedKeys, config.LoadWorkers); err != nil {
+				return nil, fmt.Errorf("failed to load rules: %w", err)
+			}
+		default:
+			return nil, fmt.Errorf("either engine, rules directory or bundle is required")
 		}
 	}
 
@@ -190,10 +249,16 @@ func NewHTTPServer(config *Config) (*HTTPServer, error) {
 		engine:   config.Engine,
 		logger:   logger,
 		logLevel: config.LogLevel,
+		manifest: manifestFunc,
+		certs:    map[string]*tlsutil.CertManager{"http": config.CertManager},
 		ctx:      ctx,
 		cancel:   cancel,
 	}
 
+	for name, m := range config.CertMetrics {
+		hs.certs[name] = m
+	}
+
 	// If engine mutex provided, use it; otherwise create own mutex
 	if config.EngineMutex != nil {
 		hs.mu = config.EngineMutex
@@ -210,22 +275,72 @@ func NewHTTPServer(config *Config) (*HTTPServer, error) {
 	}
 
 	// Health and monitoring endpoints (always enabled)
-	mux.HandleFunc("/health", hs.handleHealth)
-	mux.HandleFunc("/ready", hs.handleReady)
-	mux.HandleFunc("/stats", hs.handleStats)
-	mux.HandleFunc("/metrics", hs.handleMetrics)
+	hs.handleMonitoring(mux)
+
+	tlsConfig := config.TLSConfig
+	if tlsConfig == nil && config.CertManager != nil {
+		tlsConfig = config.CertManager.TLSConfig()
+	}
+	if tlsConfig != nil {
+		tlsConfig = withHTTP2(tlsConfig)
+	}
 
 	hs.server = &http.Server{
 		Addr:         config.Address,
 		Handler:      mux,
+		TLSConfig:    tlsConfig,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
 
+	if config.HealthAddress != "" {
+		healthMux := http.NewServeMux()
+		hs.handleMonitoring(healthMux)
+		hs.health = &http.Server{
+			Addr:         config.HealthAddress,
+			Handler:      healthMux,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  120 * time.Second,
+		}
+	}
+
 	return hs, nil
 }
 
+// handleMonitoring registers the health and monitoring endpoints
+func (hs *HTTPServer) handleMonitoring(mux *http.ServeMux) {
+	mux.HandleFunc("/health", hs.handleHealth)
+	mux.HandleFunc("/ready", hs.handleReady)
+	mux.HandleFunc("/stats", hs.handleStats)
+	mux.HandleFunc("/metrics", hs.handleMetrics)
+}
+
+// withHTTP2 returns a copy of config that offers HTTP/2 and HTTP/1.1 with
+// ALPN, also in the configurations its GetConfigForClient returns
+func withHTTP2(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	for _, proto := range []string{"h2", "http/1.1"} {
+		if !slices.Contains(config.NextProtos, proto) {
+			config.NextProtos = append(config.NextProtos, proto)
+		}
+	}
+	if getConfig := config.GetConfigForClient; getConfig != nil {
+		protos := config.NextProtos
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			clientConfig, err := getConfig(hello)
+			if clientConfig == nil || err != nil {
+				return clientConfig, err
+			}
+			clientConfig = clientConfig.Clone()
+			clientConfig.NextProtos = protos
+			return clientConfig, nil
+		}
+	}
+	return config
+}
+
 // Start begins accepting HTTP requests in a background goroutine.
 //
 // This method returns immediately after launching the HTTP server.
@@ -233,23 +348,56 @@ func NewHTTPServer(config *Config) (*HTTPServer, error) {
 // unrecoverable error occurs.
 //
 // The server handles POST requests to /access/v1/evaluation according
-// to the AuthZen Authorization API 1.0 specification.
+// to the AuthZen Authorization API 1.0 specification. With a TLS
+// configuration it serves HTTPS and HTTP/2; a HealthAddress is served in
+// plain HTTP alongside.
 //
 // Returns an error only if the server cannot be started (e.g., port
 // already in use). Runtime errors are logged but don't propagate to
 // the caller.
 func (hs *HTTPServer) Start() error {
-	hs.logInfo("AuthZen HTTP server listening on %s", hs.server.Addr)
+	listener, err := net.Listen("tcp", hs.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", hs.server.Addr, err)
+	}
+	if hs.health != nil {
+		hs.healthListener, err = net.Listen("tcp", hs.health.Addr)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to listen on %s: %w", hs.health.Addr, err)
+		}
+	}
+	hs.listener = listener
+
+	if hs.server.TLSConfig != nil {
+		hs.logInfo("AuthZen HTTPS server listening on %s", listener.Addr())
+	} else {
+		hs.logInfo("AuthZen HTTP server listening on %s", listener.Addr())
+	}
+	hs.serve(hs.server, listener)
+	if hs.health != nil {
+		hs.logInfo("Health endpoints listening on %s", hs.healthListener.Addr())
+		hs.serve(hs.health, hs.healthListener)
+	}
+	return nil
+}
 
+// serve runs srv on listener in the background, with TLS if srv has a
+// TLS configuration
+func (hs *HTTPServer) serve(srv *http.Server, listener net.Listener) {
 	hs.wg.Add(1)
 	go func() {
 		defer hs.wg.Done()
-		if err := hs.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ServeTLS(listener, "", "")
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			hs.logError("HTTP server error: %v", err)
 		}
 	}()
-
-	return nil
 }
 
 // Close gracefully shuts down the HTTP server.
@@ -271,6 +419,11 @@ func (hs *HTTPServer) Close() error {
 	if err := hs.server.Shutdown(ctx); err != nil {
 		return fmt.Errorf("HTTP server shutdown error: %w", err)
 	}
+	if hs.health != nil {
+		if err := hs.health.Shutdown(ctx); err != nil {
+			return fmt.Errorf("health server shutdown error: %w", err)
+		}
+	}
 
 	hs.wg.Wait()
 	hs.logInfo("HTTP server stopped")
@@ -376,9 +529,21 @@ func (hs *HTTPServer) handleEvaluation(w http.ResponseWriter, r *http.Request) {
 func (hs *HTTPServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	if manifest := hs.bundleManifest(); manifest != nil {
+		fmt.Fprintf(w, `{"status":"ok","revision":%q}`, manifest.Revision)
+		return
+	}
 	fmt.Fprintf(w, `{"status":"ok"}`)
 }
 
+// bundleManifest returns the manifest of the loaded bundle, if any
+func (hs *HTTPServer) bundleManifest() *persist.Manifest {
+	if hs.manifest == nil {
+		return nil
+	}
+	return hs.manifest()
+}
+
 // handleReady returns readiness status based on whether rules are loaded.
 func (hs *HTTPServer) handleReady(w http.ResponseWriter, r *http.Request) {
 	// Check if we have any rules loaded
@@ -440,6 +605,8 @@ func (hs *HTTPServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "spocp_index_rules_by_tag %d\n", rulesByTag)
 		}
 	}
+
+	tlsutil.WriteMetrics(w, hs.certs)
 }
 
 // handleStats returns JSON statistics about the HTTP server and engine.
@@ -466,6 +633,16 @@ func (hs *HTTPServer) handleStats(w http.ResponseWriter, r *http.Request) {
 		tagCount = int64(v)
 	}
 
+	bundleStats := ""
+	if manifest := hs.bundleManifest(); manifest != nil {
+		bundleStats = fmt.Sprintf(`,
+  "bundle": {
+    "version": %q,
+    "revision": %q,
+    "created": %q
+  }`, manifest.Version, manifest.Revision, manifest.Created.Format(time.RFC3339))
+	}
+
 	fmt.Fprintf(w, `{
   "requests": {
     "total": %d,
@@ -481,7 +658,7 @@ func (hs *HTTPServer) handleStats(w http.ResponseWriter, r *http.Request) {
   "indexing": {
     "enabled": %t,
     "tag_count": %d
-  }
+  }%s
 }`,
 		hs.metrics.requestsTotal.Load(),
 		hs.metrics.requestsOK.Load(),
@@ -492,6 +669,7 @@ func (hs *HTTPServer) handleStats(w http.ResponseWriter, r *http.Request) {
 		rulesByTag,
 		indexingEnabled,
 		tagCount,
+		bundleStats,
 	)
 }
 
@@ -524,10 +702,37 @@ func (hs *HTTPServer) GetMetrics() map[string]int64 {
 	}
 }
 
-// loadRulesFromDir loads all .spoc files from a directory into the engine.
-func loadRulesFromDir(engine *spocp.Engine, dir string) error {
-	var ruleCount int
+// loadRulesFromBundle loads a rule bundle into the engine, verifying its
+// signature if trusted keys are given.
+func loadRulesFromBundle(engine *spocp.Engine, bundlePath string, trustedKeys *signing.KeyRing) (*persist.Manifest, error) {
+	opts := persist.DefaultLoadOptions()
+	if trustedKeys != nil {
+		opts.Verify = trustedKeys.Verify
+		opts.VerifySignature = trustedKeys.VerifySignature
+	}
+
+	bundle, err := persist.LoadBundle(bundlePath, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(bundle.Rules) == 0 {
+		return nil, fmt.Errorf("no rules loaded from %s", bundlePath)
+	}
+
+	engine.LoadRuleset(bundle.Ruleset())
+	return &bundle.Manifest, nil
+}
+
+// loadRulesFromDir loads all .spoc files from a directory into the engine,
+// verifying their signatures if trusted keys are given. Files are parsed
+// by up to workers goroutines and indexed in lexical order.
+func loadRulesFromDir(engine *spocp.Engine, dir string, trustedKeys *signing.KeyRing, workers int) error {
+	opts := persist.DefaultLoadOptions()
+	if trustedKeys != nil {
+		opts.Verify = trustedKeys.Verify
+	}
 
+	var files []string
 	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -535,27 +740,23 @@ func loadRulesFromDir(engine *spocp.Engine, dir string) error {
 		if d.IsDir() || !strings.HasSuffix(path, ".spoc") {
 			return nil
 		}
-
-		rules, err := persist.LoadFileToSlice(path)
-		if err != nil {
-			return fmt.Errorf("failed to load %s: %w", path, err)
-		}
-
-		for _, rule := range rules {
-			engine.AddRuleElement(rule)
-			ruleCount++
-		}
-
+		files = append(files, path)
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 
+	sets, err := persist.LoadRulesets(files, opts, workers)
 	if err != nil {
 		return err
 	}
 
-	if ruleCount == 0 {
+	rs := persist.MergeRulesets(sets...)
+	if len(rs.Rules) == 0 {
 		return fmt.Errorf("no rules loaded from %s", dir)
 	}
+	engine.LoadRuleset(rs)
 
 	return nil
 }
@@ -2,12 +2,22 @@ package httpserver
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -15,7 +25,9 @@ import (
 
 	"github.com/sirosfoundation/go-spocp"
 	"github.com/sirosfoundation/go-spocp/pkg/authzen"
+	"github.com/sirosfoundation/go-spocp/pkg/persist"
 	"github.com/sirosfoundation/go-spocp/pkg/server"
+	"github.com/sirosfoundation/go-spocp/pkg/signing"
 )
 
 // Helper to create a test engine with rules
@@ -506,3 +518,198 @@ func TestLoadRulesFromDirErrors(t *testing.T) {
 		t.Error("Expected error for empty rules dir")
 	}
 }
+
+func TestLoadRulesFromDirSigned(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+
+	pub, priv, _ := signing.GenerateKey()
+	keys := signing.NewKeyRing(pub)
+
+	_, err := NewHTTPServer(&Config{Address: ":0", RulesDir: rulesDir, TrustedKeys: keys})
+	if !errors.Is(err, signing.ErrUnsigned) {
+		t.Fatalf("Expected unsigned rules to be rejected, got: %v", err)
+	}
+
+	if err := signing.SignFile(priv, filepath.Join(rulesDir, "test.spoc")); err != nil {
+		t.Fatalf("SignFile failed: %v", err)
+	}
+	hs, err := NewHTTPServer(&Config{Address: ":0", RulesDir: rulesDir, TrustedKeys: keys})
+	if err != nil {
+		t.Fatalf("Expected signed rules to load, got: %v", err)
+	}
+	if allowed, _ := hs.engine.Query("(4:read)"); !allowed {
+		t.Error("Expected signed rule to be loaded")
+	}
+}
+
+func TestBundleRevision(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+
+	bundlePath := filepath.Join(t.TempDir(), "policy.tar.gz")
+	if _, err := persist.SaveBundle(bundlePath, rulesDir, persist.BundleOptions{Revision: "rev-7"}); err != nil {
+		t.Fatalf("SaveBundle failed: %v", err)
+	}
+
+	hs, err := NewHTTPServer(&Config{Address: ":0", BundlePath: bundlePath})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	hs.handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if body := w.Body.String(); body != `{"status":"ok","revision":"rev-7"}` {
+		t.Errorf("Unexpected health body: %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	hs.handleStats(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if !strings.Contains(w.Body.String(), `"revision": "rev-7"`) {
+		t.Errorf("Expected revision in stats: %s", w.Body.String())
+	}
+
+	// In shared mode the revision comes from the engine's owner
+	shared, err := NewHTTPServer(&Config{
+		Address:  ":0",
+		Engine:   createTestEngine([]string{"(4:read)"}),
+		Manifest: func() *persist.Manifest { return &persist.Manifest{Revision: "rev-8"} },
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	w = httptest.NewRecorder()
+	shared.handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if !strings.Contains(w.Body.String(), `"revision":"rev-8"`) {
+		t.Errorf("Unexpected health body: %s", w.Body.String())
+	}
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1
+func testCertificate(t *testing.T, commonName string, usage x509.ExtKeyUsage) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+// TestTLS tests HTTPS with client certificates, HTTP/2 and the plain
+// health port
+func TestTLS(t *testing.T) {
+	serverCert, serverParsed := testCertificate(t, "spocp test", x509.ExtKeyUsageServerAuth)
+	clientCert, clientParsed := testCertificate(t, "pep", x509.ExtKeyUsageClientAuth)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientParsed)
+	roots := x509.NewCertPool()
+	roots.AddCert(serverParsed)
+
+	srv, err := NewHTTPServer(&Config{
+		Address:       "127.0.0.1:0",
+		HealthAddress: "127.0.0.1:0",
+		EnableAuthZen: true,
+		Engine:        createTestEngine([]string{"(4:read)"}),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer func() {
+		if err := srv.Close(); err != nil {
+			t.Errorf("Failed to close server: %v", err)
+		}
+	}()
+	url := "https://" + srv.listener.Addr().String() + "/health"
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2, got %s", resp.Proto)
+	}
+
+	// Client certificates are required
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	defer anonymous.CloseIdleConnections()
+	if resp, err := anonymous.Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("Expected a request without a client certificate to fail")
+	}
+
+	// The health port speaks plain HTTP
+	plain := &http.Client{Transport: &http.Transport{}}
+	defer plain.CloseIdleConnections()
+	resp, err = plain.Get("http://" + srv.healthListener.Addr().String() + "/health")
+	if err != nil {
+		t.Fatalf("Health request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 on the health port, got %d", resp.StatusCode)
+	}
+	resp, err = plain.Post("http://"+srv.healthListener.Addr().String()+"/access/v1/evaluation", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("Health request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected AuthZen not to be served on the health port, got %d", resp.StatusCode)
+	}
+}
+
+// TestWithHTTP2 tests that configurations chosen per client offer HTTP/2
+func TestWithHTTP2(t *testing.T) {
+	perClient := &tls.Config{MinVersion: tls.VersionTLS12}
+	config := withHTTP2(&tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) { return perClient, nil },
+	})
+	if !slices.Equal(config.NextProtos, []string{"h2", "http/1.1"}) {
+		t.Errorf("Unexpected protocols %v", config.NextProtos)
+	}
+	got, err := config.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.NextProtos, []string{"h2", "http/1.1"}) {
+		t.Errorf("Unexpected per-client protocols %v", got.NextProtos)
+	}
+	if len(perClient.NextProtos) != 0 {
+		t.Error("The per-client configuration must not be modified")
+	}
+}
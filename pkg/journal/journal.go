@@ -0,0 +1,481 @@
+// Package journal implements an append-only write-ahead journal of rule
+// changes made at runtime, so that they survive reloads and restarts.
+//
+// Each record is one line:
+//
+//	<crc32> <op> <length>:<canonical rule>\n
+//
+// where crc32 is the hex-encoded IEEE CRC-32 of "<op> <length>:<rule>",
+// op is "A" (add) or "D" (delete) and the rule is a length-prefixed
+// canonical S-expression, so the journal stays readable with standard
+// tools. A record that is incomplete or fails its checksum marks a torn
+// write: it and everything after it are truncated when the journal is
+// opened.
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// Op is the kind of change recorded
+type Op byte
+
+const (
+	OpAdd    Op = 'A' // rule added
+	OpDelete Op = 'D' // rule deleted
+)
+
+func (o Op) String() string {
+	switch o {
+	case OpAdd:
+		return "add"
+	case OpDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("Op(%q)", byte(o))
+	}
+}
+
+// SyncPolicy controls when appended records are flushed to stable storage
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs after every append (default, safest)
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs in the background every Options.SyncInterval
+	SyncInterval
+	// SyncNever leaves flushing to the operating system
+	SyncNever
+)
+
+// ParseSyncPolicy parses "always", "interval" or "never"
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always", "":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return 0, fmt.Errorf("invalid sync policy %q (must be: always, interval, never)", s)
+	}
+}
+
+// Options configures a journal
+type Options struct {
+	// Sync is the fsync policy
+	Sync SyncPolicy
+
+	// SyncInterval is the flush period for SyncInterval (default: 1s)
+	SyncInterval time.Duration
+}
+
+// Record is a single journal entry
+type Record struct {
+	Op   Op
+	Rule sexp.Element
+}
+
+// journalFile is the open journal file, an *os.File outside of tests
+type journalFile interface {
+	io.ReadWriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// Journal is an open journal file. It is safe for concurrent use.
+type Journal struct {
+	mu        sync.Mutex
+	file      journalFile
+	path      string
+	opts      Options
+	records   int
+	truncated int64
+	dirty     bool
+	closed    bool
+	broken    error // why appends are refused, after a failed write could not be undone
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// Open opens or creates the journal at path, discarding a torn tail
+func Open(path string, opts Options) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600) //nolint:gosec // journal path is configured by the operator
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	records, valid, err := scan(file, info.Size(), nil)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if valid < size {
+		if err := file.Truncate(valid); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to truncate torn journal tail: %w", err)
+		}
+		if _, err := file.Seek(valid, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	j := &Journal{
+		file:      file,
+		path:      path,
+		opts:      opts,
+		records:   records,
+		truncated: size - valid,
+		done:      make(chan struct{}),
+	}
+
+	if opts.Sync == SyncInterval {
+		interval := opts.SyncInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		j.wg.Add(1)
+		go j.syncLoop(interval)
+	}
+
+	return j, nil
+}
+
+// Path returns the journal file path
+func (j *Journal) Path() string {
+	return j.path
+}
+
+// Len returns the number of records in the journal
+func (j *Journal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.records
+}
+
+// Truncated returns the number of bytes discarded as a torn tail by Open
+func (j *Journal) Truncated() int64 {
+	return j.truncated
+}
+
+// Append writes a record, syncing it according to the sync policy
+func (j *Journal) Append(op Op, rule sexp.Element) error {
+	return j.AppendAll([]Record{{Op: op, Rule: rule}})
+}
+
+// AppendAll writes records in order with a single write and sync. Other
+// appends are never interleaved with them, but a crash during the write
+// can still keep a prefix of the records. If the write or sync fails, the
+// bytes written are truncated again, so that the next append does not
+// follow a torn record; if that fails too, later appends are refused.
+func (j *Journal) AppendAll(records []Record) error {
+	var buf []byte
+	for _, r := range records {
+		if r.Op != OpAdd && r.Op != OpDelete {
+			return fmt.Errorf("invalid journal op %v", r.Op)
+		}
+		buf = append(buf, encode(r.Op, r.Rule)...)
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.broken != nil {
+		return j.broken
+	}
+	offset, err := j.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	if _, err := j.file.Write(buf); err != nil {
+		j.undo(offset)
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if j.opts.Sync == SyncAlways {
+		if err := j.file.Sync(); err != nil {
+			j.undo(offset)
+			return fmt.Errorf("failed to sync journal: %w", err)
+		}
+	}
+	j.records += len(records)
+	if j.opts.Sync == SyncInterval {
+		j.dirty = true
+	}
+	return nil
+}
+
+// undo truncates the journal to offset after a failed append, or marks it
+// broken if that fails; the caller must hold mu
+func (j *Journal) undo(offset int64) {
+	err := j.file.Truncate(offset)
+	if err == nil {
+		_, err = j.file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		j.broken = fmt.Errorf("journal is broken after a failed write: %w", err)
+	}
+}
+
+// Records returns all records in order
+func (j *Journal) Records() ([]Record, error) {
+	var records []Record
+	err := j.Replay(func(r Record) error {
+		records = append(records, r)
+		return nil
+	})
+	return records, err
+}
+
+// Replay calls fn for every record in order, stopping at the first error
+func (j *Journal) Replay(fn func(Record) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	size, err := j.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	defer j.file.Seek(0, io.SeekEnd) //nolint:errcheck // next Write reports failures
+
+	_, _, err = scan(j.file, size, fn)
+	return err
+}
+
+// Rewrite atomically replaces the journal contents with records, e.g.
+// after compaction. The directory is synced after the rename, so that a
+// crash leaves either the old or the new journal.
+func (j *Journal) Rewrite(records []Record) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	tmp := j.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600) //nolint:gosec // next to the journal
+	if err != nil {
+		return fmt.Errorf("failed to rewrite journal: %w", err)
+	}
+
+	w := bufio.NewWriter(file)
+	for _, r := range records {
+		w.Write(encode(r.Op, r.Rule)) //nolint:errcheck // reported by Flush
+	}
+	err = w.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to rewrite journal: %w", err)
+	}
+
+	// The new file is the journal from here on
+	j.file.Close()
+	j.file = file
+	j.records = len(records)
+	j.dirty = false
+	j.broken = nil
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(j.path)); err != nil {
+		return fmt.Errorf("failed to sync journal directory: %w", err)
+	}
+	return nil
+}
+
+// syncDir flushes directory metadata, such as a rename, to disk
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// Directories cannot be opened for syncing on Windows
+		return nil
+	}
+	d, err := os.Open(dir) //nolint:gosec // directory of the journal
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Sync flushes appended records to stable storage
+func (j *Journal) Sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.dirty = false
+	return j.file.Sync()
+}
+
+// Close syncs and closes the journal. Closing it again does nothing.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	if j.closed {
+		j.mu.Unlock()
+		return nil
+	}
+	j.closed = true
+	j.mu.Unlock()
+
+	close(j.done)
+	j.wg.Wait()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.file.Sync(); err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
+
+// syncLoop periodically flushes records for SyncInterval
+func (j *Journal) syncLoop(interval time.Duration) {
+	defer j.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-ticker.C:
+			j.mu.Lock()
+			if j.dirty {
+				j.file.Sync() //nolint:errcheck // retried on the next tick and at Close
+				j.dirty = false
+			}
+			j.mu.Unlock()
+		}
+	}
+}
+
+// encode formats a record line
+func encode(op Op, rule sexp.Element) []byte {
+	canonical := rule.String()
+	body := fmt.Appendf(nil, "%c %d:%s", byte(op), len(canonical), canonical)
+	line := fmt.Appendf(nil, "%08x ", crc32.ChecksumIEEE(body))
+	line = append(line, body...)
+	return append(line, '\n')
+}
+
+var errTorn = errors.New("torn record")
+
+// maxRecordSize bounds the length of a rule in a record, so that a
+// corrupted length cannot make decode allocate more than that
+const maxRecordSize = 64 << 20
+
+// scan reads the size bytes of r, calling fn (if not nil) for each
+// record. It returns the number of valid records and the offset following
+// the last one. Invalid data ends the scan without an error.
+func scan(r io.Reader, size int64, fn func(Record) error) (int, int64, error) {
+	br := bufio.NewReader(r)
+	var count int
+	var offset int64
+
+	for {
+		record, n, err := decode(br, size-offset)
+		if errors.Is(err, io.EOF) || errors.Is(err, errTorn) {
+			return count, offset, nil
+		}
+		if err != nil {
+			return count, offset, err
+		}
+		if fn != nil {
+			if err := fn(record); err != nil {
+				return count, offset, err
+			}
+		}
+		count++
+		offset += n
+	}
+}
+
+// decode reads one record of at most remaining bytes, returning its size
+// in bytes
+func decode(br *bufio.Reader, remaining int64) (Record, int64, error) {
+	// "<crc32> <op> <length>:"
+	head, err := br.ReadBytes(':')
+	if err != nil {
+		if len(head) == 0 && errors.Is(err, io.EOF) {
+			return Record{}, 0, io.EOF
+		}
+		if errors.Is(err, io.EOF) {
+			return Record{}, 0, errTorn
+		}
+		return Record{}, 0, err
+	}
+	if len(head) < 13 || head[8] != ' ' || head[10] != ' ' {
+		return Record{}, 0, errTorn
+	}
+	sum, err := strconv.ParseUint(string(head[:8]), 16, 32)
+	if err != nil {
+		return Record{}, 0, errTorn
+	}
+	length, err := strconv.Atoi(string(head[11 : len(head)-1]))
+	if err != nil || length < 0 || length > maxRecordSize || int64(len(head)+length+1) > remaining {
+		return Record{}, 0, errTorn
+	}
+
+	rest := make([]byte, length+1)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return Record{}, 0, errTorn
+		}
+		return Record{}, 0, err
+	}
+	if rest[length] != '\n' {
+		return Record{}, 0, errTorn
+	}
+
+	body := append(bytes.Clone(head[9:]), rest[:length]...)
+	if crc32.ChecksumIEEE(body) != uint32(sum) {
+		return Record{}, 0, errTorn
+	}
+
+	op := Op(head[9])
+	if op != OpAdd && op != OpDelete {
+		return Record{}, 0, errTorn
+	}
+	rule, err := sexp.NewParser(string(rest[:length])).Parse()
+	if err != nil {
+		return Record{}, 0, errTorn
+	}
+
+	return Record{Op: op, Rule: rule}, int64(len(head) + len(rest)), nil
+}
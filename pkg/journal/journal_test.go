@@ -0,0 +1,281 @@
+package journal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+func parse(t *testing.T, s string) sexp.Element {
+	t.Helper()
+	elem, err := sexp.NewParser(s).Parse()
+	if err != nil {
+		t.Fatalf("parse %q: %v", s, err)
+	}
+	return elem
+}
+
+func TestAppendReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.journal")
+
+	j, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := j.Append(OpAdd, parse(t, "(4:http(4:page5:index))")); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := j.Append(OpAdd, parse(t, "(4:http(4:page4:blog))")); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := j.Append(OpDelete, parse(t, "(4:http(4:page5:index))")); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	j, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer j.Close()
+
+	if j.Len() != 3 {
+		t.Errorf("Len = %d, want 3", j.Len())
+	}
+	records, err := j.Records()
+	if err != nil {
+		t.Fatalf("Records failed: %v", err)
+	}
+	want := []struct {
+		op   Op
+		rule string
+	}{
+		{OpAdd, "(4:http(4:page5:index))"},
+		{OpAdd, "(4:http(4:page4:blog))"},
+		{OpDelete, "(4:http(4:page5:index))"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(records), len(want))
+	}
+	for i, w := range want {
+		if records[i].Op != w.op || records[i].Rule.String() != w.rule {
+			t.Errorf("record %d = %v %s, want %v %s", i, records[i].Op, records[i].Rule, w.op, w.rule)
+		}
+	}
+
+	// Appends after replay go to the end
+	if err := j.Append(OpAdd, parse(t, "(1:a)")); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	records, _ = j.Records()
+	if len(records) != 4 || records[3].Rule.String() != "(1:a)" {
+		t.Errorf("append after replay: got %v", records)
+	}
+
+	// A batch with an invalid op writes nothing
+	err = j.AppendAll([]Record{{Op: OpAdd, Rule: parse(t, "(1:b)")}, {Op: Op(0), Rule: parse(t, "(1:c)")}})
+	if err == nil {
+		t.Error("expected AppendAll to reject an invalid op")
+	}
+	if err := j.AppendAll([]Record{{Op: OpAdd, Rule: parse(t, "(1:b)")}, {Op: OpDelete, Rule: parse(t, "(1:a)")}}); err != nil {
+		t.Fatalf("AppendAll failed: %v", err)
+	}
+	records, _ = j.Records()
+	if j.Len() != 6 || len(records) != 6 || records[5].Op != OpDelete {
+		t.Errorf("AppendAll: Len = %d, records %v", j.Len(), records)
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.journal")
+
+	j, err := Open(path, Options{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	j.Append(OpAdd, parse(t, "(1:a)"))
+	j.Append(OpAdd, parse(t, "(1:b)"))
+	j.Close()
+
+	data, _ := os.ReadFile(path)
+	good := len(data)
+
+	tests := []struct {
+		name string
+		tail string
+	}{
+		{"partial header", "1234"},
+		{"partial record", "00000000 A 9:(1:c"},
+		{"bad checksum", "00000000 A 5:(1:c)\n"},
+		{"bad op", "00000000 X 5:(1:c)\n"},
+		{"huge length", "00000000 A 999999999999999:(1:c)\n"},
+		{"length past the end", "00000000 A 50000:(1:c)\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.WriteFile(path, append(data[:good:good], tt.tail...), 0600)
+
+			j, err := Open(path, Options{})
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer j.Close()
+
+			if j.Len() != 2 {
+				t.Errorf("Len = %d, want 2", j.Len())
+			}
+			if j.Truncated() != int64(len(tt.tail)) {
+				t.Errorf("Truncated = %d, want %d", j.Truncated(), len(tt.tail))
+			}
+			info, _ := os.Stat(path)
+			if info.Size() != int64(good) {
+				t.Errorf("file size = %d, want %d", info.Size(), good)
+			}
+		})
+	}
+}
+
+// shortWriter writes only part of the next write, then fails
+type shortWriter struct {
+	journalFile
+	fail         bool
+	truncateFail bool
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if !w.fail {
+		return w.journalFile.Write(p)
+	}
+	w.fail = false
+	n, _ := w.journalFile.Write(p[:len(p)/2])
+	return n, errors.New("disk full")
+}
+
+func (w *shortWriter) Truncate(size int64) error {
+	if w.truncateFail {
+		return errors.New("read-only")
+	}
+	return w.journalFile.Truncate(size)
+}
+
+// TestShortWrite tests that a failed append leaves no torn record in front
+// of later appends
+func TestShortWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.journal")
+
+	j, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	w := &shortWriter{journalFile: j.file}
+	j.file = w
+
+	j.Append(OpAdd, parse(t, "(1:a)"))
+	w.fail = true
+	if err := j.Append(OpAdd, parse(t, "(1:b)")); err == nil {
+		t.Fatal("Expected the short write to fail")
+	}
+	if err := j.Append(OpAdd, parse(t, "(1:c)")); err != nil {
+		t.Fatalf("Append after a short write failed: %v", err)
+	}
+	j.Close()
+
+	j, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	records, _ := j.Records()
+	if len(records) != 2 || records[1].Rule.String() != "(1:c)" || j.Truncated() != 0 {
+		t.Errorf("Expected records a and c, got %v (%d bytes truncated)", records, j.Truncated())
+	}
+
+	// If the partial write cannot be removed, later appends are refused
+	w = &shortWriter{journalFile: j.file, fail: true, truncateFail: true}
+	j.file = w
+	j.Append(OpAdd, parse(t, "(1:d)"))
+	if err := j.Append(OpAdd, parse(t, "(1:e)")); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("Expected the journal to be broken, got %v", err)
+	}
+	j.Close()
+}
+
+func TestRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.journal")
+
+	j, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer j.Close()
+
+	for _, r := range []string{"(1:a)", "(1:b)", "(1:c)"} {
+		j.Append(OpAdd, parse(t, r))
+	}
+
+	if err := j.Rewrite([]Record{{Op: OpDelete, Rule: parse(t, "(1:z)")}}); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	if j.Len() != 1 {
+		t.Errorf("Len = %d, want 1", j.Len())
+	}
+
+	j.Append(OpAdd, parse(t, "(1:d)"))
+	records, err := j.Records()
+	if err != nil {
+		t.Fatalf("Records failed: %v", err)
+	}
+	if len(records) != 2 || records[0].Rule.String() != "(1:z)" || records[1].Rule.String() != "(1:d)" {
+		t.Errorf("after rewrite: got %v", records)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary file left behind")
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.journal")
+
+	j, err := Open(path, Options{Sync: SyncInterval, SyncInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := j.Append(OpAdd, parse(t, "(1:a)")); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := j.Close(); err != nil {
+		t.Errorf("second Close failed: %v", err)
+	}
+
+	j, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer j.Close()
+	if j.Len() != 1 {
+		t.Errorf("Len = %d, want 1", j.Len())
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for s, want := range map[string]SyncPolicy{"": SyncAlways, "always": SyncAlways, "interval": SyncInterval, "never": SyncNever} {
+		got, err := ParseSyncPolicy(s)
+		if err != nil || got != want {
+			t.Errorf("ParseSyncPolicy(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Error("expected error for invalid policy")
+	}
+}
@@ -0,0 +1,207 @@
+package persist
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// SaveOptions controls how files are written
+type SaveOptions struct {
+	// Backups is the number of previous versions to keep as
+	// <file>.1 (newest) to <file>.N (oldest); 0 keeps none
+	Backups int
+}
+
+// SaveFileWithOptions saves rules like SaveFile, keeping backups of the
+// previous versions of the file as configured in opts
+func SaveFileWithOptions(filename string, rules []sexp.Element, format FileFormat, opts SaveOptions) error {
+	if err := checkStarForms(rules, format); err != nil {
+		return err
+	}
+	return WriteFileAtomic(filename, opts, func(w io.Writer) error {
+		switch format {
+		case FormatBinary:
+			return saveBinary(w, rules)
+		case FormatBinaryV2:
+			return writeRulesetV2(w, NewRuleset(rules, nil), BinaryOptions{})
+		case FormatAdvanced:
+			return saveAdvanced(w, rules)
+		case FormatJSON:
+			return saveJSON(w, rules)
+		case FormatYAML:
+			return saveYAML(w, rules)
+		default:
+			return saveCanonical(w, rules)
+		}
+	})
+}
+
+// checkStarForms refuses typed star forms for the formats that write them
+// as lists tagged "*": those load back as plain lists, which only match
+// queries holding the same list and so grant nothing the star form did.
+func checkStarForms(rules []sexp.Element, format FileFormat) error {
+	var name string
+	switch format {
+	case FormatBinary:
+		name = "binary version 1"
+	case FormatAdvanced:
+		name = "advanced"
+	case FormatBinaryV2, FormatJSON, FormatYAML:
+		return nil
+	default:
+		name = "canonical"
+	}
+	for i, rule := range rules {
+		if hasStarForm(rule) {
+			return fmt.Errorf("rule %d: %s files cannot hold typed star forms, use binary version 2, JSON or YAML", i+1, name)
+		}
+	}
+	return nil
+}
+
+// hasStarForm reports whether elem is or contains a typed star form
+func hasStarForm(elem sexp.Element) bool {
+	if elem.IsStarForm() {
+		return true
+	}
+	if list, ok := elem.(*sexp.List); ok {
+		for _, child := range list.Elements {
+			if hasStarForm(child) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BackupPath returns the name of the n-th backup of filename (1 is newest)
+func BackupPath(filename string, n int) string {
+	return fmt.Sprintf("%s.%d", filename, n)
+}
+
+// WriteFileAtomic replaces filename with the output of write so that
+// readers, and the file after a crash, see either the old or the new
+// contents in full. The data is written to a temporary file in the same
+// directory, flushed to disk and renamed over filename; the directory is
+// then synced so the rename itself is durable. If write fails, filename is
+// left untouched.
+func WriteFileAtomic(filename string, opts SaveOptions, write func(w io.Writer) error) (err error) {
+	dir := filepath.Dir(filename)
+
+	// Keep the mode of the file being replaced
+	perm := os.FileMode(0644)
+	if info, statErr := os.Stat(filename); statErr == nil {
+		perm = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(tmp)
+	if err := write(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	if opts.Backups > 0 {
+		if err := rotateBackups(filename, opts.Backups); err != nil {
+			return fmt.Errorf("failed to keep backup: %w", err)
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// rotateBackups shifts <file>.1..<file>.n-1 up by one and links the
+// current file as <file>.1, so filename itself never goes missing
+func rotateBackups(filename string, n int) error {
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	for i := n - 1; i >= 1; i-- {
+		err := os.Rename(BackupPath(filename, i), BackupPath(filename, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	backup := BackupPath(filename, 1)
+	if err := os.Remove(backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(filename, backup); err == nil {
+		return nil
+	}
+	// Hard links are not supported everywhere; fall back to a copy
+	return copyFile(filename, backup)
+}
+
+// copyFile copies src to dst, syncing dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src) //nolint:gosec // path derived from the file being saved
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst) //nolint:gosec // path derived from the file being saved
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// syncDir flushes directory metadata (such as a rename) to disk
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// Directories cannot be opened for syncing on Windows
+		return nil
+	}
+	d, err := os.Open(dir) //nolint:gosec // directory of the file being saved
+	if err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
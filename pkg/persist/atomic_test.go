@@ -0,0 +1,90 @@
+package persist
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// TestWriteFileAtomicFailure tests that a failed write leaves the file intact
+func TestWriteFileAtomicFailure(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "rules.spoc")
+	if err := os.WriteFile(filename, []byte("(4:read)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	errDiskFull := errors.New("disk full")
+	err := WriteFileAtomic(filename, SaveOptions{}, func(w io.Writer) error {
+		w.Write([]byte("(5:wri"))
+		return errDiskFull
+	})
+	if !errors.Is(err, errDiskFull) {
+		t.Fatalf("Expected write error, got %v", err)
+	}
+
+	data, _ := os.ReadFile(filename)
+	if string(data) != "(4:read)\n" {
+		t.Errorf("File changed after failed write: %q", data)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the original file, found %d entries", len(entries))
+	}
+}
+
+// TestWriteFileAtomicKeepsMode tests that the replaced file keeps its mode
+func TestWriteFileAtomicKeepsMode(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.spoc")
+	if err := os.WriteFile(filename, []byte("(4:read)\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SaveFile(filename, []sexp.Element{sexp.NewAtom("write")}, FormatCanonical); err != nil {
+		t.Fatalf("SaveFile failed: %v", err)
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+}
+
+// TestSaveFileBackups tests backup rotation
+func TestSaveFileBackups(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.spoc")
+	opts := SaveOptions{Backups: 2}
+
+	for _, name := range []string{"v1", "v2", "v3", "v4"} {
+		rules := []sexp.Element{sexp.NewAtom(name)}
+		if err := SaveFileWithOptions(filename, rules, FormatCanonical, opts); err != nil {
+			t.Fatalf("SaveFileWithOptions(%s) failed: %v", name, err)
+		}
+	}
+
+	for path, want := range map[string]string{
+		filename:                "v4",
+		BackupPath(filename, 1): "v3",
+		BackupPath(filename, 2): "v2",
+	} {
+		rules, err := LoadFileToSlice(path)
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", path, err)
+		}
+		if len(rules) != 1 || rules[0].(*sexp.Atom).Value != want {
+			t.Errorf("%s: expected %s, got %v", filepath.Base(path), want, rules)
+		}
+	}
+
+	if _, err := os.Stat(BackupPath(filename, 3)); !os.IsNotExist(err) {
+		t.Error("Expected only 2 backups to be kept")
+	}
+}
@@ -0,0 +1,702 @@
+package persist
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+	"github.com/sirosfoundation/go-spocp/pkg/starform"
+)
+
+// Binary format version 2 stores rules pre-parsed so that loading does not
+// re-parse canonical strings or rebuild the tag index:
+//
+// - Magic number: "SPOCP" (5 bytes)
+// - Version: uint8 = 2 (1 byte)
+// - Flags: uint8 (1 byte), bit 0 = payload is DEFLATE-compressed
+// - Checksum: SHA-256 of the payload as stored (32 bytes)
+// - Payload length: uint64 (8 bytes)
+// - Payload:
+//   - String table: uvarint count, then uvarint length + bytes per string
+//   - Rule count, atom count, list count, child slot count (uvarints)
+//   - One element tree per rule (see node* constants); strings are
+//     uvarint indices into the string table
+//   - Metadata flag (uvarint 0/1), then per rule: file, line, template,
+//     template source and sorted parameter pairs
+//   - Tag index: uvarint tag count; per tag the tag string and the
+//     delta-encoded rule indices
+//   - Atom rules: delta-encoded rule indices
+//
+// All integers in the payload are unsigned varints.
+
+const binaryVersion2 = 2
+
+const (
+	flagCompressed = 1 << 0
+)
+
+// element tree node types
+const (
+	nodeAtom byte = iota + 1
+	nodeList
+	nodeWildcard
+	nodeSet
+	nodeRange
+	nodePrefix
+	nodeSuffix
+)
+
+// v2HeaderSize is the size of the header following magic and version
+const v2HeaderSize = 1 + sha256.Size + 8
+
+// maxPayloadSize bounds the decompressed payload of a version 2 file, as
+// the header only records the compressed length
+const maxPayloadSize = 1 << 30
+
+var errCorrupt = errors.New("corrupt ruleset payload")
+
+// Ruleset is a set of rules with a prebuilt tag index, as stored in
+// version 2 binary files
+type Ruleset struct {
+	Rules []sexp.Element
+
+	// Meta holds per-rule metadata parallel to Rules (nil if not recorded)
+	Meta []RuleMeta
+
+	// TagIndex maps a list tag to the indices of rules with that tag
+	TagIndex map[string][]int
+
+	// AtomRules holds the indices of rules that are not lists
+	AtomRules []int
+}
+
+// NewRuleset builds a ruleset and its tag index; meta may be nil
+func NewRuleset(rules []sexp.Element, meta []RuleMeta) *Ruleset {
+	rs := &Ruleset{
+		Rules:     rules,
+		Meta:      meta,
+		TagIndex:  make(map[string][]int),
+		AtomRules: make([]int, 0),
+	}
+	for i, rule := range rules {
+		if list, ok := rule.(*sexp.List); ok {
+			rs.TagIndex[list.Tag] = append(rs.TagIndex[list.Tag], i)
+		} else {
+			rs.AtomRules = append(rs.AtomRules, i)
+		}
+	}
+	return rs
+}
+
+// BinaryOptions controls how version 2 binary files are written
+type BinaryOptions struct {
+	// Compress the payload with DEFLATE
+	Compress bool
+}
+
+// SaveRuleset writes a ruleset in binary format version 2, replacing the
+// file atomically
+func SaveRuleset(filename string, rs *Ruleset, opts BinaryOptions) error {
+	return WriteFileAtomic(filename, SaveOptions{}, func(w io.Writer) error {
+		return writeRulesetV2(w, rs, opts)
+	})
+}
+
+// LoadRuleset loads a ruleset from any supported file. Version 2 binary
+// files provide their index directly; for other formats it is built.
+func LoadRuleset(filename string, opts LoadOptions) (*Ruleset, error) {
+	if opts.Format == FormatBinary || opts.Format == FormatBinaryV2 || isBinaryFile(filename) {
+		return loadBinaryFile(filename, opts)
+	}
+
+	rules, err := LoadFileWithMeta(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	return rulesetFromRules(rules), nil
+}
+
+// rulesetFromRules builds a ruleset from loaded rules
+func rulesetFromRules(rules []Rule) *Ruleset {
+	elems := make([]sexp.Element, len(rules))
+	meta := make([]RuleMeta, len(rules))
+	for i, rule := range rules {
+		elems[i] = rule.Element
+		meta[i] = rule.Meta
+	}
+	return NewRuleset(elems, meta)
+}
+
+// Clone returns a copy of rs that shares the rules and metadata but has its
+// own index, so it can be handed to an engine (which takes ownership of the
+// index) while rs is kept for reuse
+func (rs *Ruleset) Clone() *Ruleset {
+	clone := &Ruleset{
+		Rules:     rs.Rules[:len(rs.Rules):len(rs.Rules)],
+		Meta:      rs.Meta[:len(rs.Meta):len(rs.Meta)],
+		TagIndex:  make(map[string][]int, len(rs.TagIndex)),
+		AtomRules: append(make([]int, 0, len(rs.AtomRules)), rs.AtomRules...),
+	}
+	for tag, indices := range rs.TagIndex {
+		clone.TagIndex[tag] = append([]int(nil), indices...)
+	}
+	return clone
+}
+
+// LoadRulesetFS loads a ruleset from a file in fsys like LoadRuleset
+func LoadRulesetFS(fsys fs.FS, name string, opts LoadOptions) (*Ruleset, error) {
+	if opts.Format == FormatBinary || opts.Format == FormatBinaryV2 || isBinaryFile(name) {
+		l := newLoader(opts)
+		l.fsys = fsys
+		data, err := l.readFile(name)
+		if err != nil {
+			return nil, err
+		}
+		rs, err := decodeBinary(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return rs, nil
+	}
+
+	rules, err := LoadFSWithMeta(fsys, name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return rulesetFromRules(rules), nil
+}
+
+// loadBinaryFile reads a binary ruleset of any version, memory-mapping the
+// file if requested. Verified files are read into memory instead.
+func loadBinaryFile(filename string, opts LoadOptions) (*Ruleset, error) {
+	if opts.Verify != nil {
+		data, err := readVerified(filename, opts)
+		if err != nil {
+			return nil, err
+		}
+		return decodeBinary(data)
+	}
+
+	opts.opened(filename)
+	file, err := os.Open(filename) //nolint:gosec // rule files are chosen by the operator
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	if !opts.MemoryMap {
+		return readBinary(file)
+	}
+
+	data, unmap, err := mapFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map file: %w", err)
+	}
+	defer unmap() //nolint:errcheck // decoded rules do not reference the mapping
+
+	return decodeBinary(data)
+}
+
+// decodeBinary decodes a complete binary file held in memory
+func decodeBinary(data []byte) (*Ruleset, error) {
+	n := len(binaryMagic)
+	if len(data) > n && string(data[:n]) == binaryMagic && data[n] == binaryVersion2 {
+		return decodeV2(data[n+1:])
+	}
+	return readBinary(bytes.NewReader(data))
+}
+
+// writeRulesetV2 encodes a ruleset in binary format version 2
+func writeRulesetV2(w io.Writer, rs *Ruleset, opts BinaryOptions) error {
+	if rs.Meta != nil && len(rs.Meta) != len(rs.Rules) {
+		return fmt.Errorf("metadata count %d does not match rule count %d", len(rs.Meta), len(rs.Rules))
+	}
+
+	enc := &v2Encoder{strings: make(map[string]uint64)}
+	if err := enc.encode(rs); err != nil {
+		return err
+	}
+
+	payload := enc.payload()
+	flags := byte(0)
+	if opts.Compress {
+		var compressed bytes.Buffer
+		fw, err := flate.NewWriter(&compressed, flate.BestSpeed)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(payload); err != nil {
+			return err
+		}
+		if err := fw.Close(); err != nil {
+			return err
+		}
+		payload = compressed.Bytes()
+		flags |= flagCompressed
+	}
+
+	sum := sha256.Sum256(payload)
+
+	header := make([]byte, 0, len(binaryMagic)+1+v2HeaderSize)
+	header = append(header, binaryMagic...)
+	header = append(header, binaryVersion2, flags)
+	header = append(header, sum[:]...)
+	header = binary.LittleEndian.AppendUint64(header, uint64(len(payload)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// decodeV2 decodes the part of a version 2 file following the version byte
+func decodeV2(data []byte) (*Ruleset, error) {
+	if len(data) < v2HeaderSize {
+		return nil, fmt.Errorf("truncated header")
+	}
+	flags := data[0]
+	checksum := data[1 : 1+sha256.Size]
+	length := binary.LittleEndian.Uint64(data[1+sha256.Size:])
+	payload := data[v2HeaderSize:]
+	if uint64(len(payload)) != length {
+		return nil, fmt.Errorf("payload length %d does not match header (%d)", len(payload), length)
+	}
+
+	sum := sha256.Sum256(payload)
+	if !bytes.Equal(sum[:], checksum) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+
+	if flags&flagCompressed != 0 {
+		inflated, err := inflate(payload, maxPayloadSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress payload: %w", err)
+		}
+		payload = inflated
+	}
+
+	dec := &v2Decoder{buf: payload}
+	rs := dec.decode()
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	return rs, nil
+}
+
+// inflate decompresses a payload, failing if it exceeds limit bytes
+func inflate(payload []byte, limit int64) ([]byte, error) {
+	inflated, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(payload)), limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(inflated)) > limit {
+		return nil, fmt.Errorf("payload exceeds %d bytes", limit)
+	}
+	return inflated, nil
+}
+
+// v2Encoder builds the payload of a version 2 file
+type v2Encoder struct {
+	strings map[string]uint64
+	table   []string
+	body    []byte
+	atoms   int
+	lists   int
+	slots   int
+}
+
+func (e *v2Encoder) uvarint(v uint64) {
+	e.body = binary.AppendUvarint(e.body, v)
+}
+
+func (e *v2Encoder) str(s string) {
+	idx, ok := e.strings[s]
+	if !ok {
+		idx = uint64(len(e.table))
+		e.strings[s] = idx
+		e.table = append(e.table, s)
+	}
+	e.uvarint(idx)
+}
+
+func (e *v2Encoder) indices(indices []int) {
+	e.uvarint(uint64(len(indices)))
+	prev := 0
+	for _, idx := range indices {
+		e.uvarint(uint64(idx - prev)) //nolint:gosec // indices are ascending
+		prev = idx
+	}
+}
+
+func (e *v2Encoder) encode(rs *Ruleset) error {
+	var trees []byte
+	for i, rule := range rs.Rules {
+		if err := e.element(rule); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	trees, e.body = e.body, nil
+
+	// Counts go before the trees so the decoder can preallocate
+	e.uvarint(uint64(len(rs.Rules)))
+	e.uvarint(uint64(e.atoms))
+	e.uvarint(uint64(e.lists))
+	e.uvarint(uint64(e.slots))
+	e.body = append(e.body, trees...)
+
+	if rs.Meta == nil {
+		e.uvarint(0)
+	} else {
+		e.uvarint(1)
+		for _, meta := range rs.Meta {
+			e.str(meta.File)
+			e.uvarint(uint64(max(meta.Line, 0)))
+			e.str(meta.Template)
+			e.str(meta.TemplateSource)
+			keys := make([]string, 0, len(meta.Params))
+			for key := range meta.Params {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			e.uvarint(uint64(len(keys)))
+			for _, key := range keys {
+				e.str(key)
+				e.str(meta.Params[key])
+			}
+		}
+	}
+
+	index := rs.TagIndex
+	atomRules := rs.AtomRules
+	if index == nil {
+		built := NewRuleset(rs.Rules, nil)
+		index, atomRules = built.TagIndex, built.AtomRules
+	}
+	tags := make([]string, 0, len(index))
+	for tag := range index {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	e.uvarint(uint64(len(tags)))
+	for _, tag := range tags {
+		e.str(tag)
+		e.indices(index[tag])
+	}
+	e.indices(atomRules)
+
+	return nil
+}
+
+func (e *v2Encoder) element(elem sexp.Element) error {
+	switch el := elem.(type) {
+	case *sexp.Atom:
+		e.atoms++
+		e.body = append(e.body, nodeAtom)
+		e.str(el.Value)
+	case *sexp.List:
+		e.lists++
+		e.slots += len(el.Elements)
+		e.body = append(e.body, nodeList)
+		e.str(el.Tag)
+		e.uvarint(uint64(len(el.Elements)))
+		for _, child := range el.Elements {
+			if err := e.element(child); err != nil {
+				return err
+			}
+		}
+	case *starform.Wildcard:
+		e.body = append(e.body, nodeWildcard)
+	case *starform.Set:
+		e.slots += len(el.Elements)
+		e.body = append(e.body, nodeSet)
+		e.uvarint(uint64(len(el.Elements)))
+		for _, child := range el.Elements {
+			if err := e.element(child); err != nil {
+				return err
+			}
+		}
+	case *starform.Range:
+		e.body = append(e.body, nodeRange)
+		e.str(string(el.RangeType))
+		var bounds byte
+		if el.LowerBound != nil {
+			bounds |= 1
+		}
+		if el.UpperBound != nil {
+			bounds |= 2
+		}
+		e.body = append(e.body, bounds)
+		for _, b := range []*starform.RangeBound{el.LowerBound, el.UpperBound} {
+			if b != nil {
+				e.str(string(b.Op))
+				e.str(b.Value)
+			}
+		}
+	case *starform.Prefix:
+		e.body = append(e.body, nodePrefix)
+		e.str(el.Value)
+	case *starform.Suffix:
+		e.body = append(e.body, nodeSuffix)
+		e.str(el.Value)
+	default:
+		return fmt.Errorf("unsupported element type %T", elem)
+	}
+	return nil
+}
+
+// payload assembles the string table and body
+func (e *v2Encoder) payload() []byte {
+	size := len(e.body) + binary.MaxVarintLen64
+	for _, s := range e.table {
+		size += len(s) + binary.MaxVarintLen64
+	}
+	out := make([]byte, 0, size)
+	out = binary.AppendUvarint(out, uint64(len(e.table)))
+	for _, s := range e.table {
+		out = binary.AppendUvarint(out, uint64(len(s)))
+		out = append(out, s...)
+	}
+	return append(out, e.body...)
+}
+
+// v2Decoder decodes a version 2 payload. Errors are sticky: after the first
+// failure all reads return zero values and err is set.
+type v2Decoder struct {
+	buf []byte
+	off int
+	err error
+
+	strs  []string
+	atoms []sexp.Atom
+	lists []sexp.List
+	slots []sexp.Element
+}
+
+func (d *v2Decoder) fail() {
+	if d.err == nil {
+		d.err = errCorrupt
+	}
+}
+
+func (d *v2Decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf[d.off:])
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.off += n
+	return v
+}
+
+// count reads a count that cannot exceed the remaining payload size
+func (d *v2Decoder) count() int {
+	v := d.uvarint()
+	if v > uint64(len(d.buf)-d.off) {
+		d.fail()
+		return 0
+	}
+	return int(v)
+}
+
+func (d *v2Decoder) byte() byte {
+	if d.err != nil || d.off >= len(d.buf) {
+		d.fail()
+		return 0
+	}
+	b := d.buf[d.off]
+	d.off++
+	return b
+}
+
+func (d *v2Decoder) str() string {
+	idx := d.uvarint()
+	if idx >= uint64(len(d.strs)) {
+		d.fail()
+		return ""
+	}
+	return d.strs[idx]
+}
+
+func (d *v2Decoder) indices(limit int) []int {
+	n := d.count()
+	out := make([]int, 0, n)
+	prev := 0
+	for i := 0; i < n && d.err == nil; i++ {
+		idx := prev + int(d.uvarint()) //nolint:gosec // bounds checked below
+		if idx < prev || (i > 0 && idx == prev) || idx >= limit {
+			d.fail()
+			return nil
+		}
+		out = append(out, idx)
+		prev = idx
+	}
+	return out
+}
+
+func (d *v2Decoder) decode() *Ruleset {
+	nstrs := d.count()
+	d.strs = make([]string, nstrs)
+	for i := range d.strs {
+		n := d.count()
+		if d.err != nil {
+			return nil
+		}
+		d.strs[i] = string(d.buf[d.off : d.off+n])
+		d.off += n
+	}
+
+	nrules := d.count()
+	d.atoms = make([]sexp.Atom, d.count())
+	d.lists = make([]sexp.List, d.count())
+	d.slots = make([]sexp.Element, d.count())
+	if d.err != nil {
+		return nil
+	}
+
+	rs := &Ruleset{Rules: make([]sexp.Element, nrules)}
+	for i := range rs.Rules {
+		rs.Rules[i] = d.element()
+		if d.err != nil {
+			return nil
+		}
+	}
+
+	if d.uvarint() == 1 {
+		rs.Meta = make([]RuleMeta, nrules)
+		for i := range rs.Meta {
+			meta := &rs.Meta[i]
+			meta.File = d.str()
+			meta.Line = int(d.uvarint()) //nolint:gosec // line numbers are small
+			meta.Template = d.str()
+			meta.TemplateSource = d.str()
+			if n := d.count(); n > 0 {
+				meta.Params = make(map[string]string, n)
+				for j := 0; j < n; j++ {
+					key := d.str()
+					meta.Params[key] = d.str()
+				}
+			}
+		}
+	}
+
+	ntags := d.count()
+	rs.TagIndex = make(map[string][]int, ntags)
+	for i := 0; i < ntags && d.err == nil; i++ {
+		tag := d.str()
+		if _, dup := rs.TagIndex[tag]; dup {
+			d.fail()
+			return nil
+		}
+		rs.TagIndex[tag] = d.indices(nrules)
+	}
+	rs.AtomRules = d.indices(nrules)
+	if d.err == nil && !validIndex(rs) {
+		d.fail()
+	}
+
+	if d.err == nil && d.off != len(d.buf) {
+		d.fail()
+	}
+	return rs
+}
+
+// validIndex reports whether the stored index of a decoded ruleset lists
+// every rule exactly once, under its own tag. The engine uses the index as
+// is, so a rule listed under another tag would never be found by queries.
+func validIndex(rs *Ruleset) bool {
+	total := len(rs.AtomRules)
+	for tag, indices := range rs.TagIndex {
+		for _, i := range indices {
+			if list, ok := rs.Rules[i].(*sexp.List); !ok || list.Tag != tag {
+				return false
+			}
+		}
+		total += len(indices)
+	}
+	for _, i := range rs.AtomRules {
+		if _, ok := rs.Rules[i].(*sexp.List); ok {
+			return false
+		}
+	}
+	// Indices ascend strictly, so with the tags checked no rule is listed
+	// twice, and the total shows none is missing
+	return total == len(rs.Rules)
+}
+
+func (d *v2Decoder) element() sexp.Element {
+	switch d.byte() {
+	case nodeAtom:
+		if len(d.atoms) == 0 {
+			d.fail()
+			return nil
+		}
+		atom := &d.atoms[0]
+		d.atoms = d.atoms[1:]
+		atom.Value = d.str()
+		return atom
+	case nodeList:
+		if len(d.lists) == 0 {
+			d.fail()
+			return nil
+		}
+		list := &d.lists[0]
+		d.lists = d.lists[1:]
+		list.Tag = d.str()
+		list.Elements = d.children()
+		return list
+	case nodeWildcard:
+		return &starform.Wildcard{}
+	case nodeSet:
+		return &starform.Set{Elements: d.children()}
+	case nodeRange:
+		r := &starform.Range{RangeType: starform.RangeType(d.str())}
+		bounds := d.byte()
+		if bounds&1 != 0 {
+			r.LowerBound = &starform.RangeBound{Op: starform.RangeOp(d.str()), Value: d.str()}
+		}
+		if bounds&2 != 0 {
+			r.UpperBound = &starform.RangeBound{Op: starform.RangeOp(d.str()), Value: d.str()}
+		}
+		return r
+	case nodePrefix:
+		return &starform.Prefix{Value: d.str()}
+	case nodeSuffix:
+		return &starform.Suffix{Value: d.str()}
+	default:
+		d.fail()
+		return nil
+	}
+}
+
+// children decodes a counted sequence of elements into the shared slot slice
+func (d *v2Decoder) children() []sexp.Element {
+	n := d.count()
+	if n == 0 || d.err != nil {
+		return nil
+	}
+	if n > len(d.slots) {
+		d.fail()
+		return nil
+	}
+	children := d.slots[:n:n]
+	d.slots = d.slots[n:]
+	for i := range children {
+		children[i] = d.element()
+		if d.err != nil {
+			return nil
+		}
+	}
+	return children
+}
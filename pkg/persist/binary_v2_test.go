@@ -0,0 +1,251 @@
+package persist
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+	"github.com/sirosfoundation/go-spocp/pkg/starform"
+)
+
+func testRulesetRules() []sexp.Element {
+	return []sexp.Element{
+		sexp.NewList("http",
+			sexp.NewList("page", &starform.Prefix{Value: "/admin/"}),
+			sexp.NewList("action", &starform.Set{Elements: []sexp.Element{sexp.NewAtom("GET"), sexp.NewAtom("POST")}}),
+		),
+		sexp.NewList("file",
+			sexp.NewList("name", &starform.Suffix{Value: ".pdf"}),
+			sexp.NewList("size", &starform.Range{
+				RangeType:  starform.RangeNumeric,
+				LowerBound: &starform.RangeBound{Op: starform.OpGE, Value: "5"},
+				UpperBound: &starform.RangeBound{Op: starform.OpLT, Value: "100"},
+			}),
+			&starform.Wildcard{},
+		),
+		sexp.NewAtom("admin"),
+		sexp.NewList("http", sexp.NewAtom("binary\x00data")),
+	}
+}
+
+func TestRulesetV2RoundTrip(t *testing.T) {
+	rules := testRulesetRules()
+	meta := make([]RuleMeta, len(rules))
+	meta[1] = RuleMeta{
+		File:           "web.spoc",
+		Line:           3,
+		Template:       "web",
+		TemplateSource: "(4:file5:$name)",
+		Params:         map[string]string{"name": ".pdf", "max": "100"},
+	}
+
+	for _, compress := range []bool{false, true} {
+		filename := filepath.Join(t.TempDir(), "rules.spocp")
+		if err := SaveRuleset(filename, NewRuleset(rules, meta), BinaryOptions{Compress: compress}); err != nil {
+			t.Fatalf("SaveRuleset failed: %v", err)
+		}
+
+		rs, err := LoadRuleset(filename, DefaultLoadOptions())
+		if err != nil {
+			t.Fatalf("LoadRuleset (compress=%v) failed: %v", compress, err)
+		}
+		if len(rs.Rules) != len(rules) {
+			t.Fatalf("Expected %d rules, got %d", len(rules), len(rs.Rules))
+		}
+		for i, rule := range rules {
+			if rs.Rules[i].String() != rule.String() {
+				t.Errorf("Rule %d: expected %s, got %s", i, rule, rs.Rules[i])
+			}
+		}
+		if _, ok := rs.Rules[1].(*sexp.List).Elements[1].(*sexp.List).Elements[0].(*starform.Range); !ok {
+			t.Errorf("Expected range star form to be restored")
+		}
+		if !reflect.DeepEqual(rs.Meta[1], meta[1]) {
+			t.Errorf("Expected meta %+v, got %+v", meta[1], rs.Meta[1])
+		}
+		if !reflect.DeepEqual(rs.TagIndex, map[string][]int{"http": {0, 3}, "file": {1}}) {
+			t.Errorf("Unexpected tag index: %v", rs.TagIndex)
+		}
+		if !reflect.DeepEqual(rs.AtomRules, []int{2}) {
+			t.Errorf("Unexpected atom rules: %v", rs.AtomRules)
+		}
+	}
+}
+
+func TestRulesetV2MemoryMap(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.spocp")
+	if err := SaveFile(filename, testRulesetRules(), FormatBinaryV2); err != nil {
+		t.Fatalf("SaveFile failed: %v", err)
+	}
+
+	opts := DefaultLoadOptions()
+	opts.MemoryMap = true
+	loaded, err := LoadFile(filename, opts)
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if len(loaded) != 4 || loaded[3].String() != "(4:http11:binary\x00data)" {
+		t.Errorf("Unexpected rules: %v", loaded)
+	}
+}
+
+func TestRulesetV2Corruption(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.spocp")
+	if err := SaveFile(filename, testRulesetRules(), FormatBinaryV2); err != nil {
+		t.Fatalf("SaveFile failed: %v", err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"flipped byte", flipLastByte(data), "checksum mismatch"},
+		{"truncated", data[:len(data)-3], "does not match header"},
+		{"short header", data[:10], "truncated header"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(filename, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadRuleset(filename, DefaultLoadOptions())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestRulesetV2BadIndex tests that a stored index that does not match
+// the rules is rejected
+func TestRulesetV2BadIndex(t *testing.T) {
+	rules := testRulesetRules() // http, file, admin, http
+	tests := []struct {
+		name      string
+		index     map[string][]int
+		atomRules []int
+	}{
+		{"wrong tag", map[string][]int{"http": {0, 1}, "file": {3}}, []int{2}},
+		{"missing rule", map[string][]int{"http": {0}, "file": {1}}, []int{2}},
+		{"list as atom", map[string][]int{"http": {0}, "file": {1}}, []int{2, 3}},
+		{"atom under tag", map[string][]int{"http": {0, 2, 3}, "file": {1}}, []int{}},
+		{"duplicate", map[string][]int{"http": {0, 0, 3}, "file": {1}}, []int{2}},
+	}
+
+	filename := filepath.Join(t.TempDir(), "rules.spocp")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := &Ruleset{Rules: rules, TagIndex: tt.index, AtomRules: tt.atomRules}
+			if err := SaveRuleset(filename, rs, BinaryOptions{}); err != nil {
+				t.Fatalf("SaveRuleset failed: %v", err)
+			}
+			if _, err := LoadRuleset(filename, DefaultLoadOptions()); err == nil {
+				t.Error("Expected the index to be rejected")
+			}
+		})
+	}
+}
+
+// TestInflateLimit tests that a compressed payload may not expand past
+// the limit
+func TestInflateLimit(t *testing.T) {
+	var compressed bytes.Buffer
+	fw, _ := flate.NewWriter(&compressed, flate.BestSpeed)
+	if _, err := fw.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := inflate(compressed.Bytes(), 1000); err != nil || len(data) != 1000 {
+		t.Errorf("Expected 1000 bytes, got %d, %v", len(data), err)
+	}
+	if _, err := inflate(compressed.Bytes(), 999); err == nil || !strings.Contains(err.Error(), "exceeds 999 bytes") {
+		t.Errorf("Expected the limit to be exceeded, got %v", err)
+	}
+}
+
+func flipLastByte(data []byte) []byte {
+	out := append([]byte(nil), data...)
+	out[len(out)-1] ^= 0xff
+	return out
+}
+
+func TestLoadRulesetFromV1AndText(t *testing.T) {
+	tmpDir := t.TempDir()
+	rules := []sexp.Element{
+		sexp.NewList("http", sexp.NewAtom("GET")),
+		sexp.NewAtom("admin"),
+	}
+
+	v1 := filepath.Join(tmpDir, "rules.bin")
+	if err := SaveFile(v1, rules, FormatBinary); err != nil {
+		t.Fatalf("SaveFile failed: %v", err)
+	}
+	text := writeRuleFile(t, tmpDir, "rules.spoc", "(4:http3:GET)\n5:admin\n")
+
+	for _, filename := range []string{v1, text} {
+		rs, err := LoadRuleset(filename, DefaultLoadOptions())
+		if err != nil {
+			t.Fatalf("LoadRuleset(%s) failed: %v", filename, err)
+		}
+		if len(rs.Rules) != 2 || !reflect.DeepEqual(rs.TagIndex, map[string][]int{"http": {0}}) ||
+			!reflect.DeepEqual(rs.AtomRules, []int{1}) {
+			t.Errorf("%s: unexpected ruleset %+v", filename, rs)
+		}
+	}
+}
+
+func BenchmarkLoadRulesetV2(b *testing.B) {
+	filename := filepath.Join(b.TempDir(), "bench.spocp")
+
+	rules := make([]sexp.Element, 100000)
+	for i := range rules {
+		rules[i] = sexp.NewList(fmt.Sprintf("svc%d", i%50),
+			sexp.NewList("user", sexp.NewAtom(fmt.Sprintf("user%d", i))),
+			sexp.NewList("action", sexp.NewAtom("read")),
+		)
+	}
+	SaveRuleset(filename, NewRuleset(rules, nil), BinaryOptions{})
+
+	opts := DefaultLoadOptions()
+	opts.MemoryMap = true
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		LoadRuleset(filename, opts)
+	}
+}
+
+func TestRulesetClone(t *testing.T) {
+	rs := NewRuleset(testRulesetRules(), nil)
+	clone := rs.Clone()
+	if !reflect.DeepEqual(rs.TagIndex, clone.TagIndex) || !reflect.DeepEqual(rs.AtomRules, clone.AtomRules) {
+		t.Fatal("Clone index differs")
+	}
+
+	// Changing the clone's index, as an engine does, leaves rs untouched
+	want := fmt.Sprint(rs.TagIndex)
+	clone.TagIndex["http"] = append(clone.TagIndex["http"], 99)
+	clone.TagIndex["new"] = []int{100}
+	clone.Rules = append(clone.Rules, sexp.NewAtom("extra"))
+	if got := fmt.Sprint(rs.TagIndex); got != want {
+		t.Errorf("Original index changed: %s, want %s", got, want)
+	}
+	if len(rs.Rules) != len(testRulesetRules()) {
+		t.Errorf("Original rules changed: %d", len(rs.Rules))
+	}
+}
@@ -0,0 +1,417 @@
+package persist
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// A bundle is a gzip-compressed tar archive holding a ruleset as one unit:
+//
+//	MANIFEST.json       format, version, revision, creation time and the
+//	                    path, size and SHA-256 of every other file
+//	MANIFEST.json.sig   optional signature over MANIFEST.json
+//	rules/*.spoc ...    rule files, include targets and template data
+//
+// Every rule file in the bundle (see IsRuleFile and IsRuleDocument) is
+// loaded, as for a rules directory, in manifest order. Includes and
+// template data files are resolved inside the bundle. Since the manifest
+// pins the hash of every file, a signature over the manifest covers the
+// whole bundle.
+
+// BundleFormat is the manifest format version written by SaveBundle
+const BundleFormat = 1
+
+const (
+	// ManifestName is the name of the manifest inside a bundle
+	ManifestName = "MANIFEST.json"
+
+	// ManifestSignatureName is the name of the manifest signature inside a bundle
+	ManifestSignatureName = "MANIFEST.json.sig"
+)
+
+// DefaultMaxBundleSize is the default for LoadOptions.MaxBundleSize. A
+// bundle is extracted into memory, and the limit is enforced while
+// extracting, before any signature is checked, so that an unverified
+// archive cannot exhaust memory.
+const DefaultMaxBundleSize = 1 << 30
+
+// tarBlockSize is the size of a tar header block
+const tarBlockSize = 512
+
+// Manifest describes the contents of a bundle
+type Manifest struct {
+	Format   int            `json:"format"`
+	Version  string         `json:"version"`
+	Revision string         `json:"revision"`
+	Created  time.Time      `json:"created"`
+	Files    []ManifestFile `json:"files"`
+}
+
+// ManifestFile is a file entry in a bundle manifest
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Bundle is a loaded bundle
+type Bundle struct {
+	Manifest Manifest
+
+	// Rules holds the rules of all rule files; Meta.File is the path
+	// inside the bundle
+	Rules []Rule
+
+	// Signed reports whether the bundle carried a signature that was verified
+	Signed bool
+}
+
+// Ruleset returns the rules of the bundle with a prebuilt index
+func (b *Bundle) Ruleset() *Ruleset {
+	elems := make([]sexp.Element, len(b.Rules))
+	meta := make([]RuleMeta, len(b.Rules))
+	for i, rule := range b.Rules {
+		elems[i] = rule.Element
+		meta[i] = rule.Meta
+	}
+	return NewRuleset(elems, meta)
+}
+
+// BundleOptions controls how bundles are written
+type BundleOptions struct {
+	// Version is a free-form policy version (e.g. "2.1.0")
+	Version string
+
+	// Revision identifies the exact policy revision (e.g. a commit hash)
+	Revision string
+
+	// Created is recorded in the manifest (default: now)
+	Created time.Time
+
+	// Sign, if set, returns a signature over the manifest, stored as
+	// MANIFEST.json.sig
+	Sign func(manifest []byte) ([]byte, error)
+}
+
+// SaveBundle writes every regular file below dir, except signature files,
+// into a bundle archive and returns its manifest
+func SaveBundle(filename, dir string, opts BundleOptions) (*Manifest, error) {
+	created := opts.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	manifest := &Manifest{
+		Format:   BundleFormat,
+		Version:  opts.Version,
+		Revision: opts.Revision,
+		Created:  created.UTC().Truncate(time.Second),
+	}
+
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(p, ".sig") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if name == ManifestName {
+			return nil
+		}
+		data, err := os.ReadFile(p) //nolint:gosec // bundle sources are chosen by the operator
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		files[name] = data
+		manifest.Files = append(manifest.Files, ManifestFile{
+			Path:   name,
+			Size:   int64(len(data)),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle sources: %w", err)
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	var signature []byte
+	if opts.Sign != nil {
+		if signature, err = opts.Sign(manifestData); err != nil {
+			return nil, fmt.Errorf("failed to sign manifest: %w", err)
+		}
+	}
+
+	// Nodes reloading the bundle must never see a partial archive
+	err = WriteFileAtomic(filename, SaveOptions{}, func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		add := func(name string, data []byte) error {
+			hdr := &tar.Header{
+				Name:    name,
+				Mode:    0644,
+				Size:    int64(len(data)),
+				ModTime: manifest.Created,
+				Format:  tar.FormatPAX,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := tw.Write(data)
+			return err
+		}
+
+		if err := add(ManifestName, manifestData); err != nil {
+			return err
+		}
+		if signature != nil {
+			if err := add(ManifestSignatureName, signature); err != nil {
+				return err
+			}
+		}
+		for _, f := range manifest.Files {
+			if err := add(f.Path, files[f.Path]); err != nil {
+				return err
+			}
+		}
+
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// LoadBundle reads a bundle, checks every file against the manifest and
+// loads its rules.
+//
+// If opts.VerifySignature is set and the bundle contains a manifest
+// signature, the signature is checked with it. Otherwise, if opts.Verify is
+// set, the archive as a whole is passed to it (for a detached signature
+// next to the bundle). If either is set, an unsigned bundle is rejected.
+func LoadBundle(filename string, opts LoadOptions) (*Bundle, error) {
+	opts.opened(filename)
+	archive, err := os.ReadFile(filename) //nolint:gosec // bundles are chosen by the operator
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	bundle, files, signature, err := readBundle(archive, opts.maxBundleSize())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	switch {
+	case signature != nil && opts.VerifySignature != nil:
+		if err := opts.VerifySignature(files[ManifestName], signature); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		bundle.Signed = true
+	case opts.Verify != nil:
+		if err := opts.Verify(filename, archive); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		bundle.Signed = true
+	case opts.VerifySignature != nil:
+		return nil, fmt.Errorf("%s: bundle is not signed", filename)
+	}
+
+	// The manifest hashes vouch for the files from here on
+	opts.Verify = nil
+	fsys := memFS(files)
+	var ruleFiles []string
+	for _, f := range bundle.Manifest.Files {
+		if IsRuleFile(f.Path) && IsRuleDocument(f.Path, files[f.Path]) {
+			ruleFiles = append(ruleFiles, f.Path)
+		}
+	}
+	// Included files are loaded where they are included
+	for _, name := range TopLevelFiles(fsys, ruleFiles, opts) {
+		l := newLoader(opts)
+		l.fsys = fsys
+		l.rules = bundle.Rules
+		l.count = len(bundle.Rules)
+		if err := l.loadFile(name); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		bundle.Rules = l.rules
+		if opts.MaxRules > 0 && len(bundle.Rules) >= opts.MaxRules {
+			break
+		}
+	}
+
+	return bundle, nil
+}
+
+// maxBundleSize returns the limit on the size extracted from a bundle
+func (opts LoadOptions) maxBundleSize() int64 {
+	if opts.MaxBundleSize > 0 {
+		return opts.MaxBundleSize
+	}
+	return DefaultMaxBundleSize
+}
+
+// readBundle extracts a bundle archive and checks it against its manifest.
+// The extracted files, counting a tar header block for each entry, must
+// not exceed limit bytes in total.
+func readBundle(archive []byte, limit int64) (*Bundle, map[string][]byte, []byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("not a bundle: %w", err)
+	}
+	defer gz.Close()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	var total int64
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("corrupt bundle: %w", err)
+		}
+		// Empty entries count too, or there could be any number of them
+		if total += tarBlockSize; total > limit || hdr.Size > limit-total {
+			return nil, nil, nil, fmt.Errorf("bundle exceeds %d bytes uncompressed", limit)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, nil, nil, fmt.Errorf("bundle entry %s is not a regular file", hdr.Name)
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if !fs.ValidPath(name) {
+			return nil, nil, nil, fmt.Errorf("invalid bundle entry name %q", hdr.Name)
+		}
+		if _, dup := files[name]; dup {
+			return nil, nil, nil, fmt.Errorf("duplicate bundle entry %s", name)
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, hdr.Size))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("corrupt bundle: %w", err)
+		}
+		total += int64(len(data))
+		files[name] = data
+	}
+
+	manifestData, ok := files[ManifestName]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("bundle has no %s", ManifestName)
+	}
+	bundle := &Bundle{}
+	if err := json.Unmarshal(manifestData, &bundle.Manifest); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if bundle.Manifest.Format != BundleFormat {
+		return nil, nil, nil, fmt.Errorf("unsupported bundle format %d", bundle.Manifest.Format)
+	}
+
+	listed := make(map[string]bool, len(bundle.Manifest.Files))
+	for _, f := range bundle.Manifest.Files {
+		data, ok := files[f.Path]
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("manifest file %s missing from bundle", f.Path)
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != f.Size || hex.EncodeToString(sum[:]) != f.SHA256 {
+			return nil, nil, nil, fmt.Errorf("bundle file %s does not match manifest", f.Path)
+		}
+		listed[f.Path] = true
+	}
+	for name := range files {
+		if !listed[name] && name != ManifestName && name != ManifestSignatureName {
+			return nil, nil, nil, fmt.Errorf("bundle file %s not listed in manifest", name)
+		}
+	}
+
+	return bundle, files, files[ManifestSignatureName], nil
+}
+
+// memFS is a read-only file system over the files of a bundle
+type memFS map[string][]byte
+
+func (m memFS) Open(name string) (fs.File, error) {
+	data, err := m.ReadFile(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.Unwrap(err)}
+	}
+	return &memFile{name: name, Reader: bytes.NewReader(data)}, nil
+}
+
+func (m memFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	data, ok := m[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	return data, nil
+}
+
+func (m memFS) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	var matches []string
+	for name := range m {
+		if ok, _ := path.Match(pattern, name); ok {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// memFile is an open memFS file
+type memFile struct {
+	name string
+	*bytes.Reader
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return memFileInfo{f}, nil }
+func (f *memFile) Close() error               { return nil }
+
+// memFileInfo describes a memFile
+type memFileInfo struct{ f *memFile }
+
+func (i memFileInfo) Name() string       { return path.Base(i.f.name) }
+func (i memFileInfo) Size() int64        { return i.f.Size() }
+func (i memFileInfo) Mode() fs.FileMode  { return 0444 }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() any           { return nil }
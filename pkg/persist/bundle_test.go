@@ -0,0 +1,250 @@
+package persist
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeBundleSources(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeRuleFile(t, dir, "rules/http.spoc", "include \"../common/base.inc\"\n(4:http4:POST)\n")
+	writeRuleFile(t, dir, "rules/roles.spoc", "template r (4:role2:$r)\ninstantiate r \"../data/roles.csv\"\n")
+	writeRuleFile(t, dir, "common/base.inc", "(4:http3:GET)\n")
+	writeRuleFile(t, dir, "data/roles.csv", "r\nadmin\nuser\n")
+	writeRuleFile(t, dir, "rules/http.spoc.sig", "ignored")
+	return dir
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	dir := writeBundleSources(t)
+	filename := filepath.Join(t.TempDir(), "policy.tar.gz")
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	manifest, err := SaveBundle(filename, dir, BundleOptions{Version: "1.2.0", Revision: "abc123", Created: created})
+	if err != nil {
+		t.Fatalf("SaveBundle failed: %v", err)
+	}
+	if len(manifest.Files) != 4 {
+		t.Fatalf("Expected 4 files in manifest, got %+v", manifest.Files)
+	}
+
+	bundle, err := LoadBundle(filename, DefaultLoadOptions())
+	if err != nil {
+		t.Fatalf("LoadBundle failed: %v", err)
+	}
+	if bundle.Manifest.Revision != "abc123" || bundle.Manifest.Version != "1.2.0" || !bundle.Manifest.Created.Equal(created) {
+		t.Errorf("Unexpected manifest: %+v", bundle.Manifest)
+	}
+	if bundle.Signed {
+		t.Error("Expected unsigned bundle")
+	}
+
+	want := []string{"(4:http3:GET)", "(4:http4:POST)", "(4:role5:admin)", "(4:role4:user)"}
+	if len(bundle.Rules) != len(want) {
+		t.Fatalf("Expected %d rules, got %d", len(want), len(bundle.Rules))
+	}
+	for i, w := range want {
+		if got := bundle.Rules[i].Element.String(); got != w {
+			t.Errorf("Rule %d: expected %s, got %s", i, w, got)
+		}
+	}
+	if bundle.Rules[0].Meta.File != "common/base.inc" {
+		t.Errorf("Expected bundle-relative file name, got %q", bundle.Rules[0].Meta.File)
+	}
+	if rs := bundle.Ruleset(); len(rs.TagIndex["http"]) != 2 {
+		t.Errorf("Unexpected ruleset index: %v", rs.TagIndex)
+	}
+}
+
+func TestBundleSignature(t *testing.T) {
+	dir := writeBundleSources(t)
+	filename := filepath.Join(t.TempDir(), "policy.tar.gz")
+
+	sign := func(data []byte) ([]byte, error) { return []byte("sig:" + string(data[:10])), nil }
+	if _, err := SaveBundle(filename, dir, BundleOptions{Revision: "r1", Sign: sign}); err != nil {
+		t.Fatalf("SaveBundle failed: %v", err)
+	}
+
+	opts := DefaultLoadOptions()
+	opts.VerifySignature = func(data, sig []byte) error {
+		if !strings.HasPrefix(string(sig), "sig:") {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	bundle, err := LoadBundle(filename, opts)
+	if err != nil {
+		t.Fatalf("LoadBundle failed: %v", err)
+	}
+	if !bundle.Signed {
+		t.Error("Expected bundle to be reported as signed")
+	}
+
+	opts.VerifySignature = func(data, sig []byte) error { return errors.New("untrusted") }
+	if _, err := LoadBundle(filename, opts); err == nil || !strings.Contains(err.Error(), "untrusted") {
+		t.Errorf("Expected signature error, got: %v", err)
+	}
+
+	// Unsigned bundles are rejected when verification is requested
+	unsigned := filepath.Join(t.TempDir(), "unsigned.tar.gz")
+	if _, err := SaveBundle(unsigned, dir, BundleOptions{}); err != nil {
+		t.Fatalf("SaveBundle failed: %v", err)
+	}
+	if _, err := LoadBundle(unsigned, opts); err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Errorf("Expected unsigned bundle to be rejected, got: %v", err)
+	}
+
+	// A detached signature over the archive is checked with Verify
+	opts.Verify = func(name string, data []byte) error { return nil }
+	if bundle, err := LoadBundle(unsigned, opts); err != nil || !bundle.Signed {
+		t.Errorf("Expected detached verification to be used, got: %v", err)
+	}
+}
+
+// writeTarGz writes an archive with the given entries in order
+func writeTarGz(t *testing.T, filename string, entries [][2]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e[0], Mode: 0644, Size: int64(len(e[1]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	gz.Close()
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBundleTampering(t *testing.T) {
+	manifest := `{"format":1,"revision":"r","files":[{"path":"a.spoc","size":9,"sha256":"` +
+		"c1a2b6b1a6b7c7b7c3a1f6e0a6e5a8d0a7e6f7d3c7b1a9e1f1a0b9c8d7e6f5a4" + `"}]}`
+
+	tests := []struct {
+		name    string
+		entries [][2]string
+		wantErr string
+	}{
+		{"no manifest", [][2]string{{"a.spoc", "(4:read)\n"}}, "has no MANIFEST.json"},
+		{"hash mismatch", [][2]string{{ManifestName, manifest}, {"a.spoc", "(4:read)\n"}}, "does not match manifest"},
+		{"missing file", [][2]string{{ManifestName, manifest}}, "missing from bundle"},
+		{"unlisted file", [][2]string{{ManifestName, `{"format":1,"files":[]}`}, {"x.spoc", "(1:x)"}}, "not listed"},
+		{"bad path", [][2]string{{"../evil.spoc", "(1:x)"}}, "invalid bundle entry"},
+		{"unknown format", [][2]string{{ManifestName, `{"format":9}`}}, "unsupported bundle format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "b.tar.gz")
+			writeTarGz(t, filename, tt.entries)
+			_, err := LoadBundle(filename, DefaultLoadOptions())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBundleIncludeEscape(t *testing.T) {
+	dir := t.TempDir()
+	writeRuleFile(t, dir, "main.spoc", "include \"../outside.spoc\"\n")
+	filename := filepath.Join(t.TempDir(), "b.tar.gz")
+	if _, err := SaveBundle(filename, dir, BundleOptions{}); err != nil {
+		t.Fatalf("SaveBundle failed: %v", err)
+	}
+	if _, err := LoadBundle(filename, DefaultLoadOptions()); err == nil {
+		t.Error("Expected include outside the bundle to fail")
+	}
+}
+
+// TestBundleIncludedRuleFile tests that a rule file included by another
+// one is loaded only where it is included
+func TestBundleIncludedRuleFile(t *testing.T) {
+	dir := t.TempDir()
+	writeRuleFile(t, dir, "main.spoc", "include \"http.d/*.spoc\"\n(5:admin)\n")
+	writeRuleFile(t, dir, "http.d/get.spoc", "(4:http3:GET)\n")
+	filename := filepath.Join(t.TempDir(), "b.tar.gz")
+	if _, err := SaveBundle(filename, dir, BundleOptions{}); err != nil {
+		t.Fatalf("SaveBundle failed: %v", err)
+	}
+	bundle, err := LoadBundle(filename, DefaultLoadOptions())
+	if err != nil {
+		t.Fatalf("LoadBundle failed: %v", err)
+	}
+	if len(bundle.Rules) != 2 {
+		t.Errorf("Expected 2 rules, got %d", len(bundle.Rules))
+	}
+}
+
+// TestBundleSizeLimit tests that extraction stops at the size limit,
+// before a signature is checked
+func TestBundleSizeLimit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "b.tar.gz")
+	if _, err := SaveBundle(filename, writeBundleSources(t), BundleOptions{}); err != nil {
+		t.Fatalf("SaveBundle failed: %v", err)
+	}
+	archive, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, files, _, err := readBundle(archive, DefaultMaxBundleSize)
+	if err != nil {
+		t.Fatalf("readBundle failed: %v", err)
+	}
+	size := int64(0)
+	for _, data := range files {
+		size += tarBlockSize + int64(len(data))
+	}
+	if _, _, _, err := readBundle(archive, size); err != nil {
+		t.Errorf("Expected a bundle of exactly the limit to load, got: %v", err)
+	}
+	if _, _, _, err := readBundle(archive, size-1); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("Expected the limit to be enforced, got: %v", err)
+	}
+
+	// The limit can be set through the load options
+	opts := DefaultLoadOptions()
+	opts.MaxBundleSize = size
+	if _, err := LoadBundle(filename, opts); err != nil {
+		t.Errorf("Expected a bundle within MaxBundleSize to load, got: %v", err)
+	}
+	opts.MaxBundleSize = size - 1
+	if _, err := LoadBundle(filename, opts); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("Expected MaxBundleSize to be enforced, got: %v", err)
+	}
+
+	// An entry claiming more than the limit is refused from its header
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "huge.spoc", Mode: 0644, Size: DefaultMaxBundleSize}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Flush()
+	gz.Close()
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts = DefaultLoadOptions()
+	opts.Verify = func(string, []byte) error {
+		t.Error("Expected no verification of an oversized bundle")
+		return nil
+	}
+	if _, err := LoadBundle(filename, opts); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("Expected an oversized bundle to be refused, got: %v", err)
+	}
+}
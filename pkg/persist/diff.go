@@ -0,0 +1,177 @@
+package persist
+
+import (
+	"github.com/sirosfoundation/go-spocp/pkg/compare"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// RuleDiff is the difference between two rulesets. Rules are compared by
+// their canonical form; a rule present several times is matched once per
+// copy.
+type RuleDiff struct {
+	// Added holds the rules only in the new ruleset, in its order
+	Added []sexp.Element
+
+	// Removed holds the rules only in the old ruleset, in its order
+	Removed []sexp.Element
+
+	// Unchanged holds the rules in both rulesets, in the new order
+	Unchanged []sexp.Element
+
+	// Changes holds the permission impact of the added and removed rules
+	// if DiffOptions.Semantic was set
+	Changes []RuleChange
+}
+
+// Equal reports whether both rulesets hold the same rules
+func (d *RuleDiff) Equal() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+// Impact classifies how a rule change affects what is granted
+type Impact int
+
+const (
+	// ImpactEquivalent: a removed and an added rule grant the same
+	ImpactEquivalent Impact = iota
+	// ImpactWidened: an added rule grants strictly more than a removed one
+	ImpactWidened
+	// ImpactNarrowed: an added rule grants strictly less than a removed one
+	ImpactNarrowed
+	// ImpactGranted: an added rule grants what no old rule granted
+	ImpactGranted
+	// ImpactRevoked: a removed rule granted what no new rule grants
+	ImpactRevoked
+)
+
+// String returns the name of the impact
+func (i Impact) String() string {
+	switch i {
+	case ImpactEquivalent:
+		return "equivalent"
+	case ImpactWidened:
+		return "widened"
+	case ImpactNarrowed:
+		return "narrowed"
+	case ImpactGranted:
+		return "granted"
+	case ImpactRevoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// RuleChange is the permission impact of an added or removed rule
+type RuleChange struct {
+	Impact Impact
+
+	// Old is the removed rule; nil for ImpactGranted
+	Old sexp.Element
+
+	// New is the added rule; nil for ImpactRevoked
+	New sexp.Element
+}
+
+// DiffOptions controls how rulesets are compared
+type DiffOptions struct {
+	// Semantic relates added and removed rules by the permissions they
+	// grant (see compare.LessPermissive) and fills RuleDiff.Changes.
+	// This compares every added rule with every removed and old rule.
+	Semantic bool
+}
+
+// Diff compares two rulesets by canonical form
+func Diff(old, new []sexp.Element) *RuleDiff {
+	return DiffWithOptions(old, new, DiffOptions{})
+}
+
+// DiffWithOptions compares two rulesets
+func DiffWithOptions(old, new []sexp.Element, opts DiffOptions) *RuleDiff {
+	d := &RuleDiff{}
+
+	oldCount := countRules(old)
+	for _, rule := range new {
+		key := rule.String()
+		if oldCount[key] > 0 {
+			oldCount[key]--
+			d.Unchanged = append(d.Unchanged, rule)
+		} else {
+			d.Added = append(d.Added, rule)
+		}
+	}
+
+	newCount := countRules(new)
+	for _, rule := range old {
+		key := rule.String()
+		if newCount[key] > 0 {
+			newCount[key]--
+		} else {
+			d.Removed = append(d.Removed, rule)
+		}
+	}
+
+	if opts.Semantic {
+		d.Changes = semanticChanges(old, new, d.Added, d.Removed)
+	}
+	return d
+}
+
+// countRules counts the copies of every rule by canonical form
+func countRules(rules []sexp.Element) map[string]int {
+	counts := make(map[string]int, len(rules))
+	for _, rule := range rules {
+		counts[rule.String()]++
+	}
+	return counts
+}
+
+// semanticChanges relates every added rule to the removed rules it can be
+// compared with. Added rules comparable with none grant new permissions
+// unless an old rule already covered them; removed rules comparable with
+// none revoke permissions unless a new rule still covers them.
+func semanticChanges(old, new, added, removed []sexp.Element) []RuleChange {
+	var changes []RuleChange
+	paired := make([]bool, len(removed))
+	for _, a := range added {
+		found := false
+		for i, r := range removed {
+			narrower := compare.LessPermissive(a, r)
+			wider := compare.LessPermissive(r, a)
+			var impact Impact
+			switch {
+			case narrower && wider:
+				impact = ImpactEquivalent
+			case wider:
+				impact = ImpactWidened
+			case narrower:
+				impact = ImpactNarrowed
+			default:
+				continue
+			}
+			changes = append(changes, RuleChange{Impact: impact, Old: r, New: a})
+			paired[i] = true
+			found = true
+		}
+		if !found && !coveredBy(a, old) {
+			changes = append(changes, RuleChange{Impact: ImpactGranted, New: a})
+		}
+	}
+
+	for i, r := range removed {
+		if !paired[i] && !coveredBy(r, new) {
+			changes = append(changes, RuleChange{Impact: ImpactRevoked, Old: r})
+		}
+	}
+	return changes
+}
+
+// coveredBy reports whether one of rules grants at least what rule grants
+func coveredBy(rule sexp.Element, rules []sexp.Element) bool {
+	for _, r := range rules {
+		if compare.LessPermissive(rule, r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package persist
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+	"github.com/sirosfoundation/go-spocp/pkg/starform"
+)
+
+func ruleStrings(rules []sexp.Element) []string {
+	s := make([]string, len(rules))
+	for i, r := range rules {
+		s[i] = r.String()
+	}
+	return s
+}
+
+func TestDiff(t *testing.T) {
+	old := parseRules(t, []string{"(1:a)", "(1:b)", "(1:b)", "(1:c)"})
+	new := parseRules(t, []string{"(1:d)", "(1:b)", "(1:a)"})
+
+	d := Diff(old, new)
+	if got := ruleStrings(d.Added); !reflect.DeepEqual(got, []string{"(1:d)"}) {
+		t.Errorf("Added: got %v", got)
+	}
+	if got := ruleStrings(d.Removed); !reflect.DeepEqual(got, []string{"(1:b)", "(1:c)"}) {
+		t.Errorf("Removed: got %v", got)
+	}
+	if got := ruleStrings(d.Unchanged); !reflect.DeepEqual(got, []string{"(1:b)", "(1:a)"}) {
+		t.Errorf("Unchanged: got %v", got)
+	}
+	if d.Equal() || d.Changes != nil {
+		t.Errorf("Expected a plain diff with changes, got %+v", d)
+	}
+
+	if d := Diff(old, old); !d.Equal() || len(d.Unchanged) != len(old) {
+		t.Errorf("Expected equal rulesets, got %+v", d)
+	}
+}
+
+func TestDiffSemantic(t *testing.T) {
+	old := parseRules(t, []string{
+		"(4:http(4:page10:index.html)(6:action3:GET))", // widened to any action
+		"(4:file(4:path4:/etc)(6:action))",             // narrowed to reading
+		"(3:ssh(4:host3:db1))",                         // widened to any host
+		"(3:ssh(4:host3:web))",                         // widened to any host
+		"(4:mail(4:user))",                             // covers the new mail rule
+		"(3:dns(8:resolver)(5:zones))",                 // revoked
+	})
+	new := parseRules(t, []string{
+		"(4:http(4:page10:index.html)(6:action))",
+		"(4:file(4:path4:/etc)(6:action4:read))",
+		"(3:ssh(4:host))",
+		"(4:mail(4:user))",
+		"(4:mail(4:user5:alice))", // covered by the old mail rule
+		"(3:ftp)",                 // granted
+	})
+
+	// A one-element set grants the same as its element
+	set := &starform.Set{Elements: []sexp.Element{sexp.NewAtom("hall")}}
+	old = append(old, sexp.NewList("print", sexp.NewList("printer", set)))
+	new = append(new, sexp.NewList("print", sexp.NewList("printer", sexp.NewAtom("hall"))))
+
+	d := DiffWithOptions(old, new, DiffOptions{Semantic: true})
+	got := make(map[string]Impact)
+	for _, c := range d.Changes {
+		key := ""
+		if c.Old != nil {
+			key += c.Old.String()
+		}
+		key += " -> "
+		if c.New != nil {
+			key += c.New.String()
+		}
+		got[key] = c.Impact
+	}
+
+	want := map[string]Impact{
+		"(4:http(4:page10:index.html)(6:action3:GET)) -> (4:http(4:page10:index.html)(6:action))": ImpactWidened,
+		"(4:file(4:path4:/etc)(6:action)) -> (4:file(4:path4:/etc)(6:action4:read))":              ImpactNarrowed,
+		"(3:ssh(4:host3:db1)) -> (3:ssh(4:host))":                                                 ImpactWidened,
+		"(3:ssh(4:host3:web)) -> (3:ssh(4:host))":                                                 ImpactWidened,
+		"(3:dns(8:resolver)(5:zones)) -> ":                                                        ImpactRevoked,
+		" -> (3:ftp)":                                                                             ImpactGranted,
+		"(5:print(7:printer(1:*3:set4:hall))) -> (5:print(7:printer4:hall))":                      ImpactEquivalent,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected changes:\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestImpactString(t *testing.T) {
+	for impact, want := range map[Impact]string{
+		ImpactEquivalent: "equivalent",
+		ImpactWidened:    "widened",
+		ImpactNarrowed:   "narrowed",
+		ImpactGranted:    "granted",
+		ImpactRevoked:    "revoked",
+		Impact(99):       "unknown",
+	} {
+		if got := impact.String(); got != want {
+			t.Errorf("%d: expected %q, got %q", impact, want, got)
+		}
+	}
+}
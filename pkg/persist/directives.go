@@ -0,0 +1,964 @@
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// Text rule files are read statement by statement rather than line by line.
+// A statement is either a rule or one of the following directives:
+//
+//	include "other.spoc"      load the rules of another file
+//	include "rules.d/*.spoc"  load every file matching a glob pattern, in lexical order
+//	define NAME <sexp>        bind NAME to an S-expression
+//	$name = <sexp>            bind the variable $name to an S-expression
+//	template NAME <sexp>      declare a rule template with $param placeholders
+//	instantiate NAME "x.csv"  emit one rule per row of a CSV or JSON data file
+//
+// A rule (or the S-expression of a define) may span several lines: the
+// statement ends at the end of the line on which its parentheses balance.
+// Text following the closing parenthesis on that line is ignored, and whole
+// comment lines may appear inside a statement.
+//
+// Included paths are relative to the including file. Include cycles are
+// reported as errors. A define is referenced as $NAME in later rules, like a
+// variable, and both are replaced by the bound S-expression; other atoms are
+// never replaced, so a define may share its name with an atom. Templates are
+// described in template.go.
+
+// ParseError reports a problem in a rule file together with its location.
+type ParseError struct {
+	File string // empty when loading from a reader
+	Line int
+	Col  int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("%d:%d: %v", e.Line, e.Col, e.Err)
+	}
+	return fmt.Sprintf("%s:%d:%d: %v", e.File, e.Line, e.Col, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// defineName matches valid names for the define and template directives
+	defineName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+	// variableName matches valid names for variables and template parameters
+	variableName = regexp.MustCompile(`^\$[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+type statementKind int
+
+const (
+	stmtRule statementKind = iota
+	stmtDefine
+	stmtInclude
+	stmtVariable
+	stmtTemplate
+	stmtInstantiate
+)
+
+// position is a 1-based line and column in a rule file
+type position struct {
+	line int
+	col  int
+}
+
+// statement is one complete rule or directive read from a rule file
+type statement struct {
+	kind  statementKind
+	name  string    // define, variable or template name
+	path  string    // include or instantiate data path
+	text  string    // S-expression text with insignificant whitespace removed
+	runs  []textRun // source positions of text
+	last  position  // source position of the last byte of text
+	start position
+}
+
+// textRun maps the bytes of statement text from offset off on to
+// consecutive columns starting at pos, so positions take memory per line
+// rather than per byte
+type textRun struct {
+	off int
+	pos position
+}
+
+// posAt returns the source position of byte offset off in the statement text
+func (st *statement) posAt(off int) position {
+	if len(st.runs) == 0 {
+		return st.start
+	}
+	if off >= len(st.text) {
+		off = len(st.text) - 1
+	}
+	if off < 0 {
+		off = 0
+	}
+	i := sort.Search(len(st.runs), func(i int) bool { return st.runs[i].off > off }) - 1
+	run := st.runs[i]
+	return position{line: run.pos.line, col: run.pos.col + off - run.off}
+}
+
+// statementReader splits a rule file into statements, tracking parenthesis
+// depth and canonical atom lengths so that rules may span lines. Lines may
+// be of any length.
+//
+// With SkipInvalid, a statement that does not balance is dropped rather
+// than ending the file: reading resumes on the line after its first line,
+// at the next line that starts in the first column, so that a missing
+// parenthesis does not swallow the rules after it.
+type statementReader struct {
+	reader   *bufio.Reader
+	comments []string
+	advanced bool
+	line     int
+
+	// recover is set with SkipInvalid. lines holds the lines of the
+	// current statement so they can be read again after it fails, from
+	// pending, and skipping is set until a line starts a statement again.
+	recover  bool
+	lines    []string
+	pending  []string
+	skipping bool
+
+	// per-statement state
+	st        *statement
+	text      strings.Builder
+	depth     int
+	inAtom    int  // bytes of canonical atom payload still to consume
+	num       int  // pending canonical length prefix
+	numActive bool // whether num holds a length prefix in progress
+	inQuote   bool // inside a quoted token (advanced form)
+	done      bool
+}
+
+func newStatementReader(r io.Reader, opts LoadOptions) *statementReader {
+	return &statementReader{
+		reader:   bufio.NewReader(r),
+		comments: opts.Comments,
+		advanced: opts.Format == FormatAdvanced,
+		recover:  opts.SkipInvalid,
+	}
+}
+
+// next returns the next statement, or io.EOF when the input is exhausted.
+// Errors are returned as *ParseError without a file name.
+func (sr *statementReader) next() (*statement, error) {
+	for {
+		st, err := sr.read()
+		if _, ok := err.(*ParseError); !ok || !sr.recover {
+			return st, err
+		}
+		sr.skip()
+	}
+}
+
+// skip drops the statement being read after an error and arranges for
+// reading to resume after its first line
+func (sr *statementReader) skip() {
+	if len(sr.lines) > 1 {
+		sr.pending = append(sr.lines[1:len(sr.lines):len(sr.lines)], sr.pending...)
+	}
+	sr.line = sr.st.start.line
+	sr.lines = nil
+	sr.st = nil
+	sr.skipping = true
+}
+
+// read returns the next statement as next does, without recovering from
+// errors
+func (sr *statementReader) read() (*statement, error) {
+	for {
+		line, err := sr.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading file: %w", err)
+		}
+		sr.line++
+
+		if sr.st == nil {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" || isComment(trimmed, sr.comments) {
+				continue
+			}
+			if sr.skipping {
+				if line[0] == ' ' || line[0] == '\t' {
+					continue
+				}
+				sr.skipping = false
+			}
+			if sr.recover {
+				sr.lines = append(sr.lines[:0], line)
+			}
+			col := len(line) - len(strings.TrimLeft(line, " \t")) + 1
+			sr.begin(position{line: sr.line, col: col})
+
+			st, err := sr.startStatement(line[col-1:], col)
+			if err != nil {
+				return nil, err
+			}
+			if st != nil {
+				return st, nil
+			}
+		} else {
+			if sr.recover {
+				sr.lines = append(sr.lines, line)
+			}
+			trimmed := strings.TrimSpace(line)
+			if sr.inAtom == 0 && !sr.inQuote && isComment(trimmed, sr.comments) {
+				continue
+			}
+			sr.newline()
+			if err := sr.feed(line, 1); err != nil {
+				return nil, err
+			}
+		}
+
+		if sr.done || (sr.depth == 0 && sr.inAtom == 0 && !sr.inQuote && sr.text.Len() > 0) {
+			return sr.finish(), nil
+		}
+	}
+
+	if sr.st != nil {
+		start := sr.st.start
+		return nil, &ParseError{Line: start.line, Col: start.col, Err: fmt.Errorf("unterminated statement: unbalanced parentheses")}
+	}
+	return nil, io.EOF
+}
+
+// startStatement handles the first line of a statement, recognizing
+// directives. It returns the statement if the directive is complete.
+func (sr *statementReader) startStatement(body string, col int) (*statement, error) {
+	if strings.HasPrefix(body, "$") {
+		name, expr, ok := splitAssignment(body)
+		if !ok || !variableName.MatchString(name) {
+			return nil, &ParseError{Line: sr.line, Col: col, Err: fmt.Errorf("invalid variable assignment")}
+		}
+		sr.st.kind = stmtVariable
+		sr.st.name = name
+		return nil, sr.feed(expr, col+len(body)-len(expr))
+	}
+
+	keyword, rest, ok := splitDirective(body)
+	if !ok {
+		return nil, sr.feed(body, col)
+	}
+
+	restCol := col + len(body) - len(rest)
+	switch keyword {
+	case "include":
+		path, err := parseIncludePath(rest)
+		if err != nil {
+			return nil, &ParseError{Line: sr.line, Col: restCol, Err: err}
+		}
+		sr.st.kind = stmtInclude
+		sr.st.path = path
+	case "instantiate":
+		name, arg := splitField(rest)
+		if !defineName.MatchString(name) {
+			return nil, &ParseError{Line: sr.line, Col: restCol, Err: fmt.Errorf("invalid template name %q", name)}
+		}
+		path, err := parseIncludePath(arg)
+		if err != nil {
+			return nil, &ParseError{Line: sr.line, Col: restCol + len(rest) - len(arg), Err: err}
+		}
+		sr.st.kind = stmtInstantiate
+		sr.st.name = name
+		sr.st.path = path
+	default: // define, template
+		name, expr := splitField(rest)
+		if !defineName.MatchString(name) {
+			return nil, &ParseError{Line: sr.line, Col: restCol, Err: fmt.Errorf("invalid %s name %q", keyword, name)}
+		}
+		sr.st.kind = stmtDefine
+		if keyword == "template" {
+			sr.st.kind = stmtTemplate
+		}
+		sr.st.name = name
+		return nil, sr.feed(expr, restCol+len(rest)-len(expr))
+	}
+
+	st := sr.st
+	sr.st = nil
+	return st, nil
+}
+
+// readLine returns the next line without its line ending, or io.EOF
+func (sr *statementReader) readLine() (string, error) {
+	if len(sr.pending) > 0 {
+		line := sr.pending[0]
+		sr.pending = sr.pending[1:]
+		return line, nil
+	}
+	line, err := sr.reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), nil
+}
+
+func (sr *statementReader) begin(start position) {
+	sr.st = &statement{kind: stmtRule, start: start}
+	sr.text.Reset()
+	sr.depth = 0
+	sr.inAtom = 0
+	sr.num = 0
+	sr.numActive = false
+	sr.inQuote = false
+	sr.done = false
+}
+
+func (sr *statementReader) finish() *statement {
+	st := sr.st
+	st.text = sr.text.String()
+	sr.st = nil
+	return st
+}
+
+func (sr *statementReader) write(b byte, pos position) {
+	st := sr.st
+	if len(st.runs) == 0 || pos.line != st.last.line || pos.col != st.last.col+1 {
+		st.runs = append(st.runs, textRun{off: sr.text.Len(), pos: pos})
+	}
+	st.last = pos
+	sr.text.WriteByte(b)
+}
+
+// newline accounts for the line break between two lines of a statement
+func (sr *statementReader) newline() {
+	pos := position{line: sr.line - 1, col: 1}
+	if len(sr.st.runs) > 0 {
+		pos = sr.st.last
+	}
+	switch {
+	case sr.inAtom > 0:
+		sr.write('\n', pos)
+		sr.inAtom--
+	case sr.advanced:
+		sr.write(' ', pos)
+	}
+}
+
+// feed consumes one line segment starting at column col
+func (sr *statementReader) feed(segment string, col int) error {
+	for i := 0; i < len(segment) && !sr.done; i++ {
+		b := segment[i]
+		pos := position{line: sr.line, col: col + i}
+
+		if sr.inAtom > 0 {
+			sr.write(b, pos)
+			sr.inAtom--
+			continue
+		}
+
+		if sr.advanced {
+			if b == '"' {
+				sr.inQuote = !sr.inQuote
+			}
+			if sr.inQuote || b == '"' {
+				sr.write(b, pos)
+				continue
+			}
+			if b == '\t' || b == '\r' {
+				b = ' '
+			}
+		} else {
+			switch {
+			case b == ' ' || b == '\t' || b == '\r':
+				continue
+			case b >= '0' && b <= '9':
+				if !sr.numActive {
+					sr.num = 0
+					sr.numActive = true
+				}
+				if sr.num < 1<<30 {
+					sr.num = sr.num*10 + int(b-'0')
+				}
+				sr.write(b, pos)
+				continue
+			case b == ':' && sr.numActive:
+				sr.numActive = false
+				sr.inAtom = sr.num
+				sr.write(b, pos)
+				continue
+			}
+			sr.numActive = false
+		}
+
+		switch b {
+		case '(':
+			sr.depth++
+		case ')':
+			sr.depth--
+			if sr.depth < 0 {
+				return &ParseError{Line: pos.line, Col: pos.col, Err: fmt.Errorf("unexpected ')'")}
+			}
+			if sr.depth == 0 {
+				sr.done = true
+			}
+		}
+		sr.write(b, pos)
+	}
+	return nil
+}
+
+// splitDirective recognizes a leading directive keyword
+func splitDirective(body string) (keyword, rest string, ok bool) {
+	for _, kw := range []string{"include", "define", "template", "instantiate"} {
+		if len(body) > len(kw) && strings.HasPrefix(body, kw) && (body[len(kw)] == ' ' || body[len(kw)] == '\t') {
+			return kw, strings.TrimLeft(body[len(kw):], " \t"), true
+		}
+	}
+	return "", "", false
+}
+
+// splitAssignment splits "$name = expr" into name and expression
+func splitAssignment(body string) (name, expr string, ok bool) {
+	eq := strings.IndexByte(body, '=')
+	if eq < 0 {
+		return "", "", false
+	}
+	return strings.TrimRight(body[:eq], " \t"), strings.TrimLeft(body[eq+1:], " \t"), true
+}
+
+// splitField splits off the first whitespace-delimited field
+func splitField(s string) (field, rest string) {
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimLeft(s[i:], " \t")
+	}
+	return s, ""
+}
+
+// parseIncludePath extracts the (optionally quoted) path argument of an include
+func parseIncludePath(arg string) (string, error) {
+	arg = strings.TrimSpace(arg)
+	if strings.HasPrefix(arg, `"`) {
+		quoted, err := strconv.QuotedPrefix(arg)
+		if err != nil {
+			return "", fmt.Errorf("invalid include path %s", arg)
+		}
+		path, _ := strconv.Unquote(quoted) //nolint:errcheck // validated by QuotedPrefix
+		if path == "" {
+			return "", fmt.Errorf("empty include path")
+		}
+		return path, nil
+	}
+	path, _ := splitField(arg)
+	if path == "" {
+		return "", fmt.Errorf("include requires a path")
+	}
+	return path, nil
+}
+
+// loader reads rule files, following includes and expanding defines,
+// variables and templates
+type loader struct {
+	opts      LoadOptions
+	fsys      fs.FS                   // file system to read from; nil for the OS file system
+	vars      map[string]sexp.Element // variables and defines, by reference
+	templates map[string]*template
+	stack     []string // files currently being loaded, for cycle detection
+	rules     []Rule
+	count     int // rules loaded
+
+	// emit, if set, receives each rule instead of rules
+	emit func(Rule) error
+
+	// input counts the bytes read from the top-level file for progress
+	// reports
+	input *countingReader
+}
+
+func newLoader(opts LoadOptions) *loader {
+	return &loader{
+		opts:      opts,
+		vars:      make(map[string]sexp.Element),
+		templates: make(map[string]*template),
+		rules:     make([]Rule, 0),
+	}
+}
+
+// elements returns the loaded rules without metadata
+func (l *loader) elements() []sexp.Element {
+	elems := make([]sexp.Element, len(l.rules))
+	for i, rule := range l.rules {
+		elems[i] = rule.Element
+	}
+	return elems
+}
+
+// full reports whether the MaxRules limit has been reached
+func (l *loader) full() bool {
+	return l.opts.MaxRules > 0 && l.count >= l.opts.MaxRules
+}
+
+// add records a loaded rule, passing it to emit if set
+func (l *loader) add(rule Rule) error {
+	l.count++
+	if l.opts.Progress != nil && l.count%l.progressInterval() == 0 {
+		l.opts.Progress(l.progress())
+	}
+	if l.emit != nil {
+		return l.emit(rule)
+	}
+	l.rules = append(l.rules, rule)
+	return nil
+}
+
+// loadFile loads a rule file, detecting binary, JSON and YAML files by
+// extension
+func (l *loader) loadFile(filename string) error {
+	abs, err := l.canonical(filename)
+	if err != nil {
+		return err
+	}
+	for i, f := range l.stack {
+		if f == abs {
+			cycle := append(append([]string{}, l.stack[i:]...), abs)
+			return fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	l.stack = append(l.stack, abs)
+	defer func() { l.stack = l.stack[:len(l.stack)-1] }()
+
+	if isBinaryFile(filename) {
+		return l.loadBinaryFile(filename)
+	}
+	if format, ok := structuredFormat(filename, l.opts.Format); ok {
+		return l.loadStructuredFile(filename, format)
+	}
+
+	file, err := l.open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if len(l.stack) == 1 && l.opts.Progress != nil {
+		return l.loadReader(l.track(file), filename)
+	}
+	return l.loadReader(file, filename)
+}
+
+// canonical returns the name identifying a file for cycle detection
+func (l *loader) canonical(filename string) (string, error) {
+	if l.fsys != nil {
+		return path.Clean(filename), nil
+	}
+	return filepath.Abs(filename)
+}
+
+// open opens a rule or data file, verifying it if requested
+func (l *loader) open(filename string) (io.ReadCloser, error) {
+	if l.fsys == nil {
+		return openVerified(filename, l.opts)
+	}
+	if l.opts.Verify == nil {
+		l.opts.opened(filename)
+		file, err := l.fsys.Open(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file: %w", err)
+		}
+		return file, nil
+	}
+	data, err := l.readFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// readFile reads a whole file, verifying it if requested
+func (l *loader) readFile(filename string) ([]byte, error) {
+	if l.fsys == nil {
+		file, err := openVerified(filename, l.opts)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return io.ReadAll(file)
+	}
+	l.opts.opened(filename)
+	data, err := fs.ReadFile(l.fsys, filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	if l.opts.Verify != nil {
+		if err := l.opts.Verify(filename, data); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	return data, nil
+}
+
+// resolve interprets a path named in filename relative to that file
+func (l *loader) resolve(filename, name string) string {
+	if l.fsys != nil {
+		return path.Join(path.Dir(filename), name)
+	}
+	return resolvePath(filename, name)
+}
+
+// glob returns the files matching pattern
+func (l *loader) glob(pattern string) ([]string, error) {
+	if l.fsys != nil {
+		return fs.Glob(l.fsys, pattern)
+	}
+	return filepath.Glob(pattern)
+}
+
+// loadBinaryFile appends the rules of a binary file, keeping stored metadata
+func (l *loader) loadBinaryFile(filename string) error {
+	var rs *Ruleset
+	var err error
+	if l.fsys == nil {
+		rs, err = loadBinaryFile(filename, l.opts)
+	} else {
+		var data []byte
+		if data, err = l.readFile(filename); err == nil {
+			rs, err = decodeBinary(data)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	for i, rule := range rs.Rules {
+		if l.full() {
+			break
+		}
+		meta := RuleMeta{File: filename}
+		if rs.Meta != nil {
+			meta = rs.Meta[i]
+		}
+		if err := l.add(Rule{Element: rule, Meta: meta}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadReader loads rules from text; filename is used for error messages and
+// to resolve relative paths (empty for anonymous readers)
+func (l *loader) loadReader(r io.Reader, filename string) error {
+	sr := newStatementReader(r, l.opts)
+
+	for !l.full() {
+		st, err := sr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if pe, ok := err.(*ParseError); ok {
+				pe.File = filename
+			}
+			return err
+		}
+
+		if err := l.statement(filename, st); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// statement processes one rule or directive
+func (l *loader) statement(filename string, st *statement) error {
+	errorf := func(format string, args ...any) error {
+		return &ParseError{File: filename, Line: st.start.line, Col: st.start.col, Err: fmt.Errorf(format, args...)}
+	}
+
+	switch st.kind {
+	case stmtInclude:
+		return l.include(filename, st)
+
+	case stmtInstantiate:
+		return l.instantiate(filename, st)
+
+	case stmtDefine, stmtVariable:
+		elem, err := l.parse(filename, st)
+		if err != nil {
+			return err
+		}
+		name := st.name
+		if st.kind == stmtDefine {
+			name = "$" + name
+		}
+		if _, exists := l.vars[name]; exists {
+			return errorf("%s is already defined", name)
+		}
+		expanded, err := l.expand(elem, nil)
+		if err != nil {
+			return errorf("%v", err)
+		}
+		l.vars[name] = expanded
+
+	case stmtTemplate:
+		elem, err := l.parse(filename, st)
+		if err != nil {
+			return err
+		}
+		if _, exists := l.templates[st.name]; exists {
+			return errorf("template %s is already defined", st.name)
+		}
+		l.templates[st.name] = newTemplate(st.name, elem, filename, st.start.line)
+
+	default:
+		elem, err := l.parse(filename, st)
+		if err != nil {
+			if l.opts.SkipInvalid {
+				return nil
+			}
+			return err
+		}
+		expanded, err := l.expand(elem, nil)
+		if err != nil {
+			if l.opts.SkipInvalid {
+				return nil
+			}
+			return errorf("%v", err)
+		}
+		return l.add(Rule{
+			Element: expanded,
+			Meta:    RuleMeta{File: filename, Line: st.start.line},
+		})
+	}
+
+	return nil
+}
+
+// resolvePath resolves a path named in a rule file relative to that file
+func resolvePath(filename, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(filename), path)
+}
+
+// include loads every file named by an include directive
+func (l *loader) include(filename string, st *statement) error {
+	target := l.resolve(filename, st.path)
+
+	files := []string{target}
+	if strings.ContainsAny(target, "*?[") {
+		matches, err := l.glob(target)
+		if err != nil {
+			return &ParseError{File: filename, Line: st.start.line, Col: st.start.col,
+				Err: fmt.Errorf("include %q: %w", st.path, err)}
+		}
+		sort.Strings(matches)
+		files = matches
+	}
+
+	for _, f := range files {
+		if l.full() {
+			break
+		}
+		if err := l.loadFile(f); err != nil {
+			if _, ok := err.(*ParseError); ok {
+				return err
+			}
+			return &ParseError{File: filename, Line: st.start.line, Col: st.start.col,
+				Err: fmt.Errorf("include %q: %w", st.path, err)}
+		}
+	}
+	return nil
+}
+
+// TopLevelFiles returns the files among names, in their order, that no
+// other file among them includes, directly or through further includes.
+// Loading every rule file of a directory or bundle would load an included
+// file twice, once on its own and once where it is included, so such
+// callers load only these. Files that include each other in a cycle are
+// kept, so loading reports the cycle. Names are slash-separated paths in
+// fsys; problems with the files are left for loading to report.
+func TopLevelFiles(fsys fs.FS, names []string, opts LoadOptions) []string {
+	l := newLoader(opts)
+	l.fsys = fsys
+	targets := make(map[string][]string)
+	includes := func(name string) []string {
+		if t, ok := targets[name]; ok {
+			return t
+		}
+		targets[name] = l.includeTargets(name)
+		return targets[name]
+	}
+
+	included := make(map[string]bool)
+	var mark func(name string)
+	mark = func(name string) {
+		for _, target := range includes(name) {
+			if !included[target] {
+				included[target] = true
+				mark(target)
+			}
+		}
+	}
+	for _, name := range names {
+		mark(name)
+	}
+
+	top := make(map[string]bool)
+	reached := make(map[string]bool)
+	var reach func(name string)
+	reach = func(name string) {
+		reached[name] = true
+		for _, target := range includes(name) {
+			if !reached[target] {
+				reach(target)
+			}
+		}
+	}
+	for _, name := range names {
+		if !included[name] {
+			top[name] = true
+			reach(name)
+		}
+	}
+	// Only a cycle leaves included files unreached
+	for _, name := range names {
+		if !reached[name] {
+			top[name] = true
+			reach(name)
+		}
+	}
+
+	var files []string
+	for _, name := range names {
+		if top[name] {
+			files = append(files, name)
+		}
+	}
+	return files
+}
+
+// includeTargets returns the files named by the include directives of a
+// text rule file, ignoring any errors
+func (l *loader) includeTargets(filename string) []string {
+	if isBinaryFile(filename) {
+		return nil
+	}
+	if _, ok := structuredFormat(filename, l.opts.Format); ok {
+		return nil
+	}
+	file, err := l.fsys.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var targets []string
+	sr := newStatementReader(file, l.opts)
+	for {
+		st, err := sr.next()
+		if err != nil {
+			return targets
+		}
+		if st.kind != stmtInclude {
+			continue
+		}
+		target := l.resolve(filename, st.path)
+		if !strings.ContainsAny(target, "*?[") {
+			targets = append(targets, target)
+			continue
+		}
+		matches, _ := l.glob(target) //nolint:errcheck // reported when loading
+		targets = append(targets, matches...)
+	}
+}
+
+// parse parses the S-expression text of a statement
+func (l *loader) parse(filename string, st *statement) (sexp.Element, error) {
+	if l.opts.Format == FormatAdvanced {
+		elem, err := sexp.NewParser(advancedToCanonical(st.text)).Parse()
+		if err != nil {
+			return nil, &ParseError{File: filename, Line: st.start.line, Col: st.start.col,
+				Err: fmt.Errorf("failed to parse rule: %w", err)}
+		}
+		return elem, nil
+	}
+
+	parser := sexp.NewParser(st.text)
+	elem, err := parser.Parse()
+	if err != nil {
+		pos := st.posAt(parser.Pos())
+		return nil, &ParseError{File: filename, Line: pos.line, Col: pos.col,
+			Err: fmt.Errorf("failed to parse rule: %w", err)}
+	}
+	return elem, nil
+}
+
+// expand replaces $name references to defines and variables. Atoms
+// starting with $ are references only once a define or variable is
+// declared, or in a template instantiated with params; until then they stay
+// literal, so files without them load as before. Values in params take
+// precedence over variables; a reference to an unknown variable is an
+// error.
+func (l *loader) expand(elem sexp.Element, params map[string]sexp.Element) (sexp.Element, error) {
+	if len(l.vars) == 0 && params == nil {
+		return elem, nil
+	}
+
+	var missing string
+	expanded := substitute(elem, func(atom *sexp.Atom) (sexp.Element, bool) {
+		if !strings.HasPrefix(atom.Value, "$") {
+			return nil, false
+		}
+		if value, ok := params[atom.Value]; ok {
+			return value, true
+		}
+		if value, ok := l.vars[atom.Value]; ok {
+			return value, true
+		}
+		if missing == "" && variableName.MatchString(atom.Value) {
+			missing = atom.Value
+		}
+		return nil, false
+	})
+	if missing != "" {
+		return nil, fmt.Errorf("undefined variable %s", missing)
+	}
+	return expanded, nil
+}
+
+// substitute rebuilds elem, replacing atoms for which replace returns true
+func substitute(elem sexp.Element, replace func(*sexp.Atom) (sexp.Element, bool)) sexp.Element {
+	switch e := elem.(type) {
+	case *sexp.Atom:
+		if value, ok := replace(e); ok {
+			return value
+		}
+		return e
+	case *sexp.List:
+		elements := make([]sexp.Element, len(e.Elements))
+		for i, child := range e.Elements {
+			elements[i] = substitute(child, replace)
+		}
+		return sexp.NewList(e.Tag, elements...)
+	default:
+		return elem
+	}
+}
@@ -0,0 +1,330 @@
+package persist
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func writeRuleFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestLoadMultiLineRules(t *testing.T) {
+	tmpDir := t.TempDir()
+	filename := writeRuleFile(t, tmpDir, "multi.spoc", `# nested rule over several lines
+(4:http
+  (4:page10:index.html)
+  # comment inside a rule
+  (6:action3:GET)
+)
+(5:admin)
+(4:note9:two
+lines)
+`)
+
+	loaded, err := LoadFile(filename, DefaultLoadOptions())
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+
+	want := []string{
+		"(4:http(4:page10:index.html)(6:action3:GET))",
+		"(5:admin)",
+		"(4:note9:two\nlines)",
+	}
+	if len(loaded) != len(want) {
+		t.Fatalf("Expected %d rules, got %d", len(want), len(loaded))
+	}
+	for i, w := range want {
+		if loaded[i].String() != w {
+			t.Errorf("Rule %d: expected %q, got %q", i, w, loaded[i].String())
+		}
+	}
+}
+
+func TestLoadMultiLineAdvanced(t *testing.T) {
+	tmpDir := t.TempDir()
+	filename := writeRuleFile(t, tmpDir, "advanced.spoc", `(http
+  (page index.html)
+  (action GET))
+`)
+
+	opts := DefaultLoadOptions()
+	opts.Format = FormatAdvanced
+	loaded, err := LoadFile(filename, opts)
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if len(loaded) != 1 {
+		t.Fatalf("Expected 1 rule, got %d", len(loaded))
+	}
+	if got := loaded[0].String(); got != "(4:http(4:page10:index.html)(6:action3:GET))" {
+		t.Errorf("Unexpected rule: %s", got)
+	}
+}
+
+func TestLoadInclude(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeRuleFile(t, tmpDir, "common.spoc", "(4:http3:GET)\n")
+	writeRuleFile(t, tmpDir, "rules.d/a.spoc", "(4:file4:read)\n")
+	writeRuleFile(t, tmpDir, "rules.d/b.spoc", "(4:file5:write)\n")
+	main := writeRuleFile(t, tmpDir, "main.spoc", `include "common.spoc"
+include rules.d/*.spoc
+(5:admin)
+`)
+
+	loaded, err := LoadFile(main, DefaultLoadOptions())
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+
+	want := []string{"(4:http3:GET)", "(4:file4:read)", "(4:file5:write)", "(5:admin)"}
+	if len(loaded) != len(want) {
+		t.Fatalf("Expected %d rules, got %d", len(want), len(loaded))
+	}
+	for i, w := range want {
+		if loaded[i].String() != w {
+			t.Errorf("Rule %d: expected %s, got %s", i, w, loaded[i].String())
+		}
+	}
+}
+
+// TestTopLevelFiles tests that files included by others are left out
+func TestTopLevelFiles(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.spoc":        {Data: []byte("include \"lib/*.spoc\"\n(5:admin)\n")},
+		"lib/a.spoc":       {Data: []byte("(1:a)\n")},
+		"lib/b.spoc":       {Data: []byte("include \"../shared.spoc\"\n")},
+		"shared.spoc":      {Data: []byte("(6:shared)\n")},
+		"other.spoc":       {Data: []byte("(5:other)\n")},
+		"cycle/one.spoc":   {Data: []byte("include \"two.spoc\"\n")},
+		"cycle/two.spoc":   {Data: []byte("include \"one.spoc\"\n")},
+		"broken.spoc":      {Data: []byte("(1:a\n")},
+		"rules.json":       {Data: []byte(`{"rules": []}`)},
+		"missing.spoc":     {Data: []byte("include \"nowhere.spoc\"\n")},
+		"lib/unused.spocp": {Data: []byte{}},
+	}
+	names := []string{"broken.spoc", "cycle/one.spoc", "cycle/two.spoc", "lib/a.spoc", "lib/b.spoc",
+		"lib/unused.spocp", "main.spoc", "missing.spoc", "other.spoc", "rules.json", "shared.spoc"}
+
+	got := TopLevelFiles(fsys, names, DefaultLoadOptions())
+	want := []string{"broken.spoc", "cycle/one.spoc", "lib/unused.spocp", "main.spoc", "missing.spoc", "other.spoc", "rules.json"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestLoadIncludeCycle(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeRuleFile(t, tmpDir, "a.spoc", "include \"b.spoc\"\n")
+	writeRuleFile(t, tmpDir, "b.spoc", "include \"a.spoc\"\n")
+
+	_, err := LoadFile(filepath.Join(tmpDir, "a.spoc"), DefaultLoadOptions())
+	if err == nil {
+		t.Fatal("Expected include cycle error")
+	}
+	if !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("Expected include cycle error, got: %v", err)
+	}
+}
+
+func TestLoadIncludeMissing(t *testing.T) {
+	tmpDir := t.TempDir()
+	main := writeRuleFile(t, tmpDir, "main.spoc", "(5:admin)\ninclude \"missing.spoc\"\n")
+
+	_, err := LoadFile(main, DefaultLoadOptions())
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("Expected ParseError, got: %v", err)
+	}
+	if pe.Line != 2 || pe.Col != 1 {
+		t.Errorf("Expected error at 2:1, got %d:%d", pe.Line, pe.Col)
+	}
+}
+
+func TestLoadDefine(t *testing.T) {
+	tmpDir := t.TempDir()
+	filename := writeRuleFile(t, tmpDir, "define.spoc", `define read (6:action4:read)
+define ADMIN (4:user
+  5:admin)
+(4:file5:$read6:$ADMIN4:read)
+`)
+
+	loaded, err := LoadFile(filename, DefaultLoadOptions())
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if len(loaded) != 1 {
+		t.Fatalf("Expected 1 rule, got %d", len(loaded))
+	}
+	// Only references are replaced, not atoms that happen to share a name
+	want := "(4:file(6:action4:read)(4:user5:admin)4:read)"
+	if got := loaded[0].String(); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestLoadDefineErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"invalid name", "define 1bad (4:http)\n"},
+		{"redefinition", "define A (1:a)\ndefine A (1:b)\n"},
+		{"variable redefinition", "define A (1:a)\n$A = (1:b)\n"},
+		{"invalid expression", "define A (x)\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := writeRuleFile(t, t.TempDir(), "bad.spoc", tt.content)
+			if _, err := LoadFile(filename, DefaultLoadOptions()); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
+
+// TestLoadSkipInvalidUnbalanced tests that with SkipInvalid, loading
+// resumes after a statement that does not balance
+func TestLoadSkipInvalidUnbalanced(t *testing.T) {
+	filename := writeRuleFile(t, t.TempDir(), "bad.spoc", `(4:http3:GET)
+)
+  (5:stray)
+(4:http
+  (4:page)
+(4:http4:POST)
+# comment
+(4:file
+  5:write)
+(2:ok
+`)
+
+	if _, err := LoadFile(filename, DefaultLoadOptions()); err == nil {
+		t.Error("Expected error without SkipInvalid")
+	}
+
+	opts := DefaultLoadOptions()
+	opts.SkipInvalid = true
+	rules, err := LoadFileWithMeta(filename, opts)
+	if err != nil {
+		t.Fatalf("LoadFileWithMeta failed: %v", err)
+	}
+	var got []string
+	for _, rule := range rules {
+		got = append(got, fmt.Sprintf("%d:%s", rule.Meta.Line, rule.Element))
+	}
+	want := "1:(4:http3:GET) 6:(4:http4:POST) 8:(4:file5:write)"
+	if strings.Join(got, " ") != want {
+		t.Errorf("Expected %s, got %s", want, strings.Join(got, " "))
+	}
+}
+
+func TestParseErrorLocation(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		line    int
+		col     int
+	}{
+		{"bad atom in continuation", "(5:admin)\n(4:http\n  xx:GET)\n", 3, 3},
+		{"unterminated", "(5:admin)\n  (4:http\n(3:GET\n", 2, 3},
+		{"stray close", ")\n", 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := writeRuleFile(t, t.TempDir(), "bad.spoc", tt.content)
+			_, err := LoadFile(filename, DefaultLoadOptions())
+			var pe *ParseError
+			if !errors.As(err, &pe) {
+				t.Fatalf("Expected ParseError, got: %v", err)
+			}
+			if pe.File != filename {
+				t.Errorf("Expected file %s, got %s", filename, pe.File)
+			}
+			if pe.Line != tt.line || pe.Col != tt.col {
+				t.Errorf("Expected %d:%d, got %d:%d (%v)", tt.line, tt.col, pe.Line, pe.Col, err)
+			}
+			if !strings.HasPrefix(err.Error(), filename+":") {
+				t.Errorf("Error should start with file name: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadVerify(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeRuleFile(t, tmpDir, "base.spoc", "(4:http3:GET)\n")
+	writeRuleFile(t, tmpDir, "d.csv", "x\n1\n")
+	filename := writeRuleFile(t, tmpDir, "main.spoc", "include \"base.spoc\"\ntemplate t (1:a2:$x)\ninstantiate t \"d.csv\"\n")
+
+	var seen []string
+	opts := DefaultLoadOptions()
+	opts.Verify = func(name string, data []byte) error {
+		seen = append(seen, filepath.Base(name))
+		return nil
+	}
+	if _, err := LoadFile(filename, opts); err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if strings.Join(seen, ",") != "main.spoc,base.spoc,d.csv" {
+		t.Errorf("Expected every file to be verified, got %v", seen)
+	}
+
+	opts.Verify = func(name string, data []byte) error {
+		if filepath.Base(name) == "base.spoc" {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	_, err := LoadFile(filename, opts)
+	if err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Errorf("Expected verification error, got: %v", err)
+	}
+
+	binFile := filepath.Join(tmpDir, "rules.spocp")
+	if err := SaveFile(binFile, nil, FormatBinaryV2); err != nil {
+		t.Fatal(err)
+	}
+	opts.Verify = func(name string, data []byte) error { return errors.New("rejected") }
+	if _, err := LoadRuleset(binFile, opts); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("Expected binary file to be verified, got: %v", err)
+	}
+}
+
+func TestLoadOpened(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeRuleFile(t, tmpDir, "base.spoc", "(4:http3:GET)\n")
+	writeRuleFile(t, tmpDir, "d.csv", "x\n1\n")
+	filename := writeRuleFile(t, tmpDir, "main.spoc", "include \"base.spoc\"\ntemplate t (1:a2:$x)\ninstantiate t \"d.csv\"\n")
+
+	var seen []string
+	opts := DefaultLoadOptions()
+	opts.Opened = func(name string) {
+		seen = append(seen, filepath.Base(name))
+	}
+	if _, err := LoadFile(filename, opts); err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if _, err := LoadRulesetFS(os.DirFS(tmpDir), "main.spoc", opts); err != nil {
+		t.Fatalf("LoadRulesetFS failed: %v", err)
+	}
+	want := "main.spoc,base.spoc,d.csv"
+	if got := strings.Join(seen, ","); got != want+","+want {
+		t.Errorf("Expected every file to be reported twice, got %v", seen)
+	}
+}
@@ -0,0 +1,465 @@
+package persist
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+	"github.com/sirosfoundation/go-spocp/pkg/starform"
+)
+
+// JSON and YAML rule files hold a document with a "rules" array:
+//
+//	{"rules": [ <element>, ... ]}
+//
+// where each element is one of
+//
+//	"GET"                                      atom (UTF-8 string)
+//	{"bytes": "<base64>"}                      atom that is not valid UTF-8
+//	{"tag": "http", "elements": [...]}         list; "elements" may be omitted
+//	{"wildcard": true}                         (* )
+//	{"set": [<element>, ...]}                  (* set ...)
+//	{"range": "numeric", "ge": 5, "lt": 10}    (* range numeric ge 5 lt 10)
+//	{"prefix": "/home/"}                       (* prefix /home/)
+//	{"suffix": ".pdf"}                         (* suffix .pdf)
+//
+// Range types are alpha, numeric, date, time, ipv4 and ipv6; the bounds are
+// ge or gt and le or lt, given as strings or (for numeric ranges) JSON
+// numbers, whose literal text is kept. Star forms load as the typed
+// elements of package starform. Lists whose tag is "*" load as lists, so a
+// rule read from a canonical file converts to JSON and back unchanged. The
+// reverse does not hold: canonical files have no typed star forms, so
+// SaveFile refuses to write rules holding them in that format.
+
+// jsonDocument is the top level of a JSON rule file
+type jsonDocument struct {
+	Rules []json.RawMessage `json:"rules"`
+}
+
+// decodeJSONRules decodes a JSON rule document. Element errors are reported
+// per rule so that SkipInvalid can skip them.
+func decodeJSONRules(data []byte) ([]json.RawMessage, error) {
+	var doc jsonDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			// Offset counts the offending byte
+			line, col := offsetPosition(data, max(syntaxErr.Offset-1, 0))
+			return nil, &ParseError{Line: line, Col: col, Err: err}
+		}
+		return nil, fmt.Errorf("invalid JSON rule document: %w", err)
+	}
+	if doc.Rules == nil {
+		return nil, errors.New(`invalid JSON rule document: missing "rules" array`)
+	}
+	return doc.Rules, nil
+}
+
+// decodeJSONElement decodes a single JSON element; path locates it in
+// error messages
+func decodeJSONElement(data []byte, path string) (sexp.Element, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return elementFromValue(v, path)
+}
+
+// offsetPosition converts the offset of a byte to a 1-based line and column
+func offsetPosition(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// elementFromValue converts a decoded JSON or YAML value to an element.
+// Scalars are strings (YAML and JSON strings), json.Number or bool.
+func elementFromValue(v any, path string) (sexp.Element, error) {
+	errorf := func(format string, args ...any) error {
+		if path == "" {
+			return fmt.Errorf(format, args...)
+		}
+		return fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...))
+	}
+
+	switch val := v.(type) {
+	case string:
+		return sexp.NewAtom(val), nil
+	case json.Number:
+		return sexp.NewAtom(val.String()), nil
+	case map[string]any:
+		return elementFromObject(val, path, errorf)
+	case nil:
+		return nil, errorf("null is not an element")
+	default:
+		return nil, errorf("%T is not an element", v)
+	}
+}
+
+// elementFromObject converts a JSON object to a list, star form or atom
+func elementFromObject(obj map[string]any, path string, errorf func(string, ...any) error) (sexp.Element, error) {
+	allow := func(keys ...string) error {
+		for key := range obj {
+			found := false
+			for _, k := range keys {
+				if key == k {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return errorf("unexpected key %q", key)
+			}
+		}
+		return nil
+	}
+	str := func(key string) (string, error) {
+		switch val := obj[key].(type) {
+		case string:
+			return val, nil
+		case json.Number:
+			return val.String(), nil
+		default:
+			return "", errorf("%q must be a string", key)
+		}
+	}
+	children := func(key string) ([]sexp.Element, error) {
+		items, ok := obj[key].([]any)
+		if !ok && obj[key] != nil {
+			return nil, errorf("%q must be an array", key)
+		}
+		elems := make([]sexp.Element, 0, len(items))
+		for i, item := range items {
+			elem, err := elementFromValue(item, fmt.Sprintf("%s%s[%d]", joinPath(path), key, i))
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		}
+		return elems, nil
+	}
+
+	switch {
+	case has(obj, "tag"):
+		if err := allow("tag", "elements"); err != nil {
+			return nil, err
+		}
+		tag, err := str("tag")
+		if err != nil {
+			return nil, err
+		}
+		elems, err := children("elements")
+		if err != nil {
+			return nil, err
+		}
+		return &sexp.List{Tag: tag, Elements: elems}, nil
+
+	case has(obj, "bytes"):
+		if err := allow("bytes"); err != nil {
+			return nil, err
+		}
+		encoded, err := str("bytes")
+		if err != nil {
+			return nil, err
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errorf("invalid base64 in \"bytes\": %v", err)
+		}
+		return sexp.NewAtom(string(value)), nil
+
+	case has(obj, "wildcard"):
+		if err := allow("wildcard"); err != nil {
+			return nil, err
+		}
+		if b, ok := obj["wildcard"].(bool); !ok || !b {
+			if s, ok := obj["wildcard"].(string); !ok || s != "true" {
+				return nil, errorf(`"wildcard" must be true`)
+			}
+		}
+		return &starform.Wildcard{}, nil
+
+	case has(obj, "set"):
+		if err := allow("set"); err != nil {
+			return nil, err
+		}
+		elems, err := children("set")
+		if err != nil {
+			return nil, err
+		}
+		return &starform.Set{Elements: elems}, nil
+
+	case has(obj, "range"):
+		if err := allow("range", "ge", "gt", "le", "lt"); err != nil {
+			return nil, err
+		}
+		rangeType, err := str("range")
+		if err != nil {
+			return nil, err
+		}
+		switch starform.RangeType(rangeType) {
+		case starform.RangeAlpha, starform.RangeNumeric, starform.RangeDate,
+			starform.RangeTime, starform.RangeIPv4, starform.RangeIPv6:
+		default:
+			return nil, errorf("unknown range type %q", rangeType)
+		}
+		r := &starform.Range{RangeType: starform.RangeType(rangeType)}
+		for _, bound := range []struct {
+			op    starform.RangeOp
+			lower bool
+		}{{starform.OpGE, true}, {starform.OpGT, true}, {starform.OpLE, false}, {starform.OpLT, false}} {
+			if !has(obj, string(bound.op)) {
+				continue
+			}
+			value, err := str(string(bound.op))
+			if err != nil {
+				return nil, err
+			}
+			b := &starform.RangeBound{Op: bound.op, Value: value}
+			if bound.lower {
+				if r.LowerBound != nil {
+					return nil, errorf("range has both ge and gt")
+				}
+				r.LowerBound = b
+			} else {
+				if r.UpperBound != nil {
+					return nil, errorf("range has both le and lt")
+				}
+				r.UpperBound = b
+			}
+		}
+		return r, nil
+
+	case has(obj, "prefix"):
+		if err := allow("prefix"); err != nil {
+			return nil, err
+		}
+		value, err := str("prefix")
+		if err != nil {
+			return nil, err
+		}
+		return &starform.Prefix{Value: value}, nil
+
+	case has(obj, "suffix"):
+		if err := allow("suffix"); err != nil {
+			return nil, err
+		}
+		value, err := str("suffix")
+		if err != nil {
+			return nil, err
+		}
+		return &starform.Suffix{Value: value}, nil
+	}
+
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return nil, errorf("unknown element object with keys %s", strings.Join(keys, ", "))
+}
+
+func has(obj map[string]any, key string) bool {
+	_, ok := obj[key]
+	return ok
+}
+
+func joinPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	return path + "."
+}
+
+// jsonNumber matches the JSON number grammar
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// saveJSON writes rules as a JSON rule document, one rule per line
+func saveJSON(w io.Writer, rules []sexp.Element) error {
+	var buf bytes.Buffer
+	buf.WriteString("{\n  \"rules\": [")
+	for i, rule := range rules {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString("\n    ")
+		if err := writeJSONElement(&buf, rule); err != nil {
+			return err
+		}
+	}
+	if len(rules) > 0 {
+		buf.WriteString("\n  ")
+	}
+	buf.WriteString("]\n}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeJSONElement writes one element in compact JSON
+func writeJSONElement(buf *bytes.Buffer, elem sexp.Element) error {
+	str := func(s string) {
+		data, _ := json.Marshal(s) //nolint:errcheck // strings always marshal
+		buf.Write(data)
+	}
+	elems := func(list []sexp.Element) error {
+		buf.WriteByte('[')
+		for i, e := range list {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSONElement(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+
+	switch el := elem.(type) {
+	case *sexp.Atom:
+		if utf8.ValidString(el.Value) {
+			str(el.Value)
+		} else {
+			buf.WriteString(`{"bytes":`)
+			str(base64.StdEncoding.EncodeToString([]byte(el.Value)))
+			buf.WriteByte('}')
+		}
+	case *sexp.List:
+		buf.WriteString(`{"tag":`)
+		str(el.Tag)
+		if len(el.Elements) > 0 {
+			buf.WriteString(`,"elements":`)
+			if err := elems(el.Elements); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case *starform.Wildcard:
+		buf.WriteString(`{"wildcard":true}`)
+	case *starform.Set:
+		buf.WriteString(`{"set":`)
+		if err := elems(el.Elements); err != nil {
+			return err
+		}
+		buf.WriteByte('}')
+	case *starform.Range:
+		buf.WriteString(`{"range":`)
+		str(string(el.RangeType))
+		for _, b := range []*starform.RangeBound{el.LowerBound, el.UpperBound} {
+			if b == nil {
+				continue
+			}
+			buf.WriteByte(',')
+			str(string(b.Op))
+			buf.WriteByte(':')
+			if el.RangeType == starform.RangeNumeric && jsonNumber.MatchString(b.Value) {
+				buf.WriteString(b.Value)
+			} else {
+				str(b.Value)
+			}
+		}
+		buf.WriteByte('}')
+	case *starform.Prefix:
+		buf.WriteString(`{"prefix":`)
+		str(el.Value)
+		buf.WriteByte('}')
+	case *starform.Suffix:
+		buf.WriteString(`{"suffix":`)
+		str(el.Value)
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("cannot encode %T as JSON", elem)
+	}
+	return nil
+}
+
+// loadStructuredFile appends the rules of a JSON or YAML rule file
+func (l *loader) loadStructuredFile(filename string, format FileFormat) error {
+	data, err := l.readFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var values []any
+	if format == FormatYAML {
+		values, err = decodeYAMLRules(data)
+	} else {
+		var raw []json.RawMessage
+		raw, err = decodeJSONRules(data)
+		values = make([]any, len(raw))
+		for i, r := range raw {
+			values[i] = r
+		}
+	}
+	if err != nil {
+		if pe, ok := err.(*ParseError); ok {
+			pe.File = filename
+			return pe
+		}
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+
+	for i, value := range values {
+		if l.full() {
+			break
+		}
+		path := fmt.Sprintf("rules[%d]", i)
+		var elem sexp.Element
+		if raw, ok := value.(json.RawMessage); ok {
+			elem, err = decodeJSONElement(raw, path)
+		} else {
+			elem, err = elementFromValue(value, path)
+		}
+		if err != nil {
+			if l.opts.SkipInvalid {
+				continue
+			}
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		if err := l.add(Rule{Element: elem, Meta: RuleMeta{File: filename}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsRuleDocument reports whether data, read from filename, is a rule file
+// rather than another kind of file kept alongside rules: JSON and YAML
+// files must hold a top-level "rules" member, such as template data files
+// do not. Other files are always rule files.
+func IsRuleDocument(filename string, data []byte) bool {
+	format, ok := structuredFormat(filename, FormatCanonical)
+	if !ok {
+		return true
+	}
+	if format == FormatYAML {
+		doc, err := parseYAML(data)
+		if err != nil {
+			// Report the syntax error when the file is loaded
+			return true
+		}
+		m, ok := doc.(map[string]any)
+		return ok && has(m, "rules")
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		var syntaxErr *json.SyntaxError
+		return errors.As(err, &syntaxErr)
+	}
+	_, ok = doc["rules"]
+	return ok
+}
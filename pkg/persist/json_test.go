@@ -0,0 +1,321 @@
+package persist
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirosfoundation/go-spocp/pkg/compare"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+	"github.com/sirosfoundation/go-spocp/pkg/starform"
+)
+
+// roundTripRules covers atoms, nested lists, star forms written as lists
+// and atoms that are not valid UTF-8
+var roundTripRules = []string{
+	"(4:http3:GET)",
+	"(4:file(4:path11:/etc/passwd)(6:action4:read))",
+	"(5:admin)",
+	"(8:resource(1:*5:range7:numeric2:ge1:52:lt2:10))",
+	"(3:key3:\xff\x00\x01)",
+	"(4:list(0:)(1:*))",
+}
+
+func parseRules(t *testing.T, texts []string) []sexp.Element {
+	t.Helper()
+	rules := make([]sexp.Element, len(texts))
+	for i, text := range texts {
+		elem, err := sexp.NewParser(text).Parse()
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", text, err)
+		}
+		rules[i] = elem
+	}
+	return rules
+}
+
+func testRoundTrip(t *testing.T, ext string, format FileFormat) {
+	filename := filepath.Join(t.TempDir(), "rules"+ext)
+	rules := parseRules(t, roundTripRules)
+
+	if err := SaveFile(filename, rules, format); err != nil {
+		t.Fatalf("SaveFile failed: %v", err)
+	}
+	loaded, err := LoadFileToSlice(filename)
+	if err != nil {
+		data, _ := os.ReadFile(filename)
+		t.Fatalf("LoadFile failed: %v\n%s", err, data)
+	}
+	if len(loaded) != len(rules) {
+		t.Fatalf("Expected %d rules, got %d", len(rules), len(loaded))
+	}
+	for i, rule := range rules {
+		if rule.String() != loaded[i].String() {
+			t.Errorf("Rule %d mismatch: expected %q, got %q", i, rule.String(), loaded[i].String())
+		}
+	}
+}
+
+// TestJSONRoundTrip tests that canonical rules survive a trip through JSON
+func TestJSONRoundTrip(t *testing.T) {
+	testRoundTrip(t, ".json", FormatJSON)
+}
+
+// TestJSONStarForms tests the typed star form objects
+func TestJSONStarForms(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.json")
+	doc := `{
+  "rules": [
+    {"tag": "a", "elements": [{"wildcard": true}]},
+    {"tag": "b", "elements": [{"set": ["read", "write"]}]},
+    {"tag": "c", "elements": [{"range": "numeric", "ge": 5, "lt": "10"}]},
+    {"tag": "d", "elements": [{"prefix": "/home/"}, {"suffix": ".pdf"}]},
+    {"tag": "e", "elements": [12.50]}
+  ]
+}`
+	if err := os.WriteFile(filename, []byte(doc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := LoadFileToSlice(filename)
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if len(rules) != 5 {
+		t.Fatalf("Expected 5 rules, got %d", len(rules))
+	}
+
+	elem := func(i, j int) sexp.Element { return rules[i].(*sexp.List).Elements[j] }
+	if _, ok := elem(0, 0).(*starform.Wildcard); !ok {
+		t.Errorf("Expected wildcard, got %T", elem(0, 0))
+	}
+	if set, ok := elem(1, 0).(*starform.Set); !ok || len(set.Elements) != 2 {
+		t.Errorf("Expected set of 2, got %v", elem(1, 0))
+	}
+	r, ok := elem(2, 0).(*starform.Range)
+	if !ok {
+		t.Fatalf("Expected range, got %T", elem(2, 0))
+	}
+	if r.RangeType != starform.RangeNumeric || r.LowerBound.Op != starform.OpGE || r.LowerBound.Value != "5" ||
+		r.UpperBound.Op != starform.OpLT || r.UpperBound.Value != "10" {
+		t.Errorf("Unexpected range %v", r)
+	}
+	if p, ok := elem(3, 0).(*starform.Prefix); !ok || p.Value != "/home/" {
+		t.Errorf("Expected prefix /home/, got %v", elem(3, 0))
+	}
+	if s, ok := elem(3, 1).(*starform.Suffix); !ok || s.Value != ".pdf" {
+		t.Errorf("Expected suffix .pdf, got %v", elem(3, 1))
+	}
+	if a, ok := elem(4, 0).(*sexp.Atom); !ok || a.Value != "12.50" {
+		t.Errorf("Expected numbers to keep their text, got %v", elem(4, 0))
+	}
+
+	// Typed star forms are written back as typed objects
+	out := filepath.Join(t.TempDir(), "out.json")
+	if err := SaveFile(out, rules, FormatJSON); err != nil {
+		t.Fatalf("SaveFile failed: %v", err)
+	}
+	data, _ := os.ReadFile(out)
+	for _, want := range []string{`{"wildcard":true}`, `{"set":["read","write"]}`, `{"range":"numeric","ge":5,"lt":10}`, `{"prefix":"/home/"}`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected %s in output:\n%s", want, data)
+		}
+	}
+	reloaded, err := LoadFileToSlice(out)
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	for i := range rules {
+		if rules[i].String() != reloaded[i].String() {
+			t.Errorf("Rule %d mismatch: expected %s, got %s", i, rules[i], reloaded[i])
+		}
+	}
+}
+
+// TestJSONStarFormConversion tests that typed star forms keep granting
+// access through the formats that can hold them, and that the others
+// refuse them instead of writing lists that grant nothing
+func TestJSONStarFormConversion(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "rules.json")
+	doc := `{"rules": [{"tag": "r", "elements": [{"set": ["a", "b"]}]}]}`
+	if err := os.WriteFile(src, []byte(doc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadFileToSlice(src)
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+
+	permits := func(rules []sexp.Element, query string) bool {
+		q := parseRules(t, []string{query})[0]
+		for _, rule := range rules {
+			if compare.LessPermissive(q, rule) {
+				return true
+			}
+		}
+		return false
+	}
+	check := func(name string, rules []sexp.Element) {
+		t.Helper()
+		if !permits(rules, "(1:r1:a)") || permits(rules, "(1:r1:c)") {
+			t.Errorf("%s: expected (r a) permitted and (r c) denied", name)
+		}
+	}
+	check("json", rules)
+
+	for _, format := range []FileFormat{FormatCanonical, FormatAdvanced, FormatBinary} {
+		filename := filepath.Join(dir, "rules.txt")
+		err := SaveFile(filename, rules, format)
+		if err == nil || !strings.Contains(err.Error(), "typed star forms") {
+			t.Errorf("Format %d: expected typed star forms to be refused, got %v", format, err)
+		}
+		if _, statErr := os.Stat(filename); statErr == nil {
+			t.Errorf("Format %d: expected no file to be written", format)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		format FileFormat
+	}{
+		{"rules.spocp", FormatBinaryV2},
+		{"rules.yaml", FormatYAML},
+		{"out.json", FormatJSON},
+	} {
+		filename := filepath.Join(dir, tc.name)
+		if err := SaveFile(filename, rules, tc.format); err != nil {
+			t.Fatalf("%s: SaveFile failed: %v", tc.name, err)
+		}
+		loaded, err := LoadFileToSlice(filename)
+		if err != nil {
+			t.Fatalf("%s: LoadFile failed: %v", tc.name, err)
+		}
+		check(tc.name, loaded)
+
+		// And back to JSON
+		back := filepath.Join(dir, "back.json")
+		if err := SaveFile(back, loaded, FormatJSON); err != nil {
+			t.Fatalf("%s: SaveFile to JSON failed: %v", tc.name, err)
+		}
+		reloaded, err := LoadFileToSlice(back)
+		if err != nil {
+			t.Fatalf("%s: LoadFile of JSON failed: %v", tc.name, err)
+		}
+		check(tc.name+" to json", reloaded)
+	}
+}
+
+// TestJSONErrors tests error reporting for invalid documents and elements
+func TestJSONErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{"syntax", "{\n  \"rules\": [\n    \"a\",,\n  ]\n}", "rules.json:3:9:"},
+		{"no rules", `{"rule": []}`, `missing "rules"`},
+		{"null", `{"rules": [null]}`, "rules[0]: null is not an element"},
+		{"nested", `{"rules": [{"tag": "a", "elements": ["b", true]}]}`, "rules[0].elements[1]: bool is not an element"},
+		{"unknown key", `{"rules": [{"tag": "a", "id": 1}]}`, `unexpected key "id"`},
+		{"range type", `{"rules": [{"range": "color", "ge": "red"}]}`, `unknown range type "color"`},
+		{"two bounds", `{"rules": [{"range": "alpha", "ge": "a", "gt": "b"}]}`, "both ge and gt"},
+		{"bytes", `{"rules": [{"bytes": "!!"}]}`, "invalid base64"},
+		{"unknown object", `{"rules": [{"foo": 1, "bar": 2}]}`, "keys bar, foo"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "rules.json")
+			if err := os.WriteFile(filename, []byte(tt.doc), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadFileToSlice(filename)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+// TestJSONSyntaxErrorPosition tests that syntax errors are ParseErrors
+func TestJSONSyntaxErrorPosition(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.json")
+	os.WriteFile(filename, []byte("{\"rules\": [\n  \"a\" \"b\"\n]}"), 0644)
+
+	_, err := LoadFileToSlice(filename)
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("Expected ParseError, got %v", err)
+	}
+	if pe.File != filename || pe.Line != 2 || pe.Col != 7 {
+		t.Errorf("Expected %s:2:7, got %s:%d:%d", filename, pe.File, pe.Line, pe.Col)
+	}
+}
+
+// TestJSONSkipInvalid tests skipping invalid elements and MaxRules
+func TestJSONSkipInvalid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.json")
+	os.WriteFile(filename, []byte(`{"rules": ["a", null, {"tag": "b"}, "c"]}`), 0644)
+
+	opts := DefaultLoadOptions()
+	opts.SkipInvalid = true
+	rules, err := LoadFileWithMeta(filename, opts)
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("Expected 3 rules, got %d", len(rules))
+	}
+	if rules[1].Meta.File != filename {
+		t.Errorf("Expected rule from %s, got %q", filename, rules[1].Meta.File)
+	}
+
+	opts.MaxRules = 2
+	elems, err := LoadFile(filename, opts)
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if len(elems) != 2 {
+		t.Errorf("Expected 2 rules with MaxRules, got %d", len(elems))
+	}
+}
+
+// TestJSONInclude tests including a JSON file from a text rule file
+func TestJSONInclude(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "extra.json"), []byte(`{"rules": [{"tag": "http", "elements": ["GET"]}]}`), 0644)
+	os.WriteFile(filepath.Join(dir, "main.spoc"), []byte("(5:admin)\ninclude extra.json\n"), 0644)
+
+	rules, err := LoadFileToSlice(filepath.Join(dir, "main.spoc"))
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if len(rules) != 2 || rules[1].String() != "(4:http3:GET)" {
+		t.Errorf("Unexpected rules %v", rules)
+	}
+}
+
+// TestIsRuleDocument tests telling rule documents from other files
+func TestIsRuleDocument(t *testing.T) {
+	tests := []struct {
+		filename string
+		data     string
+		want     bool
+	}{
+		{"rules.json", `{"rules": []}`, true},
+		{"users.json", `[{"name": "alice"}]`, false},
+		{"users.json", `{"users": []}`, false},
+		{"broken.json", `{"rules": [`, true},
+		{"rules.yaml", "rules:\n  - a\n", true},
+		{"users.yml", "- name: alice\n", false},
+		{"rules.spoc", "(1:a)", true},
+	}
+	for _, tt := range tests {
+		if got := IsRuleDocument(tt.filename, []byte(tt.data)); got != tt.want {
+			t.Errorf("IsRuleDocument(%s, %q) = %v, want %v", tt.filename, tt.data, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package persist
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// DefaultWorkers returns the number of files loaded concurrently when no
+// worker count is given
+func DefaultWorkers() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// LoadConcurrently calls load for every name using at most workers
+// goroutines (DefaultWorkers if workers <= 0) and returns the results in
+// the order of names. If loads fail, the error of the first failing name
+// in that order is returned, so the outcome does not depend on
+// scheduling; names after a failure may not be loaded at all.
+//
+// load must be safe for concurrent use. LoadOptions.Progress, Verify and
+// Opened callbacks shared between loads are called concurrently too.
+func LoadConcurrently[T any](names []string, workers int, load func(name string) (T, error)) ([]T, error) {
+	results := make([]T, len(names))
+	errs := make([]error, len(names))
+
+	if workers <= 0 {
+		workers = DefaultWorkers()
+	}
+	workers = min(workers, len(names))
+
+	if workers <= 1 {
+		for i, name := range names {
+			var err error
+			if results[i], err = load(name); err != nil {
+				return nil, err
+			}
+		}
+		return results, nil
+	}
+
+	// Names are handed out in order, so when one fails every earlier name
+	// has already been started and will finish
+	var next atomic.Int64
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !failed.Load() {
+				i := int(next.Add(1) - 1)
+				if i >= len(names) {
+					return
+				}
+				if results[i], errs[i] = load(names[i]); errs[i] != nil {
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// LoadRulesets loads rule files concurrently with LoadRuleset and returns
+// their rulesets in the order of filenames
+func LoadRulesets(filenames []string, opts LoadOptions, workers int) ([]*Ruleset, error) {
+	return LoadConcurrently(filenames, workers, func(filename string) (*Ruleset, error) {
+		rs, err := LoadRuleset(filename, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", filename, err)
+		}
+		return rs, nil
+	})
+}
+
+// MergeRulesets concatenates rulesets in order and builds the index of the
+// result in one pass from theirs. The rulesets are not modified; the
+// result has its own rules, metadata and index. Metadata is kept if any
+// ruleset has it, with zero values for rules of rulesets that have none.
+func MergeRulesets(sets ...*Ruleset) *Ruleset {
+	total, atoms, withMeta := 0, 0, false
+	for _, rs := range sets {
+		total += len(rs.Rules)
+		atoms += len(rs.AtomRules)
+		withMeta = withMeta || rs.Meta != nil
+	}
+
+	merged := &Ruleset{
+		Rules:     make([]sexp.Element, 0, total),
+		TagIndex:  make(map[string][]int),
+		AtomRules: make([]int, 0, atoms),
+	}
+	if withMeta {
+		merged.Meta = make([]RuleMeta, 0, total)
+	}
+
+	for _, rs := range sets {
+		base := len(merged.Rules)
+		merged.Rules = append(merged.Rules, rs.Rules...)
+		if withMeta {
+			if rs.Meta != nil {
+				merged.Meta = append(merged.Meta, rs.Meta...)
+			} else {
+				merged.Meta = append(merged.Meta, make([]RuleMeta, len(rs.Rules))...)
+			}
+		}
+		for tag, indices := range rs.TagIndex {
+			bucket := merged.TagIndex[tag]
+			for _, idx := range indices {
+				bucket = append(bucket, base+idx)
+			}
+			merged.TagIndex[tag] = bucket
+		}
+		for _, idx := range rs.AtomRules {
+			merged.AtomRules = append(merged.AtomRules, base+idx)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,116 @@
+package persist
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+func TestLoadConcurrently(t *testing.T) {
+	names := make([]string, 50)
+	for i := range names {
+		names[i] = fmt.Sprint(i)
+	}
+
+	for _, workers := range []int{0, 1, 4, 100} {
+		got, err := LoadConcurrently(names, workers, func(name string) (string, error) {
+			// Finish out of order
+			if name[len(name)-1]%3 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			return "r" + name, nil
+		})
+		if err != nil {
+			t.Fatalf("workers %d: %v", workers, err)
+		}
+		for i, r := range got {
+			if r != "r"+names[i] {
+				t.Fatalf("workers %d: result %d is %q", workers, i, r)
+			}
+		}
+	}
+
+	// The first failing name in order wins, however long it takes
+	for range 10 {
+		_, err := LoadConcurrently(names, 8, func(name string) (string, error) {
+			switch name {
+			case "7":
+				time.Sleep(5 * time.Millisecond)
+				return "", errors.New("fail 7")
+			case "9", "30":
+				return "", errors.New("fail " + name)
+			}
+			return name, nil
+		})
+		if err == nil || err.Error() != "fail 7" {
+			t.Fatalf("Expected the error of name 7, got %v", err)
+		}
+	}
+
+	if got, err := LoadConcurrently(nil, 4, func(string) (int, error) { return 1, nil }); err != nil || len(got) != 0 {
+		t.Errorf("Expected no results, got %v, %v", got, err)
+	}
+}
+
+func TestLoadRulesets(t *testing.T) {
+	tmpDir := t.TempDir()
+	var files []string
+	for i := range 20 {
+		files = append(files, writeRuleFile(t, tmpDir, fmt.Sprintf("r%02d.spoc", i),
+			fmt.Sprintf("(4:http(4:page%d:%d))\n", len(fmt.Sprint(i)), i)))
+	}
+
+	sets, err := LoadRulesets(files, DefaultLoadOptions(), 4)
+	if err != nil {
+		t.Fatalf("LoadRulesets failed: %v", err)
+	}
+	for i, rs := range sets {
+		if len(rs.Rules) != 1 || rs.Meta[0].File != files[i] {
+			t.Fatalf("Ruleset %d: unexpected %+v", i, rs)
+		}
+	}
+
+	files = append(files, filepath.Join(tmpDir, "missing.spoc"))
+	if _, err := LoadRulesets(files, DefaultLoadOptions(), 4); err == nil || !strings.Contains(err.Error(), "missing.spoc") {
+		t.Errorf("Expected an error naming the missing file, got %v", err)
+	}
+}
+
+func TestMergeRulesets(t *testing.T) {
+	a := NewRuleset([]sexp.Element{
+		sexp.NewList("http", sexp.NewAtom("GET")),
+		sexp.NewAtom("admin"),
+	}, []RuleMeta{{File: "a", Line: 1}, {File: "a", Line: 2}})
+	b := NewRuleset([]sexp.Element{
+		sexp.NewList("ssh"),
+		sexp.NewList("http", sexp.NewAtom("POST")),
+	}, nil)
+	want := NewRuleset(append(append([]sexp.Element(nil), a.Rules...), b.Rules...), nil)
+	aIndex := fmt.Sprint(a.TagIndex)
+
+	merged := MergeRulesets(a, b)
+	if !reflect.DeepEqual(merged.Rules, want.Rules) ||
+		!reflect.DeepEqual(merged.TagIndex, want.TagIndex) ||
+		!reflect.DeepEqual(merged.AtomRules, want.AtomRules) {
+		t.Errorf("Unexpected merge %+v, want %+v", merged, want)
+	}
+	if len(merged.Meta) != 4 || merged.Meta[1].Line != 2 || merged.Meta[3].File != "" {
+		t.Errorf("Unexpected metadata %+v", merged.Meta)
+	}
+
+	// The merged index is independent of the inputs
+	merged.TagIndex["http"] = append(merged.TagIndex["http"], 99)
+	if got := fmt.Sprint(a.TagIndex); got != aIndex {
+		t.Errorf("Input index changed: %s", got)
+	}
+
+	if empty := MergeRulesets(); len(empty.Rules) != 0 || empty.Meta != nil {
+		t.Errorf("Unexpected empty merge %+v", empty)
+	}
+}
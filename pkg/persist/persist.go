@@ -9,6 +9,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"strings"
 
@@ -29,14 +30,50 @@ const (
 
 	// FormatBinary uses efficient binary encoding
 	FormatBinary
+
+	// FormatBinaryV2 uses binary format version 2 with pre-parsed rules,
+	// a prebuilt tag index and a checksum (see SaveRuleset)
+	FormatBinaryV2
+
+	// FormatJSON uses a JSON document with typed star forms (see json.go
+	// for the schema). Detected by the .json extension.
+	FormatJSON
+
+	// FormatYAML uses the YAML equivalent of FormatJSON, limited to a
+	// subset of YAML. Detected by the .yaml and .yml extensions.
+	FormatYAML
 )
 
+// Rule is a loaded rule together with metadata describing its origin
+type Rule struct {
+	Element sexp.Element
+	Meta    RuleMeta
+}
+
+// RuleMeta records where a rule came from
+type RuleMeta struct {
+	// File and Line locate the rule (or the instantiate directive) in its source
+	File string
+	Line int
+
+	// Template is the name of the template the rule was generated from, if any
+	Template string
+
+	// TemplateSource is the canonical form of the template body
+	TemplateSource string
+
+	// Params holds the data row the template was instantiated with
+	Params map[string]string
+}
+
 // LoadOptions controls how files are loaded
 type LoadOptions struct {
 	// Format specifies the file format (auto-detected if not specified)
 	Format FileFormat
 
-	// SkipInvalid continues loading if a rule fails to parse
+	// SkipInvalid continues loading if a rule fails to parse. In text
+	// files, a rule that does not balance is skipped up to the next line
+	// that starts in the first column.
 	SkipInvalid bool
 
 	// MaxRules limits the number of rules to load (0 = unlimited)
@@ -44,6 +81,37 @@ type LoadOptions struct {
 
 	// Comments defines comment prefixes to ignore (default: "#", "//")
 	Comments []string
+
+	// MemoryMap reads binary files through a read-only memory mapping
+	MemoryMap bool
+
+	// Verify, if set, is called with the contents of every file read
+	// (including included files and template data) before it is parsed.
+	// An error aborts loading.
+	Verify func(filename string, data []byte) error
+
+	// Opened, if set, is called with the name of every file opened for
+	// loading (including included files and template data). Unlike
+	// Verify, it does not make the loader read files into memory whole.
+	Opened func(filename string)
+
+	// VerifySignature, if set, checks a signature embedded in the data
+	// being loaded, such as the manifest signature of a bundle
+	VerifySignature func(data, signature []byte) error
+
+	// Progress, if set, is called every ProgressInterval rules while rules
+	// are loaded (see Scan). Binary files that LoadFile and LoadRuleset
+	// decode as a whole report no progress.
+	Progress func(Progress)
+
+	// ProgressInterval is the number of rules between Progress calls
+	// (default DefaultProgressInterval)
+	ProgressInterval int
+
+	// MaxBundleSize limits the total size of the files extracted from a
+	// bundle, counting one tar header block per file (default
+	// DefaultMaxBundleSize)
+	MaxBundleSize int64
 }
 
 // DefaultLoadOptions returns sensible defaults for loading rulesets
@@ -56,101 +124,86 @@ func DefaultLoadOptions() LoadOptions {
 	}
 }
 
-// LoadFile loads rules from a file and returns parsed elements
+// LoadFile loads rules from a file and returns parsed elements.
+// Text files may contain multi-line rules and include/define directives.
 func LoadFile(filename string, opts LoadOptions) ([]sexp.Element, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
-	}
-	defer file.Close()
-
 	// Auto-detect binary format
-	if opts.Format == FormatBinary || isBinaryFile(filename) {
-		return loadBinary(file)
+	if opts.Format == FormatBinary || opts.Format == FormatBinaryV2 || isBinaryFile(filename) {
+		rs, err := loadBinaryFile(filename, opts)
+		if err != nil {
+			return nil, err
+		}
+		return rs.Rules, nil
 	}
 
-	return loadText(file, opts)
+	l := newLoader(opts)
+	if err := l.loadFile(filename); err != nil {
+		return nil, err
+	}
+	return l.elements(), nil
 }
 
-// LoadFileToSlice is a convenience function that loads rules into a slice
-// This is the recommended way to load rules for most use cases
-func LoadFileToSlice(filename string) ([]sexp.Element, error) {
-	return LoadFile(filename, DefaultLoadOptions())
+// LoadFileWithMeta loads rules like LoadFile, keeping the metadata of each
+// rule (source location and, for generated rules, the template)
+func LoadFileWithMeta(filename string, opts LoadOptions) ([]Rule, error) {
+	l := newLoader(opts)
+	if opts.Format == FormatBinary || opts.Format == FormatBinaryV2 {
+		if err := l.loadBinaryFile(filename); err != nil {
+			return nil, err
+		}
+		return l.rules, nil
+	}
+
+	if err := l.loadFile(filename); err != nil {
+		return nil, err
+	}
+	return l.rules, nil
 }
 
-// SaveFile saves rules to a file in the specified format
-func SaveFile(filename string, rules []sexp.Element, format FileFormat) error {
-	file, err := os.Create(filename)
+// LoadFS loads rules from a file in fsys, such as an embed.FS, like
+// LoadFile. Includes and template data are read from fsys as well, with
+// paths relative to the including file.
+func LoadFS(fsys fs.FS, name string, opts LoadOptions) ([]sexp.Element, error) {
+	rules, err := LoadFSWithMeta(fsys, name, opts)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return nil, err
 	}
-	defer file.Close()
-
-	switch format {
-	case FormatBinary:
-		return saveBinary(file, rules)
-	case FormatAdvanced:
-		return saveAdvanced(file, rules)
-	default:
-		return saveCanonical(file, rules)
+	elems := make([]sexp.Element, len(rules))
+	for i, rule := range rules {
+		elems[i] = rule.Element
 	}
+	return elems, nil
 }
 
-// loadText loads rules from a text file (canonical or advanced form)
-func loadText(r io.Reader, opts LoadOptions) ([]sexp.Element, error) {
-	scanner := bufio.NewScanner(r)
-	rules := make([]sexp.Element, 0)
-	lineNum := 0
-
-	for scanner.Scan() {
-		lineNum++
-		line := strings.TrimSpace(scanner.Text())
-
-		// Skip empty lines
-		if line == "" {
-			continue
-		}
-
-		// Skip comments
-		if isComment(line, opts.Comments) {
-			continue
-		}
-
-		// Parse the rule
-		var elem sexp.Element
-		var err error
-
-		if opts.Format == FormatAdvanced {
-			// Convert advanced form to canonical, then parse
-			canonical := advancedToCanonical(line)
-			parser := sexp.NewParser(canonical)
-			elem, err = parser.Parse()
-		} else {
-			// Parse canonical form directly
-			parser := sexp.NewParser(line)
-			elem, err = parser.Parse()
-		}
-
-		if err != nil {
-			if opts.SkipInvalid {
-				continue
-			}
-			return nil, fmt.Errorf("line %d: failed to parse rule: %w", lineNum, err)
-		}
-
-		rules = append(rules, elem)
-
-		// Check max rules limit
-		if opts.MaxRules > 0 && len(rules) >= opts.MaxRules {
-			break
+// LoadFSWithMeta loads rules from a file in fsys like LoadFileWithMeta
+func LoadFSWithMeta(fsys fs.FS, name string, opts LoadOptions) ([]Rule, error) {
+	l := newLoader(opts)
+	l.fsys = fsys
+	if opts.Format == FormatBinary || opts.Format == FormatBinaryV2 {
+		if err := l.loadBinaryFile(name); err != nil {
+			return nil, err
 		}
+		return l.rules, nil
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading file: %w", err)
+	if err := l.loadFile(name); err != nil {
+		return nil, err
 	}
+	return l.rules, nil
+}
 
-	return rules, nil
+// LoadFileToSlice is a convenience function that loads rules into a slice
+// This is the recommended way to load rules for most use cases
+func LoadFileToSlice(filename string) ([]sexp.Element, error) {
+	return LoadFile(filename, DefaultLoadOptions())
+}
+
+// SaveFile saves rules to a file in the specified format. The file is
+// replaced atomically (see WriteFileAtomic). Rules holding typed star
+// forms, as JSON and YAML files load, can only be saved in FormatBinaryV2,
+// FormatJSON and FormatYAML; the other formats return an error.
+func SaveFile(filename string, rules []sexp.Element, format FileFormat) error {
+	return SaveFileWithOptions(filename, rules, format, SaveOptions{})
 }
 
 // saveCanonical saves rules in canonical S-expression format (one per line)
@@ -182,7 +235,7 @@ func saveAdvanced(w io.Writer, rules []sexp.Element) error {
 	return writer.Flush()
 }
 
-// Binary format specification:
+// Binary format specification (version 1, see binary_v2.go for version 2):
 // - Magic number: "SPOCP" (5 bytes)
 // - Version: uint8 (1 byte)
 // - Rule count: uint32 (4 bytes)
@@ -237,8 +290,17 @@ func saveBinary(w io.Writer, rules []sexp.Element) error {
 	return nil
 }
 
-// loadBinary loads rules from binary format
+// loadBinary loads rules from binary format (any version)
 func loadBinary(r io.Reader) ([]sexp.Element, error) {
+	rs, err := readBinary(r)
+	if err != nil {
+		return nil, err
+	}
+	return rs.Rules, nil
+}
+
+// readBinary reads a binary ruleset, dispatching on the format version
+func readBinary(r io.Reader) (*Ruleset, error) {
 	// Read and verify magic number
 	magic := make([]byte, len(binaryMagic))
 	if _, err := io.ReadFull(r, magic); err != nil {
@@ -253,10 +315,27 @@ func loadBinary(r io.Reader) ([]sexp.Element, error) {
 	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
 		return nil, fmt.Errorf("failed to read version: %w", err)
 	}
-	if version != binaryVersion {
+
+	switch version {
+	case binaryVersion:
+		rules, err := readBinaryV1(r)
+		if err != nil {
+			return nil, err
+		}
+		return NewRuleset(rules, nil), nil
+	case binaryVersion2:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read payload: %w", err)
+		}
+		return decodeV2(data)
+	default:
 		return nil, fmt.Errorf("unsupported version: %d", version)
 	}
+}
 
+// readBinaryV1 reads the rules of a version 1 file following the version byte
+func readBinaryV1(r io.Reader) ([]sexp.Element, error) {
 	// Read rule count
 	var count uint32
 	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
@@ -345,11 +424,75 @@ func isComment(line string, prefixes []string) bool {
 	return false
 }
 
+// openVerified opens a file for loading. With opts.Verify set, the file is
+// read and verified up front so that exactly the verified bytes are parsed.
+func openVerified(filename string, opts LoadOptions) (io.ReadCloser, error) {
+	if opts.Verify == nil {
+		opts.opened(filename)
+		file, err := os.Open(filename) //nolint:gosec // rule files are chosen by the operator
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file: %w", err)
+		}
+		return file, nil
+	}
+
+	data, err := readVerified(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// readVerified reads a whole file and checks it with opts.Verify
+func readVerified(filename string, opts LoadOptions) ([]byte, error) {
+	opts.opened(filename)
+	data, err := os.ReadFile(filename) //nolint:gosec // rule files are chosen by the operator
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	if err := opts.Verify(filename, data); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return data, nil
+}
+
+// opened calls the Opened callback, if set
+func (opts LoadOptions) opened(filename string) {
+	if opts.Opened != nil {
+		opts.Opened(filename)
+	}
+}
+
+// IsRuleFile reports whether filename has the extension of a rule file:
+// .spoc (text), .spocp or .bin (binary), .json, .yaml or .yml
+func IsRuleFile(filename string) bool {
+	if isBinaryFile(filename) || strings.HasSuffix(filename, ".spoc") {
+		return true
+	}
+	_, ok := structuredFormat(filename, FormatCanonical)
+	return ok
+}
+
 func isBinaryFile(filename string) bool {
 	return strings.HasSuffix(filename, ".spocp") ||
 		strings.HasSuffix(filename, ".bin")
 }
 
+// structuredFormat returns FormatJSON or FormatYAML for files in those
+// formats, detected by extension unless format names one of them, and
+// reports whether the file is structured at all
+func structuredFormat(filename string, format FileFormat) (FileFormat, bool) {
+	switch {
+	case strings.HasSuffix(filename, ".json"):
+		return FormatJSON, true
+	case strings.HasSuffix(filename, ".yaml"), strings.HasSuffix(filename, ".yml"):
+		return FormatYAML, true
+	case format == FormatJSON, format == FormatYAML:
+		return format, true
+	}
+	return format, false
+}
+
 // advancedToCanonical converts advanced form to canonical form
 // This is a simple implementation - for production use, you might want
 // a more sophisticated parser
@@ -1,9 +1,11 @@
 package persist
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
 	"testing"
+	"testing/fstest"
 
 	"github.com/sirosfoundation/go-spocp/pkg/sexp"
 )
@@ -575,3 +577,67 @@ func TestLoadBinaryErrors(t *testing.T) {
 		t.Error("Expected error for truncated file")
 	}
 }
+
+func TestLoadFS(t *testing.T) {
+	var bin bytes.Buffer
+	if err := saveBinary(&bin, []sexp.Element{sexp.NewList("binary")}); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fstest.MapFS{
+		"policy/main.spoc": {Data: []byte(`include "common/*.spoc"
+template quota (4:plan5:$tier)
+instantiate quota data/tiers.json
+`)},
+		"policy/common/base.spoc": {Data: []byte("(4:read)\n")},
+		"policy/data/tiers.json":  {Data: []byte(`[{"tier": "gold"}]`)},
+		"policy/web.json":         {Data: []byte(`{"rules": [{"tag": "http", "elements": ["GET"]}]}`)},
+		"policy/cache.spocp":      {Data: bin.Bytes()},
+	}
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"policy/main.spoc", []string{"(4:read)", "(4:plan4:gold)"}},
+		{"policy/web.json", []string{"(4:http3:GET)"}},
+		{"policy/cache.spocp", []string{"(6:binary)"}},
+	}
+	for _, tt := range tests {
+		rules, err := LoadFS(fsys, tt.name, DefaultLoadOptions())
+		if err != nil {
+			t.Fatalf("LoadFS(%s) failed: %v", tt.name, err)
+		}
+		if len(rules) != len(tt.want) {
+			t.Fatalf("LoadFS(%s): expected %d rules, got %d", tt.name, len(tt.want), len(rules))
+		}
+		for i, w := range tt.want {
+			if rules[i].String() != w {
+				t.Errorf("LoadFS(%s) rule %d: expected %s, got %s", tt.name, i, w, rules[i])
+			}
+		}
+	}
+
+	rs, err := LoadRulesetFS(fsys, "policy/main.spoc", DefaultLoadOptions())
+	if err != nil {
+		t.Fatalf("LoadRulesetFS failed: %v", err)
+	}
+	if rs.Meta[1].File != "policy/main.spoc" || rs.Meta[1].Template != "quota" {
+		t.Errorf("Unexpected metadata: %+v", rs.Meta[1])
+	}
+
+	if _, err := LoadFS(fsys, "policy/missing.spoc", DefaultLoadOptions()); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestIsRuleFile(t *testing.T) {
+	for name, want := range map[string]bool{
+		"a.spoc": true, "a.spocp": true, "a.bin": true, "a.json": true, "a.yaml": true, "a.yml": true,
+		"a.spoc.sig": false, "a.spoc.1": false, "a.csv": false, "README": false,
+	} {
+		if got := IsRuleFile(name); got != want {
+			t.Errorf("IsRuleFile(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package persist
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"iter"
+)
+
+// DefaultProgressInterval is the default for LoadOptions.ProgressInterval
+const DefaultProgressInterval = 100000
+
+// Progress reports how far loading has come
+type Progress struct {
+	// Rules is the number of rules loaded so far
+	Rules int
+
+	// Bytes is the number of bytes read from the text file or reader being
+	// loaded, not counting included files; 0 for other formats
+	Bytes int64
+
+	// Size is the size of that file if known, otherwise 0
+	Size int64
+}
+
+// errStopScan ends loading when a Scan consumer stops iterating
+var errStopScan = errors.New("scan stopped")
+
+// Scan returns an iterator over the rules of a text rule file read from r,
+// in the format given by opts, parsing one statement at a time. Unlike
+// LoadFile, rules are not collected, so memory use does not grow with the
+// number of rules (defines, variables and templates are kept), and lines
+// may be of any length.
+//
+// Include and instantiate paths are relative to the working directory.
+// Iteration stops after the first error, which is yielded with a zero
+// Rule. r is consumed, so the iterator can only be used once.
+//
+//	for rule, err := range persist.Scan(r, persist.DefaultLoadOptions()) {
+//		if err != nil {
+//			return err
+//		}
+//		engine.AddRuleElement(rule.Element)
+//	}
+func Scan(r io.Reader, opts LoadOptions) iter.Seq2[Rule, error] {
+	return func(yield func(Rule, error) bool) {
+		l := newScanLoader(opts, yield)
+		if opts.Progress != nil {
+			r = l.track(r)
+		}
+		l.finish(l.loadReader(r, ""), yield)
+	}
+}
+
+// ScanFile returns an iterator over the rules of a file like Scan. Text
+// files are read statement by statement, following includes; binary, JSON
+// and YAML files are decoded whole before their rules are yielded.
+func ScanFile(filename string, opts LoadOptions) iter.Seq2[Rule, error] {
+	return func(yield func(Rule, error) bool) {
+		l := newScanLoader(opts, yield)
+		if opts.Format == FormatBinary || opts.Format == FormatBinaryV2 {
+			l.finish(l.loadBinaryFile(filename), yield)
+			return
+		}
+		l.finish(l.loadFile(filename), yield)
+	}
+}
+
+// newScanLoader returns a loader passing rules to yield
+func newScanLoader(opts LoadOptions, yield func(Rule, error) bool) *loader {
+	l := newLoader(opts)
+	l.emit = func(rule Rule) error {
+		if !yield(rule, nil) {
+			return errStopScan
+		}
+		return nil
+	}
+	return l
+}
+
+// finish yields the error that ended loading, if the consumer is still
+// iterating
+func (l *loader) finish(err error, yield func(Rule, error) bool) {
+	if err != nil && !errors.Is(err, errStopScan) {
+		yield(Rule{}, err)
+	}
+}
+
+// progressInterval returns the number of rules between progress reports
+func (l *loader) progressInterval() int {
+	if l.opts.ProgressInterval > 0 {
+		return l.opts.ProgressInterval
+	}
+	return DefaultProgressInterval
+}
+
+// progress returns the current progress
+func (l *loader) progress() Progress {
+	p := Progress{Rules: l.count}
+	if l.input != nil {
+		p.Bytes = l.input.n
+		p.Size = l.input.size
+	}
+	return p
+}
+
+// track counts the bytes read from r, the top-level input, for progress
+// reports
+func (l *loader) track(r io.Reader) io.Reader {
+	l.input = &countingReader{r: r}
+	if f, ok := r.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			l.input.size = info.Size()
+		}
+	}
+	return l.input
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r    io.Reader
+	n    int64
+	size int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
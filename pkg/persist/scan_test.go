@@ -0,0 +1,150 @@
+package persist
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	content := "# rules\n(5:admin)\n(4:http\n  (4:page)\n)\ndefine ROLE (4:user)\n(4:role5:$ROLE)\n"
+
+	var got []string
+	var lines []int
+	for rule, err := range Scan(strings.NewReader(content), DefaultLoadOptions()) {
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		got = append(got, rule.Element.String())
+		lines = append(lines, rule.Meta.Line)
+	}
+
+	want := []string{"(5:admin)", "(4:http(4:page))", "(4:role(4:user))"}
+	if fmt.Sprint(got) != fmt.Sprint(want) || fmt.Sprint(lines) != "[2 3 7]" {
+		t.Errorf("Expected %v at lines [2 3 7], got %v at %v", want, got, lines)
+	}
+}
+
+func TestScanStop(t *testing.T) {
+	content := "(1:a)\n(1:b)\n(1:c)\n"
+	count := 0
+	for _, err := range Scan(strings.NewReader(content), DefaultLoadOptions()) {
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		count++
+		if count == 2 {
+			break
+		}
+	}
+	if count != 2 {
+		t.Errorf("Expected to stop after 2 rules, got %d", count)
+	}
+
+	// Errors end the iteration after the rules before them
+	var rules, errs int
+	for _, err := range Scan(strings.NewReader("(1:a)\n(1:b\n"), DefaultLoadOptions()) {
+		if err != nil {
+			var pe *ParseError
+			if !errors.As(err, &pe) || pe.Line != 2 {
+				t.Errorf("Expected ParseError at line 2, got %v", err)
+			}
+			errs++
+			continue
+		}
+		rules++
+	}
+	if rules != 1 || errs != 1 {
+		t.Errorf("Expected 1 rule and 1 error, got %d and %d", rules, errs)
+	}
+}
+
+func TestScanLongLines(t *testing.T) {
+	// A single rule far beyond bufio.Scanner's 64KB line limit
+	value := strings.Repeat("x", 1<<20)
+	rule := fmt.Sprintf("(4:data(5:value%d:%s))", len(value), value)
+	filename := writeRuleFile(t, t.TempDir(), "huge.spoc", "(5:admin)\n"+rule+"\n")
+
+	rules, err := LoadFile(filename, DefaultLoadOptions())
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if len(rules) != 2 || rules[1].String() != rule {
+		t.Fatalf("Expected the long rule to load intact, got %d rules", len(rules))
+	}
+
+	// Error positions stay exact on long lines
+	bad := strings.Replace(rule, "(5:value", "(5:value (5:extra) xx:", 1)
+	filename = writeRuleFile(t, t.TempDir(), "bad.spoc", bad+"\n")
+	_, err = LoadFile(filename, DefaultLoadOptions())
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Line != 1 || pe.Col != strings.Index(bad, "xx")+1 {
+		t.Errorf("Expected error at 1:%d, got %v", strings.Index(bad, "xx")+1, err)
+	}
+}
+
+func TestScanFile(t *testing.T) {
+	dir := t.TempDir()
+	writeRuleFile(t, dir, "common.spoc", "(6:common)\n")
+	var b strings.Builder
+	b.WriteString("include \"common.spoc\"\n")
+	for i := 0; i < 25; i++ {
+		fmt.Fprintf(&b, "(4:rule(2:id%d:%d))\n", len(fmt.Sprint(i)), i)
+	}
+	filename := writeRuleFile(t, dir, "main.spoc", b.String())
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reports []Progress
+	opts := DefaultLoadOptions()
+	opts.ProgressInterval = 10
+	opts.Progress = func(p Progress) { reports = append(reports, p) }
+
+	count := 0
+	for rule, err := range ScanFile(filename, opts) {
+		if err != nil {
+			t.Fatalf("ScanFile failed: %v", err)
+		}
+		if count == 0 && (rule.Element.String() != "(6:common)" || filepath.Base(rule.Meta.File) != "common.spoc") {
+			t.Errorf("Expected the included rule first, got %s from %s", rule.Element, rule.Meta.File)
+		}
+		count++
+	}
+	if count != 26 {
+		t.Errorf("Expected 26 rules, got %d", count)
+	}
+
+	if len(reports) != 2 || reports[0].Rules != 10 || reports[1].Rules != 20 {
+		t.Fatalf("Expected reports at 10 and 20 rules, got %+v", reports)
+	}
+	for _, p := range reports {
+		if p.Size != info.Size() || p.Bytes <= 0 || p.Bytes > p.Size {
+			t.Errorf("Unexpected byte counts: %+v (size %d)", p, info.Size())
+		}
+	}
+
+	// MaxRules applies to scans too
+	opts = DefaultLoadOptions()
+	opts.MaxRules = 5
+	count = 0
+	for _, err := range ScanFile(filename, opts) {
+		if err != nil {
+			t.Fatalf("ScanFile failed: %v", err)
+		}
+		count++
+	}
+	if count != 5 {
+		t.Errorf("Expected 5 rules, got %d", count)
+	}
+
+	for _, err := range ScanFile(filepath.Join(dir, "missing.spoc"), DefaultLoadOptions()) {
+		if err == nil {
+			t.Error("Expected error for missing file")
+		}
+	}
+}
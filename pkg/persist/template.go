@@ -0,0 +1,182 @@
+package persist
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// Templates generate families of near-identical rules from a data file:
+//
+//	$admins = (* set alice bob carol)
+//	template web (http (user $admins) (role $role) (path (* prefix $path)))
+//	instantiate web "web-roles.csv"
+//
+// The data file is CSV with a header row, or JSON holding an array of
+// objects. Each row yields one rule: a column named "role" binds $role.
+// Row values take precedence over variables of the same name. Every
+// generated rule records the template name, its source and the row values
+// in its RuleMeta.
+
+// template is a parsed template directive
+type template struct {
+	name   string
+	body   sexp.Element
+	source string // canonical form of the body
+	file   string
+	line   int
+}
+
+func newTemplate(name string, body sexp.Element, file string, line int) *template {
+	return &template{
+		name:   name,
+		body:   body,
+		source: body.String(),
+		file:   file,
+		line:   line,
+	}
+}
+
+// instantiate emits one rule per data row for an instantiate directive
+func (l *loader) instantiate(filename string, st *statement) error {
+	errorf := func(format string, args ...any) error {
+		return &ParseError{File: filename, Line: st.start.line, Col: st.start.col, Err: fmt.Errorf(format, args...)}
+	}
+
+	tmpl, ok := l.templates[st.name]
+	if !ok {
+		return errorf("undefined template %s", st.name)
+	}
+
+	rows, err := l.loadTemplateData(l.resolve(filename, st.path))
+	if err != nil {
+		return errorf("instantiate %s: %v", st.name, err)
+	}
+
+	for i, row := range rows {
+		if l.full() {
+			break
+		}
+
+		params := make(map[string]sexp.Element, len(row))
+		for key, value := range row {
+			params["$"+key] = sexp.NewAtom(value)
+		}
+
+		elem, err := l.expand(tmpl.body, params)
+		if err != nil {
+			return errorf("instantiate %s: row %d: %v", st.name, i+1, err)
+		}
+
+		err = l.add(Rule{
+			Element: elem,
+			Meta: RuleMeta{
+				File:           filename,
+				Line:           st.start.line,
+				Template:       tmpl.name,
+				TemplateSource: tmpl.source,
+				Params:         row,
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadTemplateData reads template rows from a CSV or JSON file
+func (l *loader) loadTemplateData(path string) ([]map[string]string, error) {
+	file, err := l.open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return parseCSVRows(file)
+	case ".json":
+		return parseJSONRows(file)
+	default:
+		return nil, fmt.Errorf("unsupported data file %s (want .csv or .json)", path)
+	}
+}
+
+// parseCSVRows reads CSV with a header row naming the parameters
+func parseCSVRows(r io.Reader) ([]map[string]string, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	header := records[0]
+	for _, name := range header {
+		if !variableName.MatchString("$" + name) {
+			return nil, fmt.Errorf("invalid parameter name %q in header", name)
+		}
+	}
+
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, name := range header {
+			row[name] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseJSONRows reads a JSON array of objects with scalar values
+func parseJSONRows(r io.Reader) ([]map[string]string, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+
+	var objects []map[string]any
+	if err := decoder.Decode(&objects); err != nil {
+		return nil, err
+	}
+
+	rows := make([]map[string]string, 0, len(objects))
+	for i, obj := range objects {
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		row := make(map[string]string, len(obj))
+		for _, key := range keys {
+			if !variableName.MatchString("$" + key) {
+				return nil, fmt.Errorf("row %d: invalid parameter name %q", i+1, key)
+			}
+			switch v := obj[key].(type) {
+			case string:
+				row[key] = v
+			case json.Number:
+				row[key] = v.String()
+			case bool:
+				row[key] = fmt.Sprintf("%t", v)
+			default:
+				return nil, fmt.Errorf("row %d: parameter %q must be a string, number or boolean", i+1, key)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
@@ -0,0 +1,165 @@
+package persist
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadVariables(t *testing.T) {
+	tmpDir := t.TempDir()
+	filename := writeRuleFile(t, tmpDir, "vars.spoc", `$admins = (* set alice bob carol)
+(http (user $admins) (action GET))
+`)
+
+	opts := DefaultLoadOptions()
+	opts.Format = FormatAdvanced
+	loaded, err := LoadFile(filename, opts)
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if len(loaded) != 1 {
+		t.Fatalf("Expected 1 rule, got %d", len(loaded))
+	}
+	want := "(4:http(4:user(1:*3:set5:alice3:bob5:carol))(6:action3:GET))"
+	if got := loaded[0].String(); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestLoadUndefinedVariable(t *testing.T) {
+	filename := writeRuleFile(t, t.TempDir(), "bad.spoc", "$admins = 5:alice\n(4:http(4:user7:$nobody))\n")
+
+	_, err := LoadFile(filename, DefaultLoadOptions())
+	if err == nil || !strings.Contains(err.Error(), "undefined variable $nobody") {
+		t.Fatalf("Expected undefined variable error, got: %v", err)
+	}
+}
+
+// TestLoadDollarAtoms tests that atoms starting with $ stay literal in
+// files that declare no variables
+func TestLoadDollarAtoms(t *testing.T) {
+	filename := writeRuleFile(t, t.TempDir(), "prices.spoc", "(5:price4:$100)\n(3:env5:$HOME)\n")
+
+	loaded, err := LoadFile(filename, DefaultLoadOptions())
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if len(loaded) != 2 || loaded[1].String() != "(3:env5:$HOME)" {
+		t.Errorf("Expected the rules unchanged, got %v", loaded)
+	}
+}
+
+func TestInstantiateCSV(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeRuleFile(t, tmpDir, "roles.csv", "role,path\nadmin,/admin\n# comment\nuser,/home\n")
+	filename := writeRuleFile(t, tmpDir, "web.spoc", `$methods = (* set GET POST)
+template web (http (role $role) (path $path) (method $methods))
+instantiate web "roles.csv"
+`)
+
+	opts := DefaultLoadOptions()
+	opts.Format = FormatAdvanced
+	rules, err := LoadFileWithMeta(filename, opts)
+	if err != nil {
+		t.Fatalf("LoadFileWithMeta failed: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("Expected 2 rules, got %d", len(rules))
+	}
+
+	want := []string{
+		"(4:http(4:role5:admin)(4:path6:/admin)(6:method(1:*3:set3:GET4:POST)))",
+		"(4:http(4:role4:user)(4:path5:/home)(6:method(1:*3:set3:GET4:POST)))",
+	}
+	for i, rule := range rules {
+		if got := rule.Element.String(); got != want[i] {
+			t.Errorf("Rule %d: expected %s, got %s", i, want[i], got)
+		}
+		if rule.Meta.Template != "web" {
+			t.Errorf("Rule %d: expected template web, got %q", i, rule.Meta.Template)
+		}
+		if !strings.Contains(rule.Meta.TemplateSource, "5:$role") {
+			t.Errorf("Rule %d: template source not kept: %s", i, rule.Meta.TemplateSource)
+		}
+		if rule.Meta.File != filename || rule.Meta.Line != 3 {
+			t.Errorf("Rule %d: unexpected location %s:%d", i, rule.Meta.File, rule.Meta.Line)
+		}
+	}
+	if rules[1].Meta.Params["role"] != "user" {
+		t.Errorf("Expected params to be recorded, got %v", rules[1].Meta.Params)
+	}
+}
+
+func TestInstantiateJSON(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeRuleFile(t, tmpDir, "data/limits.json", `[{"tier": "gold", "max": 100}, {"tier": "free", "max": 5}]`)
+	filename := writeRuleFile(t, tmpDir, "limits.spoc", `template quota (4:plan5:$tier(3:max4:$max))
+instantiate quota data/limits.json
+`)
+
+	loaded, err := LoadFile(filename, DefaultLoadOptions())
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	want := []string{"(4:plan4:gold(3:max3:100))", "(4:plan4:free(3:max1:5))"}
+	if len(loaded) != len(want) {
+		t.Fatalf("Expected %d rules, got %d", len(want), len(loaded))
+	}
+	for i, w := range want {
+		if loaded[i].String() != w {
+			t.Errorf("Rule %d: expected %s, got %s", i, w, loaded[i].String())
+		}
+	}
+}
+
+func TestInstantiateErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			name:    "undefined template",
+			files:   map[string]string{"main.spoc": "instantiate nope \"x.csv\"\n"},
+			wantErr: "undefined template nope",
+		},
+		{
+			name: "missing parameter",
+			files: map[string]string{
+				"main.spoc": "template t (1:a2:$x2:$y)\ninstantiate t \"d.csv\"\n",
+				"d.csv":     "x\n1\n",
+			},
+			wantErr: "row 1: undefined variable $y",
+		},
+		{
+			name: "unsupported data file",
+			files: map[string]string{
+				"main.spoc": "template t (1:a2:$x)\ninstantiate t \"d.txt\"\n",
+				"d.txt":     "x\n",
+			},
+			wantErr: "unsupported data file",
+		},
+		{
+			name: "nested JSON value",
+			files: map[string]string{
+				"main.spoc": "template t (1:a2:$x)\ninstantiate t \"d.json\"\n",
+				"d.json":    `[{"x": {"y": 1}}]`,
+			},
+			wantErr: "must be a string",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			for name, content := range tt.files {
+				writeRuleFile(t, tmpDir, name, content)
+			}
+			_, err := LoadFile(filepath.Join(tmpDir, "main.spoc"), DefaultLoadOptions())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,603 @@
+package persist
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+	"github.com/sirosfoundation/go-spocp/pkg/starform"
+)
+
+// YAML rule files use the same document structure as JSON rule files (see
+// json.go), for example:
+//
+//	rules:
+//	  - tag: http
+//	    elements:
+//	      - tag: page
+//	        elements: [index.html]
+//	      - {range: numeric, ge: 5}
+//
+// Only the subset of YAML needed for this is supported: block mappings and
+// sequences, flow sequences and mappings, plain, single- and double-quoted
+// scalars on one line, comments and a leading "---". Anchors, aliases, tags
+// and block scalars are rejected. All scalars are strings.
+
+// yamlLine is a non-blank line with comments removed
+type yamlLine struct {
+	num    int // 1-based line number
+	indent int
+	text   string
+}
+
+// yamlParser parses the block structure of a YAML document
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseYAML parses a YAML document into maps, slices and strings
+func parseYAML(data []byte) (any, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(raw, "\r")
+		if strings.Contains(raw[:len(raw)-len(strings.TrimLeft(raw, " \t"))], "\t") {
+			return nil, &ParseError{Line: i + 1, Col: 1, Err: errors.New("tabs are not allowed for indentation")}
+		}
+		text := strings.TrimRight(stripYAMLComment(raw), " ")
+		trimmed := strings.TrimLeft(text, " ")
+		if strings.TrimSpace(trimmed) == "" {
+			continue
+		}
+		if len(p.lines) == 0 && (trimmed == "---" || strings.HasPrefix(trimmed, "%")) {
+			continue
+		}
+		if trimmed == "---" || trimmed == "..." {
+			return nil, &ParseError{Line: i + 1, Col: 1, Err: errors.New("multiple documents are not supported")}
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	v, err := p.node(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf(p.lines[p.pos], p.lines[p.pos].indent, "unexpected indentation")
+	}
+	return v, nil
+}
+
+// stripYAMLComment removes a comment that is not inside quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' '):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func (p *yamlParser) errorf(line yamlLine, col int, format string, args ...any) error {
+	return &ParseError{Line: line.num, Col: col + 1, Err: fmt.Errorf(format, args...)}
+}
+
+// node parses the block node starting at the current line
+func (p *yamlParser) node(indent int) (any, error) {
+	line := p.lines[p.pos]
+	switch {
+	case isYAMLSequenceItem(line.text):
+		return p.sequence(indent)
+	case yamlKey(line.text) >= 0:
+		return p.mapping(indent)
+	default:
+		p.pos++
+		return parseYAMLFlow(line, line.text, line.indent)
+	}
+}
+
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// yamlKey returns the index of the colon ending a mapping key, or -1
+func yamlKey(text string) int {
+	if text == "" || text[0] == '[' || text[0] == '{' {
+		return -1
+	}
+	if text[0] == '"' || text[0] == '\'' {
+		end := closingQuote(text)
+		if end < 0 || end+1 >= len(text) || text[end+1] != ':' {
+			return -1
+		}
+		if end+2 < len(text) && text[end+2] != ' ' {
+			return -1
+		}
+		return end + 1
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return i
+		}
+	}
+	return -1
+}
+
+// closingQuote returns the index of the quote ending the scalar at text[0]
+func closingQuote(text string) int {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case text[i] == quote:
+			if quote == '\'' && i+1 < len(text) && text[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// sequence parses block sequence items at indent
+func (p *yamlParser) sequence(indent int) (any, error) {
+	items := []any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent || !isYAMLSequenceItem(line.text) {
+			return nil, p.errorf(line, line.indent, "unexpected indentation")
+		}
+
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if rest == "" {
+			// The item is the nested block on the following lines
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				items = append(items, nil)
+				continue
+			}
+			v, err := p.node(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+			continue
+		}
+
+		// "- key: value" starts a mapping indented at the item content
+		offset := len(line.text) - len(rest)
+		p.lines[p.pos] = yamlLine{num: line.num, indent: line.indent + offset, text: rest}
+		v, err := p.node(line.indent + offset)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+// mapping parses block mapping entries at indent
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := map[string]any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		colon := yamlKey(line.text)
+		if line.indent > indent || colon < 0 {
+			return nil, p.errorf(line, line.indent, "expected a mapping key")
+		}
+
+		key, err := parseYAMLScalar(line, line.text[:colon], line.indent)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf(line, line.indent, "duplicate key %q", key)
+		}
+		value := strings.TrimSpace(line.text[colon+1:])
+		p.pos++
+
+		switch {
+		case value != "":
+			m[key], err = parseYAMLFlow(line, value, line.indent+colon+2)
+		case p.pos < len(p.lines) && p.lines[p.pos].indent > indent:
+			m[key], err = p.node(p.lines[p.pos].indent)
+		case p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLSequenceItem(p.lines[p.pos].text):
+			// Sequences may start at the indentation of their key
+			m[key], err = p.sequence(indent)
+		default:
+			m[key] = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// parseYAMLFlow parses a scalar or flow collection making up the rest of a line
+func parseYAMLFlow(line yamlLine, text string, col int) (any, error) {
+	fp := &yamlFlow{line: line, text: text, col: col}
+	v, err := fp.value()
+	if err != nil {
+		return nil, err
+	}
+	fp.skipSpace()
+	if fp.pos < len(fp.text) {
+		return nil, fp.errorf("unexpected %q", fp.text[fp.pos:])
+	}
+	return v, nil
+}
+
+// yamlFlow parses flow collections within a single line
+type yamlFlow struct {
+	line  yamlLine
+	text  string
+	col   int // column of text[0]
+	pos   int
+	depth int // nesting of flow collections
+}
+
+func (f *yamlFlow) errorf(format string, args ...any) error {
+	return &ParseError{Line: f.line.num, Col: f.col + f.pos + 1, Err: fmt.Errorf(format, args...)}
+}
+
+func (f *yamlFlow) skipSpace() {
+	for f.pos < len(f.text) && f.text[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+func (f *yamlFlow) value() (any, error) {
+	f.skipSpace()
+	if f.pos >= len(f.text) {
+		return nil, f.errorf("missing value")
+	}
+	switch f.text[f.pos] {
+	case '[':
+		return f.collection(']')
+	case '{':
+		return f.collection('}')
+	default:
+		return f.scalar(false)
+	}
+}
+
+// collection parses [a, b] or {k: v, ...}
+func (f *yamlFlow) collection(end byte) (any, error) {
+	f.pos++
+	f.depth++
+	defer func() { f.depth-- }()
+	var items []any
+	m := map[string]any{}
+	for {
+		f.skipSpace()
+		if f.pos < len(f.text) && f.text[f.pos] == end {
+			f.pos++
+			break
+		}
+		if end == ']' {
+			v, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		} else {
+			key, err := f.scalar(true)
+			if err != nil {
+				return nil, err
+			}
+			f.skipSpace()
+			if f.pos >= len(f.text) || f.text[f.pos] != ':' {
+				return nil, f.errorf("expected ':' after key %q", key)
+			}
+			f.pos++
+			v, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := m[key]; dup {
+				return nil, f.errorf("duplicate key %q", key)
+			}
+			m[key] = v
+		}
+		f.skipSpace()
+		if f.pos < len(f.text) && f.text[f.pos] == ',' {
+			f.pos++
+			continue
+		}
+		if f.pos < len(f.text) && f.text[f.pos] == end {
+			f.pos++
+			break
+		}
+		return nil, f.errorf("expected ',' or %q", end)
+	}
+	if end == ']' {
+		if items == nil {
+			items = []any{}
+		}
+		return items, nil
+	}
+	return m, nil
+}
+
+// scalar parses a quoted or plain scalar inside a flow collection (or the
+// whole remaining text); keys end at ':'
+func (f *yamlFlow) scalar(key bool) (string, error) {
+	f.skipSpace()
+	rest := f.text[f.pos:]
+	if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+		end := closingQuote(rest)
+		if end < 0 {
+			return "", f.errorf("unterminated quoted scalar")
+		}
+		s, err := unquoteYAML(rest[:end+1])
+		if err != nil {
+			return "", f.errorf("%v", err)
+		}
+		f.pos += end + 1
+		return s, nil
+	}
+
+	n := 0
+	for n < len(rest) {
+		c := rest[n]
+		if f.depth > 0 && strings.IndexByte(",[]{}", c) >= 0 {
+			break
+		}
+		if c == ':' && (key || n+1 == len(rest) || rest[n+1] == ' ') {
+			break
+		}
+		n++
+	}
+	s := strings.TrimSpace(rest[:n])
+	if s == "" {
+		return "", f.errorf("missing value")
+	}
+	if strings.ContainsRune("&*!|>%@`", rune(s[0])) {
+		return "", f.errorf("unsupported YAML feature %q (quote the value)", s[:1])
+	}
+	f.pos += n
+	return s, nil
+}
+
+// parseYAMLScalar parses a complete scalar such as a mapping key
+func parseYAMLScalar(line yamlLine, text string, col int) (string, error) {
+	f := &yamlFlow{line: line, text: text, col: col}
+	s, err := f.scalar(false)
+	if err != nil {
+		return "", err
+	}
+	f.skipSpace()
+	if f.pos < len(f.text) {
+		return "", f.errorf("unexpected %q", f.text[f.pos:])
+	}
+	return s, nil
+}
+
+// unquoteYAML decodes a single- or double-quoted scalar
+func unquoteYAML(s string) (string, error) {
+	if s[0] == '\'' {
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+
+	var sb strings.Builder
+	body := s[1 : len(s)-1]
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c != '\\' {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(body) {
+			return "", errors.New("invalid escape at end of string")
+		}
+		switch body[i] {
+		case '0':
+			sb.WriteByte(0)
+		case 'a':
+			sb.WriteByte('\a')
+		case 'b':
+			sb.WriteByte('\b')
+		case 't':
+			sb.WriteByte('\t')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'v':
+			sb.WriteByte('\v')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'e':
+			sb.WriteByte(0x1b)
+		case ' ', '"', '/', '\\':
+			sb.WriteByte(body[i])
+		case 'x', 'u', 'U':
+			size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[body[i]]
+			if i+1+size > len(body) {
+				return "", fmt.Errorf("invalid escape \\%c", body[i])
+			}
+			code, err := strconv.ParseUint(body[i+1:i+1+size], 16, 32)
+			if err != nil {
+				return "", fmt.Errorf("invalid escape \\%c", body[i])
+			}
+			sb.WriteRune(rune(code))
+			i += size
+		default:
+			return "", fmt.Errorf("invalid escape \\%c", body[i])
+		}
+	}
+	return sb.String(), nil
+}
+
+// decodeYAMLRules parses a YAML rule document, returning the rule values
+func decodeYAMLRules(data []byte) ([]any, error) {
+	doc, err := parseYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := doc.(map[string]any)
+	if !ok {
+		return nil, errors.New(`invalid YAML rule document: expected a mapping with a "rules" sequence`)
+	}
+	rules, ok := m["rules"].([]any)
+	if !ok {
+		return nil, errors.New(`invalid YAML rule document: missing "rules" sequence`)
+	}
+	return rules, nil
+}
+
+var (
+	// yamlPlainSafe matches scalars that can be written unquoted
+	yamlPlainSafe = regexp.MustCompile(`^[A-Za-z0-9_./$+=^(][A-Za-z0-9_./$+=^()@ -]*$`)
+
+	// yamlImplicit matches scalars other YAML parsers would not read as strings
+	yamlImplicit = regexp.MustCompile(`(?i)^([-+.]?[0-9].*|\.inf|\.nan|true|false|yes|no|on|off|y|n|null|~)$`)
+)
+
+// yamlScalar formats a string scalar, quoting it when needed
+func yamlScalar(s string) string {
+	if yamlPlainSafe.MatchString(s) && !yamlImplicit.MatchString(s) && !strings.HasSuffix(s, " ") {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// saveYAML writes rules as a YAML rule document
+func saveYAML(w io.Writer, rules []sexp.Element) error {
+	var buf bytes.Buffer
+	buf.WriteString("rules:\n")
+	for _, rule := range rules {
+		if err := writeYAMLItem(&buf, rule, 2); err != nil {
+			return err
+		}
+	}
+	if len(rules) == 0 {
+		buf.Reset()
+		buf.WriteString("rules: []\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeYAMLItem writes elem as a block sequence item at indent
+func writeYAMLItem(buf *bytes.Buffer, elem sexp.Element, indent int) error {
+	pad := strings.Repeat(" ", indent)
+	list, ok := elem.(*sexp.List)
+	if !ok || len(list.Elements) == 0 || isYAMLFlowList(list) {
+		flow, err := yamlFlowElement(elem)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, "%s- %s\n", pad, flow)
+		return nil
+	}
+
+	fmt.Fprintf(buf, "%s- tag: %s\n", pad, yamlScalar(list.Tag))
+	fmt.Fprintf(buf, "%s  elements:\n", pad)
+	for _, child := range list.Elements {
+		if err := writeYAMLItem(buf, child, indent+4); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isYAMLFlowList reports whether a list only holds atoms
+func isYAMLFlowList(list *sexp.List) bool {
+	for _, e := range list.Elements {
+		if atom, ok := e.(*sexp.Atom); !ok || !utf8.ValidString(atom.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// yamlFlowElement formats an element in flow style
+func yamlFlowElement(elem sexp.Element) (string, error) {
+	elems := func(list []sexp.Element) (string, error) {
+		parts := make([]string, len(list))
+		for i, e := range list {
+			s, err := yamlFlowElement(e)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return "[" + strings.Join(parts, ", ") + "]", nil
+	}
+
+	switch el := elem.(type) {
+	case *sexp.Atom:
+		if !utf8.ValidString(el.Value) {
+			return "{bytes: " + base64.StdEncoding.EncodeToString([]byte(el.Value)) + "}", nil
+		}
+		return yamlScalar(el.Value), nil
+	case *sexp.List:
+		if len(el.Elements) == 0 {
+			return "{tag: " + yamlScalar(el.Tag) + "}", nil
+		}
+		children, err := elems(el.Elements)
+		if err != nil {
+			return "", err
+		}
+		return "{tag: " + yamlScalar(el.Tag) + ", elements: " + children + "}", nil
+	case *starform.Wildcard:
+		return "{wildcard: true}", nil
+	case *starform.Set:
+		children, err := elems(el.Elements)
+		if err != nil {
+			return "", err
+		}
+		return "{set: " + children + "}", nil
+	case *starform.Range:
+		s := "{range: " + yamlScalar(string(el.RangeType))
+		for _, b := range []*starform.RangeBound{el.LowerBound, el.UpperBound} {
+			if b == nil {
+				continue
+			}
+			value := yamlScalar(b.Value)
+			if el.RangeType == starform.RangeNumeric && jsonNumber.MatchString(b.Value) {
+				value = b.Value
+			}
+			s += ", " + string(b.Op) + ": " + value
+		}
+		return s + "}", nil
+	case *starform.Prefix:
+		return "{prefix: " + yamlScalar(el.Value) + "}", nil
+	case *starform.Suffix:
+		return "{suffix: " + yamlScalar(el.Value) + "}", nil
+	default:
+		return "", fmt.Errorf("cannot encode %T as YAML", elem)
+	}
+}
@@ -0,0 +1,133 @@
+package persist
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestYAMLRoundTrip tests that canonical rules survive a trip through YAML
+func TestYAMLRoundTrip(t *testing.T) {
+	testRoundTrip(t, ".yaml", FormatYAML)
+}
+
+// TestParseYAML tests the supported subset of YAML
+func TestParseYAML(t *testing.T) {
+	doc := `--- # rules for the web tier
+rules:
+  # block style
+  - tag: http
+    elements:
+      - GET
+      - 'it''s'
+      - "tab\there"
+      - a, b
+  - {tag: file, elements: [{prefix: /home/}, "x # y"]}   # flow style
+  -
+    tag: empty
+  - plain scalar
+`
+	got, err := parseYAML([]byte(doc))
+	if err != nil {
+		t.Fatalf("parseYAML failed: %v", err)
+	}
+	want := map[string]any{
+		"rules": []any{
+			map[string]any{"tag": "http", "elements": []any{"GET", "it's", "tab\there", "a, b"}},
+			map[string]any{"tag": "file", "elements": []any{map[string]any{"prefix": "/home/"}, "x # y"}},
+			map[string]any{"tag": "empty"},
+			"plain scalar",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseYAML mismatch:\n got %#v\nwant %#v", got, want)
+	}
+}
+
+// TestParseYAMLErrors tests that unsupported YAML is rejected with a position
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{"tab indent", "rules:\n\t- a\n", "2:1: tabs are not allowed"},
+		{"documents", "rules: []\n---\nrules: []\n", "2:1: multiple documents"},
+		{"anchor", "rules:\n  - &x a\n", "2:"},
+		{"alias", "rules:\n  - *x\n", "2:"},
+		{"block scalar", "rules:\n  - |\n    a\n", "2:"},
+		{"unterminated", "rules: [a, b\n", "1:"},
+		{"duplicate key", "rules: []\nrules: []\n", "duplicate key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseYAML([]byte(tt.doc))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+// TestYAMLStarForms tests loading typed star forms from YAML
+func TestYAMLStarForms(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.yml")
+	doc := `rules:
+  - tag: resource
+    elements:
+      - {range: numeric, ge: 5, lt: 10}
+      - {wildcard: true}
+      - set: [read, write]
+`
+	if err := os.WriteFile(filename, []byte(doc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadFileToSlice(filename)
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if len(rules) != 1 {
+		t.Fatalf("Expected 1 rule, got %d", len(rules))
+	}
+	if got, want := rules[0].String(), "(8:resource(1:*5:range7:numeric2:ge1:52:lt2:10)(1:*)(1:*3:set4:read5:write))"; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+// TestYAMLInvalidRule tests element errors in YAML files
+func TestYAMLInvalidRule(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.yaml")
+	os.WriteFile(filename, []byte("rules:\n  - a\n  - {range: color}\n"), 0644)
+
+	_, err := LoadFileToSlice(filename)
+	if err == nil || !strings.Contains(err.Error(), `rules[1]: unknown range type "color"`) {
+		t.Errorf("Expected range type error, got %v", err)
+	}
+
+	opts := DefaultLoadOptions()
+	opts.SkipInvalid = true
+	rules, err := LoadFile(filename, opts)
+	if err != nil || len(rules) != 1 {
+		t.Errorf("Expected 1 rule with SkipInvalid, got %d (%v)", len(rules), err)
+	}
+}
+
+// TestYAMLScalar tests quoting of scalars that would not read back as strings
+func TestYAMLScalar(t *testing.T) {
+	for _, s := range []string{"GET", "/etc/passwd", "true", "no", "5", "-1", "", "a: b", "#x", "x ", "null", "[a]", "é"} {
+		out := yamlScalar(s)
+		got, err := parseYAMLScalar(yamlLine{num: 1}, out, 1)
+		if err != nil {
+			t.Errorf("yamlScalar(%q) = %s does not parse: %v", s, out, err)
+			continue
+		}
+		if got != s {
+			t.Errorf("yamlScalar(%q) = %s reads back as %q", s, out, got)
+		}
+		if s == "true" && out == "true" {
+			t.Error("Expected true to be quoted")
+		}
+	}
+}
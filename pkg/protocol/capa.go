@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version is the version of the protocol extensions implemented by this
+// package, reported by CAPA. It is raised when an extension changes in a
+// way that clients must know about.
+const Version = 1
+
+// Capability names reported by CAPA
+const (
+	// CapVersion carries the protocol version
+	CapVersion = "VERSION"
+
+	// CapStartTLS is offered on plain connections that can be upgraded
+	CapStartTLS = "STARTTLS"
+
+	// CapAuth carries the SASL mechanisms the connection can use
+	CapAuth = "AUTH"
+
+	// CapDelete, CapReload (RELOAD, including RELOAD ROLLBACK) and
+	// CapTransactions (BEGIN, COMMIT and ROLLBACK) are offered for the operations the server
+	// implements
+	CapDelete       = "DELETE"
+	CapReload       = "RELOAD"
+	CapTransactions = "TRANSACTIONS"
+
+	// CapList is offered if the server implements LIST, and carries the
+	// most rules a LIST operation returns
+	CapList = "LIST"
+
+	// CapPipelining carries the number of queries the server evaluates
+	// concurrently on a connection. Responses are written in the order of
+	// the requests, except for requests with an ID.
+	CapPipelining = "PIPELINING"
+
+	// CapRequestID is offered if the server accepts messages with an ID
+	// and answers tagged queries as soon as they are evaluated
+	CapRequestID = "REQUESTID"
+
+	// CapMaxMessage carries the largest message the server accepts, in
+	// bytes
+	CapMaxMessage = "MAXMESSAGE"
+
+	// CapMaxTransaction carries the most changes a transaction can stage
+	CapMaxTransaction = "MAXTRANSACTION"
+)
+
+// Capabilities maps the names of capabilities to their values
+type Capabilities map[string][]string
+
+// ParseCapabilities parses the lines of a CAPA response, each a name
+// followed by space-separated values
+func ParseCapabilities(lines []string) Capabilities {
+	caps := make(Capabilities, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		caps[strings.ToUpper(fields[0])] = fields[1:]
+	}
+	return caps
+}
+
+// Lines returns the capabilities as CAPA response lines, sorted by name
+func (c Capabilities) Lines() []string {
+	lines := make([]string, 0, len(c))
+	for name, values := range c {
+		lines = append(lines, strings.Join(append([]string{name}, values...), " "))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// Has reports whether a capability is present
+func (c Capabilities) Has(name string) bool {
+	_, ok := c[name]
+	return ok
+}
+
+// HasValue reports whether a capability is present with a value, such as
+// a SASL mechanism of CapAuth
+func (c Capabilities) HasValue(name, value string) bool {
+	for _, v := range c[name] {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Int returns the numeric value of a capability such as CapMaxMessage
+func (c Capabilities) Int(name string) (int, bool) {
+	values := c[name]
+	if len(values) != 1 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(values[0])
+	return n, err == nil
+}
@@ -17,6 +17,7 @@ package protocol
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
@@ -29,21 +30,85 @@ import (
 type Message struct {
 	Operation string
 	Arguments []string
+
+	// ID, if set, tags the message so that the server can answer it out
+	// of order (see CapRequestID). It is encoded as a first element "#ID"
+	// before the operation, and cannot contain ':'.
+	ID string
 }
 
 // Response codes as defined in the SPOCP protocol
 const (
-	CodeOK      = "200"
-	CodeBye     = "203"
-	CodeDenied  = "400"
-	CodeError   = "500"
-	CodeUnknown = "501"
+	CodeOK        = "200"
+	CodeMultipart = "201"
+	CodeBye       = "203"
+	CodeContinue  = "300"
+	CodeDenied    = "400"
+	CodeError     = "500"
+	CodeUnknown   = "501"
 )
 
+// OpStartTLS upgrades a plain connection to TLS. The server answers
+// CodeOK and both sides then perform a TLS handshake on the same
+// connection; the client must not send anything in between. The server
+// answers CodeError if it has no TLS configuration or the connection is
+// already encrypted, and the connection stays as it was.
+const OpStartTLS = "STARTTLS"
+
+// OpAuth authenticates a connection with SASL. The client sends the
+// mechanism name and an optional initial response; while the server
+// answers CodeContinue with a challenge, the client sends AUTH with its
+// response as the only argument, or "*" to abort. The exchange ends with
+// CodeOK, whose message carries any additional data from the mechanism,
+// or CodeDenied or CodeError.
+const OpAuth = "AUTH"
+
+// OpBegin opens a transaction on the connection. Until OpCommit or
+// OpRollback, ADD and DELETE are validated and staged instead of applied,
+// and answered with CodeOK. Closing the connection aborts the transaction.
+const OpBegin = "BEGIN"
+
+// OpCommit applies the staged changes of a transaction at once, so that
+// queries see either all of them or none. If one of them fails, none is
+// applied. The transaction ends either way.
+const OpCommit = "COMMIT"
+
+// OpRollback discards the staged changes of a transaction. Outside a
+// transaction it is an error; the rules replaced by the last reload are
+// restored with RELOAD ROLLBACK instead, so that cleaning up a
+// transaction can never revert the server's rules.
+const OpRollback = "ROLLBACK"
+
+// OpList lists the loaded rules. Each rule is sent as a CodeMultipart
+// response in canonical form, followed by CodeOK. The optional arguments
+// are pairs of a keyword and a value: MATCH with a pattern keeps the rules
+// that the pattern permits or that permit the pattern, TAG keeps the list
+// rules with that tag, and OFFSET and LIMIT select a page of the result.
+const OpList = "LIST"
+
+// OpCapa lists the capabilities of the server (see Capabilities). Each
+// capability is sent as a CodeMultipart response, followed by CodeOK.
+// Servers that predate CAPA answer CodeUnknown.
+const OpCapa = "CAPA"
+
+// DefaultMaxMessageSize is the largest message a server accepts unless
+// configured otherwise
+const DefaultMaxMessageSize = 1 << 20
+
+// ErrMessageTooLarge is returned when a message exceeds the size limit
+var ErrMessageTooLarge = errors.New("message too large")
+
 // Response represents a SPOCP protocol response
 type Response struct {
 	Code    string
 	Message string
+
+	// Parts are sent before the response as CodeMultipart responses
+	Parts []string
+
+	// ID is the ID of the message answered, if it had one. It is encoded
+	// as a "#ID:" prefix of the response and of each of its parts.
+	ID string
 }
 
 // EncodeMessage encodes a message into the SPOCP protocol format
@@ -51,7 +116,10 @@ type Response struct {
 func EncodeMessage(msg *Message) string {
 	var parts []string
 
-	// Encode operation
+	// Encode ID and operation
+	if msg.ID != "" {
+		parts = append(parts, encodeLV("#"+msg.ID))
+	}
 	parts = append(parts, encodeLV(msg.Operation))
 
 	// Encode arguments
@@ -66,9 +134,20 @@ func EncodeMessage(msg *Message) string {
 	return encodeLV(inner)
 }
 
-// EncodeResponse encodes a response into the SPOCP protocol format
+// EncodeResponse encodes a response into the SPOCP protocol format,
+// preceded by its parts
 func EncodeResponse(resp *Response) string {
-	return encodeLV(fmt.Sprintf("%s:%s", resp.Code, resp.Message))
+	prefix := ""
+	if resp.ID != "" {
+		prefix = "#" + resp.ID + ":"
+	}
+
+	var b strings.Builder
+	for _, part := range resp.Parts {
+		b.WriteString(encodeLV(prefix + CodeMultipart + ":" + part))
+	}
+	b.WriteString(encodeLV(fmt.Sprintf("%s%s:%s", prefix, resp.Code, resp.Message)))
+	return b.String()
 }
 
 // encodeLV encodes a string as length:value
@@ -78,8 +157,15 @@ func encodeLV(s string) string {
 
 // DecodeMessage decodes a SPOCP protocol message from a reader
 func DecodeMessage(r *bufio.Reader) (*Message, error) {
+	return DecodeMessageLimit(r, 0)
+}
+
+// DecodeMessageLimit decodes a message like DecodeMessage, failing with
+// ErrMessageTooLarge before reading a message longer than limit bytes.
+// A limit of 0 means no limit.
+func DecodeMessageLimit(r *bufio.Reader, limit int) (*Message, error) {
 	// Read the outer LV wrapper
-	outer, err := readLV(r)
+	outer, err := readLVLimit(r, limit)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read outer message: %w", err)
 	}
@@ -87,11 +173,21 @@ func DecodeMessage(r *bufio.Reader) (*Message, error) {
 	// Parse the inner content
 	innerReader := bufio.NewReader(strings.NewReader(outer))
 
-	// Read operation
+	// Read operation, after the ID if there is one
 	operation, err := readLV(innerReader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read operation: %w", err)
 	}
+	var id string
+	if strings.HasPrefix(operation, "#") {
+		id = operation[1:]
+		if strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid message ID: %s", id)
+		}
+		if operation, err = readLV(innerReader); err != nil {
+			return nil, fmt.Errorf("failed to read operation: %w", err)
+		}
+	}
 
 	// Read arguments
 	var arguments []string
@@ -109,6 +205,7 @@ func DecodeMessage(r *bufio.Reader) (*Message, error) {
 	return &Message{
 		Operation: operation,
 		Arguments: arguments,
+		ID:        id,
 	}, nil
 }
 
@@ -119,7 +216,14 @@ func DecodeResponse(r *bufio.Reader) (*Response, error) {
 		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
-	// Parse code:message format
+	// Parse [#id:]code:message format
+	var id string
+	if strings.HasPrefix(content, "#") {
+		var ok bool
+		if id, content, ok = strings.Cut(content[1:], ":"); !ok {
+			return nil, fmt.Errorf("invalid response format: #%s", id)
+		}
+	}
 	parts := strings.SplitN(content, ":", 2)
 	if len(parts) != 2 {
 		return nil, fmt.Errorf("invalid response format: %s", content)
@@ -128,12 +232,19 @@ func DecodeResponse(r *bufio.Reader) (*Response, error) {
 	return &Response{
 		Code:    parts[0],
 		Message: parts[1],
+		ID:      id,
 	}, nil
 }
 
 // readLV reads a length-value encoded string from a reader
 // Format: <decimal-length>:<value>
 func readLV(r *bufio.Reader) (string, error) {
+	return readLVLimit(r, 0)
+}
+
+// readLVLimit reads a length-value encoded string of at most limit bytes,
+// or any length if limit is 0
+func readLVLimit(r *bufio.Reader, limit int) (string, error) {
 	// Read length until ':'
 	lengthStr, err := r.ReadString(':')
 	if err != nil {
@@ -152,6 +263,9 @@ func readLV(r *bufio.Reader) (string, error) {
 	if length < 0 {
 		return "", fmt.Errorf("negative length not allowed: %d", length)
 	}
+	if limit > 0 && length > limit {
+		return "", fmt.Errorf("%w: %d bytes, limit %d", ErrMessageTooLarge, length, limit)
+	}
 
 	if length == 0 {
 		return "", nil
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"bufio"
+	"errors"
 	"strings"
 	"testing"
 
@@ -86,6 +87,14 @@ func TestEncodeDecodeMessage(t *testing.T) {
 				Arguments: []string{},
 			},
 		},
+		{
+			name: "QUERY with ID",
+			msg: &Message{
+				Operation: "QUERY",
+				Arguments: []string{"(4:http)"},
+				ID:        "42",
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -104,6 +113,9 @@ func TestEncodeDecodeMessage(t *testing.T) {
 			if decoded.Operation != tt.msg.Operation {
 				t.Errorf("Operation = %q, want %q", decoded.Operation, tt.msg.Operation)
 			}
+			if decoded.ID != tt.msg.ID {
+				t.Errorf("ID = %q, want %q", decoded.ID, tt.msg.ID)
+			}
 			if len(decoded.Arguments) != len(tt.msg.Arguments) {
 				t.Errorf("Arguments length = %d, want %d", len(decoded.Arguments), len(tt.msg.Arguments))
 			}
@@ -133,6 +145,10 @@ func TestEncodeDecodeResponse(t *testing.T) {
 			name: "Error response",
 			resp: &Response{Code: CodeError, Message: "Internal error"},
 		},
+		{
+			name: "Response with ID",
+			resp: &Response{Code: CodeDenied, Message: "Denied: a:b", ID: "7"},
+		},
 	}
 
 	for _, tt := range tests {
@@ -154,10 +170,34 @@ func TestEncodeDecodeResponse(t *testing.T) {
 			if decoded.Message != tt.resp.Message {
 				t.Errorf("Message = %q, want %q", decoded.Message, tt.resp.Message)
 			}
+			if decoded.ID != tt.resp.ID {
+				t.Errorf("ID = %q, want %q", decoded.ID, tt.resp.ID)
+			}
 		})
 	}
 }
 
+func TestEncodeMultipart(t *testing.T) {
+	resp := &Response{Code: CodeOK, Message: "Ok", Parts: []string{"(1:a)", "(1:b)"}}
+	encoded := EncodeResponse(resp)
+	if want := "9:201:(1:a)9:201:(1:b)6:200:Ok"; encoded != want {
+		t.Errorf("EncodeResponse() = %q, want %q", encoded, want)
+	}
+
+	r := bufio.NewReader(strings.NewReader(encoded))
+	var codes []string
+	for i := 0; i < 3; i++ {
+		decoded, err := DecodeResponse(r)
+		if err != nil {
+			t.Fatalf("DecodeResponse() error = %v", err)
+		}
+		codes = append(codes, decoded.Code)
+	}
+	if got := strings.Join(codes, " "); got != "201 201 200" {
+		t.Errorf("codes = %q, want 201 201 200", got)
+	}
+}
+
 func TestProtocolExample(t *testing.T) {
 	// Example from the spec:
 	// C: 70:5:QUERY60:(4:http(4:page10:index.html)(6:action3:GET)(6:userid4:olav))
@@ -186,6 +226,22 @@ func TestProtocolExample(t *testing.T) {
 	}
 }
 
+func TestMessageID(t *testing.T) {
+	msg := &Message{Operation: "QUERY", Arguments: []string{"(4:read)"}, ID: "7"}
+	if encoded, want := EncodeMessage(msg), "21:2:#75:QUERY8:(4:read)"; encoded != want {
+		t.Errorf("EncodeMessage() = %q, want %q", encoded, want)
+	}
+	resp := &Response{Code: CodeOK, Message: "Ok", Parts: []string{"a"}, ID: "7"}
+	if encoded, want := EncodeResponse(resp), "8:#7:201:a9:#7:200:Ok"; encoded != want {
+		t.Errorf("EncodeResponse() = %q, want %q", encoded, want)
+	}
+
+	encoded := EncodeMessage(&Message{Operation: "QUERY", Arguments: []string{"(4:read)"}, ID: "a:b"})
+	if _, err := DecodeMessage(bufio.NewReader(strings.NewReader(encoded))); err == nil {
+		t.Error("DecodeMessage() accepted an ID with ':'")
+	}
+}
+
 func TestParseQuery(t *testing.T) {
 	queryStr := "(4:http(4:page10:index.html)(6:action3:GET)(6:userid4:olav))"
 	elem, err := ParseQuery(queryStr)
@@ -205,3 +261,43 @@ func TestParseQuery(t *testing.T) {
 		t.Error("ParseQuery() returned empty list")
 	}
 }
+
+func TestDecodeMessageLimit(t *testing.T) {
+	encoded := EncodeMessage(&Message{Operation: "QUERY", Arguments: []string{"(4:http)"}})
+
+	if _, err := DecodeMessageLimit(bufio.NewReader(strings.NewReader(encoded)), 17); err != nil {
+		t.Errorf("DecodeMessageLimit() at the limit: error = %v", err)
+	}
+	_, err := DecodeMessageLimit(bufio.NewReader(strings.NewReader(encoded)), 16)
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("DecodeMessageLimit() over the limit: error = %v, want ErrMessageTooLarge", err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	caps := Capabilities{
+		CapVersion:    {"1"},
+		CapAuth:       {"SCRAM-SHA-256", "PLAIN"},
+		CapList:       nil,
+		CapMaxMessage: {"1024"},
+	}
+	lines := caps.Lines()
+	want := []string{"AUTH SCRAM-SHA-256 PLAIN", "LIST", "MAXMESSAGE 1024", "VERSION 1"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("Lines() = %q, want %q", lines, want)
+	}
+
+	parsed := ParseCapabilities(append(lines, "", "starttls"))
+	if !parsed.Has(CapList) || !parsed.Has(CapStartTLS) || parsed.Has(CapDelete) {
+		t.Errorf("ParseCapabilities() = %v", parsed)
+	}
+	if !parsed.HasValue(CapAuth, "plain") || parsed.HasValue(CapAuth, "EXTERNAL") {
+		t.Errorf("HasValue(AUTH) on %v", parsed[CapAuth])
+	}
+	if n, ok := parsed.Int(CapMaxMessage); !ok || n != 1024 {
+		t.Errorf("Int(MAXMESSAGE) = %d, %v", n, ok)
+	}
+	if _, ok := parsed.Int(CapAuth); ok {
+		t.Error("Int(AUTH) should fail for a list of values")
+	}
+}
@@ -0,0 +1,230 @@
+package sasl
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultIterations is the PBKDF2 iteration count of new credentials
+const DefaultIterations = 4096
+
+// minIterations is the lowest iteration count SCRAM allows
+const minIterations = 4096
+
+// saltSize is the salt length of new credentials
+const saltSize = 16
+
+// Credentials are the SCRAM-SHA-256 keys derived from a user's password.
+// They check PLAIN passwords too, so servers never store passwords.
+type Credentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewCredentials derives credentials from a password with a random salt
+// (DefaultIterations if iterations <= 0)
+func NewCredentials(password string, iterations int) (*Credentials, error) {
+	if iterations <= 0 {
+		iterations = DefaultIterations
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return DeriveCredentials(password, salt, iterations)
+}
+
+// DeriveCredentials derives credentials from a password and salt
+func DeriveCredentials(password string, salt []byte, iterations int) (*Credentials, error) {
+	if iterations < minIterations {
+		return nil, fmt.Errorf("iteration count %d is below %d", iterations, minIterations)
+	}
+	salted, err := saltPassword(password, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	return &Credentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  hash(hmacSum(salted, "Client Key")),
+		ServerKey:  hmacSum(salted, "Server Key"),
+	}, nil
+}
+
+// Verify reports whether password matches the credentials
+func (c *Credentials) Verify(password string) bool {
+	salted, err := saltPassword(password, c.Salt, c.Iterations)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(hash(hmacSum(salted, "Client Key")), c.StoredKey)
+}
+
+// String encodes the credentials in the RFC 5803 format
+// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+func (c *Credentials) String() string {
+	b64 := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("%s$%d:%s$%s:%s", ScramSHA256, c.Iterations, b64(c.Salt), b64(c.StoredKey), b64(c.ServerKey))
+}
+
+// ParseCredentials decodes credentials encoded by Credentials.String
+func ParseCredentials(s string) (*Credentials, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 3 || parts[0] != ScramSHA256 {
+		return nil, fmt.Errorf("invalid credentials: expected %s$<iterations>:<salt>$<StoredKey>:<ServerKey>", ScramSHA256)
+	}
+	iterations, salt, ok := strings.Cut(parts[1], ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid credentials: missing salt")
+	}
+	storedKey, serverKey, ok := strings.Cut(parts[2], ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid credentials: missing server key")
+	}
+
+	c := &Credentials{}
+	var err error
+	if c.Iterations, err = strconv.Atoi(iterations); err != nil || c.Iterations < minIterations {
+		return nil, fmt.Errorf("invalid credentials: bad iteration count %q", iterations)
+	}
+	for _, field := range []struct {
+		dst  *[]byte
+		src  string
+		size int
+	}{
+		{&c.Salt, salt, 0},
+		{&c.StoredKey, storedKey, sha256.Size},
+		{&c.ServerKey, serverKey, sha256.Size},
+	} {
+		if *field.dst, err = base64.StdEncoding.DecodeString(field.src); err != nil {
+			return nil, fmt.Errorf("invalid credentials: %w", err)
+		}
+		if field.size != 0 && len(*field.dst) != field.size {
+			return nil, fmt.Errorf("invalid credentials: key length %d", len(*field.dst))
+		}
+	}
+	return c, nil
+}
+
+// CredentialStore looks up the credentials of users. Implementations must
+// be safe for concurrent use.
+type CredentialStore interface {
+	// Lookup returns the credentials of a user, or an error wrapping
+	// ErrUnknownUser
+	Lookup(username string) (*Credentials, error)
+}
+
+// MemoryStore is a CredentialStore holding credentials in memory
+type MemoryStore struct {
+	mu    sync.RWMutex
+	users map[string]*Credentials
+}
+
+// NewMemoryStore creates an empty credential store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{users: make(map[string]*Credentials)}
+}
+
+// Set stores the credentials of a user, replacing any previous ones
+func (m *MemoryStore) Set(username string, creds *Credentials) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[username] = creds
+}
+
+// SetPassword stores credentials derived from a password
+func (m *MemoryStore) SetPassword(username, password string) error {
+	creds, err := NewCredentials(password, 0)
+	if err != nil {
+		return err
+	}
+	m.Set(username, creds)
+	return nil
+}
+
+// Remove deletes a user
+func (m *MemoryStore) Remove(username string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, username)
+}
+
+// Len returns the number of users
+func (m *MemoryStore) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.users)
+}
+
+// Lookup implements CredentialStore
+func (m *MemoryStore) Lookup(username string) (*Credentials, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	creds, ok := m.users[username]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownUser, username)
+	}
+	return creds, nil
+}
+
+// LoadCredentialFile reads a credential file into a MemoryStore. Each line
+// holds a user name and credentials as written by Credentials.String,
+// separated by ':'; empty lines and lines starting with '#' are ignored.
+func LoadCredentialFile(path string) (*MemoryStore, error) {
+	f, err := os.Open(path) //nolint:gosec // credential files are named by the operator
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	store := NewMemoryStore()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		username, encoded, ok := strings.Cut(text, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("%s:%d: expected <user>:<credentials>", path, line)
+		}
+		creds, err := ParseCredentials(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		store.Set(username, creds)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// saltPassword computes the SCRAM SaltedPassword
+func saltPassword(password string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+}
+
+// hmacSum returns HMAC-SHA-256(key, data)
+func hmacSum(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// hash returns SHA-256(data)
+func hash(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
@@ -0,0 +1,53 @@
+package sasl
+
+import "fmt"
+
+// externalServer implements EXTERNAL: the client is the identity
+// established outside SASL, and may only name that identity as authzid
+type externalServer struct {
+	identity string
+	done     bool
+}
+
+func (m *externalServer) Next(response []byte) ([]byte, bool, error) {
+	if authzid := string(response); authzid != "" && authzid != m.identity {
+		return nil, false, ErrAuthFailed
+	}
+	m.done = true
+	return nil, true, nil
+}
+
+func (m *externalServer) Identity() string {
+	if !m.done {
+		return ""
+	}
+	return m.identity
+}
+
+// externalClient is the client side of EXTERNAL
+type externalClient struct {
+	authzid string
+}
+
+// NewExternalClient authenticates with EXTERNAL as the identity the server
+// established outside SASL, such as the TLS client certificate. A
+// non-empty authzid must match that identity.
+func NewExternalClient(authzid string) ClientMechanism {
+	return &externalClient{authzid: authzid}
+}
+
+func (m *externalClient) Name() string {
+	return External
+}
+
+func (m *externalClient) Start() ([]byte, error) {
+	return []byte(m.authzid), nil
+}
+
+func (m *externalClient) Next(challenge []byte) ([]byte, error) {
+	return nil, fmt.Errorf("unexpected %s challenge", External)
+}
+
+func (m *externalClient) Finish(data []byte) error {
+	return nil
+}
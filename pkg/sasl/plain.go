@@ -0,0 +1,83 @@
+package sasl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// dummyCredentials are checked against the passwords of unknown users, so
+// that their failures take as long as a wrong password
+var dummyCredentials = sync.OnceValues(func() (*Credentials, error) {
+	return NewCredentials(randomNonce(), 0)
+})
+
+// plainServer implements PLAIN: the client sends
+// authzid NUL authcid NUL password in its initial response
+type plainServer struct {
+	store    CredentialStore
+	identity string
+}
+
+func (m *plainServer) Next(response []byte) ([]byte, bool, error) {
+	fields := bytes.Split(response, []byte{0})
+	if len(fields) != 3 {
+		return nil, false, errors.New("invalid PLAIN response")
+	}
+	authzid, username, password := string(fields[0]), string(fields[1]), string(fields[2])
+	if username == "" || (authzid != "" && authzid != username) {
+		return nil, false, ErrAuthFailed
+	}
+
+	creds, err := m.store.Lookup(username)
+	if err != nil {
+		if errors.Is(err, ErrUnknownUser) {
+			if dummy, err := dummyCredentials(); err == nil {
+				dummy.Verify(password)
+			}
+			return nil, false, ErrAuthFailed
+		}
+		return nil, false, err
+	}
+	if !creds.Verify(password) {
+		return nil, false, ErrAuthFailed
+	}
+	m.identity = username
+	return nil, true, nil
+}
+
+func (m *plainServer) Identity() string {
+	return m.identity
+}
+
+// plainClient is the client side of PLAIN
+type plainClient struct {
+	username string
+	password string
+}
+
+// NewPlainClient authenticates as username with PLAIN. The password is
+// sent as is, so PLAIN should only be used over TLS.
+func NewPlainClient(username, password string) ClientMechanism {
+	return &plainClient{username: username, password: password}
+}
+
+func (m *plainClient) Name() string {
+	return Plain
+}
+
+func (m *plainClient) Start() ([]byte, error) {
+	if m.username == "" || bytes.ContainsRune([]byte(m.username+m.password), 0) {
+		return nil, errors.New("invalid PLAIN user name or password")
+	}
+	return []byte("\x00" + m.username + "\x00" + m.password), nil
+}
+
+func (m *plainClient) Next(challenge []byte) ([]byte, error) {
+	return nil, fmt.Errorf("unexpected %s challenge", Plain)
+}
+
+func (m *plainClient) Finish(data []byte) error {
+	return nil
+}
@@ -0,0 +1,100 @@
+// Package sasl implements the SASL mechanisms used to authenticate SPOCP
+// connections: PLAIN (RFC 4616), EXTERNAL (RFC 4422) and SCRAM-SHA-256
+// (RFC 7677).
+//
+// A server creates a ServerMechanism for each exchange with NewServer and
+// feeds it the client's responses until it reports completion; a client
+// does the same with a ClientMechanism. Both sides only exchange byte
+// strings, so the mechanisms do not depend on how the protocol frames them.
+package sasl
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Mechanism names
+const (
+	Plain       = "PLAIN"
+	External    = "EXTERNAL"
+	ScramSHA256 = "SCRAM-SHA-256"
+)
+
+var (
+	// ErrAuthFailed is returned when the client's credentials are wrong.
+	// It does not tell whether the user exists.
+	ErrAuthFailed = errors.New("authentication failed")
+
+	// ErrUnknownUser is returned by a CredentialStore for users it does
+	// not know
+	ErrUnknownUser = errors.New("unknown user")
+
+	// ErrUnsupported is returned for mechanisms that are unknown or not
+	// available with the given configuration
+	ErrUnsupported = errors.New("unsupported mechanism")
+)
+
+// ServerMechanism is the server side of one authentication exchange
+type ServerMechanism interface {
+	// Next processes a response from the client. It returns the next
+	// challenge, or done and any additional data for the client once the
+	// client has authenticated. After an error the exchange is over.
+	Next(response []byte) (challenge []byte, done bool, err error)
+
+	// Identity returns the authenticated user once the exchange is done
+	Identity() string
+}
+
+// ClientMechanism is the client side of one authentication exchange
+type ClientMechanism interface {
+	// Name returns the mechanism name sent to the server
+	Name() string
+
+	// Start returns the initial response
+	Start() ([]byte, error)
+
+	// Next returns the response to a server challenge
+	Next(challenge []byte) ([]byte, error)
+
+	// Finish checks the additional data sent by the server with its
+	// success outcome
+	Finish(data []byte) error
+}
+
+// ServerConfig configures the mechanisms offered by a server
+type ServerConfig struct {
+	// Store holds the credentials checked by PLAIN and SCRAM-SHA-256;
+	// without one only EXTERNAL is available
+	Store CredentialStore
+
+	// ExternalIdentity is the identity established outside SASL, such as
+	// the subject of a verified TLS client certificate; without one
+	// EXTERNAL is not available
+	ExternalIdentity string
+}
+
+// Mechanisms returns the names of the mechanisms available with config
+func (config ServerConfig) Mechanisms() []string {
+	var names []string
+	if config.Store != nil {
+		names = append(names, ScramSHA256, Plain)
+	}
+	if config.ExternalIdentity != "" {
+		names = append(names, External)
+	}
+	return names
+}
+
+// NewServer starts the server side of an exchange with the named
+// mechanism
+func NewServer(mechanism string, config ServerConfig) (ServerMechanism, error) {
+	switch {
+	case mechanism == Plain && config.Store != nil:
+		return &plainServer{store: config.Store}, nil
+	case mechanism == ScramSHA256 && config.Store != nil:
+		return &scramServer{store: config.Store}, nil
+	case mechanism == External && config.ExternalIdentity != "":
+		return &externalServer{identity: config.ExternalIdentity}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupported, mechanism)
+}
@@ -0,0 +1,269 @@
+package sasl
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// run performs an exchange between a client and server mechanism
+func run(client ClientMechanism, server ServerMechanism) error {
+	response, err := client.Start()
+	if err != nil {
+		return err
+	}
+	for {
+		challenge, done, err := server.Next(response)
+		if err != nil {
+			return err
+		}
+		if done {
+			return client.Finish(challenge)
+		}
+		if response, err = client.Next(challenge); err != nil {
+			return err
+		}
+	}
+}
+
+// TestScramRFC7677 checks the SCRAM-SHA-256 example exchange of RFC 7677
+func TestScramRFC7677(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	creds, err := DeriveCredentials("pencil", salt, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	store.Set("user", creds)
+
+	client := &scramClient{username: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	server := &scramServer{store: store, nonce: "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"}
+
+	steps := []struct{ client, server string }{
+		{"n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+			"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"},
+		{"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="},
+	}
+
+	response, _ := client.Start()
+	for i, step := range steps {
+		if string(response) != step.client {
+			t.Fatalf("Step %d: client sent %q, want %q", i, response, step.client)
+		}
+		challenge, done, err := server.Next(response)
+		if err != nil {
+			t.Fatalf("Step %d: %v", i, err)
+		}
+		if string(challenge) != step.server || done != (i == len(steps)-1) {
+			t.Fatalf("Step %d: server sent %q (done %v), want %q", i, challenge, done, step.server)
+		}
+		if done {
+			if err := client.Finish(challenge); err != nil {
+				t.Fatalf("Finish failed: %v", err)
+			}
+			break
+		}
+		response, _ = client.Next(challenge)
+	}
+	if server.Identity() != "user" {
+		t.Errorf("Expected identity user, got %q", server.Identity())
+	}
+
+	if err := client.Finish([]byte("v=7rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err == nil {
+		t.Error("Expected a wrong server signature to fail")
+	}
+}
+
+func TestMechanisms(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.SetPassword("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetPassword("a,b=c", "other"); err != nil {
+		t.Fatal(err)
+	}
+	config := ServerConfig{Store: store, ExternalIdentity: "CN=alice"}
+
+	tests := []struct {
+		name     string
+		client   ClientMechanism
+		identity string
+		wantErr  bool
+	}{
+		{"scram", NewScramSHA256Client("alice", "secret"), "alice", false},
+		{"scram escaped name", NewScramSHA256Client("a,b=c", "other"), "a,b=c", false},
+		{"scram wrong password", NewScramSHA256Client("alice", "wrong"), "", true},
+		{"scram unknown user", NewScramSHA256Client("bob", "secret"), "", true},
+		{"plain", NewPlainClient("alice", "secret"), "alice", false},
+		{"plain wrong password", NewPlainClient("alice", "wrong"), "", true},
+		{"plain unknown user", NewPlainClient("bob", "secret"), "", true},
+		{"external", NewExternalClient(""), "CN=alice", false},
+		{"external authzid", NewExternalClient("CN=alice"), "CN=alice", false},
+		{"external other authzid", NewExternalClient("CN=bob"), "", true},
+	}
+	for _, tt := range tests {
+		server, err := NewServer(tt.client.Name(), config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		err = run(tt.client, server)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if tt.wantErr && !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("%s: expected ErrAuthFailed, got %v", tt.name, err)
+		}
+		if got := server.Identity(); got != tt.identity {
+			t.Errorf("%s: expected identity %q, got %q", tt.name, tt.identity, got)
+		}
+	}
+
+	if got := config.Mechanisms(); !reflect.DeepEqual(got, []string{ScramSHA256, Plain, External}) {
+		t.Errorf("Unexpected mechanisms %v", got)
+	}
+	if got := (ServerConfig{}).Mechanisms(); got != nil {
+		t.Errorf("Expected no mechanisms, got %v", got)
+	}
+	for _, name := range []string{"CRAM-MD5", External} {
+		if _, err := NewServer(name, ServerConfig{Store: store}); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%s: expected ErrUnsupported, got %v", name, err)
+		}
+	}
+}
+
+func TestScramServerRejects(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.SetPassword("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, first := range []string{
+		"",
+		"p=tls-unique,,n=alice,r=abc",
+		"n,,n=alice",
+		"n,,n=,r=abc",
+		"n,,n=al=ice,r=abc",
+		"n,,n=alice,r=abc,m=ext",
+		"n,a=bob,n=alice,r=abc",
+	} {
+		server, _ := NewServer(ScramSHA256, ServerConfig{Store: store})
+		if _, _, err := server.Next([]byte(first)); err == nil {
+			t.Errorf("Expected %q to be rejected", first)
+		}
+	}
+
+	// A tampered channel binding fails
+	client := NewScramSHA256Client("alice", "secret")
+	server, _ := NewServer(ScramSHA256, ServerConfig{Store: store})
+	first, _ := client.Start()
+	challenge, _, _ := server.Next(first)
+	final, _ := client.Next(challenge)
+	tampered := append([]byte("c=eSws"), final[len("c=biws"):]...)
+	if _, _, err := server.Next(tampered); err == nil {
+		t.Error("Expected a channel binding mismatch")
+	}
+}
+
+// TestScramUnknownUser tests that unknown users get the same made-up salt
+// on every attempt
+func TestScramUnknownUser(t *testing.T) {
+	store := NewMemoryStore()
+	salt := func(username string) string {
+		server, _ := NewServer(ScramSHA256, ServerConfig{Store: store})
+		first, _ := NewScramSHA256Client(username, "secret").Start()
+		challenge, _, err := server.Next(first)
+		if err != nil {
+			t.Fatalf("%s: %v", username, err)
+		}
+		for _, attr := range strings.Split(string(challenge), ",") {
+			if strings.HasPrefix(attr, "s=") {
+				return attr
+			}
+		}
+		t.Fatalf("%s: no salt in %q", username, challenge)
+		return ""
+	}
+
+	if a, b := salt("bob"), salt("bob"); a != b {
+		t.Errorf("Expected the same salt for bob, got %s and %s", a, b)
+	}
+	if a, b := salt("bob"), salt("carol"); a == b {
+		t.Errorf("Expected different salts for bob and carol, got %s", a)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	creds, err := NewCredentials("secret", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Iterations != DefaultIterations || len(creds.Salt) != saltSize {
+		t.Errorf("Unexpected credentials %+v", creds)
+	}
+	if !creds.Verify("secret") || creds.Verify("Secret") {
+		t.Error("Verify gave the wrong result")
+	}
+
+	parsed, err := ParseCredentials(creds.String())
+	if err != nil {
+		t.Fatalf("ParseCredentials failed: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, creds) {
+		t.Errorf("Round trip changed credentials: %+v", parsed)
+	}
+
+	for _, bad := range []string{
+		"",
+		"SCRAM-SHA-1$4096:c2FsdA==$a:b",
+		"SCRAM-SHA-256$100:c2FsdA==$" + creds.String()[len(creds.String())-89:],
+		"SCRAM-SHA-256$4096:c2FsdA==$c2hvcnQ=:c2hvcnQ=",
+		"SCRAM-SHA-256$4096$a:b",
+	} {
+		if _, err := ParseCredentials(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+	if _, err := DeriveCredentials("secret", []byte("salt"), 1); err == nil {
+		t.Error("Expected a low iteration count to be rejected")
+	}
+}
+
+func TestLoadCredentialFile(t *testing.T) {
+	creds, _ := NewCredentials("secret", 0)
+	path := filepath.Join(t.TempDir(), "users")
+	data := "# spocp users\n\nalice:" + creds.String() + "\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := LoadCredentialFile(path)
+	if err != nil {
+		t.Fatalf("LoadCredentialFile failed: %v", err)
+	}
+	if store.Len() != 1 {
+		t.Fatalf("Expected 1 user, got %d", store.Len())
+	}
+	if got, err := store.Lookup("alice"); err != nil || !got.Verify("secret") {
+		t.Errorf("Unexpected lookup result %+v, %v", got, err)
+	}
+	if _, err := store.Lookup("bob"); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("Expected ErrUnknownUser, got %v", err)
+	}
+	store.Remove("alice")
+	if store.Len() != 0 {
+		t.Error("Expected alice to be removed")
+	}
+
+	if err := os.WriteFile(path, []byte("alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCredentialFile(path); err == nil {
+		t.Error("Expected an error for a line without credentials")
+	}
+}
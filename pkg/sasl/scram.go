@@ -0,0 +1,297 @@
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// nonceSize is the number of random bytes in a SCRAM nonce
+const nonceSize = 18
+
+// scramServer implements SCRAM-SHA-256 without channel binding: the
+// client sends client-first, the server answers server-first, the client
+// proves its password in client-final and the server proves its own
+// knowledge of the credentials in the outcome data
+type scramServer struct {
+	store CredentialStore
+
+	// nonce is the server part of the nonce, random unless set by tests
+	nonce string
+
+	step        int
+	gs2Header   string
+	fullNonce   string
+	username    string
+	clientFirst string // client-first-bare
+	serverFirst string
+	creds       *Credentials
+	unknown     bool
+	identity    string
+}
+
+func (m *scramServer) Next(response []byte) ([]byte, bool, error) {
+	m.step++
+	switch m.step {
+	case 1:
+		challenge, err := m.first(string(response))
+		return challenge, false, err
+	case 2:
+		data, err := m.final(string(response))
+		return data, err == nil, err
+	}
+	return nil, false, errors.New("SCRAM exchange already completed")
+}
+
+// first processes client-first and returns server-first
+func (m *scramServer) first(msg string) ([]byte, error) {
+	// gs2-header: n (no channel binding) or y (client supports it but
+	// thinks the server does not), then an optional authzid
+	cbind, rest, _ := strings.Cut(msg, ",")
+	switch {
+	case cbind == "n" || cbind == "y":
+	case strings.HasPrefix(cbind, "p="):
+		return nil, errors.New("SCRAM channel binding is not supported")
+	default:
+		return nil, errors.New("invalid SCRAM client-first message")
+	}
+	authzid, bare, ok := strings.Cut(rest, ",")
+	if !ok {
+		return nil, errors.New("invalid SCRAM client-first message")
+	}
+	m.gs2Header = cbind + "," + authzid + ","
+	m.clientFirst = bare
+
+	attrs := strings.Split(bare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, errors.New("invalid SCRAM client-first message")
+	}
+	for _, attr := range attrs[2:] {
+		if strings.HasPrefix(attr, "m=") {
+			return nil, errors.New("unsupported SCRAM extension")
+		}
+	}
+	username, err := unescapeName(attrs[0][2:])
+	if err != nil || username == "" {
+		return nil, errors.New("invalid SCRAM user name")
+	}
+	clientNonce := attrs[1][2:]
+	if clientNonce == "" {
+		return nil, errors.New("invalid SCRAM nonce")
+	}
+	if authzid != "" {
+		name, err := unescapeName(strings.TrimPrefix(authzid, "a="))
+		if err != nil || !strings.HasPrefix(authzid, "a=") || name != username {
+			return nil, ErrAuthFailed
+		}
+	}
+	m.username = username
+
+	m.creds, err = m.store.Lookup(username)
+	if errors.Is(err, ErrUnknownUser) {
+		// Carry on with made-up credentials, so the exchange does not
+		// reveal which users exist
+		m.unknown = true
+		m.creds, err = unknownCredentials(username), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if m.nonce == "" {
+		m.nonce = randomNonce()
+	}
+	m.fullNonce = clientNonce + m.nonce
+	m.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", m.fullNonce,
+		base64.StdEncoding.EncodeToString(m.creds.Salt), m.creds.Iterations)
+	return []byte(m.serverFirst), nil
+}
+
+// final checks client-final and returns server-final
+func (m *scramServer) final(msg string) ([]byte, error) {
+	withoutProof, proof, ok := strings.Cut(msg, ",p=")
+	if !ok {
+		return nil, errors.New("invalid SCRAM client-final message")
+	}
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || attrs[0] != "c="+base64.StdEncoding.EncodeToString([]byte(m.gs2Header)) {
+		return nil, errors.New("SCRAM channel binding mismatch")
+	}
+	if attrs[1] != "r="+m.fullNonce {
+		return nil, errors.New("SCRAM nonce mismatch")
+	}
+	clientProof, err := base64.StdEncoding.DecodeString(proof)
+	if err != nil || len(clientProof) != len(m.creds.StoredKey) {
+		return nil, errors.New("invalid SCRAM proof")
+	}
+
+	authMessage := m.clientFirst + "," + m.serverFirst + "," + withoutProof
+	clientKey := hmacSum(m.creds.StoredKey, authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= clientProof[i]
+	}
+	if m.unknown || !hmac.Equal(hash(clientKey), m.creds.StoredKey) {
+		return nil, ErrAuthFailed
+	}
+
+	m.identity = m.username
+	return []byte("v=" + base64.StdEncoding.EncodeToString(hmacSum(m.creds.ServerKey, authMessage))), nil
+}
+
+func (m *scramServer) Identity() string {
+	return m.identity
+}
+
+// scramClient is the client side of SCRAM-SHA-256
+type scramClient struct {
+	username string
+	password string
+
+	// nonce is the client nonce, random unless set by tests
+	nonce string
+
+	clientFirst     string // client-first-bare
+	serverSignature []byte
+}
+
+// NewScramSHA256Client authenticates as username with SCRAM-SHA-256. The
+// password never leaves the client and the server proves it knows the
+// user's credentials too. Passwords are used as given, without SASLprep
+// normalization.
+func NewScramSHA256Client(username, password string) ClientMechanism {
+	return &scramClient{username: username, password: password}
+}
+
+func (m *scramClient) Name() string {
+	return ScramSHA256
+}
+
+func (m *scramClient) Start() ([]byte, error) {
+	if m.username == "" {
+		return nil, errors.New("SCRAM requires a user name")
+	}
+	if m.nonce == "" {
+		m.nonce = randomNonce()
+	}
+	m.clientFirst = "n=" + escapeName(m.username) + ",r=" + m.nonce
+	return []byte("n,," + m.clientFirst), nil
+}
+
+func (m *scramClient) Next(challenge []byte) ([]byte, error) {
+	if m.clientFirst == "" || m.serverSignature != nil {
+		return nil, errors.New("unexpected SCRAM challenge")
+	}
+	serverFirst := string(challenge)
+	attrs := strings.Split(serverFirst, ",")
+	if len(attrs) < 3 || !strings.HasPrefix(attrs[0], "r=") ||
+		!strings.HasPrefix(attrs[1], "s=") || !strings.HasPrefix(attrs[2], "i=") {
+		return nil, errors.New("invalid SCRAM server-first message")
+	}
+	nonce := attrs[0][2:]
+	if !strings.HasPrefix(nonce, m.nonce) || len(nonce) == len(m.nonce) {
+		return nil, errors.New("SCRAM nonce mismatch")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs[1][2:])
+	if err != nil {
+		return nil, errors.New("invalid SCRAM salt")
+	}
+	iterations, err := strconv.Atoi(attrs[2][2:])
+	if err != nil {
+		return nil, errors.New("invalid SCRAM iteration count")
+	}
+	// Refusing low counts keeps a server from weakening the proof
+	if iterations < minIterations {
+		return nil, fmt.Errorf("SCRAM iteration count %d is below %d", iterations, minIterations)
+	}
+	salted, err := saltPassword(m.password, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + nonce
+	authMessage := m.clientFirst + "," + serverFirst + "," + withoutProof
+	clientKey := hmacSum(salted, "Client Key")
+	proof := hmacSum(hash(clientKey), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	m.serverSignature = hmacSum(hmacSum(salted, "Server Key"), authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (m *scramClient) Finish(data []byte) error {
+	if m.serverSignature == nil {
+		return errors.New("SCRAM exchange not completed")
+	}
+	msg := string(data)
+	if e, ok := strings.CutPrefix(msg, "e="); ok {
+		return fmt.Errorf("SCRAM error: %s", e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(msg, "v="))
+	if err != nil || !strings.HasPrefix(msg, "v=") || !hmac.Equal(signature, m.serverSignature) {
+		return errors.New("SCRAM server signature mismatch")
+	}
+	return nil
+}
+
+// randomNonce returns a printable random nonce
+// unknownSecret keys the salts made up for unknown users; it is random
+// for each server process
+var unknownSecret = sync.OnceValue(func() []byte {
+	b := make([]byte, sha256.Size)
+	_, _ = rand.Read(b) //nolint:errcheck // crypto/rand.Read does not fail
+	return b
+})
+
+// unknownCredentials makes up credentials for a user the store does not
+// know. The salt is derived from the user name, so that it stays the same
+// between attempts like the salt of a real user, and the keys are random
+// as the exchange fails anyway.
+func unknownCredentials(username string) *Credentials {
+	key := make([]byte, sha256.Size)
+	_, _ = rand.Read(key) //nolint:errcheck // crypto/rand.Read does not fail
+	return &Credentials{
+		Salt:       hmacSum(unknownSecret(), username)[:saltSize],
+		Iterations: DefaultIterations,
+		StoredKey:  key,
+		ServerKey:  key,
+	}
+}
+
+func randomNonce() string {
+	b := make([]byte, nonceSize)
+	_, _ = rand.Read(b) //nolint:errcheck // crypto/rand.Read does not fail
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// escapeName encodes ',' and '=' in a SCRAM user name
+func escapeName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+// unescapeName decodes a SCRAM user name
+func unescapeName(name string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			b.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=3D"):
+			b.WriteByte('=')
+		case strings.HasPrefix(name[i:], "=2C"):
+			b.WriteByte(',')
+		default:
+			return "", errors.New("invalid escape in SCRAM user name")
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
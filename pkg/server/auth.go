@@ -0,0 +1,160 @@
+package server
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/sirosfoundation/go-spocp/pkg/admin"
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sasl"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// handleAuth processes an AUTH operation: the start of an exchange, or the
+// client's response to a challenge
+func (s *Server) handleAuth(sess *session, msg *protocol.Message) *protocol.Response {
+	if sess.auth != nil {
+		switch {
+		case len(msg.Arguments) != 1:
+			return s.abortAuth(sess)
+		case msg.Arguments[0] == "*":
+			sess.auth = nil
+			s.metrics.authFailed.Add(1)
+			return &protocol.Response{Code: protocol.CodeError, Message: "Authentication aborted"}
+		}
+		return s.authStep(sess, []byte(msg.Arguments[0]))
+	}
+
+	if sess.identity != "" {
+		return &protocol.Response{Code: protocol.CodeError, Message: "Already authenticated"}
+	}
+	if len(msg.Arguments) == 0 || len(msg.Arguments) > 2 {
+		return &protocol.Response{
+			Code:    protocol.CodeError,
+			Message: "AUTH requires a mechanism and an optional initial response",
+		}
+	}
+
+	mechanism := strings.ToUpper(msg.Arguments[0])
+	if mechanism == sasl.Plain && !sess.tls && !sess.loopback {
+		return &protocol.Response{Code: protocol.CodeError, Message: "PLAIN requires TLS"}
+	}
+	auth, err := sasl.NewServer(mechanism, sasl.ServerConfig{
+		Store:            s.credentials,
+		ExternalIdentity: peerIdentity(sess),
+	})
+	if err != nil {
+		return &protocol.Response{Code: protocol.CodeError, Message: "Unsupported mechanism: " + mechanism}
+	}
+
+	s.metrics.authTotal.Add(1)
+	sess.auth = auth
+	sess.mechanism = mechanism
+	if len(msg.Arguments) == 1 {
+		// No initial response: ask for one with an empty challenge
+		return &protocol.Response{Code: protocol.CodeContinue}
+	}
+	return s.authStep(sess, []byte(msg.Arguments[1]))
+}
+
+// authStep passes a client response to the exchange in progress
+func (s *Server) authStep(sess *session, response []byte) *protocol.Response {
+	challenge, done, err := sess.auth.Next(response)
+	switch {
+	case err != nil:
+		sess.auth = nil
+		s.metrics.authFailed.Add(1)
+		s.logWarn("Authentication from %s with %s failed: %v", sess.remote, sess.mechanism, err)
+		if errors.Is(err, sasl.ErrAuthFailed) {
+			return &protocol.Response{Code: protocol.CodeDenied, Message: "Authentication failed"}
+		}
+		return &protocol.Response{Code: protocol.CodeError, Message: "Authentication failed: " + err.Error()}
+	case !done:
+		return &protocol.Response{Code: protocol.CodeContinue, Message: string(challenge)}
+	}
+
+	sess.identity = sess.auth.Identity()
+	sess.auth = nil
+	s.logInfo("Client %s authenticated as %s with %s", sess.remote, sess.identity, sess.mechanism)
+	if len(challenge) == 0 {
+		return &protocol.Response{Code: protocol.CodeOK, Message: "Ok"}
+	}
+	return &protocol.Response{Code: protocol.CodeOK, Message: string(challenge)}
+}
+
+// abortAuth cancels the exchange in progress because the client sent
+// something other than a response
+func (s *Server) abortAuth(sess *session) *protocol.Response {
+	sess.auth = nil
+	s.metrics.authFailed.Add(1)
+	return &protocol.Response{Code: protocol.CodeError, Message: "Authentication aborted, expected an AUTH response"}
+}
+
+// peerIdentity returns the subject of the verified TLS client certificate,
+// the identity for SASL EXTERNAL, or "" if there is none
+func peerIdentity(sess *session) string {
+	if sess.peer == nil {
+		return ""
+	}
+	return sess.peer.Subject
+}
+
+// isAdminOp reports whether an operation changes or reveals the server's
+// rules. Changes staged in a transaction are authorized one by one, so
+// ROLLBACK is not an administrative operation.
+func isAdminOp(sess *session, op string) bool {
+	switch op {
+	case "ADD", "DELETE", "RELOAD", protocol.OpList:
+		return true
+	}
+	return false
+}
+
+// authorizeAdmin checks an administrative operation against the admin
+// policy, if there is one
+func (s *Server) authorizeAdmin(sess *session, msg *protocol.Message) bool {
+	if s.adminPolicy == nil {
+		return true
+	}
+
+	var rule sexp.Element
+	switch {
+	case (msg.Operation == "ADD" || msg.Operation == "DELETE") && len(msg.Arguments) == 1:
+		// An invalid rule is reported by the operation itself
+		if parsed, err := protocol.ParseRule(msg.Arguments[0]); err == nil {
+			rule = parsed
+		}
+	case msg.Operation == protocol.OpList:
+		// A listing of one tag is authorized for that rule tag
+		if f, err := parseListArgs(msg.Arguments); err == nil && f.tag != "" {
+			rule = sexp.NewList(f.tag)
+		}
+	}
+	// RELOAD ROLLBACK keeps its own op, so admin rules can allow
+	// reloads without allowing reverts
+	op := msg.Operation
+	if isReloadRollback(msg) {
+		op = "ROLLBACK"
+	}
+	return s.adminPolicy.Authorize(admin.Request{
+		Op:      op,
+		Subject: sess.identity,
+		Rule:    rule,
+		Peer:    sess.peer,
+	})
+}
+
+// logAudit records an administrative operation and the identity that
+// performed it
+func (s *Server) logAudit(sess *session, msg *protocol.Message, resp *protocol.Response) {
+	who := sess.identity
+	if who == "" {
+		who = "anonymous"
+	}
+	if sess.peer != nil {
+		who += " (certificate " + sess.peer.Fingerprint + ")"
+	}
+	outcome, _, _ := strings.Cut(resp.Message, "\n")
+	s.logInfo("AUDIT %s %s by %s from %s: %s %s", msg.Operation, strings.Join(msg.Arguments, " "),
+		who, sess.remote, resp.Code, outcome)
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sirosfoundation/go-spocp/pkg/admin"
+	"github.com/sirosfoundation/go-spocp/pkg/client"
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sasl"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+	"github.com/sirosfoundation/go-spocp/pkg/tlsutil"
+)
+
+// testCredentials returns a store with the user alice
+func testCredentials(t *testing.T) *sasl.MemoryStore {
+	t.Helper()
+	store := sasl.NewMemoryStore()
+	if err := store.SetPassword("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// TestAuth tests authenticating with SCRAM-SHA-256 and PLAIN before
+// changing rules
+func TestAuth(t *testing.T) {
+	srv := startTestServer(t, &Config{Credentials: testCredentials(t), RequireAuth: true})
+	addr := srv.listener.Addr().String()
+
+	c, err := client.NewClient(&client.Config{Address: addr})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+	if ok, err := c.QueryString("(4:read)"); !ok || err != nil {
+		t.Errorf("Queries should not need authentication: %v, %v", ok, err)
+	}
+	if err := c.AddString("(5:write)"); err == nil {
+		t.Error("Expected ADD to require authentication")
+	}
+	if err := c.Authenticate(sasl.NewScramSHA256Client("alice", "wrong")); !errors.Is(err, sasl.ErrAuthFailed) {
+		t.Errorf("Expected ErrAuthFailed, got %v", err)
+	}
+	if err := c.Authenticate(sasl.NewScramSHA256Client("alice", "secret")); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if err := c.AddString("(5:write)"); err != nil {
+		t.Errorf("ADD after authentication failed: %v", err)
+	}
+	if err := c.Authenticate(sasl.NewScramSHA256Client("alice", "secret")); err == nil {
+		t.Error("Expected a second AUTH to fail")
+	}
+
+	// The client keeps PLAIN off connections without TLS unless asked
+	_, err = client.NewClient(&client.Config{Address: addr, Auth: sasl.NewPlainClient("alice", "secret")})
+	if !errors.Is(err, client.ErrInsecureAuth) {
+		t.Errorf("Expected ErrInsecureAuth, got %v", err)
+	}
+
+	// PLAIN is allowed from loopback without TLS
+	plain, err := client.NewClient(&client.Config{Address: addr, Auth: sasl.NewPlainClient("alice", "secret"), InsecureAuth: true})
+	if err != nil {
+		t.Fatalf("Failed to connect with PLAIN: %v", err)
+	}
+	defer plain.Close()
+	if err := plain.DeleteString("(5:write)"); err != nil {
+		t.Errorf("DELETE after authentication failed: %v", err)
+	}
+
+	if got := srv.metrics.authTotal.Load(); got != 3 {
+		t.Errorf("Expected 3 authentication exchanges, got %d", got)
+	}
+	if got := srv.metrics.authFailed.Load(); got != 1 {
+		t.Errorf("Expected 1 failed authentication, got %d", got)
+	}
+}
+
+// TestAuthExternal tests authenticating with a TLS client certificate
+func TestAuthExternal(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	clientCert, parsed := testCertificate(t, "alice", x509.ExtKeyUsageClientAuth)
+	serverTLS.ClientCAs = x509.NewCertPool()
+	serverTLS.ClientCAs.AddCert(parsed)
+	serverTLS.ClientAuth = tls.VerifyClientCertIfGiven
+	clientTLS.Certificates = []tls.Certificate{clientCert}
+
+	srv := startTestServer(t, &Config{TLSConfig: serverTLS, RequireAuth: true})
+	addr := srv.listener.Addr().String()
+
+	c, err := client.NewClient(&client.Config{Address: addr, TLSConfig: clientTLS, Auth: sasl.NewExternalClient("")})
+	if err != nil {
+		t.Fatalf("Failed to authenticate with EXTERNAL: %v", err)
+	}
+	defer c.Close()
+	if err := c.AddString("(5:write)"); err != nil {
+		t.Errorf("ADD after authentication failed: %v", err)
+	}
+
+	// Without a client certificate EXTERNAL is not available
+	clientTLS = clientTLS.Clone()
+	clientTLS.Certificates = nil
+	if _, err := client.NewClient(&client.Config{Address: addr, TLSConfig: clientTLS, Auth: sasl.NewExternalClient("")}); err == nil {
+		t.Error("Expected EXTERNAL to fail without a client certificate")
+	}
+}
+
+// TestAuthExchange tests the AUTH operation and the audit log
+func TestAuthExchange(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+
+	// The server is not serving, so only this test writes to the log
+	var logBuf bytes.Buffer
+	srv, err := NewServer(&Config{
+		Address:     "127.0.0.1:0",
+		RulesDir:    rulesDir,
+		Credentials: testCredentials(t),
+		Logger:      log.New(&logBuf, "", 0),
+		LogLevel:    LogLevelInfo,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+	auth := func(args ...string) *protocol.Message {
+		return &protocol.Message{Operation: protocol.OpAuth, Arguments: args}
+	}
+	query := &protocol.Message{Operation: "QUERY", Arguments: []string{"(4:read)"}}
+
+	sess := &session{remote: "192.0.2.1:1234"}
+	steps := []struct {
+		name string
+		msg  *protocol.Message
+		code string
+	}{
+		{"PLAIN without TLS", auth("PLAIN", "\x00alice\x00secret"), protocol.CodeError},
+		{"unknown mechanism", auth("CRAM-MD5"), protocol.CodeError},
+		{"EXTERNAL without certificate", auth("EXTERNAL"), protocol.CodeError},
+		{"missing mechanism", auth(), protocol.CodeError},
+		{"start", auth("SCRAM-SHA-256"), protocol.CodeContinue},
+		{"interrupted", query, protocol.CodeError},
+		{"query after abort", query, protocol.CodeOK},
+		{"restart", auth("SCRAM-SHA-256"), protocol.CodeContinue},
+		{"abort", auth("*"), protocol.CodeError},
+		{"anonymous add", &protocol.Message{Operation: "ADD", Arguments: []string{"(5:write)"}}, protocol.CodeOK},
+	}
+	for _, step := range steps {
+		if resp := srv.handleMessage(sess, step.msg); resp.Code != step.code {
+			t.Errorf("%s: expected %s, got %s %s", step.name, step.code, resp.Code, resp.Message)
+		}
+	}
+
+	mech := sasl.NewScramSHA256Client("alice", "secret")
+	first, _ := mech.Start()
+	resp := srv.handleMessage(sess, auth("scram-sha-256", string(first)))
+	if resp.Code != protocol.CodeContinue {
+		t.Fatalf("Expected a challenge, got %s %s", resp.Code, resp.Message)
+	}
+	final, err := mech.Next([]byte(resp.Message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp = srv.handleMessage(sess, auth(string(final))); resp.Code != protocol.CodeOK {
+		t.Fatalf("Expected success, got %s %s", resp.Code, resp.Message)
+	}
+	if err := mech.Finish([]byte(resp.Message)); err != nil {
+		t.Errorf("Server signature rejected: %v", err)
+	}
+	if sess.identity != "alice" || sess.mechanism != sasl.ScramSHA256 {
+		t.Errorf("Unexpected session identity %q (%s)", sess.identity, sess.mechanism)
+	}
+	srv.handleMessage(sess, &protocol.Message{Operation: "DELETE", Arguments: []string{"(5:write)"}})
+
+	logs := logBuf.String()
+	for _, want := range []string{
+		"AUDIT ADD (5:write) by anonymous from 192.0.2.1:1234: 200 Ok",
+		"Client 192.0.2.1:1234 authenticated as alice with SCRAM-SHA-256",
+		"AUDIT DELETE (5:write) by alice from 192.0.2.1:1234: 200 Ok",
+	} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("Expected log %q in:\n%s", want, logs)
+		}
+	}
+
+	if _, err := NewServer(&Config{Address: ":0", RulesDir: "x", RequireAuth: true}); err == nil {
+		t.Error("Expected RequireAuth without credentials to be rejected")
+	}
+}
+
+// TestAdminPolicy tests authorizing administrative operations with an
+// admin ruleset
+func TestAdminPolicy(t *testing.T) {
+	policy := admin.New(
+		sexp.NewList(admin.Tag, sexp.NewList("op", sexp.NewAtom("ADD")),
+			sexp.NewList("subject", sexp.NewAtom("alice")), sexp.NewList("rule-tag", sexp.NewAtom("http"))),
+		sexp.NewList(admin.Tag, sexp.NewList("op", sexp.NewAtom("RELOAD")), sexp.NewList("subject", sexp.NewAtom("bob"))),
+	)
+	srv := startTestServer(t, &Config{AdminPolicy: policy})
+
+	alice := &session{identity: "alice"}
+	bob := &session{identity: "bob"}
+	add := func(rule string) *protocol.Message {
+		return &protocol.Message{Operation: "ADD", Arguments: []string{rule}}
+	}
+	reload := &protocol.Message{Operation: "RELOAD"}
+	tests := []struct {
+		name string
+		sess *session
+		msg  *protocol.Message
+		code string
+	}{
+		{"alice adds http", alice, add("(4:http(4:page5:index))"), protocol.CodeOK},
+		{"alice adds ssh", alice, add("(3:ssh)"), protocol.CodeDenied},
+		{"alice adds an invalid rule", alice, add("(4:http"), protocol.CodeDenied},
+		{"alice reloads", alice, reload, protocol.CodeDenied},
+		{"bob reloads", bob, reload, protocol.CodeOK},
+		{"bob adds http", bob, add("(4:http)"), protocol.CodeDenied},
+		{"bob rolls back a reload", bob, &protocol.Message{Operation: "RELOAD", Arguments: []string{"ROLLBACK"}}, protocol.CodeDenied},
+		{"anonymous reloads", &session{}, reload, protocol.CodeDenied},
+		{"anonymous queries", &session{}, &protocol.Message{Operation: "QUERY", Arguments: []string{"(4:read)"}}, protocol.CodeOK},
+	}
+	for _, tt := range tests {
+		if resp := srv.handleMessage(tt.sess, tt.msg); resp.Code != tt.code {
+			t.Errorf("%s: expected %s, got %s %s", tt.name, tt.code, resp.Code, resp.Message)
+		}
+	}
+}
+
+// TestAdminPolicyPeer tests admin rules on the client's TLS certificate
+func TestAdminPolicyPeer(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	clientCert, parsed := testCertificate(t, "ops", x509.ExtKeyUsageClientAuth)
+	serverTLS.ClientCAs = x509.NewCertPool()
+	serverTLS.ClientCAs.AddCert(parsed)
+	serverTLS.ClientAuth = tls.VerifyClientCertIfGiven
+
+	// Only the holder of the ops certificate may change the rules
+	ops := tlsutil.NewPeerIdentity(parsed)
+	policy := admin.New(sexp.NewList(admin.Tag, sexp.NewList("op"), sexp.NewList("subject"),
+		sexp.NewList("rule-tag"), sexp.NewList("peer", sexp.NewList("subject"),
+			sexp.NewList("fingerprint", sexp.NewAtom(ops.Fingerprint)))))
+	srv := startTestServer(t, &Config{TLSConfig: serverTLS, AdminPolicy: policy})
+	addr := srv.listener.Addr().String()
+
+	anonymous, err := client.NewClient(&client.Config{Address: addr, TLSConfig: clientTLS})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer anonymous.Close()
+	if err := anonymous.AddString("(5:write)"); err == nil {
+		t.Error("Expected ADD without a client certificate to be denied")
+	}
+
+	clientTLS = clientTLS.Clone()
+	clientTLS.Certificates = []tls.Certificate{clientCert}
+	c, err := client.NewClient(&client.Config{Address: addr, TLSConfig: clientTLS})
+	if err != nil {
+		t.Fatalf("Failed to connect with a client certificate: %v", err)
+	}
+	defer c.Close()
+	if err := c.AddString("(5:write)"); err != nil {
+		t.Errorf("ADD with the ops certificate failed: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sasl"
+)
+
+// handleCapa processes a CAPA operation. The capabilities depend on the
+// connection: STARTTLS is offered until TLS is active, and AUTH lists the
+// mechanisms the connection can use once TLS requirements are met.
+func (s *Server) handleCapa(sess *session, msg *protocol.Message) *protocol.Response {
+	if len(msg.Arguments) != 0 {
+		return &protocol.Response{Code: protocol.CodeError, Message: "CAPA takes no arguments"}
+	}
+
+	caps := protocol.Capabilities{
+		protocol.CapVersion:        {strconv.Itoa(protocol.Version)},
+		protocol.CapDelete:         nil,
+		protocol.CapReload:         nil,
+		protocol.CapList:           {strconv.Itoa(maxListLimit)},
+		protocol.CapTransactions:   nil,
+		protocol.CapPipelining:     {strconv.Itoa(pipelineDepth)},
+		protocol.CapRequestID:      nil,
+		protocol.CapMaxMessage:     {strconv.Itoa(s.maxMessageSize)},
+		protocol.CapMaxTransaction: {strconv.Itoa(maxTransactionOps)},
+	}
+	if !sess.tls && s.tlsConfig != nil {
+		caps[protocol.CapStartTLS] = nil
+	}
+	if !s.requiresTLS(sess, protocol.OpAuth) {
+		var mechanisms []string
+		config := sasl.ServerConfig{Store: s.credentials, ExternalIdentity: peerIdentity(sess)}
+		for _, mechanism := range config.Mechanisms() {
+			// Same rule as handleAuth
+			if mechanism == sasl.Plain && !sess.tls && !sess.loopback {
+				continue
+			}
+			mechanisms = append(mechanisms, mechanism)
+		}
+		if len(mechanisms) > 0 {
+			caps[protocol.CapAuth] = mechanisms
+		}
+	}
+	return &protocol.Response{Code: protocol.CodeOK, Message: "Ok", Parts: caps.Lines()}
+}
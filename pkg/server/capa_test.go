@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sirosfoundation/go-spocp/pkg/client"
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+)
+
+// TestCapa tests that capabilities follow the state of the connection
+func TestCapa(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	srv := startTestServer(t, &Config{
+		TLSConfig:   serverTLS,
+		StartTLS:    true,
+		RequireTLS:  true,
+		Credentials: testCredentials(t),
+	})
+
+	tests := []struct {
+		name string
+		sess *session
+		want string
+	}{
+		{"plain", &session{}, "DELETE|LIST 1000|MAXMESSAGE 1048576|MAXTRANSACTION 10000|PIPELINING 64|RELOAD|REQUESTID|STARTTLS|TRANSACTIONS|VERSION 1"},
+		{"loopback", &session{loopback: true}, "AUTH SCRAM-SHA-256 PLAIN|DELETE|LIST 1000|MAXMESSAGE 1048576|MAXTRANSACTION 10000|PIPELINING 64|RELOAD|REQUESTID|STARTTLS|TRANSACTIONS|VERSION 1"},
+		{"tls", &session{tls: true}, "AUTH SCRAM-SHA-256 PLAIN|DELETE|LIST 1000|MAXMESSAGE 1048576|MAXTRANSACTION 10000|PIPELINING 64|RELOAD|REQUESTID|TRANSACTIONS|VERSION 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.handleMessage(tt.sess, &protocol.Message{Operation: protocol.OpCapa})
+			if resp.Code != protocol.CodeOK {
+				t.Fatalf("CAPA failed: %s %s", resp.Code, resp.Message)
+			}
+			if got := strings.Join(resp.Parts, "|"); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	// The client negotiates again after STARTTLS
+	c, err := client.NewClient(&client.Config{
+		Address:   srv.listener.Addr().String(),
+		TLSConfig: clientTLS,
+		StartTLS:  client.StartTLSRequired,
+		Require:   []string{protocol.CapList, protocol.CapTransactions},
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+	caps := c.Capabilities()
+	if caps.Has(protocol.CapStartTLS) || !caps.HasValue(protocol.CapAuth, "PLAIN") {
+		t.Errorf("Expected the capabilities of a TLS connection, got %v", caps)
+	}
+}
+
+// TestMaxMessageSize tests that oversized messages close the connection
+func TestMaxMessageSize(t *testing.T) {
+	srv := startTestServer(t, &Config{MaxMessageSize: 64})
+	addr := srv.listener.Addr().String()
+
+	c, err := client.NewClient(&client.Config{Address: addr})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+	rule := fmt.Sprintf("(4:http(4:page%d:%s))", 60, strings.Repeat("x", 60))
+	if err := c.AddString(rule); !errors.Is(err, protocol.ErrMessageTooLarge) {
+		t.Errorf("Expected the client to refuse a message over MAXMESSAGE, got %v", err)
+	}
+
+	// A client that ignores the limit is disconnected
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(protocol.EncodeMessage(&protocol.Message{Operation: "ADD", Arguments: []string{rule}}))); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := protocol.DecodeResponse(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if resp.Code != protocol.CodeError || resp.Message != "Message too large" {
+		t.Errorf("Expected 500 Message too large, got %s %s", resp.Code, resp.Message)
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sirosfoundation/go-spocp"
+	"github.com/sirosfoundation/go-spocp/pkg/persist"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// ErrReloadRejected is returned when a reload fails a reload guard: the
+// rule count changed by more than Config.MaxRuleDelta or a canary query
+// changed its decision. The current rules are kept.
+var ErrReloadRejected = errors.New("reload rejected")
+
+// maxDiffLines limits the rules listed in a reload diff
+const maxDiffLines = 100
+
+// Canary is a query whose decision must not change across reloads
+type Canary struct {
+	// Query in canonical S-expression form
+	Query string
+
+	// Allow is the expected decision
+	Allow bool
+
+	query sexp.Element
+}
+
+// LoadCanaries reads canary queries from a file with one canary per line:
+// "allow" or "deny" followed by a query in canonical form. Blank lines and
+// lines starting with # are ignored.
+//
+//	allow (5:spocp(8:resource4:file)(6:action4:read))
+//	deny (5:spocp(8:resource6:shadow)(6:action4:read))
+func LoadCanaries(filename string) ([]Canary, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var canaries []Canary
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		decision, query, _ := strings.Cut(text, " ")
+		canary := Canary{Query: strings.TrimSpace(query)}
+		switch decision {
+		case "allow":
+			canary.Allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("%s:%d: expected allow or deny, got %q", filename, line, decision)
+		}
+		if err := canary.parse(); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+		canaries = append(canaries, canary)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return canaries, nil
+}
+
+// parse parses the canary query
+func (c *Canary) parse() error {
+	query, err := sexp.NewParser(c.Query).Parse()
+	if err != nil {
+		return fmt.Errorf("invalid canary query %q: %w", c.Query, err)
+	}
+	c.query = query
+	return nil
+}
+
+// decision returns the name of an allow or deny decision
+func decision(allow bool) string {
+	if allow {
+		return "allow"
+	}
+	return "deny"
+}
+
+// checkGuards returns an error wrapping ErrReloadRejected if replacing
+// current by next violates a reload guard. current is nil for the initial
+// load, which is only checked against the canaries.
+func (s *Server) checkGuards(current, next *spocp.Engine) error {
+	if current != nil && s.maxRuleDelta > 0 {
+		before, after := current.RuleCount(), next.RuleCount()
+		if before > 0 {
+			delta := float64(after-before) / float64(before)
+			if delta < 0 {
+				delta = -delta
+			}
+			if delta > s.maxRuleDelta {
+				return fmt.Errorf("%w: rule count changes from %d to %d (%.0f%%, limit %.0f%%)",
+					ErrReloadRejected, before, after, delta*100, s.maxRuleDelta*100)
+			}
+		}
+	}
+
+	for _, c := range s.canaries {
+		if got := next.QueryElement(c.query); got != c.Allow {
+			return fmt.Errorf("%w: canary %s changes from %s to %s",
+				ErrReloadRejected, c.Query, decision(c.Allow), decision(got))
+		}
+	}
+	return nil
+}
+
+// ruleDiff describes the rules a reload adds and removes
+type ruleDiff struct {
+	before, after int
+	added         []string
+	removed       []string
+}
+
+// diffRules compares two sets of rules; duplicates are counted
+func diffRules(old, current []sexp.Element) *ruleDiff {
+	diff := persist.Diff(old, current)
+	d := &ruleDiff{before: len(old), after: len(current)}
+	for _, r := range diff.Added {
+		d.added = append(d.added, r.String())
+	}
+	for _, r := range diff.Removed {
+		d.removed = append(d.removed, r.String())
+	}
+	sort.Strings(d.added)
+	sort.Strings(d.removed)
+	return d
+}
+
+// String returns a summary line followed by the added and removed rules
+func (d *ruleDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d -> %d rules (+%d -%d)", d.before, d.after, len(d.added), len(d.removed))
+
+	listed := 0
+	list := func(prefix string, rules []string) {
+		for _, r := range rules {
+			if listed == maxDiffLines {
+				return
+			}
+			b.WriteString("\n" + prefix + " " + r)
+			listed++
+		}
+	}
+	list("+", d.added)
+	list("-", d.removed)
+	if more := len(d.added) + len(d.removed) - listed; more > 0 {
+		fmt.Fprintf(&b, "\n... and %d more", more)
+	}
+	return b.String()
+}
+
+// rollbackState holds the rules replaced by the last reload
+type rollbackState struct {
+	engine   *spocp.Engine
+	manifest *persist.Manifest
+	rules    int64 // rules loaded from files
+	journal  int   // journal records applied to engine
+
+	// unjournaled is Server.unjournaled at the reload
+	unjournaled int64
+}
+
+// Rollback restores the rules that were in use before the last reload,
+// including runtime changes made since. Without a journal those changes
+// cannot be applied to the previous rules, so Rollback fails if any were
+// made. Only one reload can be undone; the rule files are not changed, so
+// the next reload applies them again.
+func (s *Server) Rollback() error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	prev := s.previous
+	if prev == nil {
+		return errors.New("no previous rules to roll back to")
+	}
+	if n := s.unjournaled.Load() - prev.unjournaled; n > 0 {
+		return fmt.Errorf("%d runtime changes since the reload are not journaled and would be lost", n)
+	}
+
+	// Runtime changes made after the reload apply to the old rules too
+	if s.journal != nil {
+		records, err := s.journal.Records()
+		if err != nil {
+			return fmt.Errorf("failed to read journal: %w", err)
+		}
+		if prev.journal < len(records) {
+			applyRecords(prev.engine, records[prev.journal:], s.logDebug)
+		}
+	}
+
+	s.mu.Lock()
+	s.engine = prev.engine
+	s.mu.Unlock()
+	s.manifest.Store(prev.manifest)
+	s.previous = nil
+
+	s.metrics.rulesLoaded.Store(prev.rules)
+	s.metrics.rollbacksTotal.Add(1)
+	s.logInfo("Rolled back to the previous rules (%d rules)", prev.engine.RuleCount())
+	return nil
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// TestMaxRuleDelta tests that reloads changing too many rules are rejected
+func TestMaxRuleDelta(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(1:a)", "(1:b)", "(1:c)", "(1:d)"})
+	defer os.RemoveAll(rulesDir)
+
+	srv, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir, MaxRuleDelta: 0.25})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	// One of four rules is within the limit
+	writeFile(t, rulesDir, "test.spoc", "(1:a)\n(1:b)\n(1:c)\n")
+	if err := srv.reloadRules(reloadManual, reloadApply); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	// Two of three is not
+	writeFile(t, rulesDir, "test.spoc", "(1:a)\n")
+	err = srv.reloadRules(reloadManual, reloadApply)
+	if !errors.Is(err, ErrReloadRejected) {
+		t.Fatalf("Expected ErrReloadRejected, got %v", err)
+	}
+	expectQuery(t, srv, "(1:c)", protocol.CodeOK)
+	if got := srv.metrics.reloadsGuarded.Load(); got != 1 {
+		t.Errorf("Expected 1 guarded reload, got %d", got)
+	}
+
+	// The watcher does not retry the rejected files
+	if reloaded, _ := srv.reloadIfChanged(reloadPoll); reloaded {
+		t.Error("Expected no reload of rejected files")
+	}
+
+	if resp := sendOp(t, srv, "RELOAD", "FORCE"); resp.Code != protocol.CodeOK {
+		t.Fatalf("RELOAD FORCE failed: %s", resp.Message)
+	}
+	expectQuery(t, srv, "(1:c)", protocol.CodeDenied)
+}
+
+// TestCanaries tests that reloads changing a canary decision are rejected
+func TestCanaries(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+
+	canaries := []Canary{
+		{Query: "(4:read)", Allow: true},
+		{Query: "(6:delete)", Allow: false},
+	}
+	srv, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir, Canaries: canaries})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	writeFile(t, rulesDir, "test.spoc", "(4:read)\n(5:write)\n")
+	if err := srv.reloadRules(reloadManual, reloadApply); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	writeFile(t, rulesDir, "test.spoc", "(4:read)\n(6:delete)\n")
+	err = srv.reloadRules(reloadManual, reloadApply)
+	if !errors.Is(err, ErrReloadRejected) || !strings.Contains(err.Error(), "(6:delete)") {
+		t.Fatalf("Expected rejection by the delete canary, got %v", err)
+	}
+	expectQuery(t, srv, "(5:write)", protocol.CodeOK)
+	expectQuery(t, srv, "(6:delete)", protocol.CodeDenied)
+
+	// Canaries also guard the initial load
+	_, err = NewServer(&Config{Address: ":0", RulesDir: rulesDir, Canaries: canaries})
+	if !errors.Is(err, ErrReloadRejected) {
+		t.Errorf("Expected startup to be rejected, got %v", err)
+	}
+
+	_, err = NewServer(&Config{Address: ":0", RulesDir: rulesDir, Canaries: []Canary{{Query: "(4:read"}}})
+	if err == nil {
+		t.Error("Expected error for invalid canary query")
+	}
+}
+
+// TestReloadDryRun tests that RELOAD DRYRUN reports changes without
+// applying them
+func TestReloadDryRun(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)", "(4:list)"})
+	defer os.RemoveAll(rulesDir)
+
+	srv, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir, MaxRuleDelta: 0.5})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	writeFile(t, rulesDir, "test.spoc", "(4:read)\n(5:write)\n")
+	resp := sendOp(t, srv, "RELOAD", "dryrun")
+	if resp.Code != protocol.CodeOK {
+		t.Fatalf("RELOAD DRYRUN failed: %s", resp.Message)
+	}
+	want := "2 -> 2 rules (+1 -1)\n+ (5:write)\n- (4:list)"
+	if resp.Message != want {
+		t.Errorf("Expected diff %q, got %q", want, resp.Message)
+	}
+	expectQuery(t, srv, "(4:list)", protocol.CodeOK)
+	expectQuery(t, srv, "(5:write)", protocol.CodeDenied)
+
+	// A dry run is not a check: the change is still applied
+	if reloaded, err := srv.reloadIfChanged(reloadPoll); !reloaded || err != nil {
+		t.Fatalf("Expected reload after dry run, got %v, %v", reloaded, err)
+	}
+	expectQuery(t, srv, "(5:write)", protocol.CodeOK)
+
+	// Dry runs report guard violations with the diff
+	writeFile(t, rulesDir, "test.spoc", "")
+	resp = sendOp(t, srv, "RELOAD", "DRYRUN")
+	if resp.Code != protocol.CodeError || !strings.Contains(resp.Message, "reload rejected") ||
+		!strings.Contains(resp.Message, "2 -> 0 rules (+0 -2)") {
+		t.Errorf("Expected rejected dry run with diff, got %s: %s", resp.Code, resp.Message)
+	}
+	if got := srv.metrics.reloadsGuarded.Load(); got != 0 {
+		t.Errorf("Expected dry runs not to count as guarded reloads, got %d", got)
+	}
+
+	if resp := sendOp(t, srv, "RELOAD", "NOW"); resp.Code != protocol.CodeError {
+		t.Errorf("Expected error for unknown RELOAD argument, got %s", resp.Code)
+	}
+}
+
+// TestRollback tests that RELOAD ROLLBACK restores the rules replaced by
+// the last reload along with later runtime changes
+func TestRollback(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+	journalPath := filepath.Join(t.TempDir(), "rules.journal")
+
+	srv, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir, JournalPath: journalPath})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	if resp := sendOp(t, srv, "RELOAD", "ROLLBACK"); resp.Code != protocol.CodeError {
+		t.Errorf("Expected ROLLBACK without a reload to fail, got %s", resp.Code)
+	}
+
+	sendOp(t, srv, "ADD", "(4:list)")
+	writeFile(t, rulesDir, "test.spoc", "(5:write)\n")
+	if resp := sendOp(t, srv, "RELOAD"); resp.Code != protocol.CodeOK {
+		t.Fatalf("Reload failed: %s", resp.Message)
+	}
+	sendOp(t, srv, "ADD", "(6:delete)")
+	expectQuery(t, srv, "(4:read)", protocol.CodeDenied)
+
+	if resp := sendOp(t, srv, "RELOAD", "ROLLBACK"); resp.Code != protocol.CodeOK {
+		t.Fatalf("ROLLBACK failed: %s", resp.Message)
+	}
+	expectQuery(t, srv, "(4:read)", protocol.CodeOK)
+	expectQuery(t, srv, "(4:list)", protocol.CodeOK)
+	expectQuery(t, srv, "(6:delete)", protocol.CodeOK)
+	expectQuery(t, srv, "(5:write)", protocol.CodeDenied)
+
+	// Only the last reload can be undone
+	if resp := sendOp(t, srv, "RELOAD", "ROLLBACK"); resp.Code != protocol.CodeError {
+		t.Errorf("Expected second ROLLBACK to fail, got %s", resp.Code)
+	}
+	if got := srv.metrics.rollbacksTotal.Load(); got != 1 {
+		t.Errorf("Expected 1 rollback, got %d", got)
+	}
+
+	// Compaction renumbers the journal, which ends the rollback window
+	if resp := sendOp(t, srv, "RELOAD"); resp.Code != protocol.CodeOK {
+		t.Fatalf("Reload failed: %s", resp.Message)
+	}
+	if err := srv.CompactJournal(); err != nil {
+		t.Fatalf("CompactJournal failed: %v", err)
+	}
+	if resp := sendOp(t, srv, "RELOAD", "ROLLBACK"); resp.Code != protocol.CodeError {
+		t.Errorf("Expected ROLLBACK after compaction to fail, got %s", resp.Code)
+	}
+}
+
+// TestRollbackWithoutJournal tests that RELOAD ROLLBACK is refused when it
+// would drop runtime changes that are not journaled
+func TestRollbackWithoutJournal(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+
+	srv, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	writeFile(t, rulesDir, "test.spoc", "(5:write)\n")
+	if resp := sendOp(t, srv, "RELOAD"); resp.Code != protocol.CodeOK {
+		t.Fatalf("Reload failed: %s", resp.Message)
+	}
+	sendOp(t, srv, "ADD", "(6:delete)")
+
+	if resp := sendOp(t, srv, "RELOAD", "ROLLBACK"); resp.Code != protocol.CodeError || !strings.Contains(resp.Message, "not journaled") {
+		t.Errorf("Expected ROLLBACK to be refused, got %s %s", resp.Code, resp.Message)
+	}
+	expectQuery(t, srv, "(6:delete)", protocol.CodeOK)
+
+	// Without changes since the reload, rolling back loses nothing
+	if resp := sendOp(t, srv, "RELOAD"); resp.Code != protocol.CodeOK {
+		t.Fatalf("Reload failed: %s", resp.Message)
+	}
+	if resp := sendOp(t, srv, "RELOAD", "ROLLBACK"); resp.Code != protocol.CodeOK {
+		t.Errorf("Expected ROLLBACK to succeed, got %s %s", resp.Code, resp.Message)
+	}
+}
+
+// TestLoadCanaries tests reading canary files
+func TestLoadCanaries(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "canaries", "# expected decisions\nallow (4:read)\n\ndeny  (6:delete)\n")
+
+	canaries, err := LoadCanaries(filepath.Join(dir, "canaries"))
+	if err != nil {
+		t.Fatalf("LoadCanaries failed: %v", err)
+	}
+	if len(canaries) != 2 || canaries[0].Query != "(4:read)" || !canaries[0].Allow ||
+		canaries[1].Query != "(6:delete)" || canaries[1].Allow {
+		t.Errorf("Unexpected canaries: %+v", canaries)
+	}
+
+	for name, content := range map[string]string{
+		"decision": "permit (4:read)\n",
+		"query":    "allow (4:read\n",
+	} {
+		writeFile(t, dir, name, content)
+		if _, err := LoadCanaries(filepath.Join(dir, name)); err == nil || !strings.Contains(err.Error(), ":1:") {
+			t.Errorf("%s: expected error with line number, got %v", name, err)
+		}
+	}
+}
+
+// TestDiffRules tests rule diffs, including duplicates and truncation
+func TestDiffRules(t *testing.T) {
+	parse := func(rules ...string) []sexp.Element {
+		var elements []sexp.Element
+		for _, r := range rules {
+			e, err := sexp.NewParser(r).Parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			elements = append(elements, e)
+		}
+		return elements
+	}
+
+	d := diffRules(parse("(1:a)", "(1:a)", "(1:b)"), parse("(1:a)", "(1:c)"))
+	if want := "3 -> 2 rules (+1 -2)\n+ (1:c)\n- (1:a)\n- (1:b)"; d.String() != want {
+		t.Errorf("Expected %q, got %q", want, d.String())
+	}
+
+	var many []sexp.Element
+	for i := 0; i < maxDiffLines+5; i++ {
+		many = append(many, sexp.NewList(strings.Repeat("x", i+1)))
+	}
+	lines := strings.Split(diffRules(nil, many).String(), "\n")
+	if len(lines) != maxDiffLines+2 || lines[len(lines)-1] != "... and 5 more" {
+		t.Errorf("Expected truncated diff, got %d lines ending in %q", len(lines), lines[len(lines)-1])
+	}
+}
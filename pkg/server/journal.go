@@ -0,0 +1,225 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/sirosfoundation/go-spocp"
+	"github.com/sirosfoundation/go-spocp/pkg/journal"
+	"github.com/sirosfoundation/go-spocp/pkg/persist"
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// openJournal opens the configured journal, discarding a torn tail left
+// by a crash
+func (s *Server) openJournal(config *Config) error {
+	j, err := journal.Open(config.JournalPath, journal.Options{
+		Sync:         config.JournalSync,
+		SyncInterval: config.JournalSyncInterval,
+	})
+	if err != nil {
+		return err
+	}
+	if n := j.Truncated(); n > 0 {
+		s.logWarn("Discarded %d bytes of incomplete journal records in %s", n, config.JournalPath)
+	}
+	s.journal = j
+	s.metrics.journalRecords.Store(int64(j.Len()))
+	return nil
+}
+
+// replayJournal applies the journaled runtime changes to engine
+func (s *Server) replayJournal(engine *spocp.Engine) (int, error) {
+	if s.journal == nil {
+		return 0, nil
+	}
+
+	records, err := s.journal.Records()
+	if err != nil {
+		return 0, fmt.Errorf("failed to replay journal: %w", err)
+	}
+	applyRecords(engine, records, s.logDebug)
+	return len(records), nil
+}
+
+// applyRecords applies journal records to engine
+func applyRecords(engine *spocp.Engine, records []journal.Record, logDebug func(string, ...interface{})) {
+	for _, r := range records {
+		switch r.Op {
+		case journal.OpAdd:
+			engine.AddRuleElement(r.Rule)
+		case journal.OpDelete:
+			// The rule may have been removed from the rule files since
+			if !engine.RemoveRule(r.Rule) {
+				logDebug("Journaled delete of %s matches no rule", r.Rule)
+			}
+		}
+	}
+}
+
+// handleDelete processes a DELETE operation
+func (s *Server) handleDelete(msg *protocol.Message) *protocol.Response {
+	s.metrics.deletesTotal.Add(1)
+
+	if len(msg.Arguments) != 1 {
+		return &protocol.Response{
+			Code:    protocol.CodeError,
+			Message: "DELETE requires exactly one argument",
+		}
+	}
+
+	// Parse rule
+	rule, err := protocol.ParseRule(msg.Arguments[0])
+	if err != nil {
+		return &protocol.Response{
+			Code:    protocol.CodeError,
+			Message: fmt.Sprintf("Invalid rule: %v", err),
+		}
+	}
+
+	if s.journal != nil {
+		// Keep journal order and engine swaps consistent
+		s.reloadMutex.Lock()
+		defer s.reloadMutex.Unlock()
+	}
+
+	s.mu.Lock()
+	removed := s.engine.RemoveRule(rule)
+	s.mu.Unlock()
+
+	if !removed {
+		return &protocol.Response{Code: protocol.CodeError, Message: "Rule not found"}
+	}
+
+	if err := s.appendJournal(journal.OpDelete, rule); err != nil {
+		// Not durable: undo so the client can retry
+		s.mu.Lock()
+		s.engine.AddRuleElement(rule)
+		s.mu.Unlock()
+		return &protocol.Response{Code: protocol.CodeError, Message: "Journal write failed"}
+	}
+
+	return &protocol.Response{Code: protocol.CodeOK, Message: "Ok"}
+}
+
+// appendJournal records a runtime change if journaling is enabled, and
+// otherwise counts it. The caller must hold reloadMutex if it is enabled.
+func (s *Server) appendJournal(op journal.Op, rule sexp.Element) error {
+	return s.appendJournalAll([]journal.Record{{Op: op, Rule: rule}})
+}
+
+// appendJournalAll records the runtime changes of a transaction with a
+// single write, like appendJournal.
+func (s *Server) appendJournalAll(records []journal.Record) error {
+	if s.journal == nil {
+		// Counted so that Rollback does not silently drop them
+		s.unjournaled.Add(int64(len(records)))
+		return nil
+	}
+
+	if err := s.journal.AppendAll(records); err != nil {
+		s.logError("Journal write failed: %v", err)
+		return err
+	}
+	s.metrics.journalRecords.Store(int64(s.journal.Len()))
+
+	if s.compactThreshold > 0 && s.journal.Len() >= s.compactThreshold {
+		if err := s.compactJournal(); err != nil {
+			s.logWarn("Journal compaction failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// CompactJournal folds the journal into the runtime rules file, leaving
+// only deletes of rules defined in other rule files in the journal.
+// The loaded rules do not change.
+func (s *Server) CompactJournal() error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	return s.compactJournal()
+}
+
+// compactJournal implements CompactJournal; the caller must hold reloadMutex
+func (s *Server) compactJournal() error {
+	switch {
+	case s.journal == nil:
+		return errors.New("journal is not enabled")
+	case s.runtimeRulesFile == "":
+		return errors.New("no runtime rules file (rules are not loaded from a directory)")
+	case s.trustedKeys != nil:
+		return errors.New("cannot compact into an unsigned rules file when signatures are required")
+	}
+
+	var rules []sexp.Element
+	if _, err := os.Stat(s.runtimeRulesFile); err == nil {
+		rules, err = persist.LoadFile(s.runtimeRulesFile, persist.DefaultLoadOptions())
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", s.runtimeRulesFile, err)
+		}
+	}
+
+	records, err := s.journal.Records()
+	if err != nil {
+		return err
+	}
+
+	// Deletes of rules that are not in the runtime file must stay in the
+	// journal, since rule files managed by operators are never rewritten
+	var pending []journal.Record
+	for _, r := range records {
+		switch r.Op {
+		case journal.OpAdd:
+			rules = append(rules, r.Rule)
+		case journal.OpDelete:
+			if i := indexOfRule(rules, r.Rule); i >= 0 {
+				rules = append(rules[:i:i], rules[i+1:]...)
+			} else {
+				pending = append(pending, r)
+			}
+		}
+	}
+
+	if err := persist.SaveFile(s.runtimeRulesFile, rules, persist.FormatCanonical); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.runtimeRulesFile, err)
+	}
+
+	// Record positions change, so runtime changes can no longer be
+	// replayed on the rules replaced by the last reload
+	s.previous = nil
+
+	if err := s.journal.Rewrite(pending); err != nil {
+		// The journal still holds the folded adds; they would be applied
+		// twice on the next reload, so report the failure loudly
+		s.logError("Journal rewrite after compaction failed: %v", err)
+		return err
+	}
+
+	s.metrics.journalCompactions.Add(1)
+	s.metrics.journalRecords.Store(int64(len(pending)))
+	s.logInfo("Compacted %d journal records into %s (%d runtime rules)", len(records)-len(pending), s.runtimeRulesFile, len(rules))
+	return nil
+}
+
+// indexOfRule returns the index of the first rule equal to rule, or -1
+func indexOfRule(rules []sexp.Element, rule sexp.Element) int {
+	target := rule.String()
+	for i, r := range rules {
+		if r.String() == target {
+			return i
+		}
+	}
+	return -1
+}
+
+// closeJournal closes the journal if one is open
+func (s *Server) closeJournal() {
+	if s.journal == nil {
+		return
+	}
+	if err := s.journal.Close(); err != nil {
+		s.logError("Failed to close journal: %v", err)
+	}
+}
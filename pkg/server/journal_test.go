@@ -0,0 +1,194 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+)
+
+func sendOp(t *testing.T, srv *Server, op string, args ...string) *protocol.Response {
+	t.Helper()
+	return srv.handleMessage(&session{}, &protocol.Message{Operation: op, Arguments: args})
+}
+
+func expectQuery(t *testing.T, srv *Server, query, code string) {
+	t.Helper()
+	if resp := sendOp(t, srv, "QUERY", query); resp.Code != code {
+		t.Errorf("QUERY %s: expected %s, got %s: %s", query, code, resp.Code, resp.Message)
+	}
+}
+
+// TestJournalSurvivesReloadAndRestart tests that runtime changes are
+// replayed on top of the rule files
+func TestJournalSurvivesReloadAndRestart(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)", "(4:list)"})
+	defer os.RemoveAll(rulesDir)
+	journalPath := filepath.Join(t.TempDir(), "rules.journal")
+
+	config := &Config{Address: ":0", RulesDir: rulesDir, JournalPath: journalPath}
+	srv, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	if resp := sendOp(t, srv, "ADD", "(5:write)"); resp.Code != protocol.CodeOK {
+		t.Fatalf("ADD failed: %s", resp.Message)
+	}
+	if resp := sendOp(t, srv, "DELETE", "(4:list)"); resp.Code != protocol.CodeOK {
+		t.Fatalf("DELETE failed: %s", resp.Message)
+	}
+
+	if resp := srv.handleReload(&protocol.Message{Operation: "RELOAD"}); resp.Code != protocol.CodeOK {
+		t.Fatalf("Reload failed: %s", resp.Message)
+	}
+	expectQuery(t, srv, "(5:write)", protocol.CodeOK)
+	expectQuery(t, srv, "(4:list)", protocol.CodeDenied)
+	srv.Close()
+
+	// Restart
+	srv, err = NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to restart server: %v", err)
+	}
+	defer srv.Close()
+
+	expectQuery(t, srv, "(4:read)", protocol.CodeOK)
+	expectQuery(t, srv, "(5:write)", protocol.CodeOK)
+	expectQuery(t, srv, "(4:list)", protocol.CodeDenied)
+}
+
+// TestJournalTornTail tests that a partially written record is discarded
+func TestJournalTornTail(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+	journalPath := filepath.Join(t.TempDir(), "rules.journal")
+
+	config := &Config{Address: ":0", RulesDir: rulesDir, JournalPath: journalPath}
+	srv, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	sendOp(t, srv, "ADD", "(5:write)")
+	srv.Close()
+
+	f, _ := os.OpenFile(journalPath, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString("1f2e3d4c A 8:(6:del")
+	f.Close()
+
+	srv, err = NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to restart server: %v", err)
+	}
+	defer srv.Close()
+
+	expectQuery(t, srv, "(5:write)", protocol.CodeOK)
+	if srv.journal.Len() != 1 {
+		t.Errorf("Expected 1 journal record, got %d", srv.journal.Len())
+	}
+}
+
+// TestCompactJournal tests folding the journal into runtime.spoc
+func TestCompactJournal(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)", "(4:list)"})
+	defer os.RemoveAll(rulesDir)
+	journalPath := filepath.Join(t.TempDir(), "rules.journal")
+
+	config := &Config{Address: ":0", RulesDir: rulesDir, JournalPath: journalPath}
+	srv, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	sendOp(t, srv, "ADD", "(5:write)")
+	sendOp(t, srv, "ADD", "(6:delete)")
+	sendOp(t, srv, "DELETE", "(6:delete)")
+	sendOp(t, srv, "DELETE", "(4:list)")
+
+	if err := srv.CompactJournal(); err != nil {
+		t.Fatalf("CompactJournal failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(rulesDir, "runtime.spoc"))
+	if err != nil {
+		t.Fatalf("runtime.spoc not written: %v", err)
+	}
+	if got := strings.TrimSpace(string(data)); got != "(5:write)" {
+		t.Errorf("runtime.spoc = %q, want (5:write)", got)
+	}
+
+	// Only the delete of a rule from another file remains
+	records, err := srv.journal.Records()
+	if err != nil {
+		t.Fatalf("Records failed: %v", err)
+	}
+	if len(records) != 1 || records[0].Rule.String() != "(4:list)" {
+		t.Errorf("Expected journal to keep only the delete of (4:list), got %v", records)
+	}
+	srv.Close()
+
+	srv, err = NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to restart server: %v", err)
+	}
+	defer srv.Close()
+
+	expectQuery(t, srv, "(4:read)", protocol.CodeOK)
+	expectQuery(t, srv, "(5:write)", protocol.CodeOK)
+	expectQuery(t, srv, "(6:delete)", protocol.CodeDenied)
+	expectQuery(t, srv, "(4:list)", protocol.CodeDenied)
+	if n := srv.GetEngine().RuleCount(); n != 2 {
+		t.Errorf("Expected 2 rules after restart, got %d", n)
+	}
+}
+
+// TestJournalAutoCompact tests compaction once the threshold is reached
+func TestJournalAutoCompact(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+
+	srv, err := NewServer(&Config{
+		Address:                 ":0",
+		RulesDir:                rulesDir,
+		JournalPath:             filepath.Join(t.TempDir(), "rules.journal"),
+		JournalCompactThreshold: 2,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	sendOp(t, srv, "ADD", "(1:a)")
+	sendOp(t, srv, "ADD", "(1:b)")
+
+	if srv.journal.Len() != 0 {
+		t.Errorf("Expected empty journal after compaction, got %d records", srv.journal.Len())
+	}
+	if srv.metrics.journalCompactions.Load() != 1 {
+		t.Errorf("Expected 1 compaction, got %d", srv.metrics.journalCompactions.Load())
+	}
+	if resp := srv.handleReload(&protocol.Message{Operation: "RELOAD"}); resp.Code != protocol.CodeOK {
+		t.Fatalf("Reload failed: %s", resp.Message)
+	}
+	if n := srv.GetEngine().RuleCount(); n != 3 {
+		t.Errorf("Expected 3 rules after reload, got %d", n)
+	}
+}
+
+// TestCompactJournalWithoutJournal tests that compaction needs a journal
+func TestCompactJournalWithoutJournal(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+
+	srv, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	if err := srv.CompactJournal(); err == nil {
+		t.Error("Expected error when journal is not enabled")
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirosfoundation/go-spocp/pkg/compare"
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// maxListLimit is the most rules a LIST operation returns, and the limit
+// of a LIST without LIMIT
+const maxListLimit = 1000
+
+// listFilter selects the rules returned by LIST
+type listFilter struct {
+	pattern sexp.Element
+	tag     string
+	offset  int
+	limit   int
+}
+
+// parseListArgs parses the keyword and value pairs of a LIST operation
+func parseListArgs(args []string) (*listFilter, error) {
+	if len(args)%2 != 0 {
+		return nil, fmt.Errorf("LIST arguments must be keyword and value pairs")
+	}
+
+	f := &listFilter{limit: maxListLimit}
+	for i := 0; i < len(args); i += 2 {
+		keyword, value := strings.ToUpper(args[i]), args[i+1]
+		var err error
+		switch keyword {
+		case "MATCH":
+			f.pattern, err = protocol.ParseQuery(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern: %v", err)
+			}
+		case "TAG":
+			f.tag = value
+		case "OFFSET", "LIMIT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s must be a non-negative number", keyword)
+			}
+			switch {
+			case keyword == "OFFSET":
+				f.offset = n
+			case n > maxListLimit:
+				return nil, fmt.Errorf("LIMIT must be at most %d", maxListLimit)
+			case n > 0:
+				f.limit = n
+			}
+		default:
+			return nil, fmt.Errorf("unknown LIST keyword %s", args[i])
+		}
+	}
+	return f, nil
+}
+
+// match reports whether a rule passes the pattern and tag filters
+func (f *listFilter) match(rule sexp.Element) bool {
+	if f.tag != "" {
+		if list, ok := rule.(*sexp.List); !ok || list.Tag != f.tag {
+			return false
+		}
+	}
+	if f.pattern != nil {
+		return compare.LessPermissive(f.pattern, rule) || compare.LessPermissive(rule, f.pattern)
+	}
+	return true
+}
+
+// handleList processes a LIST operation
+func (s *Server) handleList(msg *protocol.Message) *protocol.Response {
+	f, err := parseListArgs(msg.Arguments)
+	if err != nil {
+		return &protocol.Response{Code: protocol.CodeError, Message: err.Error()}
+	}
+
+	var parts []string
+	skipped := 0
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for rule := range s.engine.Rules() {
+		if len(parts) == f.limit {
+			break
+		}
+		if !f.match(rule) {
+			continue
+		}
+		if skipped < f.offset {
+			skipped++
+			continue
+		}
+		parts = append(parts, rule.String())
+	}
+	return &protocol.Response{Code: protocol.CodeOK, Message: "Ok", Parts: parts}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sirosfoundation/go-spocp/pkg/admin"
+	"github.com/sirosfoundation/go-spocp/pkg/client"
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// TestList tests listing rules with filters and paging
+func TestList(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{
+		"(4:http(4:page10:index.html)(6:action3:GET))",
+		"(4:http(4:page10:admin.html))",
+		"(3:ftp(4:file))",
+	})
+	defer os.RemoveAll(rulesDir)
+
+	srv, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"all", nil, 3},
+		{"tag", []string{"TAG", "http"}, 2},
+		{"pattern permitted by rules", []string{"MATCH", "(4:http(4:page10:index.html)(6:action3:GET)(6:userid4:olav))"}, 1},
+		{"pattern permitting rules", []string{"match", "(4:http)"}, 2},
+		{"page", []string{"OFFSET", "1", "LIMIT", "1"}, 1},
+		{"past the end", []string{"OFFSET", "5"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := sendOp(t, srv, protocol.OpList, tt.args...)
+			if resp.Code != protocol.CodeOK {
+				t.Fatalf("LIST failed: %s %s", resp.Code, resp.Message)
+			}
+			if len(resp.Parts) != tt.want {
+				t.Errorf("Expected %d rules, got %v", tt.want, resp.Parts)
+			}
+		})
+	}
+
+	for _, args := range [][]string{{"TAG"}, {"LIMIT", "-1"}, {"MATCH", "(4:http"}, {"SORT", "tag"}} {
+		if resp := sendOp(t, srv, protocol.OpList, args...); resp.Code != protocol.CodeError {
+			t.Errorf("LIST %v: expected an error, got %s", args, resp.Code)
+		}
+	}
+}
+
+// TestListClient tests paging through rules with the client iterator and
+// authorizing listings of a tag
+func TestListClient(t *testing.T) {
+	// Anyone may list http rules, only the full listing is refused
+	policy := admin.New(sexp.NewList(admin.Tag, sexp.NewList("op", sexp.NewAtom(protocol.OpList)),
+		sexp.NewList("subject"), sexp.NewList("rule-tag", sexp.NewAtom("read"))))
+	srv := startTestServer(t, &Config{AdminPolicy: policy})
+	srv.mu.Lock()
+	for _, rule := range []string{"(4:read(1:a))", "(4:read(1:b))", "(4:read(1:c))", "(5:write)"} {
+		if err := srv.engine.AddRule(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.mu.Unlock()
+
+	c, err := client.NewClient(&client.Config{Address: srv.listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	var got []string
+	for rule, err := range c.List(&client.ListOptions{Tag: "read", PageSize: 2}) {
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		got = append(got, sexp.AdvancedForm(rule))
+	}
+	if want := "(read)|(read (a))|(read (b))|(read (c))"; strings.Join(got, "|") != want {
+		t.Errorf("Expected %q, got %q", want, strings.Join(got, "|"))
+	}
+
+	for _, err := range c.List(nil) {
+		if err == nil || !strings.Contains(err.Error(), "Not authorized") {
+			t.Errorf("Expected the full listing to be refused, got %v", err)
+		}
+	}
+}
+
+// TestListLimit tests that listings are bounded by the server's limit,
+// and that the client pages within it
+func TestListLimit(t *testing.T) {
+	srv := startTestServer(t, &Config{})
+	srv.mu.Lock()
+	for i := 0; i < maxListLimit; i++ {
+		srv.engine.AddRuleElement(sexp.NewList("rule", sexp.NewAtom(strconv.Itoa(i))))
+	}
+	srv.mu.Unlock()
+
+	if resp := sendOp(t, srv, protocol.OpList); resp.Code != protocol.CodeOK || len(resp.Parts) != maxListLimit {
+		t.Errorf("Expected a bare LIST to return %d rules, got %s with %d", maxListLimit, resp.Code, len(resp.Parts))
+	}
+	if resp := sendOp(t, srv, protocol.OpList, "LIMIT", strconv.Itoa(maxListLimit+1)); resp.Code != protocol.CodeError {
+		t.Errorf("Expected LIMIT above %d to be refused, got %s", maxListLimit, resp.Code)
+	}
+
+	c, err := client.NewClient(&client.Config{Address: srv.listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	n := 0
+	for _, err := range c.List(&client.ListOptions{PageSize: 5000}) {
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		n++
+	}
+	if n != maxListLimit+1 {
+		t.Errorf("Expected %d rules, got %d", maxListLimit+1, n)
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+)
+
+// pipelineDepth limits the queries evaluated concurrently on a connection,
+// and the responses waiting to be written in order
+const pipelineDepth = 64
+
+// pipeline evaluates the queries of a connection concurrently while the
+// next messages are read. Responses to queries without an ID are written
+// in the order of the requests; tagged queries are answered as soon as
+// they are evaluated. Any other operation is a barrier: it waits until
+// every earlier response is written, so that it sees, and changes, the
+// same state as if the connection were processed one message at a time.
+type pipeline struct {
+	s    *Server
+	sess *session
+
+	// jobs are the queries waiting for a worker; workers are started as
+	// needed, up to pipelineDepth
+	jobs    chan job
+	workers int
+	idle    atomic.Int32
+
+	// queue holds the pending responses to untagged queries, in order,
+	// and tagged the responses to tagged queries once evaluated
+	queue  chan chan *protocol.Response
+	tagged chan *protocol.Response
+
+	// mu serializes writes to the session
+	mu sync.Mutex
+
+	// inflight counts the queries whose response is not written yet
+	inflight sync.WaitGroup
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// job is a query to evaluate, with the channel for its response if it
+// has no ID
+type job struct {
+	msg     *protocol.Message
+	pending chan *protocol.Response
+}
+
+func (s *Server) newPipeline(sess *session) *pipeline {
+	p := &pipeline{
+		s:      s,
+		sess:   sess,
+		jobs:   make(chan job, pipelineDepth),
+		queue:  make(chan chan *protocol.Response, pipelineDepth),
+		tagged: make(chan *protocol.Response, pipelineDepth),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go p.writeResponses()
+	return p
+}
+
+// concurrent reports whether a message can be evaluated concurrently with
+// the messages around it. Queries only read the engine; during an
+// authentication exchange every message aborts it, so it stays in order.
+func (p *pipeline) concurrent(msg *protocol.Message) bool {
+	return msg.Operation == "QUERY" && p.sess.auth == nil
+}
+
+// query evaluates a query in the background. It blocks while the
+// connection already has pipelineDepth queries waiting.
+func (p *pipeline) query(msg *protocol.Message) {
+	p.inflight.Add(1)
+	j := job{msg: msg}
+	if msg.ID == "" {
+		j.pending = make(chan *protocol.Response, 1)
+		p.queue <- j.pending
+	}
+	if p.idle.Load() == 0 && p.workers < pipelineDepth {
+		p.workers++
+		go p.work()
+	}
+	p.jobs <- j
+}
+
+// work evaluates queries until the pipeline is closed
+func (p *pipeline) work() {
+	for {
+		p.idle.Add(1)
+		j, ok := <-p.jobs
+		p.idle.Add(-1)
+		if !ok {
+			return
+		}
+
+		resp := p.s.handleMessage(p.sess, j.msg)
+		resp.ID = j.msg.ID
+		if j.pending != nil {
+			j.pending <- resp
+		} else {
+			p.tagged <- resp
+		}
+	}
+}
+
+// writeResponses writes the responses to queries: tagged ones as they
+// come, the others in order. Responses are flushed together, once no
+// other response is ready.
+func (p *pipeline) writeResponses() {
+	defer close(p.done)
+
+	// head receives the next response in order, once it is known
+	var head chan *protocol.Response
+	yielded := false
+	for {
+		queue := p.queue
+		if head != nil {
+			queue = nil
+		}
+
+		var resp *protocol.Response
+		select {
+		case resp = <-head:
+			head = nil
+		case resp = <-p.tagged:
+		case head = <-queue:
+			continue
+		default:
+			// Give the workers a chance to add to the batch first
+			if !yielded {
+				yielded = true
+				runtime.Gosched()
+				continue
+			}
+			p.flush()
+			select {
+			case resp = <-head:
+				head = nil
+			case resp = <-p.tagged:
+			case head = <-queue:
+				continue
+			case <-p.stop:
+				return
+			}
+		}
+
+		yielded = false
+		p.mu.Lock()
+		if err := p.s.writeResponse(p.sess.writer, resp); err != nil {
+			p.fail(err)
+		}
+		p.mu.Unlock()
+		p.inflight.Done()
+	}
+}
+
+// flush writes the buffered responses
+func (p *pipeline) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sess.writer.Buffered() == 0 {
+		return
+	}
+	if err := p.sess.writer.Flush(); err != nil {
+		p.fail(err)
+	}
+}
+
+// fail closes the connection after a failed write, which ends the
+// connection's loop at its next read. The caller holds mu.
+func (p *pipeline) fail(err error) {
+	p.s.logError("Error sending response to %s: %v", p.sess.remote, err)
+	p.sess.conn.Close()
+}
+
+// write writes the response to a barrier, after wait
+func (p *pipeline) write(resp *protocol.Response) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.s.sendResponse(p.sess.writer, resp)
+}
+
+// upgrade switches the connection to TLS after STARTTLS, while nothing
+// is written
+func (p *pipeline) upgrade() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.s.upgradeTLS(p.sess)
+}
+
+// wait blocks until every query read so far is answered
+func (p *pipeline) wait() {
+	p.inflight.Wait()
+}
+
+// close waits for the queries in flight and stops the workers and the
+// writer
+func (p *pipeline) close() {
+	p.inflight.Wait()
+	close(p.jobs)
+	close(p.stop)
+	<-p.done
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sirosfoundation/go-spocp/pkg/client"
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+)
+
+// TestPipeline tests that pipelined messages are answered in order, and
+// that changes act as barriers between the queries around them
+func TestPipeline(t *testing.T) {
+	srv := startTestServer(t, &Config{})
+
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	messages := []*protocol.Message{
+		{Operation: "QUERY", Arguments: []string{"(4:read)"}},
+		{Operation: "QUERY", Arguments: []string{"(5:write)"}},
+		{Operation: "ADD", Arguments: []string{"(5:write)"}},
+		{Operation: "QUERY", Arguments: []string{"(5:write)"}},
+		{Operation: "QUERY", Arguments: []string{"(5:write)"}, ID: "w"},
+		{Operation: "QUERY", Arguments: []string{"(4:exec)"}, ID: "x"},
+		{Operation: "QUERY", Arguments: []string{"(4:read)"}},
+		{Operation: "LOGOUT"},
+	}
+	var batch strings.Builder
+	for i := 0; i < 50; i++ {
+		batch.WriteString(protocol.EncodeMessage(messages[0]))
+	}
+	for _, msg := range messages {
+		batch.WriteString(protocol.EncodeMessage(msg))
+	}
+	if _, err := conn.Write([]byte(batch.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	var ordered []string
+	tagged := map[string]string{}
+	for {
+		resp, err := protocol.DecodeResponse(reader)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if resp.ID != "" {
+			tagged[resp.ID] = resp.Code
+			continue
+		}
+		ordered = append(ordered, resp.Code)
+		if resp.Code == protocol.CodeBye {
+			break
+		}
+	}
+
+	want := strings.Repeat("200 ", 50) + "200 400 200 200 200 203"
+	if got := strings.Join(ordered, " "); got != want {
+		t.Errorf("Expected responses %q, got %q", want, got)
+	}
+	if tagged["w"] != protocol.CodeOK || tagged["x"] != protocol.CodeDenied || len(tagged) != 2 {
+		t.Errorf("Expected tagged responses w=200 x=400, got %v", tagged)
+	}
+}
+
+// TestPipelineClient tests QueryAsync against the server, with request IDs
+func TestPipelineClient(t *testing.T) {
+	srv := startTestServer(t, &Config{})
+
+	c, err := client.NewClient(&client.Config{
+		Address: srv.listener.Addr().String(),
+		Require: []string{protocol.CapPipelining, protocol.CapRequestID},
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	futures := make([]*client.QueryFuture, 1000)
+	for i := range futures {
+		tag := "read"
+		if i%2 == 1 {
+			tag = "write"
+		}
+		futures[i] = c.QueryAsync(sexp.NewList(tag))
+	}
+	for i, f := range futures {
+		if ok, err := f.Wait(); err != nil || ok != (i%2 == 0) {
+			t.Errorf("Query %d: got %v, %v", i, ok, err)
+		}
+	}
+
+	// Synchronous operations share the connection
+	if err := c.AddString("(5:write)"); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if ok, err := c.QueryAsync(sexp.NewList("write")).Wait(); !ok || err != nil {
+		t.Errorf("Expected the added rule to apply, got %v, %v", ok, err)
+	}
+}
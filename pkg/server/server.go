@@ -5,6 +5,7 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -12,6 +13,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -19,8 +21,14 @@ import (
 	"time"
 
 	"github.com/sirosfoundation/go-spocp"
+	"github.com/sirosfoundation/go-spocp/pkg/admin"
+	"github.com/sirosfoundation/go-spocp/pkg/journal"
 	"github.com/sirosfoundation/go-spocp/pkg/persist"
 	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sasl"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+	"github.com/sirosfoundation/go-spocp/pkg/signing"
+	"github.com/sirosfoundation/go-spocp/pkg/tlsutil"
 )
 
 // LogLevel defines the verbosity of logging
@@ -39,7 +47,15 @@ type Server struct {
 	listener       net.Listener
 	engine         *spocp.Engine
 	rulesDir       string
+	rulesFS        fs.FS
+	loadWorkers    int
 	tlsConfig      *tls.Config
+	requireTLS     bool
+	credentials    sasl.CredentialStore
+	requireAuth    bool
+	adminPolicy    *admin.Policy
+	certManager    *tlsutil.CertManager
+	maxMessageSize int
 	mu             sync.RWMutex
 	reloadMutex    sync.Mutex
 	logger         *log.Logger
@@ -50,18 +66,52 @@ type Server struct {
 	pidFile        string
 	healthAddr     string
 	healthListener net.Listener
+	trustedKeys    *signing.KeyRing
+	bundlePath     string
+	manifest       atomic.Pointer[persist.Manifest]
+
+	journal          *journal.Journal
+	runtimeRulesFile string
+	compactThreshold int
+	unjournaled      atomic.Int64 // runtime changes made without a journal
+
+	// Change detection and parsed rule files, guarded by reloadMutex
+	fileStates  map[string]fileState // sources at the last reload or check
+	cacheStates map[string]fileState // sources ruleCache was loaded from
+	ruleCache   map[string]*cachedRuleFile
+
+	// Reload guards, and the rules replaced by the last reload (guarded by
+	// reloadMutex)
+	maxRuleDelta float64
+	canaries     []Canary
+	previous     *rollbackState
 
 	// Metrics
 	metrics struct {
-		queriesTotal     atomic.Int64
-		queriesOK        atomic.Int64
-		queriesDenied    atomic.Int64
-		addsTotal        atomic.Int64
-		reloadsTotal     atomic.Int64
-		reloadsFailed    atomic.Int64
-		connectionsTotal atomic.Int64
-		lastReloadTime   atomic.Value // time.Time
-		rulesLoaded      atomic.Int64
+		queriesTotal       atomic.Int64
+		queriesOK          atomic.Int64
+		queriesDenied      atomic.Int64
+		addsTotal          atomic.Int64
+		deletesTotal       atomic.Int64
+		txCommitted        atomic.Int64
+		txAborted          atomic.Int64
+		journalRecords     atomic.Int64
+		journalCompactions atomic.Int64
+		reloadsTotal       atomic.Int64
+		reloadsFailed      atomic.Int64
+		reloadsRejected    atomic.Int64
+		reloadsGuarded     atomic.Int64
+		rollbacksTotal     atomic.Int64
+		reloadsByReason    map[string]*atomic.Int64
+		reloadFilesParsed  atomic.Int64
+		reloadFilesReused  atomic.Int64
+		connectionsTotal   atomic.Int64
+		startTLSTotal      atomic.Int64
+		startTLSFailed     atomic.Int64
+		authTotal          atomic.Int64
+		authFailed         atomic.Int64
+		lastReloadTime     atomic.Value // time.Time
+		rulesLoaded        atomic.Int64
 	}
 }
 
@@ -70,27 +120,114 @@ type Config struct {
 	// Address to listen on (e.g., ":6000")
 	Address string
 
-	// Directory containing .spoc rule files
+	// Directory containing .spoc rule files and JSON/YAML rule documents
 	RulesDir string
 
+	// RulesFS is a file system, such as an embed.FS, to load rule files
+	// from instead of RulesDir. Signatures for TrustedKeys are read from
+	// it too.
+	RulesFS fs.FS
+
+	// BundlePath is a rule bundle (tar.gz with manifest) to load instead
+	// of RulesDir
+	BundlePath string
+
+	// LoadWorkers is the number of rule files parsed concurrently on
+	// reloads (default: GOMAXPROCS). Rules are still loaded in file order.
+	LoadWorkers int
+
 	// TLS configuration (optional, nil for plain TCP)
 	TLSConfig *tls.Config
 
+	// CertManager, if set and TLSConfig is not, provides the TLS
+	// configuration so that certificates can be rotated without a restart,
+	// and adds certificate metrics
+	CertManager *tlsutil.CertManager
+
+	// StartTLS listens for plain TCP even though TLSConfig is set; clients
+	// upgrade their connections with the STARTTLS operation
+	StartTLS bool
+
+	// RequireTLS, with StartTLS, refuses operations other than STARTTLS,
+	// CAPA and LOGOUT on plain connections, except from loopback addresses
+	RequireTLS bool
+
+	// Credentials enables authentication with the AUTH operation using
+	// the SASL PLAIN and SCRAM-SHA-256 mechanisms. EXTERNAL is available
+	// on TLS connections with a verified client certificate regardless.
+	Credentials sasl.CredentialStore
+
+	// RequireAuth refuses ADD, DELETE, RELOAD and LIST on connections
+	// that have not authenticated
+	RequireAuth bool
+
+	// AdminPolicy, if set, authorizes ADD, DELETE, RELOAD and LIST with
+	// an admin query for the connection's identity (see package admin)
+	AdminPolicy *admin.Policy
+
+	// MaxMessageSize is the largest message accepted, in bytes; larger
+	// ones close the connection (default: protocol.DefaultMaxMessageSize)
+	MaxMessageSize int
+
 	// Logger (optional, defaults to discard logger)
 	Logger *log.Logger
 
 	// LogLevel controls verbosity (default: LogLevelError)
 	LogLevel LogLevel
 
-	// ReloadInterval for automatic rule reloading (0 to disable)
+	// ReloadInterval for automatic rule reloading (0 to disable). Rule
+	// files are checked at this interval and reloaded only if their
+	// contents changed.
 	ReloadInterval time.Duration
 
+	// Watch reloads rules as soon as rule files change, using inotify on
+	// Linux. Elsewhere, and for RulesFS, files are polled every
+	// ReloadInterval (default DefaultPollInterval).
+	Watch bool
+
+	// WatchDebounce is how long to wait for a burst of changes to settle
+	// before reloading (default DefaultWatchDebounce)
+	WatchDebounce time.Duration
+
+	// MaxRuleDelta rejects reloads that change the number of rules by more
+	// than this fraction of the current count, e.g. 0.1 for 10% (0 to
+	// disable). RELOAD FORCE bypasses the limit.
+	MaxRuleDelta float64
+
+	// Canaries are queries that must keep their decision; reloads that
+	// change one are rejected (see LoadCanaries)
+	Canaries []Canary
+
 	// PidFile path for storing process ID (optional)
 	PidFile string
 
 	// HealthAddr for health check endpoint (e.g., ":8080", optional)
 	HealthAddr string
 
+	// TrustedKeys, if set, requires every rule file to carry a detached
+	// signature by one of these keys. Reloads with unsigned or invalid
+	// files are rejected and the current rules are kept.
+	TrustedKeys *signing.KeyRing
+
+	// JournalPath enables the write-ahead journal: rules added or deleted
+	// at runtime are recorded there and replayed on top of the rule files
+	// at startup and on every reload (optional)
+	JournalPath string
+
+	// JournalSync is the journal fsync policy (default: journal.SyncAlways)
+	JournalSync journal.SyncPolicy
+
+	// JournalSyncInterval is the flush period for journal.SyncInterval
+	JournalSyncInterval time.Duration
+
+	// JournalCompactThreshold compacts the journal automatically once it
+	// holds this many records (0 to disable; see CompactJournal)
+	JournalCompactThreshold int
+
+	// RuntimeRulesFile receives journaled rules on compaction
+	// (default: runtime.spoc in RulesDir)
+	RuntimeRulesFile string
+
 	// Engine allows providing a pre-existing engine (optional, for testing/benchmarking)
 	// If provided, RulesDir is not required and rules are not loaded from disk.
 	Engine *spocp.Engine
@@ -101,15 +238,45 @@ func NewServer(config *Config) (*Server, error) {
 	if config.Address == "" {
 		return nil, fmt.Errorf("address is required")
 	}
+	if config.TLSConfig == nil && config.CertManager != nil {
+		config.TLSConfig = config.CertManager.TLSConfig()
+	}
+	if config.StartTLS && config.TLSConfig == nil {
+		return nil, fmt.Errorf("STARTTLS requires a TLS configuration")
+	}
+	if config.RequireTLS && !config.StartTLS {
+		return nil, fmt.Errorf("RequireTLS requires StartTLS")
+	}
+	if config.RequireAuth && config.Credentials == nil &&
+		(config.TLSConfig == nil || config.TLSConfig.ClientAuth < tls.VerifyClientCertIfGiven) {
+		return nil, fmt.Errorf("RequireAuth requires Credentials or verified client certificates")
+	}
+	if config.MaxRuleDelta < 0 {
+		return nil, fmt.Errorf("max rule delta must not be negative")
+	}
+	canaries := make([]Canary, len(config.Canaries))
+	for i, c := range config.Canaries {
+		if err := c.parse(); err != nil {
+			return nil, err
+		}
+		canaries[i] = c
+	}
 
-	// If no pre-existing engine provided, we need RulesDir
+	// If no pre-existing engine provided, we need RulesDir or BundlePath
 	if config.Engine == nil {
-		if config.RulesDir == "" {
-			return nil, fmt.Errorf("rules directory is required (or provide Engine)")
-		}
-		// Check if rules directory exists
-		if _, err := os.Stat(config.RulesDir); os.IsNotExist(err) {
-			return nil, fmt.Errorf("rules directory does not exist: %s", config.RulesDir)
+		switch {
+		case config.BundlePath != "":
+			if _, err := os.Stat(config.BundlePath); os.IsNotExist(err) {
+				return nil, fmt.Errorf("rule bundle does not exist: %s", config.BundlePath)
+			}
+		case config.RulesFS != nil:
+		case config.RulesDir == "":
+			return nil, fmt.Errorf("rules directory is required (or provide RulesFS, BundlePath or Engine)")
+		default:
+			// Check if rules directory exists
+			if _, err := os.Stat(config.RulesDir); os.IsNotExist(err) {
+				return nil, fmt.Errorf("rules directory does not exist: %s", config.RulesDir)
+			}
 		}
 	}
 
@@ -133,19 +300,46 @@ func NewServer(config *Config) (*Server, error) {
 	}
 
 	s := &Server{
-		engine:     engine,
-		rulesDir:   config.RulesDir,
-		tlsConfig:  config.TLSConfig,
-		logger:     logger,
-		logLevel:   logLevel,
-		ctx:        ctx,
-		cancel:     cancel,
-		pidFile:    config.PidFile,
-		healthAddr: config.HealthAddr,
+		engine:      engine,
+		rulesDir:    config.RulesDir,
+		rulesFS:     config.RulesFS,
+		loadWorkers: config.LoadWorkers,
+		tlsConfig:   config.TLSConfig,
+		requireTLS:  config.RequireTLS,
+		credentials: config.Credentials,
+		requireAuth: config.RequireAuth,
+		adminPolicy: config.AdminPolicy,
+		certManager: config.CertManager,
+		logger:      logger,
+		logLevel:    logLevel,
+		ctx:         ctx,
+		cancel:      cancel,
+		pidFile:     config.PidFile,
+		healthAddr:  config.HealthAddr,
+		trustedKeys: config.TrustedKeys,
+		bundlePath:  config.BundlePath,
+
+		maxRuleDelta: config.MaxRuleDelta,
+		canaries:     canaries,
+	}
+
+	s.maxMessageSize = config.MaxMessageSize
+	if s.maxMessageSize <= 0 {
+		s.maxMessageSize = protocol.DefaultMaxMessageSize
+	}
+
+	s.compactThreshold = config.JournalCompactThreshold
+	s.runtimeRulesFile = config.RuntimeRulesFile
+	if s.runtimeRulesFile == "" && config.RulesDir != "" && config.RulesFS == nil && config.BundlePath == "" {
+		s.runtimeRulesFile = filepath.Join(config.RulesDir, "runtime.spoc")
 	}
 
 	// Initialize last reload time
 	s.metrics.lastReloadTime.Store(time.Now())
+	s.metrics.reloadsByReason = make(map[string]*atomic.Int64)
+	for _, reason := range reloadReasons {
+		s.metrics.reloadsByReason[reason] = new(atomic.Int64)
+	}
 
 	// Write PID file if configured
 	if config.PidFile != "" {
@@ -155,21 +349,35 @@ func NewServer(config *Config) (*Server, error) {
 		}
 	}
 
-	// Load initial rules (only if not using pre-existing engine)
-	if config.Engine == nil {
-		if err := s.reloadRules(); err != nil {
+	// Open the journal before loading rules so it is replayed
+	if config.JournalPath != "" {
+		if err := s.openJournal(config); err != nil {
 			cancel()
 			s.removePidFile()
-			return nil, fmt.Errorf("failed to load initial rules: %w", err)
+			return nil, fmt.Errorf("failed to open journal: %w", err)
 		}
 	}
 
-	// Create listener
+	// Load initial rules (a pre-existing engine only gets the journal)
 	var err error
-	if config.TLSConfig != nil {
+	if config.Engine == nil {
+		err = s.reloadRules(reloadStartup, reloadApply)
+	} else {
+		_, err = s.replayJournal(engine)
+	}
+	if err != nil {
+		cancel()
+		s.closeJournal()
+		s.removePidFile()
+		return nil, fmt.Errorf("failed to load initial rules: %w", err)
+	}
+
+	// Create listener
+	if config.TLSConfig != nil && !config.StartTLS {
 		s.listener, err = tls.Listen("tcp", config.Address, config.TLSConfig)
 		if err != nil {
 			cancel()
+			s.closeJournal()
 			s.removePidFile()
 			return nil, fmt.Errorf("failed to create TLS listener: %w", err)
 		}
@@ -178,10 +386,15 @@ func NewServer(config *Config) (*Server, error) {
 		s.listener, err = net.Listen("tcp", config.Address)
 		if err != nil {
 			cancel()
+			s.closeJournal()
 			s.removePidFile()
 			return nil, fmt.Errorf("failed to create listener: %w", err)
 		}
-		s.logInfo("Server listening on %s (plain TCP)", config.Address)
+		if config.StartTLS {
+			s.logInfo("Server listening on %s (plain TCP with STARTTLS)", config.Address)
+		} else {
+			s.logInfo("Server listening on %s (plain TCP)", config.Address)
+		}
 	}
 
 	// Start health check endpoint if configured
@@ -189,15 +402,15 @@ func NewServer(config *Config) (*Server, error) {
 		if err := s.startHealthCheck(); err != nil {
 			cancel()
 			s.listener.Close()
+			s.closeJournal()
 			s.removePidFile()
 			return nil, fmt.Errorf("failed to start health check: %w", err)
 		}
 	}
 
 	// Start automatic reloading if configured
-	if config.ReloadInterval > 0 {
-		s.wg.Add(1)
-		go s.autoReload(config.ReloadInterval)
+	if config.Engine == nil && (config.Watch || config.ReloadInterval > 0) {
+		s.startWatching(config)
 	}
 
 	return s, nil
@@ -240,6 +453,8 @@ func (s *Server) Close() error {
 	// Wait for all connections to close
 	s.wg.Wait()
 
+	s.closeJournal()
+
 	// Remove PID file
 	s.removePidFile()
 
@@ -250,13 +465,26 @@ func (s *Server) Close() error {
 // handleConnection processes a client connection
 func (s *Server) handleConnection(conn net.Conn) {
 	defer s.wg.Done()
-	defer conn.Close()
 
-	remoteAddr := conn.RemoteAddr().String()
+	sess := newSession(conn)
+	defer func() { sess.conn.Close() }()
+	defer s.abortTransaction(sess)
+
+	remoteAddr := sess.remote
 	s.logDebug("New connection from %s", remoteAddr)
 
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
+	// Handshake up front so that the client's certificate is known before
+	// the first operation
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := s.handshake(sess, tlsConn); err != nil {
+			s.logWarn("Connection from %s rejected: %v", remoteAddr, err)
+			return
+		}
+	}
+
+	// Queries are evaluated while the next messages are read
+	p := s.newPipeline(sess)
+	defer p.close()
 
 	for {
 		select {
@@ -266,30 +494,42 @@ func (s *Server) handleConnection(conn net.Conn) {
 		}
 
 		// Set read deadline
-		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Minute)) //nolint:errcheck // non-critical timeout setting
+		_ = sess.conn.SetReadDeadline(time.Now().Add(5 * time.Minute)) //nolint:errcheck // non-critical timeout setting
 
 		// Read message
-		msg, err := protocol.DecodeMessage(reader)
+		msg, err := protocol.DecodeMessageLimit(sess.reader, s.maxMessageSize)
 		if err != nil {
 			if err.Error() == "EOF" {
 				s.logDebug("Client %s disconnected", remoteAddr)
 				return
 			}
 			s.logError("Error reading from %s: %v", remoteAddr, err)
-			_ = s.sendResponse(writer, &protocol.Response{ //nolint:errcheck // best-effort error response
+			message := "Protocol error"
+			if errors.Is(err, protocol.ErrMessageTooLarge) {
+				message = "Message too large"
+			}
+			p.wait()
+			_ = p.write(&protocol.Response{ //nolint:errcheck // best-effort error response
 				Code:    protocol.CodeError,
-				Message: "Protocol error",
+				Message: message,
 			})
 			return
 		}
 
 		s.logDebug("Received from %s: %s %v", remoteAddr, msg.Operation, msg.Arguments)
 
-		// Handle message
-		resp := s.handleMessage(msg)
+		if p.concurrent(msg) {
+			p.query(msg)
+			continue
+		}
+
+		// Anything else waits for the queries before it
+		p.wait()
+		resp := s.handleMessage(sess, msg)
+		resp.ID = msg.ID
 
 		// Send response
-		if err := s.sendResponse(writer, resp); err != nil {
+		if err := p.write(resp); err != nil {
 			s.logError("Error sending response to %s: %v", remoteAddr, err)
 			return
 		}
@@ -299,20 +539,72 @@ func (s *Server) handleConnection(conn net.Conn) {
 			s.logDebug("Client %s logged out", remoteAddr)
 			return
 		}
+
+		if sess.upgrade {
+			if err := p.upgrade(); err != nil {
+				s.logError("STARTTLS from %s: %v", remoteAddr, err)
+				return
+			}
+			s.logDebug("Client %s started TLS", remoteAddr)
+		}
 	}
 }
 
 // handleMessage processes a protocol message and returns a response
-func (s *Server) handleMessage(msg *protocol.Message) *protocol.Response {
+func (s *Server) handleMessage(sess *session, msg *protocol.Message) (resp *protocol.Response) {
+	if s.requiresTLS(sess, msg.Operation) {
+		return &protocol.Response{
+			Code:    protocol.CodeError,
+			Message: "TLS required, use STARTTLS",
+		}
+	}
+	if sess.auth != nil && msg.Operation != protocol.OpAuth {
+		return s.abortAuth(sess)
+	}
+	if msg.Operation == protocol.OpCommit {
+		defer func() { s.logAudit(sess, msg, resp) }()
+	}
+	if isAdminOp(sess, msg.Operation) {
+		defer func() { s.logAudit(sess, msg, resp) }()
+		if s.requireAuth && sess.identity == "" {
+			return &protocol.Response{Code: protocol.CodeDenied, Message: "Authentication required"}
+		}
+		if !s.authorizeAdmin(sess, msg) {
+			return &protocol.Response{Code: protocol.CodeDenied, Message: "Not authorized"}
+		}
+	}
+
 	switch msg.Operation {
 	case "QUERY":
 		return s.handleQuery(msg)
 	case "ADD":
+		if sess.tx != nil {
+			return s.handleStage(sess, msg)
+		}
 		return s.handleAdd(msg)
+	case "DELETE":
+		if sess.tx != nil {
+			return s.handleStage(sess, msg)
+		}
+		return s.handleDelete(msg)
 	case "LOGOUT":
 		return &protocol.Response{Code: protocol.CodeBye, Message: "Bye"}
 	case "RELOAD":
-		return s.handleReload()
+		return s.handleReload(msg)
+	case protocol.OpList:
+		return s.handleList(msg)
+	case protocol.OpCapa:
+		return s.handleCapa(sess, msg)
+	case protocol.OpBegin:
+		return s.handleBegin(sess, msg)
+	case protocol.OpCommit:
+		return s.handleCommit(sess, msg)
+	case protocol.OpRollback:
+		return s.handleRollback(sess, msg)
+	case protocol.OpStartTLS:
+		return s.handleStartTLS(sess, msg)
+	case protocol.OpAuth:
+		return s.handleAuth(sess, msg)
 	default:
 		return &protocol.Response{
 			Code:    protocol.CodeUnknown,
@@ -374,6 +666,15 @@ func (s *Server) handleAdd(msg *protocol.Message) *protocol.Response {
 		}
 	}
 
+	if s.journal != nil {
+		// Keep journal order and engine swaps consistent
+		s.reloadMutex.Lock()
+		defer s.reloadMutex.Unlock()
+	}
+	if err := s.appendJournal(journal.OpAdd, rule); err != nil {
+		return &protocol.Response{Code: protocol.CodeError, Message: "Journal write failed"}
+	}
+
 	// Add rule
 	s.mu.Lock()
 	s.engine.AddRuleElement(rule)
@@ -382,11 +683,40 @@ func (s *Server) handleAdd(msg *protocol.Message) *protocol.Response {
 	return &protocol.Response{Code: protocol.CodeOK, Message: "Ok"}
 }
 
-// handleReload processes a RELOAD operation
-func (s *Server) handleReload() *protocol.Response {
+// handleReload processes a RELOAD operation. RELOAD DRYRUN reports the
+// changes a reload would make without applying them, and RELOAD FORCE
+// bypasses the reload guards.
+func (s *Server) handleReload(msg *protocol.Message) *protocol.Response {
+	mode := reloadApply
+	switch {
+	case len(msg.Arguments) == 0:
+	case len(msg.Arguments) == 1 && strings.EqualFold(msg.Arguments[0], "DRYRUN"):
+		mode = reloadDryRun
+	case len(msg.Arguments) == 1 && strings.EqualFold(msg.Arguments[0], "FORCE"):
+		mode = reloadForce
+	case isReloadRollback(msg):
+		return s.handleReloadRollback()
+	default:
+		return &protocol.Response{
+			Code:    protocol.CodeError,
+			Message: "RELOAD takes no argument, DRYRUN, FORCE or ROLLBACK",
+		}
+	}
+
+	if mode == reloadDryRun {
+		diff, err := s.dryRunReload()
+		switch {
+		case diff == nil:
+			return &protocol.Response{Code: protocol.CodeError, Message: fmt.Sprintf("Reload failed: %v", err)}
+		case err != nil:
+			return &protocol.Response{Code: protocol.CodeError, Message: fmt.Sprintf("Reload failed: %v\n%s", err, diff)}
+		}
+		return &protocol.Response{Code: protocol.CodeOK, Message: diff.String()}
+	}
+
 	s.metrics.reloadsTotal.Add(1)
 
-	if err := s.reloadRules(); err != nil {
+	if err := s.reloadRules(reloadManual, mode); err != nil {
 		s.metrics.reloadsFailed.Add(1)
 		return &protocol.Response{
 			Code:    protocol.CodeError,
@@ -396,56 +726,185 @@ func (s *Server) handleReload() *protocol.Response {
 	return &protocol.Response{Code: protocol.CodeOK, Message: "Reloaded"}
 }
 
+// isReloadRollback reports whether msg is a RELOAD ROLLBACK
+func isReloadRollback(msg *protocol.Message) bool {
+	return msg.Operation == "RELOAD" && len(msg.Arguments) == 1 && strings.EqualFold(msg.Arguments[0], "ROLLBACK")
+}
+
+// handleReloadRollback processes a RELOAD ROLLBACK operation
+func (s *Server) handleReloadRollback() *protocol.Response {
+	if err := s.Rollback(); err != nil {
+		return &protocol.Response{
+			Code:    protocol.CodeError,
+			Message: fmt.Sprintf("Rollback failed: %v", err),
+		}
+	}
+	return &protocol.Response{Code: protocol.CodeOK, Message: "Rolled back"}
+}
+
 // sendResponse sends a response to the client
 func (s *Server) sendResponse(writer *bufio.Writer, resp *protocol.Response) error {
-	encoded := protocol.EncodeResponse(resp)
-	if _, err := writer.WriteString(encoded); err != nil {
+	if err := s.writeResponse(writer, resp); err != nil {
 		return err
 	}
 	return writer.Flush()
 }
 
-// reloadRules reloads all .spoc files from the rules directory
+// writeResponse buffers a response without flushing it
+func (s *Server) writeResponse(writer *bufio.Writer, resp *protocol.Response) error {
+	// Parts are encoded one at a time so that long listings are streamed
+	for _, part := range resp.Parts {
+		encoded := protocol.EncodeResponse(&protocol.Response{Code: protocol.CodeMultipart, Message: part, ID: resp.ID})
+		if _, err := writer.WriteString(encoded); err != nil {
+			return err
+		}
+	}
+	encoded := protocol.EncodeResponse(&protocol.Response{Code: resp.Code, Message: resp.Message, ID: resp.ID})
+	_, err := writer.WriteString(encoded)
+	return err
+}
+
+// reloadRules reloads all rule files from the rules directory or file
+// system, or the rule bundle if one is configured; reason says what
+// triggered the reload. Rule files that did not change since the last
+// reload are not parsed again.
 // Uses atomic swap to ensure no downtime
-func (s *Server) reloadRules() error {
+func (s *Server) reloadRules(reason string, mode reloadMode) error {
 	s.reloadMutex.Lock()
 	defer s.reloadMutex.Unlock()
 
-	s.logDebug("Reloading rules from %s", s.rulesDir)
+	states, err := s.scanRuleSources()
+	if err != nil {
+		return err
+	}
+	_, err = s.reloadLocked(reason, states, mode)
+	return err
+}
+
+// dryRunReload loads the rules as a reload would and returns the changes
+// to the current rules, with the reload guard error if any. The diff is
+// nil if the rules could not be loaded.
+func (s *Server) dryRunReload() (*ruleDiff, error) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	states, err := s.scanRuleSources()
+	if err != nil {
+		return nil, err
+	}
+	return s.reloadLocked(reloadManual, states, reloadDryRun)
+}
+
+// reloadIfChanged reloads rules if a rule source changed since the last
+// reload or check, and reports whether it did
+func (s *Server) reloadIfChanged(reason string) (bool, error) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	states, err := s.scanRuleSources()
+	if err != nil {
+		return false, err
+	}
+	changes := diffStates(s.fileStates, states)
+	if len(changes) == 0 {
+		s.fileStates = states
+		return false, nil
+	}
+	s.logInfo("Rule files changed: %s", strings.Join(changes, ", "))
+	_, err = s.reloadLocked(reason, states, reloadApply)
+	return true, err
+}
+
+// reloadMode selects how reloadLocked treats the new rules
+type reloadMode int
+
+const (
+	reloadApply  reloadMode = iota // check reload guards and swap
+	reloadDryRun                   // check reload guards and report changes
+	reloadForce                    // swap without checking reload guards
+)
+
+// reloadLocked loads the rules from sources in the given states into a new
+// engine and swaps it in; the caller must hold reloadMutex. Dry runs
+// return the differences to the current rules and change nothing.
+func (s *Server) reloadLocked(reason string, states map[string]fileState, mode reloadMode) (*ruleDiff, error) {
+	if mode != reloadDryRun {
+		// A failed reload is not retried until the files change again
+		s.fileStates = states
+	}
+
+	opts := persist.DefaultLoadOptions()
+	if s.trustedKeys != nil {
+		opts.Verify = s.trustedKeys.Verify
+		opts.VerifySignature = s.trustedKeys.VerifySignature
+		if s.bundlePath == "" && s.rulesFS != nil {
+			opts.Verify = s.trustedKeys.VerifyFS(s.rulesFS)
+		}
+	}
 
 	// Create new engine
 	newEngine := spocp.NewEngine()
 
-	// Find all .spoc files
-	var ruleFiles []string
-	err := filepath.WalkDir(s.rulesDir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if !d.IsDir() && strings.HasSuffix(path, ".spoc") {
-			ruleFiles = append(ruleFiles, path)
+	var manifest *persist.Manifest
+	var load *ruleLoad
+	var err error
+	if s.bundlePath != "" {
+		manifest, load, err = s.loadBundle(newEngine, opts)
+	} else {
+		load, err = s.loadRulesDir(newEngine, opts, states)
+	}
+	if err != nil {
+		if errors.Is(err, signing.ErrVerification) && mode != reloadDryRun {
+			s.metrics.reloadsRejected.Add(1)
+			s.logError("Rejected rules: %v", err)
 		}
-		return nil
-	})
+		return nil, err
+	}
+
+	// Runtime changes apply on top of the rule files
+	replayed, err := s.replayJournal(newEngine)
 	if err != nil {
-		return fmt.Errorf("failed to scan rules directory: %w", err)
+		return nil, err
 	}
 
-	if len(ruleFiles) == 0 {
-		s.logWarn("No .spoc files found in %s", s.rulesDir)
+	// The initial load has nothing to compare with or roll back to
+	var current *spocp.Engine
+	if reason != reloadStartup {
+		s.mu.RLock()
+		current = s.engine
+		s.mu.RUnlock()
 	}
 
-	// Load each file
-	totalRules := 0
-	for _, file := range ruleFiles {
-		rules, err := persist.LoadFileToSlice(file)
+	if mode == reloadDryRun {
+		var old []sexp.Element
+		if current != nil {
+			s.mu.RLock()
+			old = current.ExportRules()
+			s.mu.RUnlock()
+		}
+		return diffRules(old, newEngine.ExportRules()), s.checkGuards(current, newEngine)
+	}
+
+	if mode != reloadForce {
+		s.mu.RLock()
+		err := s.checkGuards(current, newEngine)
+		s.mu.RUnlock()
 		if err != nil {
-			return fmt.Errorf("failed to load %s: %w", file, err)
+			s.metrics.reloadsGuarded.Add(1)
+			s.logError("Kept current rules: %v", err)
+			return nil, err
 		}
+	}
 
-		for _, rule := range rules {
-			newEngine.AddRuleElement(rule)
-			totalRules++
+	if current != nil {
+		// The current engine has every journal record applied
+		s.previous = &rollbackState{
+			engine:   current,
+			manifest: s.manifest.Load(),
+			rules:    s.metrics.rulesLoaded.Load(),
+			journal:  replayed,
+
+			unjournaled: s.unjournaled.Load(),
 		}
 	}
 
@@ -453,33 +912,151 @@ func (s *Server) reloadRules() error {
 	s.mu.Lock()
 	s.engine = newEngine
 	s.mu.Unlock()
+	s.manifest.Store(manifest)
+	s.ruleCache = load.cache
+	s.cacheStates = states
 
 	// Update metrics
-	s.metrics.rulesLoaded.Store(int64(totalRules))
+	s.metrics.rulesLoaded.Store(int64(load.rules))
 	s.metrics.lastReloadTime.Store(time.Now())
+	s.metrics.reloadsByReason[reason].Add(1)
+	s.metrics.reloadFilesParsed.Add(int64(load.parsed))
+	s.metrics.reloadFilesReused.Add(int64(load.reused))
 
-	s.logInfo("Loaded %d rules from %d files", totalRules, len(ruleFiles))
-	return nil
+	if manifest != nil {
+		s.logInfo("Loaded %d rules from %d files (%s, bundle revision %s)", load.rules, load.files, reason, manifest.Revision)
+	} else {
+		s.logInfo("Loaded %d rules from %d files (%s, %d parsed, %d unchanged)", load.rules, load.files, reason, load.parsed, load.reused)
+	}
+	if replayed > 0 {
+		s.logInfo("Replayed %d journal records", replayed)
+	}
+	return nil, nil
 }
 
-// autoReload periodically reloads rules
-func (s *Server) autoReload(interval time.Duration) {
-	defer s.wg.Done()
+// ruleLoad summarizes the rule files loaded by a reload
+type ruleLoad struct {
+	rules  int // rules loaded
+	files  int // rule files loaded
+	parsed int // files parsed
+	reused int // unchanged files taken from the cache
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	cache map[string]*cachedRuleFile
+}
 
-	for {
-		select {
-		case <-s.ctx.Done():
-			return
-		case <-ticker.C:
-			if err := s.reloadRules(); err != nil {
-				s.logError("Auto-reload failed: %v", err)
-				s.metrics.reloadsFailed.Add(1)
+// loadRulesDir loads every rule file below the rules directory, or in
+// the rules file system, into engine. Files whose sources are unchanged in
+// states are taken from the rule cache instead of being parsed.
+func (s *Server) loadRulesDir(engine *spocp.Engine, opts persist.LoadOptions, states map[string]fileState) (*ruleLoad, error) {
+	fsys, source := s.rulesSource()
+	s.logDebug("Reloading rules from %s", source)
+
+	ruleFiles, err := s.findRuleFiles(fsys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan rules directory: %w", err)
+	}
+	// Included files are loaded where they are included
+	ruleFiles = persist.TopLevelFiles(fsys, ruleFiles, opts)
+
+	if len(ruleFiles) == 0 {
+		s.logWarn("No rule files found in %s", source)
+	}
+
+	// Added or removed files may match an include glob, so parsed files
+	// are only reused while the set of files stays the same
+	reuse := sameFiles(s.cacheStates, states)
+
+	// Parse changed files concurrently, detecting their formats by
+	// extension
+	var stale []string
+	for _, name := range ruleFiles {
+		if !reuse || !s.ruleCache[name].valid(states) {
+			stale = append(stale, name)
+		}
+	}
+	parsed, err := persist.LoadConcurrently(stale, s.loadWorkers, func(name string) (*cachedRuleFile, error) {
+		return s.parseRuleFile(fsys, name, opts, states)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Index the rules of all files in file order in one pass
+	load := &ruleLoad{files: len(ruleFiles), parsed: len(stale), cache: make(map[string]*cachedRuleFile)}
+	for i, name := range stale {
+		load.cache[name] = parsed[i]
+	}
+	sets := make([]*persist.Ruleset, len(ruleFiles))
+	for i, name := range ruleFiles {
+		cached, ok := load.cache[name]
+		if !ok {
+			cached = s.ruleCache[name]
+			load.cache[name] = cached
+			load.reused++
+		}
+		sets[i] = cached.ruleset
+		load.rules += len(cached.ruleset.Rules)
+	}
+	// The merged ruleset has its own index, so cached rulesets stay intact
+	engine.LoadRuleset(persist.MergeRulesets(sets...))
+
+	return load, nil
+}
+
+// findRuleFiles returns the rule files in fsys in lexical order, skipping
+// JSON and YAML files that are not rule documents (such as template data)
+func (s *Server) findRuleFiles(fsys fs.FS) ([]string, error) {
+	var ruleFiles []string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !persist.IsRuleFile(name) {
+			return nil
+		}
+		switch path.Ext(name) {
+		case ".json", ".yaml", ".yml":
+			data, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return err
+			}
+			if !persist.IsRuleDocument(name, data) {
+				s.logDebug("Skipping %s: not a rule document", name)
+				return nil
 			}
 		}
+		ruleFiles = append(ruleFiles, name)
+		return nil
+	})
+	return ruleFiles, err
+}
+
+// rulesSource returns the file system rule files are loaded from and a
+// description of it for logging
+func (s *Server) rulesSource() (fs.FS, string) {
+	if s.rulesFS != nil {
+		return s.rulesFS, "rules file system"
+	}
+	return os.DirFS(s.rulesDir), s.rulesDir
+}
+
+// loadBundle loads the rule bundle into engine
+func (s *Server) loadBundle(engine *spocp.Engine, opts persist.LoadOptions) (*persist.Manifest, *ruleLoad, error) {
+	s.logDebug("Reloading rules from bundle %s", s.bundlePath)
+
+	bundle, err := persist.LoadBundle(s.bundlePath, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load bundle: %w", err)
 	}
+
+	engine.LoadRuleset(bundle.Ruleset())
+	return &bundle.Manifest, &ruleLoad{rules: len(bundle.Rules), files: len(bundle.Manifest.Files)}, nil
+}
+
+// Manifest returns the manifest of the loaded rule bundle, or nil if rules
+// are not loaded from a bundle
+func (s *Server) Manifest() *persist.Manifest {
+	return s.manifest.Load()
 }
 
 // Logging helpers with level filtering
@@ -604,6 +1181,10 @@ func (s *Server) startHealthCheck() error {
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	if manifest := s.Manifest(); manifest != nil {
+		fmt.Fprintf(w, `{"status":"ok","revision":%q}`, manifest.Revision)
+		return
+	}
 	fmt.Fprintf(w, `{"status":"ok"}`)
 }
 
@@ -641,6 +1222,18 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "# TYPE spocp_adds_total counter\n")
 	fmt.Fprintf(w, "spocp_adds_total %d\n", s.metrics.addsTotal.Load())
 
+	fmt.Fprintf(w, "# HELP spocp_deletes_total Total number of DELETE operations\n")
+	fmt.Fprintf(w, "# TYPE spocp_deletes_total counter\n")
+	fmt.Fprintf(w, "spocp_deletes_total %d\n", s.metrics.deletesTotal.Load())
+
+	fmt.Fprintf(w, "# HELP spocp_transactions_committed_total Total number of committed transactions\n")
+	fmt.Fprintf(w, "# TYPE spocp_transactions_committed_total counter\n")
+	fmt.Fprintf(w, "spocp_transactions_committed_total %d\n", s.metrics.txCommitted.Load())
+
+	fmt.Fprintf(w, "# HELP spocp_transactions_aborted_total Total number of transactions rolled back, failed or abandoned\n")
+	fmt.Fprintf(w, "# TYPE spocp_transactions_aborted_total counter\n")
+	fmt.Fprintf(w, "spocp_transactions_aborted_total %d\n", s.metrics.txAborted.Load())
+
 	fmt.Fprintf(w, "# HELP spocp_reloads_total Total number of rule reloads\n")
 	fmt.Fprintf(w, "# TYPE spocp_reloads_total counter\n")
 	fmt.Fprintf(w, "spocp_reloads_total %d\n", s.metrics.reloadsTotal.Load())
@@ -649,14 +1242,68 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "# TYPE spocp_reloads_failed counter\n")
 	fmt.Fprintf(w, "spocp_reloads_failed %d\n", s.metrics.reloadsFailed.Load())
 
+	fmt.Fprintf(w, "# HELP spocp_reloads_rejected Total number of reloads rejected by signature verification\n")
+	fmt.Fprintf(w, "# TYPE spocp_reloads_rejected counter\n")
+	fmt.Fprintf(w, "spocp_reloads_rejected %d\n", s.metrics.reloadsRejected.Load())
+
+	fmt.Fprintf(w, "# HELP spocp_reloads_guarded_total Total number of reloads rejected by reload guards\n")
+	fmt.Fprintf(w, "# TYPE spocp_reloads_guarded_total counter\n")
+	fmt.Fprintf(w, "spocp_reloads_guarded_total %d\n", s.metrics.reloadsGuarded.Load())
+
+	fmt.Fprintf(w, "# HELP spocp_rollbacks_total Total number of rollbacks to the rules before a reload\n")
+	fmt.Fprintf(w, "# TYPE spocp_rollbacks_total counter\n")
+	fmt.Fprintf(w, "spocp_rollbacks_total %d\n", s.metrics.rollbacksTotal.Load())
+
+	fmt.Fprintf(w, "# HELP spocp_reloads_by_reason_total Total number of completed rule reloads by trigger\n")
+	fmt.Fprintf(w, "# TYPE spocp_reloads_by_reason_total counter\n")
+	for _, reason := range reloadReasons {
+		fmt.Fprintf(w, "spocp_reloads_by_reason_total{reason=%q} %d\n", reason, s.metrics.reloadsByReason[reason].Load())
+	}
+
+	fmt.Fprintf(w, "# HELP spocp_reload_files_parsed_total Total number of rule files parsed by reloads\n")
+	fmt.Fprintf(w, "# TYPE spocp_reload_files_parsed_total counter\n")
+	fmt.Fprintf(w, "spocp_reload_files_parsed_total %d\n", s.metrics.reloadFilesParsed.Load())
+
+	fmt.Fprintf(w, "# HELP spocp_reload_files_reused_total Total number of unchanged rule files reused by reloads\n")
+	fmt.Fprintf(w, "# TYPE spocp_reload_files_reused_total counter\n")
+	fmt.Fprintf(w, "spocp_reload_files_reused_total %d\n", s.metrics.reloadFilesReused.Load())
+
 	fmt.Fprintf(w, "# HELP spocp_connections_total Total number of connections\n")
 	fmt.Fprintf(w, "# TYPE spocp_connections_total counter\n")
 	fmt.Fprintf(w, "spocp_connections_total %d\n", s.metrics.connectionsTotal.Load())
 
+	fmt.Fprintf(w, "# HELP spocp_starttls_total Total number of connections upgraded with STARTTLS\n")
+	fmt.Fprintf(w, "# TYPE spocp_starttls_total counter\n")
+	fmt.Fprintf(w, "spocp_starttls_total %d\n", s.metrics.startTLSTotal.Load())
+
+	fmt.Fprintf(w, "# HELP spocp_starttls_failures_total Total number of failed STARTTLS handshakes\n")
+	fmt.Fprintf(w, "# TYPE spocp_starttls_failures_total counter\n")
+	fmt.Fprintf(w, "spocp_starttls_failures_total %d\n", s.metrics.startTLSFailed.Load())
+
+	fmt.Fprintf(w, "# HELP spocp_auth_total Total number of authentication exchanges\n")
+	fmt.Fprintf(w, "# TYPE spocp_auth_total counter\n")
+	fmt.Fprintf(w, "spocp_auth_total %d\n", s.metrics.authTotal.Load())
+
+	fmt.Fprintf(w, "# HELP spocp_auth_failures_total Total number of failed authentication exchanges\n")
+	fmt.Fprintf(w, "# TYPE spocp_auth_failures_total counter\n")
+	fmt.Fprintf(w, "spocp_auth_failures_total %d\n", s.metrics.authFailed.Load())
+
+	tlsutil.WriteMetrics(w, map[string]*tlsutil.CertManager{"tcp": s.certManager})
+
 	fmt.Fprintf(w, "# HELP spocp_rules_loaded Current number of rules loaded\n")
 	fmt.Fprintf(w, "# TYPE spocp_rules_loaded gauge\n")
 	fmt.Fprintf(w, "spocp_rules_loaded %d\n", s.metrics.rulesLoaded.Load())
 
+	if s.journal != nil {
+		fmt.Fprintf(w, "# HELP spocp_journal_records Current number of journal records\n")
+		fmt.Fprintf(w, "# TYPE spocp_journal_records gauge\n")
+		fmt.Fprintf(w, "spocp_journal_records %d\n", s.metrics.journalRecords.Load())
+
+		fmt.Fprintf(w, "# HELP spocp_journal_compactions_total Total number of journal compactions\n")
+		fmt.Fprintf(w, "# TYPE spocp_journal_compactions_total counter\n")
+		fmt.Fprintf(w, "spocp_journal_compactions_total %d\n", s.metrics.journalCompactions.Load())
+	}
+
 	if lastReload, ok := s.metrics.lastReloadTime.Load().(time.Time); ok {
 		fmt.Fprintf(w, "# HELP spocp_last_reload_timestamp_seconds Timestamp of last reload\n")
 		fmt.Fprintf(w, "# TYPE spocp_last_reload_timestamp_seconds gauge\n")
@@ -694,6 +1341,30 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 		tagCount = int64(v)
 	}
 
+	byReason := make([]string, len(reloadReasons))
+	for i, reason := range reloadReasons {
+		byReason[i] = fmt.Sprintf("%q: %d", reason, s.metrics.reloadsByReason[reason].Load())
+	}
+
+	journalStats := ""
+	if s.journal != nil {
+		journalStats = fmt.Sprintf(`,
+  "journal": {
+    "records": %d,
+    "compactions": %d
+  }`, s.metrics.journalRecords.Load(), s.metrics.journalCompactions.Load())
+	}
+
+	bundleStats := ""
+	if manifest := s.Manifest(); manifest != nil {
+		bundleStats = fmt.Sprintf(`,
+  "bundle": {
+    "version": %q,
+    "revision": %q,
+    "created": %q
+  }`, manifest.Version, manifest.Revision, manifest.Created.Format(time.RFC3339))
+	}
+
 	fmt.Fprintf(w, `{
   "queries": {
     "total": %d,
@@ -701,12 +1372,31 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
     "denied": %d
   },
   "adds": %d,
+  "deletes": %d,
+  "transactions": {
+    "committed": %d,
+    "aborted": %d
+  },
   "reloads": {
     "total": %d,
     "failed": %d,
+    "rejected": %d,
+    "guarded": %d,
+    "rollbacks": %d,
+    "by_reason": {%s},
+    "files_parsed": %d,
+    "files_reused": %d,
     "last": %q
   },
   "connections": %d,
+  "starttls": {
+    "upgrades": %d,
+    "failures": %d
+  },
+  "auth": {
+    "attempts": %d,
+    "failures": %d
+  },
   "rules": {
     "loaded": %d,
     "total": %d,
@@ -715,21 +1405,36 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
   "indexing": {
     "enabled": %t,
     "tags": %d
-  }
+  }%s%s
 }`,
 		s.metrics.queriesTotal.Load(),
 		s.metrics.queriesOK.Load(),
 		s.metrics.queriesDenied.Load(),
 		s.metrics.addsTotal.Load(),
+		s.metrics.deletesTotal.Load(),
+		s.metrics.txCommitted.Load(),
+		s.metrics.txAborted.Load(),
 		s.metrics.reloadsTotal.Load(),
 		s.metrics.reloadsFailed.Load(),
+		s.metrics.reloadsRejected.Load(),
+		s.metrics.reloadsGuarded.Load(),
+		s.metrics.rollbacksTotal.Load(),
+		strings.Join(byReason, ", "),
+		s.metrics.reloadFilesParsed.Load(),
+		s.metrics.reloadFilesReused.Load(),
 		lastReload,
 		s.metrics.connectionsTotal.Load(),
+		s.metrics.startTLSTotal.Load(),
+		s.metrics.startTLSFailed.Load(),
+		s.metrics.authTotal.Load(),
+		s.metrics.authFailed.Load(),
 		s.metrics.rulesLoaded.Load(),
 		totalRules,
 		rulesByTag,
 		indexingEnabled,
 		tagCount,
+		journalStats,
+		bundleStats,
 	)
 }
 
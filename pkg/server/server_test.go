@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -12,10 +13,14 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/sirosfoundation/go-spocp"
+	"github.com/sirosfoundation/go-spocp/pkg/persist"
 	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sexp"
+	"github.com/sirosfoundation/go-spocp/pkg/signing"
 )
 
 // Helper to create a temp directory with rule files
@@ -214,6 +219,30 @@ func TestHandleMessage(t *testing.T) {
 			},
 			expectedCode: protocol.CodeError,
 		},
+		{
+			name: "DELETE OK",
+			message: &protocol.Message{
+				Operation: "DELETE",
+				Arguments: []string{"(5:write)"},
+			},
+			expectedCode: protocol.CodeOK,
+		},
+		{
+			name: "DELETE error - not found",
+			message: &protocol.Message{
+				Operation: "DELETE",
+				Arguments: []string{"(5:write)"},
+			},
+			expectedCode: protocol.CodeError,
+		},
+		{
+			name: "DELETE error - no args",
+			message: &protocol.Message{
+				Operation: "DELETE",
+				Arguments: []string{},
+			},
+			expectedCode: protocol.CodeError,
+		},
 		{
 			name: "LOGOUT",
 			message: &protocol.Message{
@@ -242,7 +271,7 @@ func TestHandleMessage(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			resp := srv.handleMessage(tt.message)
+			resp := srv.handleMessage(&session{}, tt.message)
 			if resp.Code != tt.expectedCode {
 				t.Errorf("Expected code %s, got %s: %s", tt.expectedCode, resp.Code, resp.Message)
 			}
@@ -487,12 +516,218 @@ func TestReloadRules(t *testing.T) {
 	defer srv.Close()
 
 	// Reload should succeed
-	resp := srv.handleReload()
+	resp := srv.handleReload(&protocol.Message{Operation: "RELOAD"})
 	if resp.Code != protocol.CodeOK {
 		t.Errorf("Expected reload OK, got %s: %s", resp.Code, resp.Message)
 	}
 }
 
+// TestReloadSignedRules tests that reloads refuse unsigned or tampered files
+func TestReloadSignedRules(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+	ruleFile := filepath.Join(rulesDir, "test.spoc")
+
+	pub, priv, _ := signing.GenerateKey()
+	keys := signing.NewKeyRing(pub)
+
+	// Unsigned rules are refused at startup
+	if _, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir, TrustedKeys: keys}); err == nil {
+		t.Fatal("Expected unsigned rules to be rejected")
+	}
+
+	if err := signing.SignFile(priv, ruleFile); err != nil {
+		t.Fatalf("SignFile failed: %v", err)
+	}
+
+	var logBuf bytes.Buffer
+	srv, err := NewServer(&Config{
+		Address:     ":0",
+		RulesDir:    rulesDir,
+		TrustedKeys: keys,
+		Logger:      log.New(&logBuf, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	// Tamper with the rules after signing
+	if err := os.WriteFile(ruleFile, []byte("(5:write)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resp := srv.handleReload(&protocol.Message{Operation: "RELOAD"})
+	if resp.Code != protocol.CodeError {
+		t.Errorf("Expected tampered reload to fail, got %s: %s", resp.Code, resp.Message)
+	}
+	if !strings.Contains(logBuf.String(), "Rejected rules") {
+		t.Errorf("Expected rejection to be logged, got: %s", logBuf.String())
+	}
+	if srv.metrics.reloadsRejected.Load() != 1 {
+		t.Errorf("Expected 1 rejected reload, got %d", srv.metrics.reloadsRejected.Load())
+	}
+
+	// The previously verified rules stay active
+	if allowed, _ := srv.GetEngine().Query("(4:read)"); !allowed {
+		t.Error("Expected previous rules to remain loaded")
+	}
+
+	if err := signing.SignFile(priv, ruleFile); err != nil {
+		t.Fatalf("SignFile failed: %v", err)
+	}
+	if resp := srv.handleReload(&protocol.Message{Operation: "RELOAD"}); resp.Code != protocol.CodeOK {
+		t.Errorf("Expected re-signed reload OK, got %s: %s", resp.Code, resp.Message)
+	}
+	if allowed, _ := srv.GetEngine().Query("(5:write)"); !allowed {
+		t.Error("Expected new rules after re-signing")
+	}
+}
+
+// TestBundleRevision tests loading a bundle and reporting its revision
+func TestBundleRevision(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+
+	bundlePath := filepath.Join(t.TempDir(), "policy.tar.gz")
+	if _, err := persist.SaveBundle(bundlePath, rulesDir, persist.BundleOptions{Version: "1.0", Revision: "rev-42"}); err != nil {
+		t.Fatalf("SaveBundle failed: %v", err)
+	}
+
+	srv, err := NewServer(&Config{Address: ":0", BundlePath: bundlePath})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	if allowed, _ := srv.GetEngine().Query("(4:read)"); !allowed {
+		t.Error("Expected bundle rules to be loaded")
+	}
+	if m := srv.Manifest(); m == nil || m.Revision != "rev-42" {
+		t.Fatalf("Unexpected manifest: %+v", m)
+	}
+
+	w := httptest.NewRecorder()
+	srv.handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if body := w.Body.String(); body != `{"status":"ok","revision":"rev-42"}` {
+		t.Errorf("Unexpected health body: %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleStats(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats struct {
+		Bundle struct {
+			Version  string `json:"version"`
+			Revision string `json:"revision"`
+		} `json:"bundle"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to parse stats JSON: %v", err)
+	}
+	if stats.Bundle.Version != "1.0" || stats.Bundle.Revision != "rev-42" {
+		t.Errorf("Unexpected bundle stats: %+v", stats.Bundle)
+	}
+
+	// A missing bundle is reported at creation
+	if _, err := NewServer(&Config{Address: ":0", BundlePath: "/nonexistent.tar.gz"}); err == nil {
+		t.Error("Expected error for missing bundle")
+	}
+}
+
+// TestReloadStructuredRules tests loading JSON and YAML rule documents
+// next to template data files
+func TestReloadStructuredRules(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+
+	files := map[string]string{
+		"web.json":   `{"rules": [{"tag": "http", "elements": ["GET", {"prefix": "/public/"}]}]}`,
+		"admin.yaml": "rules:\n  - {tag: admin, elements: [{set: [alice, bob]}]}\n",
+		"users.json": `[{"user": "carol"}]`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(rulesDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	if n := srv.GetEngine().RuleCount(); n != 3 {
+		t.Errorf("Expected 3 rules, got %d", n)
+	}
+	expectQuery(t, srv, "(4:http3:GET16:/public/doc.html)", protocol.CodeOK)
+	expectQuery(t, srv, "(4:http3:GET9:/private/)", protocol.CodeDenied)
+	expectQuery(t, srv, "(5:admin3:bob)", protocol.CodeOK)
+
+	// A broken rule document fails the reload and keeps the current rules
+	os.WriteFile(filepath.Join(rulesDir, "web.json"), []byte(`{"rules": [`), 0644)
+	if resp := srv.handleReload(&protocol.Message{Operation: "RELOAD"}); resp.Code != protocol.CodeError {
+		t.Errorf("Expected reload to fail, got %s", resp.Code)
+	}
+	expectQuery(t, srv, "(5:admin3:bob)", protocol.CodeOK)
+}
+
+// TestRulesFS tests loading rules from a file system instead of a directory
+func TestRulesFS(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "compiled.spocp")
+	if err := persist.SaveFile(bin, []sexp.Element{sexp.NewList("list")}, persist.FormatBinary); err != nil {
+		t.Fatal(err)
+	}
+	binData, _ := os.ReadFile(bin)
+
+	fsys := fstest.MapFS{
+		"rules/read.spoc":       {Data: []byte("(4:read)\n")},
+		"rules/compiled.spocp":  {Data: binData},
+		"rules/web.json":        {Data: []byte(`{"rules": [{"tag": "http", "elements": ["GET"]}]}`)},
+		"rules/data/users.json": {Data: []byte(`[{"user": "alice"}]`)},
+		"README.md":             {Data: []byte("# policy")},
+	}
+
+	srv, err := NewServer(&Config{Address: ":0", RulesFS: fsys})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	if n := srv.GetEngine().RuleCount(); n != 3 {
+		t.Errorf("Expected 3 rules, got %d", n)
+	}
+	expectQuery(t, srv, "(4:read)", protocol.CodeOK)
+	expectQuery(t, srv, "(4:list)", protocol.CodeOK)
+	expectQuery(t, srv, "(4:http3:GET)", protocol.CodeOK)
+
+	// Reloads read the file system again
+	fsys["rules/write.spoc"] = &fstest.MapFile{Data: []byte("(5:write)\n")}
+	if resp := srv.handleReload(&protocol.Message{Operation: "RELOAD"}); resp.Code != protocol.CodeOK {
+		t.Fatalf("Reload failed: %s", resp.Message)
+	}
+	expectQuery(t, srv, "(5:write)", protocol.CodeOK)
+}
+
+// TestRulesFSSigned tests that signatures are read from the rules file system
+func TestRulesFSSigned(t *testing.T) {
+	pub, priv, _ := signing.GenerateKey()
+	data := []byte("(4:read)\n")
+	fsys := fstest.MapFS{"read.spoc": {Data: data}}
+	config := &Config{Address: ":0", RulesFS: fsys, TrustedKeys: signing.NewKeyRing(pub)}
+
+	if _, err := NewServer(config); err == nil {
+		t.Fatal("Expected unsigned rules to be rejected")
+	}
+
+	fsys["read.spoc.sig"] = &fstest.MapFile{Data: signing.Sign(priv, data)}
+	srv, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+	expectQuery(t, srv, "(4:read)", protocol.CodeOK)
+}
+
 // TestClientConnection tests a full client-server interaction
 func TestClientConnection(t *testing.T) {
 	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
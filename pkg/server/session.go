@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/sasl"
+	"github.com/sirosfoundation/go-spocp/pkg/tlsutil"
+)
+
+// tlsHandshakeTimeout limits the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// session is the state of a client connection
+type session struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	remote string
+
+	// tls is set once the connection is encrypted, from the start or
+	// after STARTTLS
+	tls bool
+
+	// loopback is set for clients on loopback addresses
+	loopback bool
+
+	// upgrade is set by STARTTLS; the handshake starts after the response
+	upgrade bool
+
+	// identity is the user authenticated with AUTH, and mechanism the
+	// SASL mechanism used
+	identity  string
+	mechanism string
+
+	// auth is the authentication exchange in progress, if any
+	auth sasl.ServerMechanism
+
+	// peer is the client's verified TLS certificate, if any
+	peer *tlsutil.PeerIdentity
+
+	// tx is the transaction opened with BEGIN, if any
+	tx *transaction
+}
+
+// newSession returns the session of a new connection
+func newSession(conn net.Conn) *session {
+	sess := &session{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		remote: conn.RemoteAddr().String(),
+	}
+	_, sess.tls = conn.(*tls.Conn)
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		sess.loopback = addr.IP.IsLoopback()
+	}
+	return sess
+}
+
+// handleStartTLS processes a STARTTLS operation. The handshake itself
+// happens in upgradeTLS once the response is sent.
+func (s *Server) handleStartTLS(sess *session, msg *protocol.Message) *protocol.Response {
+	switch {
+	case len(msg.Arguments) != 0:
+		return &protocol.Response{Code: protocol.CodeError, Message: "STARTTLS takes no argument"}
+	case sess.tls:
+		return &protocol.Response{Code: protocol.CodeError, Message: "TLS already active"}
+	case s.tlsConfig == nil:
+		return &protocol.Response{Code: protocol.CodeError, Message: "TLS not available"}
+	case sess.reader.Buffered() > 0:
+		// Plaintext sent after STARTTLS must not be taken as encrypted
+		return &protocol.Response{Code: protocol.CodeError, Message: "Unexpected data after STARTTLS"}
+	}
+
+	sess.upgrade = true
+	return &protocol.Response{Code: protocol.CodeOK, Message: "Begin TLS negotiation"}
+}
+
+// upgradeTLS performs the TLS handshake requested with STARTTLS
+func (s *Server) upgradeTLS(sess *session) error {
+	sess.upgrade = false
+
+	conn := tls.Server(sess.conn, s.tlsConfig)
+	if err := s.handshake(sess, conn); err != nil {
+		s.metrics.startTLSFailed.Add(1)
+		return err
+	}
+
+	sess.conn = conn
+	sess.reader = bufio.NewReader(conn)
+	sess.writer = bufio.NewWriter(conn)
+	sess.tls = true
+	s.metrics.startTLSTotal.Add(1)
+	return nil
+}
+
+// handshake performs the TLS handshake of a connection and records the
+// client's verified certificate in the session
+func (s *Server) handshake(sess *session, conn *tls.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)) //nolint:errcheck // non-critical timeout setting
+	if err := conn.HandshakeContext(s.ctx); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	_ = conn.SetDeadline(time.Time{}) //nolint:errcheck // non-critical timeout setting
+
+	sess.peer = tlsutil.VerifiedPeer(conn.ConnectionState())
+	if sess.peer != nil {
+		s.logDebug("Client %s presented certificate %s (%s)", sess.remote, sess.peer.Subject, sess.peer.Fingerprint)
+	}
+	return nil
+}
+
+// requiresTLS reports whether an operation must be refused because the
+// session is not encrypted yet
+func (s *Server) requiresTLS(sess *session, op string) bool {
+	if !s.requireTLS || sess.tls || sess.loopback {
+		return false
+	}
+	return op != protocol.OpStartTLS && op != protocol.OpCapa && op != "LOGOUT"
+}
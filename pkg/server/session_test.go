@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirosfoundation/go-spocp/pkg/client"
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+	"github.com/sirosfoundation/go-spocp/pkg/tlsutil"
+)
+
+// testTLSConfigs returns a server configuration with a self-signed
+// certificate for 127.0.0.1 and a client configuration trusting it
+func testTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	cert, parsed := testCertificate(t, "spocp test", x509.ExtKeyUsageServerAuth)
+	roots := x509.NewCertPool()
+	roots.AddCert(parsed)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return serverConfig, &tls.Config{RootCAs: roots}
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1
+func testCertificate(t *testing.T, commonName string, usage x509.ExtKeyUsage) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+// startTestServer starts a server on a loopback port
+func startTestServer(t *testing.T, config *Config) *Server {
+	t.Helper()
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	t.Cleanup(func() { os.RemoveAll(rulesDir) })
+
+	config.Address = "127.0.0.1:0"
+	config.RulesDir = rulesDir
+	srv, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// TestStartTLS tests upgrading plain connections on a shared port
+func TestStartTLS(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	srv := startTestServer(t, &Config{TLSConfig: serverTLS, StartTLS: true})
+	addr := srv.listener.Addr().String()
+
+	c, err := client.NewClient(&client.Config{Address: addr, TLSConfig: clientTLS, StartTLS: client.StartTLSRequired})
+	if err != nil {
+		t.Fatalf("Failed to connect with STARTTLS: %v", err)
+	}
+	if !c.Encrypted() {
+		t.Error("Expected an encrypted connection")
+	}
+	if ok, err := c.QueryString("(4:read)"); !ok || err != nil {
+		t.Errorf("Query over TLS failed: %v, %v", ok, err)
+	}
+	if err := c.StartTLS(clientTLS); err == nil {
+		t.Error("Expected a second STARTTLS to fail")
+	}
+	c.Close()
+
+	// Legacy clients keep working in plain TCP
+	plain, err := client.NewClient(&client.Config{Address: addr})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer plain.Close()
+	if plain.Encrypted() {
+		t.Error("Expected a plain connection")
+	}
+	if ok, err := plain.QueryString("(4:read)"); !ok || err != nil {
+		t.Errorf("Plain query failed: %v, %v", ok, err)
+	}
+
+	// Clients must not trust an unknown certificate
+	if _, err := client.NewClient(&client.Config{Address: addr, StartTLS: client.StartTLSOptional}); err == nil {
+		t.Error("Expected the handshake to fail without the test root")
+	}
+
+	if got := srv.metrics.startTLSTotal.Load(); got != 1 {
+		t.Errorf("Expected 1 upgrade, got %d", got)
+	}
+	// The server sees the failure after the client gives up
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.metrics.startTLSFailed.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := srv.metrics.startTLSFailed.Load(); got != 1 {
+		t.Errorf("Expected 1 failed handshake, got %d", got)
+	}
+}
+
+// TestStartTLSUnavailable tests STARTTLS against a server without TLS
+func TestStartTLSUnavailable(t *testing.T) {
+	srv := startTestServer(t, &Config{})
+	addr := srv.listener.Addr().String()
+
+	c, err := client.NewClient(&client.Config{Address: addr, StartTLS: client.StartTLSOptional})
+	if err != nil {
+		t.Fatalf("Optional STARTTLS should fall back to plain TCP: %v", err)
+	}
+	defer c.Close()
+	if c.Encrypted() {
+		t.Error("Expected a plain connection")
+	}
+	if ok, err := c.QueryString("(4:read)"); !ok || err != nil {
+		t.Errorf("Plain query failed: %v, %v", ok, err)
+	}
+
+	if _, err := client.NewClient(&client.Config{Address: addr, StartTLS: client.StartTLSRequired}); err == nil {
+		t.Error("Expected required STARTTLS to fail")
+	}
+}
+
+// TestStartTLSInjection tests that data pipelined after STARTTLS cancels
+// the upgrade
+func TestStartTLSInjection(t *testing.T) {
+	serverTLS, _ := testTLSConfigs(t)
+	srv := startTestServer(t, &Config{TLSConfig: serverTLS, StartTLS: true})
+
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	data := protocol.EncodeMessage(&protocol.Message{Operation: protocol.OpStartTLS}) +
+		protocol.EncodeMessage(&protocol.Message{Operation: "ADD", Arguments: []string{"(5:admin)"}})
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := protocol.DecodeResponse(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if resp.Code != protocol.CodeError {
+		t.Errorf("Expected STARTTLS to be refused, got %s %s", resp.Code, resp.Message)
+	}
+}
+
+// TestRequireTLS tests that plain connections from other hosts are
+// limited to STARTTLS and LOGOUT
+func TestRequireTLS(t *testing.T) {
+	serverTLS, _ := testTLSConfigs(t)
+	srv := startTestServer(t, &Config{TLSConfig: serverTLS, StartTLS: true, RequireTLS: true})
+
+	query := &protocol.Message{Operation: "QUERY", Arguments: []string{"(4:read)"}}
+	tests := []struct {
+		name string
+		sess *session
+		msg  *protocol.Message
+		code string
+	}{
+		{"remote plain query", &session{}, query, protocol.CodeError},
+		{"remote plain logout", &session{}, &protocol.Message{Operation: "LOGOUT"}, protocol.CodeBye},
+		{"remote TLS query", &session{tls: true}, query, protocol.CodeOK},
+		{"loopback plain query", &session{loopback: true}, query, protocol.CodeOK},
+	}
+	for _, tt := range tests {
+		if resp := srv.handleMessage(tt.sess, tt.msg); resp.Code != tt.code {
+			t.Errorf("%s: expected %s, got %s %s", tt.name, tt.code, resp.Code, resp.Message)
+		}
+	}
+
+	for _, config := range []*Config{
+		{Address: ":0", RulesDir: "x", StartTLS: true},
+		{Address: ":0", RulesDir: "x", TLSConfig: serverTLS, RequireTLS: true},
+	} {
+		if _, err := NewServer(config); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
+
+// TestCertManager tests TLS from a certificate manager
+func TestCertManager(t *testing.T) {
+	cert, parsed := testCertificate(t, "spocp test", x509.ExtKeyUsageServerAuth)
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: parsed.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := tlsutil.NewCertManager(tlsutil.ServerOptions{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Failed to create certificate manager: %v", err)
+	}
+
+	srv := startTestServer(t, &Config{CertManager: certs})
+	roots := x509.NewCertPool()
+	roots.AddCert(parsed)
+	c, err := client.NewClient(&client.Config{Address: srv.listener.Addr().String(), TLSConfig: &tls.Config{RootCAs: roots}})
+	if err != nil {
+		t.Fatalf("Failed to connect with TLS: %v", err)
+	}
+	defer c.Close()
+	if ok, err := c.QueryString("(4:read)"); !ok || err != nil {
+		t.Errorf("Query over TLS failed: %v, %v", ok, err)
+	}
+
+	w := httptest.NewRecorder()
+	srv.handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	want := fmt.Sprintf("spocp_tls_certificate_expiry_timestamp_seconds{server=\"tcp\"} %d\n", parsed.NotAfter.Unix())
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("Expected %q in metrics", want)
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirosfoundation/go-spocp/pkg/journal"
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+)
+
+// maxTransactionOps limits the changes a transaction can stage, so that a
+// client cannot hold unbounded memory on the server
+const maxTransactionOps = 10000
+
+// transaction holds the changes staged on a connection since BEGIN
+type transaction struct {
+	records []journal.Record
+}
+
+// handleBegin processes a BEGIN operation
+func (s *Server) handleBegin(sess *session, msg *protocol.Message) *protocol.Response {
+	if len(msg.Arguments) != 0 {
+		return &protocol.Response{Code: protocol.CodeError, Message: "BEGIN takes no arguments"}
+	}
+	if sess.tx != nil {
+		return &protocol.Response{Code: protocol.CodeError, Message: "Transaction already open"}
+	}
+	sess.tx = &transaction{}
+	return &protocol.Response{Code: protocol.CodeOK, Message: "Transaction started"}
+}
+
+// handleStage validates an ADD or DELETE in a transaction and stages it
+func (s *Server) handleStage(sess *session, msg *protocol.Message) *protocol.Response {
+	op := journal.OpAdd
+	if msg.Operation == "DELETE" {
+		op = journal.OpDelete
+		s.metrics.deletesTotal.Add(1)
+	} else {
+		s.metrics.addsTotal.Add(1)
+	}
+
+	if len(msg.Arguments) != 1 {
+		return &protocol.Response{
+			Code:    protocol.CodeError,
+			Message: fmt.Sprintf("%s requires exactly one argument", msg.Operation),
+		}
+	}
+
+	rule, err := protocol.ParseRule(msg.Arguments[0])
+	if err != nil {
+		return &protocol.Response{
+			Code:    protocol.CodeError,
+			Message: fmt.Sprintf("Invalid rule: %v", err),
+		}
+	}
+
+	if len(sess.tx.records) >= maxTransactionOps {
+		return &protocol.Response{
+			Code:    protocol.CodeError,
+			Message: fmt.Sprintf("Transaction exceeds %d changes", maxTransactionOps),
+		}
+	}
+	sess.tx.records = append(sess.tx.records, journal.Record{Op: op, Rule: rule})
+	return &protocol.Response{Code: protocol.CodeOK, Message: "Staged"}
+}
+
+// handleCommit processes a COMMIT operation. The transaction ends whether
+// or not its changes could be applied.
+func (s *Server) handleCommit(sess *session, msg *protocol.Message) *protocol.Response {
+	if len(msg.Arguments) != 0 {
+		return &protocol.Response{Code: protocol.CodeError, Message: "COMMIT takes no arguments"}
+	}
+	tx := sess.tx
+	if tx == nil {
+		return &protocol.Response{Code: protocol.CodeError, Message: "No transaction open"}
+	}
+	sess.tx = nil
+
+	if err := s.commit(tx.records); err != nil {
+		s.metrics.txAborted.Add(1)
+		return &protocol.Response{
+			Code:    protocol.CodeError,
+			Message: fmt.Sprintf("Commit failed: %v", err),
+		}
+	}
+	s.metrics.txCommitted.Add(1)
+	return &protocol.Response{Code: protocol.CodeOK, Message: "Committed"}
+}
+
+// handleRollback processes a ROLLBACK operation
+func (s *Server) handleRollback(sess *session, msg *protocol.Message) *protocol.Response {
+	if len(msg.Arguments) != 0 {
+		return &protocol.Response{Code: protocol.CodeError, Message: "ROLLBACK takes no arguments"}
+	}
+	if sess.tx == nil {
+		return &protocol.Response{Code: protocol.CodeError, Message: "No transaction open, use RELOAD ROLLBACK to restore the rules of the last reload"}
+	}
+	sess.tx = nil
+	s.metrics.txAborted.Add(1)
+	return &protocol.Response{Code: protocol.CodeOK, Message: "Discarded"}
+}
+
+// abortTransaction discards the open transaction of a closing connection
+func (s *Server) abortTransaction(sess *session) {
+	if sess.tx == nil {
+		return
+	}
+	s.logDebug("Client %s disconnected in a transaction, discarding %d changes", sess.remote, len(sess.tx.records))
+	sess.tx = nil
+	s.metrics.txAborted.Add(1)
+}
+
+// commit applies records to the engine under a single lock, so that
+// queries see either all of them or none, and then journals them. If a
+// delete finds no rule or the journal write fails, the applied records
+// are undone.
+func (s *Server) commit(records []journal.Record) error {
+	if s.journal != nil {
+		// Keep journal order and engine swaps consistent
+		s.reloadMutex.Lock()
+		defer s.reloadMutex.Unlock()
+	}
+
+	s.mu.Lock()
+	for i, r := range records {
+		if r.Op == journal.OpDelete && !s.engine.RemoveRule(r.Rule) {
+			s.undo(records[:i])
+			s.mu.Unlock()
+			return fmt.Errorf("change %d: rule not found", i+1)
+		}
+		if r.Op == journal.OpAdd {
+			s.engine.AddRuleElement(r.Rule)
+		}
+	}
+	s.mu.Unlock()
+
+	if err := s.appendJournalAll(records); err != nil {
+		// Not durable: undo so the client can retry
+		s.mu.Lock()
+		s.undo(records)
+		s.mu.Unlock()
+		return errors.New("journal write failed")
+	}
+	return nil
+}
+
+// undo reverts applied records in reverse order; the caller must hold mu
+func (s *Server) undo(records []journal.Record) {
+	for i := len(records) - 1; i >= 0; i-- {
+		switch records[i].Op {
+		case journal.OpAdd:
+			s.engine.RemoveRule(records[i].Rule)
+		case journal.OpDelete:
+			s.engine.AddRuleElement(records[i].Rule)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirosfoundation/go-spocp/pkg/client"
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+)
+
+// TestTransaction tests staging, committing and rolling back changes
+func TestTransaction(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)", "(4:list)"})
+	defer os.RemoveAll(rulesDir)
+	journalPath := filepath.Join(t.TempDir(), "rules.journal")
+
+	config := &Config{Address: ":0", RulesDir: rulesDir, JournalPath: journalPath}
+	srv, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	sess := &session{}
+	send := func(op string, args ...string) *protocol.Response {
+		t.Helper()
+		return srv.handleMessage(sess, &protocol.Message{Operation: op, Arguments: args})
+	}
+
+	if resp := send(protocol.OpCommit); resp.Code != protocol.CodeError {
+		t.Errorf("Expected COMMIT without a transaction to fail, got %s %s", resp.Code, resp.Message)
+	}
+	if resp := send(protocol.OpBegin); resp.Code != protocol.CodeOK {
+		t.Fatalf("BEGIN failed: %s", resp.Message)
+	}
+	if resp := send(protocol.OpBegin); resp.Code != protocol.CodeError {
+		t.Errorf("Expected a nested BEGIN to fail, got %s %s", resp.Code, resp.Message)
+	}
+	if resp := send("ADD", "(5:write"); resp.Code != protocol.CodeError {
+		t.Errorf("Expected an invalid rule to be rejected when staged, got %s", resp.Code)
+	}
+	for _, op := range [][2]string{{"ADD", "(5:write)"}, {"DELETE", "(4:list)"}} {
+		if resp := send(op[0], op[1]); resp.Code != protocol.CodeOK || resp.Message != "Staged" {
+			t.Fatalf("%s %s: expected Staged, got %s %s", op[0], op[1], resp.Code, resp.Message)
+		}
+	}
+
+	// Staged changes are not visible until COMMIT
+	expectQuery(t, srv, "(5:write)", protocol.CodeDenied)
+	expectQuery(t, srv, "(4:list)", protocol.CodeOK)
+
+	if resp := send(protocol.OpCommit); resp.Code != protocol.CodeOK {
+		t.Fatalf("COMMIT failed: %s", resp.Message)
+	}
+	expectQuery(t, srv, "(5:write)", protocol.CodeOK)
+	expectQuery(t, srv, "(4:list)", protocol.CodeDenied)
+
+	// A delete of a missing rule fails the commit and undoes its adds
+	send(protocol.OpBegin)
+	send("ADD", "(6:delete)")
+	send("DELETE", "(4:list)")
+	if resp := send(protocol.OpCommit); resp.Code != protocol.CodeError {
+		t.Errorf("Expected COMMIT to fail, got %s %s", resp.Code, resp.Message)
+	}
+	expectQuery(t, srv, "(6:delete)", protocol.CodeDenied)
+
+	// ROLLBACK discards a transaction, and never reverts a reload
+	if resp := send(protocol.OpRollback); resp.Code != protocol.CodeError || !strings.Contains(resp.Message, "RELOAD ROLLBACK") {
+		t.Errorf("Expected ROLLBACK without a transaction to fail, got %s %s", resp.Code, resp.Message)
+	}
+	send(protocol.OpBegin)
+	send("DELETE", "(4:read)")
+	if resp := send(protocol.OpRollback, "now"); resp.Code != protocol.CodeError {
+		t.Errorf("Expected ROLLBACK with an argument to fail, got %s %s", resp.Code, resp.Message)
+	}
+	if resp := send(protocol.OpRollback); resp.Code != protocol.CodeOK || resp.Message != "Discarded" {
+		t.Errorf("ROLLBACK failed: %s %s", resp.Code, resp.Message)
+	}
+	if resp := send(protocol.OpCommit); resp.Code != protocol.CodeError {
+		t.Errorf("Expected COMMIT after ROLLBACK to fail, got %s", resp.Code)
+	}
+	expectQuery(t, srv, "(4:read)", protocol.CodeOK)
+
+	if got := srv.metrics.txCommitted.Load(); got != 1 {
+		t.Errorf("Expected 1 committed transaction, got %d", got)
+	}
+	if got := srv.metrics.txAborted.Load(); got != 2 {
+		t.Errorf("Expected 2 aborted transactions, got %d", got)
+	}
+	records, err := srv.journal.Records()
+	if err != nil {
+		t.Fatalf("Records failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Errorf("Expected only the committed changes in the journal, got %v", records)
+	}
+	srv.Close()
+
+	// Committed changes survive a restart
+	srv, err = NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to restart server: %v", err)
+	}
+	defer srv.Close()
+	expectQuery(t, srv, "(5:write)", protocol.CodeOK)
+	expectQuery(t, srv, "(4:list)", protocol.CodeDenied)
+}
+
+// TestTransactionDisconnect tests that closing the connection aborts an
+// open transaction
+func TestTransactionDisconnect(t *testing.T) {
+	srv := startTestServer(t, &Config{})
+	addr := srv.listener.Addr().String()
+
+	c, err := client.NewClient(&client.Config{Address: addr})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	tx, err := c.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	if err := tx.AddString("(5:write)"); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	c.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.metrics.txAborted.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the transaction to be aborted on disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectQuery(t, srv, "(5:write)", protocol.CodeDenied)
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirosfoundation/go-spocp/pkg/persist"
+	"github.com/sirosfoundation/go-spocp/pkg/signing"
+)
+
+// Reload reasons, logged and counted in spocp_reloads_by_reason_total
+const (
+	reloadStartup = "startup" // initial load
+	reloadManual  = "manual"  // RELOAD operation
+	reloadWatch   = "watch"   // file change event
+	reloadPoll    = "poll"    // change found by polling
+)
+
+var reloadReasons = []string{reloadStartup, reloadManual, reloadWatch, reloadPoll}
+
+const (
+	// DefaultWatchDebounce is the default for Config.WatchDebounce
+	DefaultWatchDebounce = 200 * time.Millisecond
+
+	// DefaultPollInterval is how often rule files are polled when Watch is
+	// set but change events are not available and ReloadInterval is 0
+	DefaultPollInterval = 2 * time.Second
+)
+
+var errWatchUnsupported = errors.New("file change events are not supported on this platform")
+
+// dirWatcher reports changes to the files below a directory
+type dirWatcher interface {
+	// Events receives a value after one or more changes
+	Events() <-chan struct{}
+	Close() error
+}
+
+// fileState identifies the contents of a rule source
+type fileState struct {
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+// cachedRuleFile holds the parsed rules of a rule file
+type cachedRuleFile struct {
+	ruleset *persist.Ruleset
+
+	// deps holds the hash of every file read to load the rules: the file
+	// itself, included files, template data and signatures
+	deps map[string][sha256.Size]byte
+}
+
+// valid reports whether none of the files c was loaded from changed
+func (c *cachedRuleFile) valid(states map[string]fileState) bool {
+	if c == nil {
+		return false
+	}
+	for name, hash := range c.deps {
+		if state, ok := states[name]; !ok || state.hash != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// startWatching starts reloading rules when rule files change
+func (s *Server) startWatching(config *Config) {
+	poll := config.ReloadInterval
+	debounce := config.WatchDebounce
+	if debounce <= 0 {
+		debounce = DefaultWatchDebounce
+	}
+
+	var w dirWatcher
+	if config.Watch {
+		if s.bundlePath != "" || s.rulesFS == nil {
+			dir, recursive := s.rulesDir, true
+			if s.bundlePath != "" {
+				dir, recursive = filepath.Dir(s.bundlePath), false
+			}
+			var err error
+			if w, err = newDirWatcher(dir, recursive); err != nil {
+				s.logWarn("Polling rule files: %v", err)
+			}
+		}
+		if w == nil && poll <= 0 {
+			poll = DefaultPollInterval
+		}
+	}
+
+	s.wg.Add(1)
+	go s.watchRules(w, poll, debounce)
+}
+
+// watchRules reloads rules after change events from w (if not nil), once
+// they have settled for debounce, and when polling every poll (if > 0)
+// finds changed files
+func (s *Server) watchRules(w dirWatcher, poll, debounce time.Duration) {
+	defer s.wg.Done()
+
+	var events <-chan struct{}
+	if w != nil {
+		defer w.Close()
+		events = w.Events()
+	}
+
+	var tick <-chan time.Time
+	if poll > 0 {
+		ticker := time.NewTicker(poll)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	settle := time.NewTimer(debounce)
+	settle.Stop()
+	defer settle.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-events:
+			settle.Reset(debounce)
+		case <-settle.C:
+			s.checkRules(reloadWatch)
+		case <-tick:
+			s.checkRules(reloadPoll)
+		}
+	}
+}
+
+// checkRules reloads rules if rule files changed
+func (s *Server) checkRules(reason string) {
+	reloaded, err := s.reloadIfChanged(reason)
+	if reloaded {
+		s.metrics.reloadsTotal.Add(1)
+	}
+	if err != nil {
+		s.logError("Auto-reload failed: %v", err)
+		s.metrics.reloadsFailed.Add(1)
+	}
+}
+
+// scanRuleSources returns the state of the rule bundle, or of every file
+// below the rules directory except hidden directories and hidden files
+// that are not rule files (such as temporary files of atomic saves).
+// Files are only hashed if their size or modification time changed since
+// the last scan.
+func (s *Server) scanRuleSources() (map[string]fileState, error) {
+	states := make(map[string]fileState)
+	scan := func(fsys fs.FS, name, key string) error {
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			return err
+		}
+		state := fileState{modTime: info.ModTime(), size: info.Size()}
+		if prev, ok := s.fileStates[key]; ok && prev.modTime.Equal(state.modTime) && prev.size == state.size {
+			state.hash = prev.hash
+		} else {
+			data, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return err
+			}
+			state.hash = sha256.Sum256(data)
+		}
+		states[key] = state
+		return nil
+	}
+
+	if s.bundlePath != "" {
+		if err := scan(os.DirFS(filepath.Dir(s.bundlePath)), filepath.Base(s.bundlePath), s.bundlePath); err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %w", err)
+		}
+		return states, nil
+	}
+
+	fsys, _ := s.rulesSource()
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		hidden := name != "." && strings.HasPrefix(d.Name(), ".")
+		if d.IsDir() {
+			if hidden {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if hidden && !persist.IsRuleFile(name) {
+			return nil
+		}
+		err = scan(fsys, name, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed while scanning
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan rules directory: %w", err)
+	}
+	return states, nil
+}
+
+// parseRuleFile loads a rule file, recording the files read for it.
+// Verified files are read whole anyway, so their hash is taken from the
+// bytes parsed; otherwise files are streamed and the hashes of the scan
+// are used. A file changed since the scan then no longer matches its
+// hash at the next scan, which parses it again.
+func (s *Server) parseRuleFile(fsys fs.FS, name string, opts persist.LoadOptions, states map[string]fileState) (*cachedRuleFile, error) {
+	cached := &cachedRuleFile{deps: make(map[string][sha256.Size]byte)}
+	if s.trustedKeys != nil {
+		verify := opts.Verify
+		opts.Verify = func(filename string, data []byte) error {
+			if err := verify(filename, data); err != nil {
+				return err
+			}
+			key := s.sourceName(filename)
+			cached.deps[key] = sha256.Sum256(data)
+			// A replaced signature has to be checked again
+			sig := signing.SignaturePath(key)
+			cached.deps[sig] = states[sig].hash
+			return nil
+		}
+	} else {
+		opts.Opened = func(filename string) {
+			key := s.sourceName(filename)
+			cached.deps[key] = states[key].hash
+		}
+	}
+
+	var err error
+	if s.rulesFS != nil {
+		cached.ruleset, err = persist.LoadRulesetFS(fsys, name, opts)
+	} else {
+		name = filepath.Join(s.rulesDir, filepath.FromSlash(name))
+		cached.ruleset, err = persist.LoadRuleset(name, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", name, err)
+	}
+	return cached, nil
+}
+
+// sourceName returns the scan key of a file read while loading rules
+func (s *Server) sourceName(filename string) string {
+	if s.rulesFS != nil {
+		return filename
+	}
+	rel, err := filepath.Rel(s.rulesDir, filename)
+	if err != nil {
+		return filename
+	}
+	return filepath.ToSlash(rel)
+}
+
+// diffStates describes the differences between two scans
+func diffStates(old, current map[string]fileState) []string {
+	var changes []string
+	for name, state := range current {
+		prev, ok := old[name]
+		switch {
+		case !ok:
+			changes = append(changes, "added "+name)
+		case prev.hash != state.hash:
+			changes = append(changes, "modified "+name)
+		}
+	}
+	for name := range old {
+		if _, ok := current[name]; !ok {
+			changes = append(changes, "removed "+name)
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// sameFiles reports whether two scans found the same files
+func sameFiles(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask selects the events that can change a rule file
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_ATTRIB | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// inotifyWatcher watches a directory tree with inotify
+type inotifyWatcher struct {
+	file      *os.File
+	recursive bool
+	events    chan struct{}
+	done      chan struct{}
+
+	mu      sync.Mutex
+	watches map[int32]string // watch descriptor to directory
+}
+
+// newDirWatcher watches dir, and its subdirectories if recursive, for
+// changes to the files in it
+func newDirWatcher(dir string, recursive bool) (dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// A non-blocking descriptor uses the runtime poller, so Close
+	// interrupts a pending Read
+	w := &inotifyWatcher{
+		file:      os.NewFile(uintptr(fd), "inotify"),
+		recursive: recursive,
+		events:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		watches:   make(map[int32]string),
+	}
+	if err := w.add(dir); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// add watches dir and, for recursive watchers, every directory below it
+func (w *inotifyWatcher) add(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The directory may be gone by the time it is walked
+			if errors.Is(err, fs.ErrNotExist) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if err := w.addWatch(path); err != nil {
+			return err
+		}
+		if !w.recursive {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) addWatch(dir string) error {
+	var wd int
+	err := w.control(func(fd int) error {
+		var err error
+		wd, err = syscall.InotifyAddWatch(fd, dir, inotifyMask)
+		return err
+	})
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	w.mu.Lock()
+	w.watches[int32(wd)] = dir //nolint:gosec // watch descriptors are small
+	w.mu.Unlock()
+	return nil
+}
+
+// control runs fn with the raw inotify descriptor
+func (w *inotifyWatcher) control(fn func(fd int) error) error {
+	raw, err := w.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	if err := raw.Control(func(fd uintptr) { fnErr = fn(int(fd)) }); err != nil { //nolint:gosec // file descriptors fit in an int
+		return err
+	}
+	return fnErr
+}
+
+// readEvents turns inotify events into notifications until the watcher is
+// closed
+func (w *inotifyWatcher) readEvents() {
+	defer close(w.done)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		changed := false
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset])) //nolint:gosec // the kernel writes whole events
+			nameLen := int(event.Len)
+			name := ""
+			if nameLen > 0 {
+				raw := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+nameLen]
+				for i, c := range raw {
+					if c == 0 {
+						raw = raw[:i]
+						break
+					}
+				}
+				name = string(raw)
+			}
+			offset += syscall.SizeofInotifyEvent + nameLen
+
+			switch {
+			case event.Mask&syscall.IN_IGNORED != 0:
+				w.mu.Lock()
+				delete(w.watches, event.Wd)
+				w.mu.Unlock()
+				continue
+			case event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && w.recursive:
+				w.mu.Lock()
+				parent := w.watches[event.Wd]
+				w.mu.Unlock()
+				if parent != "" {
+					// Files may already have been written to the new directory
+					// before it is watched; the reload scan finds them. A
+					// directory that vanished again needs no watch.
+					_ = w.add(filepath.Join(parent, name))
+				}
+			}
+			changed = true
+		}
+
+		if changed {
+			select {
+			case w.events <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Events returns a channel that receives a value after changes
+func (w *inotifyWatcher) Events() <-chan struct{} {
+	return w.events
+}
+
+// Close stops watching
+func (w *inotifyWatcher) Close() error {
+	err := w.file.Close()
+	<-w.done
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package server
+
+// newDirWatcher is only implemented on Linux; elsewhere rule files are
+// polled
+func newDirWatcher(dir string, recursive bool) (dirWatcher, error) {
+	return nil, errWatchUnsupported
+}
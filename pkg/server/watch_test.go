@@ -0,0 +1,292 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirosfoundation/go-spocp/pkg/protocol"
+)
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectFiles(t *testing.T, srv *Server, parsed, reused int64) {
+	t.Helper()
+	if got := srv.metrics.reloadFilesParsed.Load(); got != parsed {
+		t.Errorf("Expected %d files parsed, got %d", parsed, got)
+	}
+	if got := srv.metrics.reloadFilesReused.Load(); got != reused {
+		t.Errorf("Expected %d files reused, got %d", reused, got)
+	}
+}
+
+// TestReloadIfChanged tests that only changed files are parsed again
+func TestReloadIfChanged(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+	writeFile(t, rulesDir, "other.spoc", "(4:list)\n")
+
+	srv, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+	expectFiles(t, srv, 2, 0)
+
+	// Nothing changed
+	if reloaded, err := srv.reloadIfChanged(reloadPoll); reloaded || err != nil {
+		t.Fatalf("Expected no reload, got %v, %v", reloaded, err)
+	}
+
+	// Rewriting a file with the same content is not a change
+	writeFile(t, rulesDir, "other.spoc", "(4:list)\n")
+	if reloaded, _ := srv.reloadIfChanged(reloadPoll); reloaded {
+		t.Error("Expected no reload for unchanged content")
+	}
+
+	writeFile(t, rulesDir, "test.spoc", "(5:write)\n")
+	if reloaded, err := srv.reloadIfChanged(reloadPoll); !reloaded || err != nil {
+		t.Fatalf("Expected reload, got %v, %v", reloaded, err)
+	}
+	expectFiles(t, srv, 3, 1)
+	expectQuery(t, srv, "(5:write)", protocol.CodeOK)
+	expectQuery(t, srv, "(4:read)", protocol.CodeDenied)
+	expectQuery(t, srv, "(4:list)", protocol.CodeOK)
+
+	// A manual reload reuses every unchanged file
+	if resp := srv.handleReload(&protocol.Message{Operation: "RELOAD"}); resp.Code != protocol.CodeOK {
+		t.Fatalf("Reload failed: %s", resp.Message)
+	}
+	expectFiles(t, srv, 3, 3)
+
+	for reason, want := range map[string]int64{reloadStartup: 1, reloadPoll: 1, reloadManual: 1, reloadWatch: 0} {
+		if got := srv.metrics.reloadsByReason[reason].Load(); got != want {
+			t.Errorf("Expected %d %s reloads, got %d", want, reason, got)
+		}
+	}
+}
+
+// TestReloadDependencies tests that files are parsed again when a file
+// they include changes, and that added files cause a full reload
+func TestReloadDependencies(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+	writeFile(t, rulesDir, "main.spoc", "include \"common/base.inc\"\n")
+	writeFile(t, rulesDir, "common/base.inc", "(4:list)\n")
+
+	srv, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+	expectFiles(t, srv, 2, 0)
+
+	writeFile(t, rulesDir, "common/base.inc", "(6:delete)\n")
+	if reloaded, err := srv.reloadIfChanged(reloadPoll); !reloaded || err != nil {
+		t.Fatalf("Expected reload, got %v, %v", reloaded, err)
+	}
+	expectFiles(t, srv, 3, 1)
+	expectQuery(t, srv, "(6:delete)", protocol.CodeOK)
+	expectQuery(t, srv, "(4:list)", protocol.CodeDenied)
+
+	writeFile(t, rulesDir, "new.spoc", "(3:new)\n")
+	if reloaded, err := srv.reloadIfChanged(reloadPoll); !reloaded || err != nil {
+		t.Fatalf("Expected reload, got %v, %v", reloaded, err)
+	}
+	expectFiles(t, srv, 6, 1)
+	expectQuery(t, srv, "(3:new)", protocol.CodeOK)
+}
+
+// TestReloadIncludedRuleFile tests that a rule file included by another
+// one is loaded only where it is included
+func TestReloadIncludedRuleFile(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+	writeFile(t, rulesDir, "main.spoc", "include \"common/*.spoc\"\n")
+	writeFile(t, rulesDir, "common/base.spoc", "(4:list)\n")
+
+	srv, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	if got := srv.metrics.rulesLoaded.Load(); got != 2 {
+		t.Errorf("Expected 2 rules, got %d", got)
+	}
+	if got := srv.engine.RuleCount(); got != 2 {
+		t.Errorf("Expected 2 rules in the engine, got %d", got)
+	}
+	expectQuery(t, srv, "(4:list)", protocol.CodeOK)
+}
+
+// TestReloadFailureNotRetried tests that a broken file is reported once
+// and the current rules are kept
+func TestReloadFailureNotRetried(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+
+	srv, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	writeFile(t, rulesDir, "test.spoc", "(4:read\n")
+	if reloaded, err := srv.reloadIfChanged(reloadPoll); !reloaded || err == nil {
+		t.Fatalf("Expected failed reload, got %v, %v", reloaded, err)
+	}
+	if reloaded, err := srv.reloadIfChanged(reloadPoll); reloaded || err != nil {
+		t.Errorf("Expected no retry, got %v, %v", reloaded, err)
+	}
+	expectQuery(t, srv, "(4:read)", protocol.CodeOK)
+
+	writeFile(t, rulesDir, "test.spoc", "(4:read)\n(4:list)\n")
+	if reloaded, err := srv.reloadIfChanged(reloadPoll); !reloaded || err != nil {
+		t.Fatalf("Expected reload after fix, got %v, %v", reloaded, err)
+	}
+	expectQuery(t, srv, "(4:list)", protocol.CodeOK)
+}
+
+// TestParallelReload tests that files parsed concurrently are loaded in
+// file order and that the first broken file in that order is reported
+func TestParallelReload(t *testing.T) {
+	rulesDir := t.TempDir()
+	var want []string
+	for i := range 40 {
+		rule := fmt.Sprintf("(4:rule%d:%d)", len(fmt.Sprint(i)), i)
+		writeFile(t, rulesDir, fmt.Sprintf("r%02d.spoc", i), rule+"\n")
+		want = append(want, rule)
+	}
+
+	srv, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir, LoadWorkers: 4})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	rules := func() []string {
+		var got []string
+		for _, r := range srv.GetEngine().ExportRules() {
+			got = append(got, r.String())
+		}
+		return got
+	}
+	if got := rules(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Rules out of order:\n got %v\nwant %v", got, want)
+	}
+
+	// Changed files are parsed again and keep their place
+	writeFile(t, rulesDir, "r05.spoc", "(4:rule4:five)\n")
+	want[5] = "(4:rule4:five)"
+	if reloaded, err := srv.reloadIfChanged(reloadPoll); !reloaded || err != nil {
+		t.Fatalf("Expected reload, got %v, %v", reloaded, err)
+	}
+	expectFiles(t, srv, 41, 39)
+	if got := rules(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Rules out of order after reload:\n got %v\nwant %v", got, want)
+	}
+
+	writeFile(t, rulesDir, "r30.spoc", "(4:rule\n")
+	writeFile(t, rulesDir, "r10.spoc", "(4:rule\n")
+	for range 5 {
+		if err := srv.reloadRules(reloadManual, reloadApply); err == nil || !strings.Contains(err.Error(), "r10.spoc") {
+			t.Fatalf("Expected an error for r10.spoc, got %v", err)
+		}
+	}
+}
+
+// TestWatchReloads tests reloading on file changes
+func TestWatchReloads(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+
+	srv, err := NewServer(&Config{
+		Address:       ":0",
+		RulesDir:      rulesDir,
+		Watch:         true,
+		WatchDebounce: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	// Files in new subdirectories are seen too
+	writeFile(t, rulesDir, "sub/extra.spoc", "(5:write)\n")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if allowed, _ := srv.GetEngine().Query("(5:write)"); allowed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Rules were not reloaded after a change")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if srv.metrics.reloadsTotal.Load() == 0 {
+		t.Error("Expected reload to be counted")
+	}
+}
+
+// TestReloadMetrics tests the reload metrics output
+func TestReloadMetrics(t *testing.T) {
+	rulesDir := createTempRulesDir(t, []string{"(4:read)"})
+	defer os.RemoveAll(rulesDir)
+
+	srv, err := NewServer(&Config{Address: ":0", RulesDir: rulesDir})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Close()
+
+	w := httptest.NewRecorder()
+	srv.handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`spocp_reloads_by_reason_total{reason="startup"} 1`,
+		`spocp_reloads_by_reason_total{reason="watch"} 0`,
+		"spocp_reload_files_parsed_total 1",
+		"spocp_reload_files_reused_total 0",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %q in metrics", want)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleStats(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if !strings.Contains(w.Body.String(), `"by_reason": {"startup": 1, "manual": 0, "watch": 0, "poll": 0}`) {
+		t.Errorf("Unexpected stats: %s", w.Body.String())
+	}
+}
+
+func TestDiffStates(t *testing.T) {
+	a := fileState{hash: [32]byte{1}}
+	b := fileState{hash: [32]byte{2}}
+	old := map[string]fileState{"kept.spoc": a, "changed.spoc": a, "gone.spoc": a}
+	current := map[string]fileState{"kept.spoc": a, "changed.spoc": b, "new.spoc": b}
+
+	want := []string{"added new.spoc", "modified changed.spoc", "removed gone.spoc"}
+	if got := diffStates(old, current); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffStates = %v, want %v", got, want)
+	}
+	if got := diffStates(current, current); len(got) != 0 {
+		t.Errorf("Expected no changes, got %v", got)
+	}
+}
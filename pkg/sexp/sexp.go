@@ -84,6 +84,12 @@ func (p *Parser) Parse() (Element, error) {
 	return p.parseAtom()
 }
 
+// Pos returns the current byte offset of the parser in its input.
+// After a failed Parse it points at the element that could not be parsed.
+func (p *Parser) Pos() int {
+	return p.pos
+}
+
 // parseAtom parses a length-prefixed atom: <length>:<data>
 func (p *Parser) parseAtom() (*Atom, error) {
 	// Find the colon
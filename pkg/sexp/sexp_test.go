@@ -182,3 +182,21 @@ func TestCanonicalFormRoundTrip(t *testing.T) {
 		})
 	}
 }
+
+func TestParserPos(t *testing.T) {
+	parser := NewParser("(4:http3:GET)")
+	if _, err := parser.Parse(); err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if parser.Pos() != 13 {
+		t.Errorf("expected pos 13 after parse, got %d", parser.Pos())
+	}
+
+	parser = NewParser("(4:httpxx:GET)")
+	if _, err := parser.Parse(); err == nil {
+		t.Fatal("expected parse error")
+	}
+	if parser.Pos() != 7 {
+		t.Errorf("expected error pos 7, got %d", parser.Pos())
+	}
+}
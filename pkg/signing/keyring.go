@@ -0,0 +1,155 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// KeyRing holds the public keys trusted to sign rulesets
+type KeyRing struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// NewKeyRing creates a key ring trusting the given keys
+func NewKeyRing(keys ...ed25519.PublicKey) *KeyRing {
+	k := &KeyRing{keys: make(map[string]ed25519.PublicKey)}
+	for _, key := range keys {
+		k.Add(key)
+	}
+	return k
+}
+
+// LoadKeyRing reads trusted public keys from PEM files. A directory path
+// loads every .pem and .pub file in it.
+func LoadKeyRing(paths ...string) (*KeyRing, error) {
+	k := NewKeyRing()
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		files := []string{path}
+		if info.IsDir() {
+			files, err = keyFiles(path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, file := range files {
+			data, err := os.ReadFile(file) //nolint:gosec // key files are named by the operator
+			if err != nil {
+				return nil, err
+			}
+			keys, err := ParsePublicKeys(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			for _, key := range keys {
+				k.Add(key)
+			}
+		}
+	}
+	if k.Len() == 0 {
+		return nil, fmt.Errorf("no trusted keys found in %s", strings.Join(paths, ", "))
+	}
+	return k, nil
+}
+
+// keyFiles lists the key files in a directory in name order
+func keyFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if !entry.IsDir() && (ext == ".pem" || ext == ".pub") {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Add trusts an additional key
+func (k *KeyRing) Add(key ed25519.PublicKey) {
+	k.keys[KeyID(key)] = key
+}
+
+// Len returns the number of trusted keys
+func (k *KeyRing) Len() int {
+	return len(k.keys)
+}
+
+// KeyIDs returns the identifiers of the trusted keys in sorted order
+func (k *KeyRing) KeyIDs() []string {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// VerifySignature checks signature file contents against data
+func (k *KeyRing) VerifySignature(data, sigFile []byte) error {
+	sig, err := parseSignature(sigFile)
+	if err != nil {
+		return err
+	}
+	key, ok := k.keys[sig.keyID]
+	if !ok {
+		return fmt.Errorf("%w (key %s)", ErrUnknownKey, sig.keyID)
+	}
+	if !ed25519.Verify(key, data, sig.sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Verify checks data read from filename against its detached signature.
+// It has the signature of persist.LoadOptions.Verify, so a key ring can
+// be plugged into rule loading directly.
+func (k *KeyRing) Verify(filename string, data []byte) error {
+	sigFile, err := os.ReadFile(SignaturePath(filename)) //nolint:gosec // signature sits next to the rule file
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrUnsigned
+	}
+	if err != nil {
+		return err
+	}
+	return k.VerifySignature(data, sigFile)
+}
+
+// VerifyFS returns a function like Verify that reads signatures from fsys,
+// for rules loaded with persist.LoadFS
+func (k *KeyRing) VerifyFS(fsys fs.FS) func(filename string, data []byte) error {
+	return func(filename string, data []byte) error {
+		sigFile, err := fs.ReadFile(fsys, SignaturePath(filename))
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrUnsigned
+		}
+		if err != nil {
+			return err
+		}
+		return k.VerifySignature(data, sigFile)
+	}
+}
+
+// VerifyFile reads filename and checks it against its detached signature
+func (k *KeyRing) VerifyFile(filename string) error {
+	data, err := os.ReadFile(filename) //nolint:gosec // files to verify are named by the operator
+	if err != nil {
+		return err
+	}
+	return k.Verify(filename, data)
+}
@@ -0,0 +1,70 @@
+package signing
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadKeyRing(t *testing.T) {
+	dir := t.TempDir()
+	var ids []string
+	for _, name := range []string{"a.pem", "b.pub"} {
+		pub, _, _ := GenerateKey()
+		data, _ := MarshalPublicKey(pub)
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, KeyID(pub))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("ignored"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ring, err := LoadKeyRing(dir)
+	if err != nil {
+		t.Fatalf("LoadKeyRing failed: %v", err)
+	}
+	if ring.Len() != 2 {
+		t.Fatalf("Expected 2 keys, got %d", ring.Len())
+	}
+
+	single, err := LoadKeyRing(filepath.Join(dir, "a.pem"))
+	if err != nil {
+		t.Fatalf("LoadKeyRing failed: %v", err)
+	}
+	if got := single.KeyIDs(); len(got) != 1 || got[0] != ids[0] {
+		t.Errorf("Expected key id %s, got %v", ids[0], got)
+	}
+
+	if _, err := LoadKeyRing(t.TempDir()); err == nil {
+		t.Error("Expected error for directory without keys")
+	}
+	if _, err := LoadKeyRing(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("Expected error for missing key file")
+	}
+}
+
+func TestVerifyFS(t *testing.T) {
+	pub, priv, _ := GenerateKey()
+	ring := NewKeyRing(pub)
+	data := []byte("(4:read)\n")
+
+	fsys := fstest.MapFS{
+		"rules/a.spoc":     {Data: data},
+		"rules/a.spoc.sig": {Data: Sign(priv, data)},
+	}
+	verify := ring.VerifyFS(fsys)
+
+	if err := verify("rules/a.spoc", data); err != nil {
+		t.Errorf("Expected valid signature, got %v", err)
+	}
+	if err := verify("rules/a.spoc", []byte("(5:write)\n")); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected ErrBadSignature, got %v", err)
+	}
+	if err := verify("rules/b.spoc", data); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("Expected ErrUnsigned, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+// Package signing implements detached Ed25519 signatures for ruleset files.
+//
+// A signature is stored next to the file it covers, with a ".sig" suffix
+// (rules.spoc -> rules.spoc.sig). The signature file is a single line:
+//
+//	ed25519 <key-id> <base64 signature>
+//
+// where key-id is the hex-encoded first 8 bytes of the SHA-256 of the
+// public key. Keys are exchanged as PEM: PKCS #8 for private keys and
+// PKIX for public keys, as produced by openssl and crypto/x509.
+//
+// A signature covers the file contents only, not the file name or any
+// version. A signed file can therefore be copied under another name, and
+// an older signed file (with its signature) can replace a newer one; both
+// still verify. Where that matters, distribute a bundle instead (see
+// persist.SaveBundle): the signed manifest records every path together
+// with the bundle version and revision. Even a bundle can be replaced by
+// an older signed one, so compare the revision the server reports with
+// the one deployed.
+//
+// Only crypto/ed25519 and crypto/x509 from the standard library are used,
+// in line with ADR 01.
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SignatureExt is appended to a file name to form its signature file name
+const SignatureExt = ".sig"
+
+const algorithm = "ed25519"
+
+// ErrVerification is wrapped by every verification failure
+var ErrVerification = errors.New("signature verification failed")
+
+var (
+	// ErrUnsigned is returned when a file has no signature file
+	ErrUnsigned = fmt.Errorf("%w: file is not signed", ErrVerification)
+
+	// ErrUnknownKey is returned when the signing key is not trusted
+	ErrUnknownKey = fmt.Errorf("%w: signed by an untrusted key", ErrVerification)
+
+	// ErrBadSignature is returned when the signature does not match
+	ErrBadSignature = fmt.Errorf("%w: signature does not match", ErrVerification)
+)
+
+// GenerateKey creates a new Ed25519 key pair
+func GenerateKey() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	return ed25519.GenerateKey(rand.Reader)
+}
+
+// KeyID returns the identifier recorded in signatures made with key
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// SignaturePath returns the path of the detached signature for filename
+func SignaturePath(filename string) string {
+	return filename + SignatureExt
+}
+
+// Sign returns the signature file contents for data
+func Sign(key ed25519.PrivateKey, data []byte) []byte {
+	sig := ed25519.Sign(key, data)
+	pub := key.Public().(ed25519.PublicKey)
+	return fmt.Appendf(nil, "%s %s %s\n", algorithm, KeyID(pub), base64.StdEncoding.EncodeToString(sig))
+}
+
+// SignFile writes a detached signature for filename
+func SignFile(key ed25519.PrivateKey, filename string) error {
+	data, err := os.ReadFile(filename) //nolint:gosec // files to sign are named by the operator
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(SignaturePath(filename), Sign(key, data), 0644) //nolint:gosec // signatures are public
+}
+
+// signature is a parsed signature file
+type signature struct {
+	keyID string
+	sig   []byte
+}
+
+func parseSignature(data []byte) (*signature, error) {
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("%w: malformed signature file", ErrVerification)
+	}
+	if fields[0] != algorithm {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrVerification, fields[0])
+	}
+	sig, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: malformed signature", ErrVerification)
+	}
+	return &signature{keyID: fields[1], sig: sig}, nil
+}
+
+// MarshalPrivateKey encodes a private key as PKCS #8 PEM
+func MarshalPrivateKey(key ed25519.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// MarshalPublicKey encodes a public key as PKIX PEM
+func MarshalPublicKey(key ed25519.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// ParsePrivateKey decodes a PKCS #8 PEM Ed25519 private key
+func ParsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no PRIVATE KEY PEM block found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, not Ed25519", key)
+	}
+	return priv, nil
+}
+
+// ParsePublicKeys decodes all PKIX PEM Ed25519 public keys in data
+func ParsePublicKeys(data []byte) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key is %T, not Ed25519", key)
+		}
+		keys = append(keys, pub)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no PUBLIC KEY PEM block found")
+	}
+	return keys, nil
+}
+
+// LoadPrivateKey reads a PEM private key file
+func LoadPrivateKey(filename string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(filename) //nolint:gosec // key files are named by the operator
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,113 @@
+package signing
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyPEMRoundTrip(t *testing.T) {
+	pub, priv, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	privPEM, err := MarshalPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("MarshalPrivateKey failed: %v", err)
+	}
+	pubPEM, err := MarshalPublicKey(pub)
+	if err != nil {
+		t.Fatalf("MarshalPublicKey failed: %v", err)
+	}
+
+	parsedPriv, err := ParsePrivateKey(privPEM)
+	if err != nil {
+		t.Fatalf("ParsePrivateKey failed: %v", err)
+	}
+	if !parsedPriv.Equal(priv) {
+		t.Error("Private key changed in round trip")
+	}
+
+	keys, err := ParsePublicKeys(append(pubPEM, pubPEM...))
+	if err != nil {
+		t.Fatalf("ParsePublicKeys failed: %v", err)
+	}
+	if len(keys) != 2 || !keys[0].Equal(pub) {
+		t.Errorf("Unexpected public keys: %v", keys)
+	}
+
+	if _, err := ParsePrivateKey(pubPEM); err == nil {
+		t.Error("Expected error parsing public key as private key")
+	}
+	if _, err := ParsePublicKeys([]byte("not pem")); err == nil {
+		t.Error("Expected error for data without PEM blocks")
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	pub, priv, _ := GenerateKey()
+	otherPub, otherPriv, _ := GenerateKey()
+	ring := NewKeyRing(pub)
+
+	data := []byte("(4:http3:GET)\n")
+	sig := Sign(priv, data)
+
+	if err := ring.VerifySignature(data, sig); err != nil {
+		t.Errorf("Expected valid signature, got: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		sig     []byte
+		wantErr error
+	}{
+		{"tampered data", []byte("(4:http4:POST)\n"), sig, ErrBadSignature},
+		{"untrusted key", data, Sign(otherPriv, data), ErrUnknownKey},
+		{"malformed", data, []byte("ed25519 abc"), ErrVerification},
+		{"wrong algorithm", data, []byte("rsa abc AAAA"), ErrVerification},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ring.VerifySignature(tt.data, tt.sig)
+			if !errors.Is(err, tt.wantErr) || !errors.Is(err, ErrVerification) {
+				t.Errorf("Expected %v, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	ring.Add(otherPub)
+	if err := ring.VerifySignature(data, Sign(otherPriv, data)); err != nil {
+		t.Errorf("Expected added key to be trusted, got: %v", err)
+	}
+}
+
+func TestSignFile(t *testing.T) {
+	pub, priv, _ := GenerateKey()
+	ring := NewKeyRing(pub)
+
+	filename := filepath.Join(t.TempDir(), "rules.spoc")
+	if err := os.WriteFile(filename, []byte("(4:read)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ring.VerifyFile(filename); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("Expected ErrUnsigned, got: %v", err)
+	}
+
+	if err := SignFile(priv, filename); err != nil {
+		t.Fatalf("SignFile failed: %v", err)
+	}
+	if err := ring.VerifyFile(filename); err != nil {
+		t.Errorf("Expected valid signature, got: %v", err)
+	}
+
+	if err := os.WriteFile(filename, []byte("(5:write)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.VerifyFile(filename); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected ErrBadSignature, got: %v", err)
+	}
+}
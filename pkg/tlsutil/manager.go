@@ -0,0 +1,223 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CertManager serves the certificates, client CAs and CRLs of
+// ServerOptions and replaces them when their files change, so that they
+// can be rotated without a restart. One manager can back any number of
+// listeners through TLSConfig.
+type CertManager struct {
+	opts ServerOptions
+
+	// mu serializes reloads
+	mu      sync.Mutex
+	current atomic.Pointer[certState]
+
+	// failed holds the file states of the last failed reload, so that
+	// unchanged broken files are not read again on every check
+	failed map[string]fileState
+
+	reloads  atomic.Int64
+	failures atomic.Int64
+}
+
+// certState is one loaded generation of the files
+type certState struct {
+	config   *tls.Config
+	cert     *tls.Certificate
+	notAfter time.Time
+	files    map[string]fileState
+}
+
+// fileState identifies a version of a file
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewCertManager loads the files of opts
+func NewCertManager(opts ServerOptions) (*CertManager, error) {
+	m := &CertManager{opts: opts}
+	state, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	m.current.Store(state)
+	return m, nil
+}
+
+// TLSConfig returns a configuration that always uses the latest files.
+// New connections pick up a reload; established ones keep their
+// certificates.
+func (m *CertManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: m.opts.ClientAuth,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return m.current.Load().cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return m.current.Load().config, nil
+		},
+	}
+}
+
+// Reload reads the files again. The new certificates are validated before
+// they replace the current ones; on error the current ones stay in use.
+func (m *CertManager) Reload() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reload()
+}
+
+// ReloadIfChanged reloads if a file changed since the last reload. It
+// reports whether it reloaded; a failed reload is not retried until the
+// files change again.
+func (m *CertManager) ReloadIfChanged() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files, err := m.stat()
+	if err != nil {
+		return false, err
+	}
+	if sameFiles(files, m.current.Load().files) || (m.failed != nil && sameFiles(files, m.failed)) {
+		return false, nil
+	}
+	return true, m.reload()
+}
+
+// reload replaces the current state; m.mu must be held
+func (m *CertManager) reload() error {
+	state, err := m.load()
+	if err != nil {
+		m.failures.Add(1)
+		m.failed, _ = m.stat()
+		return err
+	}
+	m.failed = nil
+	m.current.Store(state)
+	m.reloads.Add(1)
+	return nil
+}
+
+// Watch checks the files every interval until ctx is done. report, if not
+// nil, is called after every reload with its outcome.
+func (m *CertManager) Watch(ctx context.Context, interval time.Duration, report func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if reloaded, err := m.ReloadIfChanged(); (reloaded || err != nil) && report != nil {
+				report(err)
+			}
+		}
+	}
+}
+
+// NotAfter returns the expiry of the current server certificate
+func (m *CertManager) NotAfter() time.Time {
+	return m.current.Load().notAfter
+}
+
+// WriteMetrics writes Prometheus metrics on the certificates of managers,
+// labelled with the name of the server each one belongs to
+func WriteMetrics(w io.Writer, managers map[string]*CertManager) {
+	names := make([]string, 0, len(managers))
+	for name, m := range managers {
+		if m != nil {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "# HELP spocp_tls_certificate_expiry_timestamp_seconds Expiry of the server certificate in Unix time\n")
+	fmt.Fprintf(w, "# TYPE spocp_tls_certificate_expiry_timestamp_seconds gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "spocp_tls_certificate_expiry_timestamp_seconds{server=%q} %d\n", name, managers[name].NotAfter().Unix())
+	}
+
+	fmt.Fprintf(w, "# HELP spocp_tls_reloads_total Total number of certificate reloads\n")
+	fmt.Fprintf(w, "# TYPE spocp_tls_reloads_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "spocp_tls_reloads_total{server=%q} %d\n", name, managers[name].reloads.Load())
+	}
+
+	fmt.Fprintf(w, "# HELP spocp_tls_reload_failures_total Total number of failed certificate reloads\n")
+	fmt.Fprintf(w, "# TYPE spocp_tls_reload_failures_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "spocp_tls_reload_failures_total{server=%q} %d\n", name, managers[name].failures.Load())
+	}
+}
+
+// load reads and validates the files
+func (m *CertManager) load() (*certState, error) {
+	// Files are stated before they are read so that a change while
+	// reading is picked up by the next check
+	files, err := m.stat()
+	if err != nil {
+		return nil, err
+	}
+	config, err := ServerConfig(m.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &config.Certificates[0]
+	now := time.Now()
+	switch {
+	case cert.Leaf == nil:
+		return nil, errors.New("server certificate could not be parsed")
+	case now.After(cert.Leaf.NotAfter):
+		return nil, fmt.Errorf("server certificate expired on %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	case now.Before(cert.Leaf.NotBefore):
+		return nil, fmt.Errorf("server certificate is not valid before %s", cert.Leaf.NotBefore.Format(time.RFC3339))
+	}
+	return &certState{config: config, cert: cert, notAfter: cert.Leaf.NotAfter, files: files}, nil
+}
+
+// stat returns the states of the files
+func (m *CertManager) stat() (map[string]fileState, error) {
+	names := append([]string{m.opts.CertFile, m.opts.KeyFile}, m.opts.ClientCAFiles...)
+	names = append(names, m.opts.CRLFiles...)
+
+	files := make(map[string]fileState, len(names))
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = fileState{modTime: info.ModTime(), size: info.Size()}
+	}
+	return files, nil
+}
+
+// sameFiles reports whether two sets of file states are equal
+func sameFiles(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, state := range a {
+		if other, ok := b[name]; !ok || other != state {
+			return false
+		}
+	}
+	return true
+}
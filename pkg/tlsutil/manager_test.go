@@ -0,0 +1,174 @@
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serverCertificate returns the certificate a server with config presents
+func serverCertificate(t *testing.T, config *tls.Config, roots *x509.CertPool) *x509.Certificate {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	go func() {
+		_ = tls.Server(serverConn, config).Handshake() //nolint:errcheck // the client reports the outcome
+	}()
+	client := tls.Client(clientConn, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	return client.ConnectionState().PeerCertificates[0]
+}
+
+// touch moves the modification time of files forward so that changes are
+// seen even on file systems with coarse timestamps
+func touch(t *testing.T, files ...string) {
+	t.Helper()
+	later := time.Now().Add(time.Minute)
+	for _, file := range files {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertManagerReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	first, firstCert := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := writeKeyPair(t, dir, first)
+	m, err := NewCertManager(ServerOptions{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("NewCertManager failed: %v", err)
+	}
+	config := m.TLSConfig()
+	if got := serverCertificate(t, config, roots); !got.Equal(firstCert) {
+		t.Error("Expected the first certificate")
+	}
+	if !m.NotAfter().Equal(firstCert.NotAfter) {
+		t.Errorf("Expected expiry %v, got %v", firstCert.NotAfter, m.NotAfter())
+	}
+
+	if reloaded, err := m.ReloadIfChanged(); reloaded || err != nil {
+		t.Errorf("Expected no reload without changes, got %v, %v", reloaded, err)
+	}
+
+	// Rotate the certificate
+	second, secondCert := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	writeKeyPair(t, dir, second)
+	touch(t, certFile, keyFile)
+	if reloaded, err := m.ReloadIfChanged(); !reloaded || err != nil {
+		t.Fatalf("Expected a reload, got %v, %v", reloaded, err)
+	}
+	if got := serverCertificate(t, config, roots); !got.Equal(secondCert) {
+		t.Error("Expected the rotated certificate on a new connection")
+	}
+
+	// A key that does not match the certificate is rejected and the
+	// current certificate stays in use
+	third, _ := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	third.PrivateKey = first.PrivateKey
+	writeKeyPair(t, dir, third)
+	touch(t, certFile, keyFile)
+	if reloaded, err := m.ReloadIfChanged(); !reloaded || err == nil {
+		t.Errorf("Expected a failed reload, got %v, %v", reloaded, err)
+	}
+	if got := serverCertificate(t, config, roots); !got.Equal(secondCert) {
+		t.Error("Expected the previous certificate after a failed reload")
+	}
+	if reloaded, _ := m.ReloadIfChanged(); reloaded {
+		t.Error("Expected unchanged broken files not to be read again")
+	}
+
+	var metrics bytes.Buffer
+	WriteMetrics(&metrics, map[string]*CertManager{"tcp": m, "http": nil})
+	for _, want := range []string{
+		"spocp_tls_reloads_total{server=\"tcp\"} 1\n",
+		"spocp_tls_reload_failures_total{server=\"tcp\"} 1\n",
+		fmt.Sprintf("spocp_tls_certificate_expiry_timestamp_seconds{server=\"tcp\"} %d\n", secondCert.NotAfter.Unix()),
+	} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("Expected %q in metrics:\n%s", want, metrics.String())
+		}
+	}
+}
+
+func TestCertManagerClientCAs(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	serverCert, _ := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	alice, aliceCert := ca.issue(t, "alice", x509.ExtKeyUsageClientAuth)
+	certFile, keyFile := writeKeyPair(t, dir, serverCert)
+	caFile := writePEM(t, dir, "ca.crt", "CERTIFICATE", ca.cert.Raw)
+	crlFile := writePEM(t, dir, "ca.crl", "X509 CRL", ca.revoke(t))
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	m, err := NewCertManager(ServerOptions{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		ClientCAFiles: []string{caFile},
+		ClientAuth:    tls.RequireAndVerifyClientCert,
+		CRLFiles:      []string{crlFile},
+	})
+	if err != nil {
+		t.Fatalf("NewCertManager failed: %v", err)
+	}
+	config := m.TLSConfig()
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("Expected the client auth policy on the configuration, got %v", config.ClientAuth)
+	}
+	if _, err := handshake(t, config, roots, &alice); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	// A new CRL revokes alice for new connections
+	writePEM(t, dir, "ca.crl", "X509 CRL", ca.revoke(t, aliceCert))
+	touch(t, crlFile)
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if _, err := handshake(t, config, roots, &alice); err == nil {
+		t.Error("Expected alice to be rejected after the CRL reload")
+	}
+}
+
+func TestCertManagerExpired(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	cert, parsed := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := writeKeyPair(t, dir, cert)
+	m, err := NewCertManager(ServerOptions{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("NewCertManager failed: %v", err)
+	}
+
+	// Replace the certificate with one that expired
+	template := *parsed
+	template.NotBefore = time.Now().Add(-2 * time.Hour)
+	template.NotAfter = time.Now().Add(-time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.cert, parsed.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, dir, "server.crt", "CERTIFICATE", der)
+	if err := m.Reload(); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected an expired certificate to be rejected, got %v", err)
+	}
+	if !m.NotAfter().Equal(parsed.NotAfter) {
+		t.Error("Expected the valid certificate to stay in use")
+	}
+}
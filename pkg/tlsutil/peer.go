@@ -0,0 +1,60 @@
+package tlsutil
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+)
+
+// PeerIdentity describes a verified client certificate
+type PeerIdentity struct {
+	// Subject is the distinguished name, e.g. "CN=alice,O=Example"
+	Subject    string
+	CommonName string
+
+	// Subject alternative names
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []string
+	URIs           []string
+
+	// Fingerprint is the hex SHA-256 digest of the certificate
+	Fingerprint string
+
+	// Issuer is the distinguished name of the certificate's issuer
+	Issuer string
+
+	// Certificate is the client certificate itself
+	Certificate *x509.Certificate
+}
+
+// NewPeerIdentity describes a certificate
+func NewPeerIdentity(cert *x509.Certificate) *PeerIdentity {
+	sum := sha256.Sum256(cert.Raw)
+	p := &PeerIdentity{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		Fingerprint:    hex.EncodeToString(sum[:]),
+		Issuer:         cert.Issuer.String(),
+		Certificate:    cert,
+	}
+	for _, ip := range cert.IPAddresses {
+		p.IPAddresses = append(p.IPAddresses, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		p.URIs = append(p.URIs, uri.String())
+	}
+	return p
+}
+
+// VerifiedPeer returns the identity of the client of a TLS connection if
+// it presented a certificate that was verified, or nil
+func VerifiedPeer(state tls.ConnectionState) *PeerIdentity {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return NewPeerIdentity(state.VerifiedChains[0][0])
+}
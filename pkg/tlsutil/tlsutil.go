@@ -0,0 +1,201 @@
+// Package tlsutil builds TLS configurations for SPOCP servers with client
+// certificate verification, certificate revocation lists (CRLs) and the
+// identity of verified clients.
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// ParseClientAuth parses a client certificate policy: "none" (default for
+// ""), "optional" (verify certificates that clients send) or "require"
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("invalid client auth %q (must be: none, optional, require)", s)
+}
+
+// ServerOptions configures ServerConfig
+type ServerOptions struct {
+	// CertFile and KeyFile hold the server certificate chain and key
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFiles are PEM bundles of the CAs that issue client
+	// certificates
+	ClientCAFiles []string
+
+	// ClientAuth is the client certificate policy; verifying clients
+	// requires ClientCAFiles
+	ClientAuth tls.ClientAuthType
+
+	// CRLFiles are certificate revocation lists (PEM or DER) of the
+	// client CAs; revoked client certificates are rejected
+	CRLFiles []string
+}
+
+// ServerConfig builds a server TLS configuration
+func ServerConfig(opts ServerOptions) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		ClientAuth:   opts.ClientAuth,
+	}
+
+	if len(opts.ClientCAFiles) > 0 {
+		if config.ClientCAs, err = LoadCertPool(opts.ClientCAFiles...); err != nil {
+			return nil, err
+		}
+	}
+	if opts.ClientAuth >= tls.VerifyClientCertIfGiven && config.ClientCAs == nil {
+		return nil, errors.New("verifying client certificates requires client CAs")
+	}
+
+	if len(opts.CRLFiles) > 0 {
+		if config.ClientAuth < tls.VerifyClientCertIfGiven {
+			return nil, errors.New("CRLs require verifying client certificates")
+		}
+		crls, err := LoadCRLs(opts.CRLFiles...)
+		if err != nil {
+			return nil, err
+		}
+		config.VerifyConnection = crls.VerifyConnection
+	}
+	return config, nil
+}
+
+// LoadCertPool reads PEM certificate bundles into a pool
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		data, err := os.ReadFile(file) //nolint:gosec // CA files are named by the operator
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", file)
+		}
+	}
+	return pool, nil
+}
+
+// CRLSet holds certificate revocation lists by issuer
+type CRLSet struct {
+	lists []*x509.RevocationList
+}
+
+// LoadCRLs reads certificate revocation lists in PEM or DER form. A PEM
+// file may hold several lists.
+func LoadCRLs(files ...string) (*CRLSet, error) {
+	set := &CRLSet{}
+	for _, file := range files {
+		data, err := os.ReadFile(file) //nolint:gosec // CRL files are named by the operator
+		if err != nil {
+			return nil, err
+		}
+		if err := set.add(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return set, nil
+}
+
+// add parses the CRLs in data
+func (s *CRLSet) add(data []byte) error {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return err
+		}
+		s.lists = append(s.lists, crl)
+		return nil
+	}
+
+	found := false
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return err
+		}
+		s.lists = append(s.lists, crl)
+		found = true
+	}
+	if !found {
+		return errors.New("no CRLs found")
+	}
+	return nil
+}
+
+// Len returns the number of revocation lists
+func (s *CRLSet) Len() int {
+	return len(s.lists)
+}
+
+// Revoked reports whether cert, issued by issuer, is revoked by a list
+// that issuer signed
+func (s *CRLSet) Revoked(cert, issuer *x509.Certificate) bool {
+	for _, crl := range s.lists {
+		if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) || crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// VerifyConnection rejects connections whose verified client certificate
+// chain contains a revoked certificate. It is meant for
+// tls.Config.VerifyConnection.
+func (s *CRLSet) VerifyConnection(state tls.ConnectionState) error {
+	for _, chain := range state.VerifiedChains {
+		for i := 0; i+1 < len(chain); i++ {
+			if s.Revoked(chain[i], chain[i+1]) {
+				return fmt.Errorf("certificate %s (serial %s) is revoked", chain[i].Subject, serial(chain[i].SerialNumber))
+			}
+		}
+	}
+	return nil
+}
+
+// NextUpdate returns the earliest time a list should be replaced by a
+// newer one, or the zero time if no list says
+func (s *CRLSet) NextUpdate() time.Time {
+	var next time.Time
+	for _, crl := range s.lists {
+		if !crl.NextUpdate.IsZero() && (next.IsZero() || crl.NextUpdate.Before(next)) {
+			next = crl.NextUpdate
+		}
+	}
+	return next
+}
+
+// serial formats a certificate serial number in hexadecimal
+func serial(n *big.Int) string {
+	return fmt.Sprintf("%X", n)
+}
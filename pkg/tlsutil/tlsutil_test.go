@@ -0,0 +1,320 @@
+package tlsutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates and revocation lists
+type testCA struct {
+	cert   *x509.Certificate
+	key    crypto.Signer
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA", Organization: []string{"Example"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// issue returns a certificate for commonName signed by the CA
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	uri, _ := url.Parse("spiffe://example.org/" + commonName)
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(ca.serial),
+		Subject:        pkix.Name{CommonName: commonName, Organization: []string{"Example"}},
+		DNSNames:       []string{commonName + ".example.org"},
+		EmailAddresses: []string{commonName + "@example.org"},
+		IPAddresses:    []net.IP{net.IPv4(127, 0, 0, 1)},
+		URIs:           []*url.URL{uri},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+// revoke returns a DER revocation list of the given certificates
+func (ca *testCA) revoke(t *testing.T, certs ...*x509.Certificate) []byte {
+	t.Helper()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, cert := range certs {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeKeyPair writes a certificate and its key as PEM files
+func writeKeyPair(t *testing.T, dir string, cert tls.Certificate) (string, string) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, dir, "server.crt", "CERTIFICATE", cert.Certificate[0]),
+		writePEM(t, dir, "server.key", "PRIVATE KEY", key)
+}
+
+func TestParseClientAuth(t *testing.T) {
+	tests := []struct {
+		in   string
+		want tls.ClientAuthType
+	}{
+		{"", tls.NoClientCert},
+		{"none", tls.NoClientCert},
+		{"optional", tls.VerifyClientCertIfGiven},
+		{"REQUIRE", tls.RequireAndVerifyClientCert},
+	}
+	for _, tt := range tests {
+		got, err := ParseClientAuth(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseClientAuth(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := ParseClientAuth("always"); err == nil {
+		t.Error("Expected an error for an invalid client auth")
+	}
+}
+
+func TestServerConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	serverCert, _ := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := writeKeyPair(t, dir, serverCert)
+	caFile := writePEM(t, dir, "ca.crt", "CERTIFICATE", ca.cert.Raw)
+	crlFile := writePEM(t, dir, "ca.crl", "X509 CRL", ca.revoke(t))
+
+	tests := []struct {
+		name string
+		opts ServerOptions
+		want string
+	}{
+		{"missing key pair", ServerOptions{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyFile},
+			"failed to load server certificate"},
+		{"verification without CAs", ServerOptions{CertFile: certFile, KeyFile: keyFile,
+			ClientAuth: tls.RequireAndVerifyClientCert}, "requires client CAs"},
+		{"CRLs without verification", ServerOptions{CertFile: certFile, KeyFile: keyFile,
+			ClientCAFiles: []string{caFile}, CRLFiles: []string{crlFile}}, "CRLs require"},
+		{"CA file without certificates", ServerOptions{CertFile: certFile, KeyFile: keyFile,
+			ClientCAFiles: []string{crlFile}, ClientAuth: tls.RequireAndVerifyClientCert}, "no certificates found"},
+		{"CRL file without CRLs", ServerOptions{CertFile: certFile, KeyFile: keyFile,
+			ClientCAFiles: []string{caFile}, ClientAuth: tls.RequireAndVerifyClientCert,
+			CRLFiles: []string{caFile}}, "no CRLs found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ServerConfig(tt.opts)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestLoadCRLs(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	other := newTestCA(t)
+	_, alice := ca.issue(t, "alice", x509.ExtKeyUsageClientAuth)
+	_, bob := ca.issue(t, "bob", x509.ExtKeyUsageClientAuth)
+
+	// A PEM file with two lists and a DER file
+	bundle := append(
+		pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: ca.revoke(t, alice)}),
+		pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: other.revoke(t)})...)
+	pemFile := filepath.Join(dir, "bundle.pem")
+	if err := os.WriteFile(pemFile, bundle, 0600); err != nil {
+		t.Fatal(err)
+	}
+	derFile := filepath.Join(dir, "other.crl")
+	if err := os.WriteFile(derFile, other.revoke(t), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	crls, err := LoadCRLs(pemFile, derFile)
+	if err != nil {
+		t.Fatalf("LoadCRLs failed: %v", err)
+	}
+	if crls.Len() != 3 {
+		t.Errorf("Expected 3 lists, got %d", crls.Len())
+	}
+	if !crls.Revoked(alice, ca.cert) {
+		t.Error("Expected alice to be revoked")
+	}
+	if crls.Revoked(bob, ca.cert) {
+		t.Error("Expected bob not to be revoked")
+	}
+	// A list is only trusted if the certificate's issuer signed it
+	if crls.Revoked(alice, other.cert) {
+		t.Error("Expected a list with another signer to be ignored")
+	}
+	if next := crls.NextUpdate(); next.IsZero() || next.Before(time.Now()) {
+		t.Errorf("Unexpected next update %v", next)
+	}
+
+	if _, err := LoadCRLs(filepath.Join(dir, "missing.crl")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+// handshake connects a client with cert to a server with config and
+// returns the server's connection state
+func handshake(t *testing.T, config *tls.Config, roots *x509.CertPool, cert *tls.Certificate) (tls.ConnectionState, error) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	clientConfig := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+	if cert != nil {
+		clientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	go func() {
+		client := tls.Client(clientConn, clientConfig)
+		_ = client.Handshake() //nolint:errcheck // the server reports the outcome
+		// Keep reading so that the server's writes to the pipe do not block
+		_, _ = client.Read(make([]byte, 1)) //nolint:errcheck // waits for close
+	}()
+
+	server := tls.Server(serverConn, config)
+	err := server.Handshake()
+	return server.ConnectionState(), err
+}
+
+func TestServerConfigClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	serverCert, _ := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	alice, aliceCert := ca.issue(t, "alice", x509.ExtKeyUsageClientAuth)
+	mallory, malloryCert := ca.issue(t, "mallory", x509.ExtKeyUsageClientAuth)
+
+	certFile, keyFile := writeKeyPair(t, dir, serverCert)
+	caFile := writePEM(t, dir, "ca.crt", "CERTIFICATE", ca.cert.Raw)
+	crlFile := filepath.Join(dir, "ca.crl")
+	if err := os.WriteFile(crlFile, ca.revoke(t, malloryCert), 0600); err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	config, err := ServerConfig(ServerOptions{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		ClientCAFiles: []string{caFile},
+		ClientAuth:    tls.VerifyClientCertIfGiven,
+		CRLFiles:      []string{crlFile},
+	})
+	if err != nil {
+		t.Fatalf("ServerConfig failed: %v", err)
+	}
+
+	state, err := handshake(t, config, roots, &alice)
+	if err != nil {
+		t.Fatalf("Handshake with a valid certificate failed: %v", err)
+	}
+	peer := VerifiedPeer(state)
+	if peer == nil {
+		t.Fatal("Expected a verified peer")
+	}
+	if peer.CommonName != "alice" || peer.Subject != "CN=alice,O=Example" {
+		t.Errorf("Unexpected subject %q (%q)", peer.Subject, peer.CommonName)
+	}
+	if peer.Issuer != "CN=Test CA,O=Example" {
+		t.Errorf("Unexpected issuer %q", peer.Issuer)
+	}
+	if len(peer.DNSNames) != 1 || peer.DNSNames[0] != "alice.example.org" ||
+		len(peer.EmailAddresses) != 1 || peer.EmailAddresses[0] != "alice@example.org" ||
+		len(peer.IPAddresses) != 1 || peer.IPAddresses[0] != "127.0.0.1" ||
+		len(peer.URIs) != 1 || peer.URIs[0] != "spiffe://example.org/alice" {
+		t.Errorf("Unexpected SANs %+v", peer)
+	}
+	if peer.Fingerprint != NewPeerIdentity(aliceCert).Fingerprint || len(peer.Fingerprint) != 64 {
+		t.Errorf("Unexpected fingerprint %q", peer.Fingerprint)
+	}
+
+	if _, err := handshake(t, config, roots, &mallory); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("Expected a revoked certificate to be rejected, got %v", err)
+	}
+
+	// Optional verification admits clients without a certificate
+	state, err = handshake(t, config, roots, nil)
+	if err != nil {
+		t.Fatalf("Handshake without a certificate failed: %v", err)
+	}
+	if VerifiedPeer(state) != nil {
+		t.Error("Expected no peer without a certificate")
+	}
+
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if _, err := handshake(t, config, roots, nil); err == nil {
+		t.Error("Expected a required certificate to be enforced")
+	}
+}
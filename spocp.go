@@ -4,14 +4,23 @@ package spocp
 
 import (
 	"fmt"
+	"slices"
+	"sync"
 
 	"github.com/sirosfoundation/go-spocp/pkg/compare"
 	"github.com/sirosfoundation/go-spocp/pkg/sexp"
 )
 
-// Engine is the main SPOCP policy engine
+// Engine is the main SPOCP policy engine.
+//
+// Rule changes (adding, removing, loading, clearing) are serialized with
+// snapshots such as SaveRulesToFile and ExportRules, so a snapshot never
+// observes a half-applied change. Queries are not synchronized with rule
+// changes; callers that query and change rules concurrently must provide
+// their own locking (see server.GetEngineMutex).
 type Engine struct {
-	rules        []sexp.Element
+	mu           sync.RWMutex     // guards rule changes against snapshots
+	rules        []sexp.Element   // in insertion order, kept across removals
 	tagIndex     map[string][]int // tag -> slice of rule indices
 	atomRules    []int            // indices of non-list rules
 	indexEnabled bool             // whether to use indexing
@@ -50,6 +59,23 @@ func (e *Engine) AddRule(rule string) error {
 
 // AddRuleElement adds a parsed rule element to the engine
 func (e *Engine) AddRuleElement(rule sexp.Element) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.addRule(rule)
+}
+
+// AddRuleElements adds parsed rules in order, taking the lock once for the
+// whole batch
+func (e *Engine) AddRuleElements(rules []sexp.Element) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, rule := range rules {
+		e.addRule(rule)
+	}
+}
+
+// addRule appends a rule and indexes it; the caller must hold mu
+func (e *Engine) addRule(rule sexp.Element) {
 	idx := len(e.rules)
 	e.rules = append(e.rules, rule)
 
@@ -65,6 +91,84 @@ func (e *Engine) AddRuleElement(rule sexp.Element) {
 	}
 }
 
+// RemoveRule removes the first rule equal to rule (compared in canonical
+// form) and reports whether one was found. The remaining rules keep their
+// order, so listings and exports stay deterministic.
+func (e *Engine) RemoveRule(rule sexp.Element) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.removeRule(rule)
+}
+
+// removeRule implements RemoveRule; the caller must hold mu. With the
+// index enabled, only the rules in the target's bucket are compared; the
+// indices of all later rules then shift down by one in every bucket.
+func (e *Engine) removeRule(rule sexp.Element) bool {
+	target := rule.String()
+	i := -1
+	if e.indexEnabled {
+		bucket := e.bucket(rule)
+		for j, idx := range bucket {
+			if e.rules[idx].String() == target {
+				i = idx
+				e.setBucket(rule, slices.Delete(bucket, j, j+1))
+				break
+			}
+		}
+	} else {
+		for j, r := range e.rules {
+			if r.String() == target {
+				i = j
+				break
+			}
+		}
+	}
+	if i < 0 {
+		return false
+	}
+
+	e.rules = slices.Delete(e.rules, i, i+1)
+	if e.indexEnabled {
+		shiftDown(e.atomRules, i)
+		for _, bucket := range e.tagIndex {
+			shiftDown(bucket, i)
+		}
+	}
+	return true
+}
+
+// shiftDown decrements the indices in bucket that follow the removed index
+// i; buckets are ascending, so the scan starts at the first larger index
+func shiftDown(bucket []int, i int) {
+	j, _ := slices.BinarySearch(bucket, i)
+	for ; j < len(bucket); j++ {
+		bucket[j]--
+	}
+}
+
+// bucket returns the indices of the rules indexed like rule; the caller
+// must hold mu
+func (e *Engine) bucket(rule sexp.Element) []int {
+	if list, ok := rule.(*sexp.List); ok {
+		return e.tagIndex[list.Tag]
+	}
+	return e.atomRules
+}
+
+// setBucket replaces the bucket of rule, dropping empty tags; the caller
+// must hold mu
+func (e *Engine) setBucket(rule sexp.Element, bucket []int) {
+	list, ok := rule.(*sexp.List)
+	switch {
+	case !ok:
+		e.atomRules = bucket
+	case len(bucket) == 0:
+		delete(e.tagIndex, list.Tag)
+	default:
+		e.tagIndex[list.Tag] = bucket
+	}
+}
+
 // Query checks if a query is authorized by any rule in the engine.
 // Returns true if there exists a rule R such that query <= R.
 func (e *Engine) Query(query string) (bool, error) {
@@ -78,7 +182,12 @@ func (e *Engine) Query(query string) (bool, error) {
 
 // QueryElement checks if a query element is authorized
 func (e *Engine) QueryElement(query sexp.Element) bool {
-	if e.indexEnabled {
+	return e.queryElement(query, e.indexEnabled)
+}
+
+// queryElement checks a query with the index or linearly
+func (e *Engine) queryElement(query sexp.Element, indexed bool) bool {
+	if indexed {
 		return e.queryIndexed(query)
 	}
 	return e.queryLinear(query)
@@ -130,10 +239,15 @@ func (e *Engine) FindMatchingRules(query string) ([]sexp.Element, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse query: %v", err)
 	}
+	return e.findMatching(queryElem, e.indexEnabled), nil
+}
 
+// findMatching returns the rules that authorize a query, found with the
+// index or linearly
+func (e *Engine) findMatching(queryElem sexp.Element, indexed bool) []sexp.Element {
 	var matches []sexp.Element
 
-	if e.indexEnabled {
+	if indexed {
 		// Use indexed search
 		if list, ok := queryElem.(*sexp.List); ok {
 			// Query is a list - use tag index
@@ -161,7 +275,7 @@ func (e *Engine) FindMatchingRules(query string) ([]sexp.Element, error) {
 		}
 	}
 
-	return matches, nil
+	return matches
 }
 
 // RuleCount returns the number of rules in the engine
@@ -171,6 +285,13 @@ func (e *Engine) RuleCount() int {
 
 // Clear removes all rules from the engine
 func (e *Engine) Clear() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reset()
+}
+
+// reset removes all rules; the caller must hold mu
+func (e *Engine) reset() {
 	e.rules = make([]sexp.Element, 0)
 	if e.indexEnabled {
 		e.tagIndex = make(map[string][]int)
@@ -229,3 +229,101 @@ func TestAddRuleError(t *testing.T) {
 		t.Error("Expected error when adding invalid rule")
 	}
 }
+
+func TestRemoveRule(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		engine := NewEngineWithIndexing(indexed)
+		engine.AddRule("(4:http(4:page5:index))")
+		engine.AddRule("(3:ftp(4:file))")
+		engine.AddRule("(5:admin)")
+		engine.AddRule("(4:http(4:page5:index))")
+
+		rule, _ := sexp.NewParser("(4:http(4:page5:index))").Parse()
+		if !engine.RemoveRule(rule) {
+			t.Fatalf("indexed=%v: expected rule to be removed", indexed)
+		}
+		if engine.RuleCount() != 3 {
+			t.Errorf("indexed=%v: expected 3 rules, got %d", indexed, engine.RuleCount())
+		}
+		// The duplicate still grants access
+		if ok, _ := engine.Query("(4:http(4:page5:index))"); !ok {
+			t.Errorf("indexed=%v: expected duplicate rule to match", indexed)
+		}
+
+		engine.RemoveRule(rule)
+		if ok, _ := engine.Query("(4:http(4:page5:index))"); ok {
+			t.Errorf("indexed=%v: expected removed rule not to match", indexed)
+		}
+		if ok, _ := engine.Query("(3:ftp(4:file))"); !ok {
+			t.Errorf("indexed=%v: expected remaining rule to match", indexed)
+		}
+		if ok, _ := engine.Query("(5:admin)"); !ok {
+			t.Errorf("indexed=%v: expected atom rule to match", indexed)
+		}
+
+		if engine.RemoveRule(rule) {
+			t.Errorf("indexed=%v: expected no rule to be removed", indexed)
+		}
+	}
+}
+
+// TestRemoveRuleShiftsIndex tests that the rules after a removed one stay
+// indexed, across tags and atoms
+func TestRemoveRuleShiftsIndex(t *testing.T) {
+	rules := []string{"(4:read)", "(5:write)", "3:foo", "(4:read4:file)", "(4:exec)"}
+	for _, indexed := range []bool{false, true} {
+		engine := NewEngineWithIndexing(indexed)
+		for _, r := range rules {
+			engine.AddRule(r)
+		}
+
+		for n, r := range rules[:len(rules)-1] {
+			rule, _ := sexp.NewParser(r).Parse()
+			if !engine.RemoveRule(rule) {
+				t.Fatalf("indexed=%v: expected %s to be removed", indexed, r)
+			}
+			for i, q := range rules {
+				want := i > n
+				if ok, _ := engine.Query(q); ok != want {
+					t.Errorf("indexed=%v: after removing %s, query %s = %v, want %v", indexed, r, q, ok, want)
+				}
+			}
+		}
+		if engine.RuleCount() != 1 {
+			t.Errorf("indexed=%v: expected 1 rule, got %d", indexed, engine.RuleCount())
+		}
+	}
+}
+
+// TestRemoveRuleKeepsOrder tests that removal keeps the remaining rules in
+// insertion order
+func TestRemoveRuleKeepsOrder(t *testing.T) {
+	rules := []string{"(4:read)", "(5:write)", "3:foo", "(4:read4:file)", "(4:exec)", "3:bar"}
+	for _, indexed := range []bool{false, true} {
+		engine := NewEngineWithIndexing(indexed)
+		for _, r := range rules {
+			engine.AddRule(r)
+		}
+
+		for _, r := range []string{"(5:write)", "(4:read)"} {
+			rule, _ := sexp.NewParser(r).Parse()
+			if !engine.RemoveRule(rule) {
+				t.Fatalf("indexed=%v: expected %s to be removed", indexed, r)
+			}
+		}
+
+		want := []string{"3:foo", "(4:read4:file)", "(4:exec)", "3:bar"}
+		got := engine.ExportRules()
+		if len(got) != len(want) {
+			t.Fatalf("indexed=%v: expected %d rules, got %d", indexed, len(want), len(got))
+		}
+		for i, r := range got {
+			if r.String() != want[i] {
+				t.Errorf("indexed=%v: rule %d = %s, want %s", indexed, i, r, want[i])
+			}
+		}
+		if ok, _ := engine.Query("(4:read4:file)"); !ok {
+			t.Errorf("indexed=%v: expected shifted rule to match", indexed)
+		}
+	}
+}